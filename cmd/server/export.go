@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+
+	"github.com/abustany/back-message-board/pkg/poststore"
+)
+
+// export downloads the posts of a running server. It implements the "export"
+// command.
+func export(logger log.Logger, args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	serverURL := flags.String("url", "http://127.0.0.1:1412", "Base URL of the server to export posts from")
+	adminUser := flags.String("adminUser", "", "Username of the admin user")
+	adminPassword := flags.String("adminPassword", "", "Password of the admin user")
+	output := flags.String("o", "-", "Path of the file to write, - for the standard output")
+	formatName := flags.String("format", "", "Format of the exported posts: csv, json or ndjson. Guessed from the extension of the output file if not set, csv for the standard output. The csv format does not store the state of the posts, so unconfirmed posts are left out.")
+
+	flags.Parse(args)
+
+	format, err := exportFormat(*formatName, *output)
+
+	if err != nil {
+		die(logger, err)
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(*serverURL, "/")+"/admin/export."+format.Name, nil)
+
+	if err != nil {
+		die(logger, errors.Wrap(err, "Error while creating export request"))
+	}
+
+	req.SetBasicAuth(*adminUser, *adminPassword)
+
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		die(logger, errors.Wrap(err, "Error while sending export request"))
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != format.ContentType {
+		die(logger, errors.Errorf("Unexpected reply from the server: %s", res.Status))
+	}
+
+	if *output == "-" {
+		if _, err := io.Copy(os.Stdout, res.Body); err != nil {
+			die(logger, errors.Wrap(err, "Error while downloading posts"))
+		}
+
+		return
+	}
+
+	// The posts are downloaded to a temporary file, renamed once the whole
+	// export was received, so that a failed download does not leave a
+	// truncated export behind
+	fd, err := ioutil.TempFile(filepath.Dir(*output), filepath.Base(*output)+".*")
+
+	if err != nil {
+		die(logger, errors.Wrapf(err, "Error while creating %s", *output))
+	}
+
+	_, err = io.Copy(fd, res.Body)
+
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(fd.Name(), *output)
+	}
+
+	if err != nil {
+		os.Remove(fd.Name())
+		die(logger, errors.Wrap(err, "Error while downloading posts"))
+	}
+}
+
+// exportFormat returns the format of an export, given the value of the -format
+// flag and the output file.
+func exportFormat(name, output string) (*poststore.Format, error) {
+	if name != "" {
+		return poststore.FormatByName(name)
+	}
+
+	if output == "-" {
+		return &poststore.FormatCSV, nil
+	}
+
+	return poststore.FormatForFile(output)
+}
@@ -1,18 +1,34 @@
-// Server serves the REST API of the message board.
+// Server serves the REST API of the message board, and optionally its gRPC API.
+//
+// Running "server export" instead downloads the posts of a running server as
+// CSV, see "server export -help".
 package main
 
 import (
 	"flag"
+	"net"
 	"net/http"
+	"net/smtp"
 	"os"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
 
+	"github.com/abustany/back-message-board/pkg/challenge"
+	"github.com/abustany/back-message-board/pkg/emailaddr"
 	"github.com/abustany/back-message-board/pkg/endpoint"
+	"github.com/abustany/back-message-board/pkg/events"
+	"github.com/abustany/back-message-board/pkg/grpcendpoint"
+	"github.com/abustany/back-message-board/pkg/idempotency"
+	"github.com/abustany/back-message-board/pkg/importjob"
+	"github.com/abustany/back-message-board/pkg/mailer"
+	"github.com/abustany/back-message-board/pkg/markdown"
 	"github.com/abustany/back-message-board/pkg/postservice"
 	"github.com/abustany/back-message-board/pkg/poststore"
+	"github.com/abustany/back-message-board/pkg/session"
+	"github.com/abustany/back-message-board/pkg/token"
+	"github.com/abustany/back-message-board/pkg/webhook"
 )
 
 func die(logger log.Logger, err error) {
@@ -20,7 +36,49 @@ func die(logger log.Logger, err error) {
 	os.Exit(1)
 }
 
-func loadCSV(logger log.Logger, store poststore.Store, filename string) {
+// csvOptions returns the dialect of the CSV files given to -load.
+func csvOptions(delimiter, columns, dateFormat, encoding string) (poststore.CSVOptions, error) {
+	options := poststore.CSVOptions{
+		HasHeader:  true,
+		DateFormat: dateFormat,
+		Encoding:   encoding,
+	}
+
+	if delimiter != "" {
+		runes := []rune(delimiter)
+
+		if len(runes) != 1 {
+			return options, errors.Errorf("Invalid CSV delimiter %s (should be a single character)", delimiter)
+		}
+
+		options.Delimiter = runes[0]
+	}
+
+	if columns != "" {
+		var err error
+
+		if options.Columns, err = poststore.ParseCSVColumns(columns); err != nil {
+			return options, err
+		}
+	}
+
+	return options, nil
+}
+
+func load(logger log.Logger, service postservice.Service, filename, formatName string, csvOptions poststore.CSVOptions, options postservice.ImportOptions) {
+	var format *poststore.Format
+	var err error
+
+	if formatName != "" {
+		format, err = poststore.FormatByName(formatName)
+	} else {
+		format, err = poststore.FormatForFile(filename)
+	}
+
+	if err != nil {
+		die(logger, err)
+	}
+
 	fd, err := os.Open(filename)
 
 	if err != nil {
@@ -29,24 +87,121 @@ func loadCSV(logger log.Logger, store poststore.Store, filename string) {
 
 	defer fd.Close()
 
-	var counter uint
+	decoder := format.NewDecoder(fd)
+
+	if format == &poststore.FormatCSV {
+		if decoder, err = poststore.NewCSVDecoderWithOptions(fd, csvOptions); err != nil {
+			die(logger, err)
+		}
+	}
+
+	var report postservice.ImportReport
 
 	defer func(start time.Time) {
-		logger.Log("event", "load_from_csv", "success", err == nil, "elapsed", time.Since(start), "n_records", counter)
+		logger.Log("event", "load", "format", format.Name, "dry_run", options.DryRun, "success", err == nil, "elapsed", time.Since(start), "n_inserted", report.Inserted, "n_overwritten", report.Overwritten, "n_skipped", report.Skipped, "n_invalid", report.Invalid)
 	}(time.Now())
 
-	counter, err = poststore.LoadFromCSV(store, fd, true)
+	report, err = service.Import(decoder, options)
+
+	for _, recordErr := range report.Errors {
+		logger.Log("event", "load", "file", filename, "record", recordErr.Record, "error", recordErr.Err)
+	}
 
 	if err != nil {
-		die(logger, errors.Wrap(err, "Error while loading data from CSV file"))
+		die(logger, errors.Wrapf(err, "Error while loading posts from %s", filename))
+	}
+}
+
+func newMailer(smtpAddr, smtpUser, smtpPassword, maildir, from string) (mailer.Mailer, error) {
+	if maildir != "" {
+		return mailer.NewMaildirMailer(maildir, from)
+	}
+
+	if smtpAddr == "" {
+		return nil, errors.New("Either an SMTP server or a Maildir is required for sending emails")
+	}
+
+	var auth smtp.Auth
+
+	if smtpUser != "" {
+		host, _, err := net.SplitHostPort(smtpAddr)
+
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid SMTP server address")
+		}
+
+		auth = smtp.PlainAuth("", smtpUser, smtpPassword, host)
+	}
+
+	return mailer.NewSMTPMailer(smtpAddr, from, auth), nil
+}
+
+// expireUnconfirmed periodically deletes the posts that were not confirmed in
+// time.
+func expireUnconfirmed(logger log.Logger, service postservice.Service, interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := service.ExpireUnconfirmed()
+
+		if err != nil {
+			logger.Log("event", "expire_unconfirmed", "error", err)
+		} else if n > 0 {
+			logger.Log("event", "expire_unconfirmed", "n_deleted", n)
+		}
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		export(log.NewJSONLogger(log.NewSyncWriter(os.Stderr)), os.Args[2:])
+		return
+	}
+
 	listenAddress := flag.String("listen", "127.0.0.1:1412", "Address on which to start the HTTP server")
+	grpcListenAddress := flag.String("grpcListen", "", "Optional, address on which to start the gRPC server, like 127.0.0.1:1413. The gRPC API is disabled if not set.")
 	adminUser := flag.String("adminUser", "", "Username of the admin user")
 	adminPassword := flag.String("adminPassword", "", "Password of the admin user")
-	csvFile := flag.String("loadCSV", "", "Optional, path of a CSV to load into the store after starting. The first record is considered as a header and is skipped.")
+	loadFile := flag.String("load", "", "Optional, path of a file to load posts from into the store after starting")
+	loadFormat := flag.String("loadFormat", "", "Format of the file given to -load: csv, json or ndjson. Guessed from the file extension if not set.")
+	csvFile := flag.String("loadCSV", "", "Deprecated, same as -load with -loadFormat csv. The first record is considered as a header and is skipped.")
+	csvDelimiter := flag.String("csvDelimiter", ",", "Field delimiter of the CSV files given to -load")
+	csvColumns := flag.String("csvColumns", "", "Optional, names of the columns of the CSV files given to -load, as a list of field=name pairs like id=Id,author=Name,email=Email,message=Text,created=Date. Only the created column is mandatory. By default, the columns are id, name, email, text and created in that order.")
+	csvDateFormat := flag.String("csvDateFormat", time.RFC3339, "Format of the creation dates in the CSV files given to -load, as a Go time layout, or \"unix\" for Unix timestamps in seconds")
+	csvEncoding := flag.String("csvEncoding", "utf-8", "Character encoding of the CSV files given to -load, like windows-1252")
+	loadDryRun := flag.Bool("loadDryRun", false, "Check the file given to -load without loading it, and exit")
+	loadWorkers := flag.Int("loadWorkers", 0, "Number of goroutines parsing and validating the records of the file given to -load. 0 uses one per CPU.")
+	loadBulk := flag.Bool("loadBulk", false, "Add the posts of the file given to -load to the store at once after reading the whole file, which is faster for large files but uses more memory")
+	loadConflicts := flag.String("loadConflicts", string(postservice.ConflictSkip), "What to do with the posts of the file given to -load whose ID already exists: skip, overwrite or fail (abort the whole load)")
+	challengeDifficulty := flag.Uint("challengeDifficulty", 0, "Optional, base difficulty (in bits) of the proof-of-work challenge required for posting. 0 disables challenges.")
+	challengeMaxDifficulty := flag.Uint("challengeMaxDifficulty", challenge.DefaultConfig.MaxDifficulty, "Maximum difficulty (in bits) of the proof-of-work challenge, reached when the posting rate is high.")
+
+	emailStrictness := flag.String("emailStrictness", "lax", "Strictness of email address validation: lax (any RFC 5322 address) or strict (fully qualified domain names only, no quoted local parts)")
+	emailBlocklist := flag.String("emailBlocklist", "", "Optional, path of a file listing disposable email domains (one per line) that are not allowed in posts")
+	confirmURL := flag.String("confirmURL", "", "Optional, prefix of the links sent to authors to confirm their email address, for example https://board.domain.com/confirm/. If set, new posts stay unpublished until confirmed.")
+	confirmExpiry := flag.Duration("confirmExpiry", 24*time.Hour, "Duration after which unconfirmed posts are deleted")
+	mailFrom := flag.String("mailFrom", "", "Sender address of confirmation emails")
+	smtpAddr := flag.String("smtpAddr", "", "Address (host:port) of the SMTP server used to send confirmation emails")
+	smtpUser := flag.String("smtpUser", "", "Optional, username used to authenticate to the SMTP server")
+	smtpPassword := flag.String("smtpPassword", "", "Optional, password used to authenticate to the SMTP server")
+	maildir := flag.String("maildir", "", "Optional, path of a Maildir where confirmation emails are delivered instead of being sent (useful for testing)")
+	editWindow := flag.Duration("editWindow", postservice.DefaultEditWindow, "Duration after the creation of a post during which its author can edit or delete it. 0 disables author edits.")
+	idempotencyCacheSize := flag.Int("idempotencyCacheSize", 10000, "Number of idempotency keys remembered for post creations. 0 disables idempotency keys.")
+	idempotencyTTL := flag.Duration("idempotencyTTL", 24*time.Hour, "Duration during which idempotency keys are remembered")
+	maxImports := flag.Int("maxImports", 100, "Number of import jobs remembered by the import API (POST /admin/imports). 0 disables the import API.")
+	eventHistory := flag.Int("eventHistory", events.DefaultHistorySize, "Number of past events remembered by the live feed (GET /admin/stream), so that clients reconnecting to it can catch up")
+	webhooksFile := flag.String("webhooks", "", "Optional, path of a JSON file configuring the webhooks receiving post events, see the README")
+	webhookQueue := flag.String("webhookQueue", "", "Path of the file where pending and failed webhook deliveries are saved. Defaults to the file given to -webhooks with a .queue suffix.")
+	feedURL := flag.String("feedURL", "", "Optional, public URL of the board, like https://board.domain.com. If set, Atom and RSS feeds of the published posts are served at /feed.atom and /feed.rss.")
+	feedTitle := flag.String("feedTitle", "Message board", "Title of the Atom and RSS feeds")
+	feedSize := flag.Uint("feedSize", endpoint.DefaultFeedSize, "Number of posts in the Atom and RSS feeds")
+	htmlBoard := flag.Bool("html", false, "Serve an HTML board at /, showing the published posts and a form to add a post")
+	htmlTitle := flag.String("htmlTitle", "Message board", "Title of the HTML board")
+	htmlTemplates := flag.String("htmlTemplates", "", "Optional, directory of templates replacing the default ones of the HTML board and of the admin console, see the README")
+	markdownMessages := flag.Bool("markdown", false, "Render the messages of the posts served to the public from Markdown to HTML, see the README")
+	markdownCacheSize := flag.Int("markdownCacheSize", markdown.DefaultCacheSize, "Number of posts whose rendered message is kept in memory")
+	adminConsole := flag.Bool("adminConsole", false, "Serve an admin moderation console at /admin/console, where admins log in with their credentials")
+	adminSessionTTL := flag.Duration("adminSessionTTL", 12*time.Hour, "Duration after which admins logged in to the console are logged out if they did not use it")
+	maxImportSize := flag.Int64("maxImportSize", 100<<20, "Maximum size in bytes of the files uploaded to the import API. 0 removes the limit.")
+	importDir := flag.String("importDir", "", "Directory where the files uploaded to the import API and their failed records are stored. Defaults to the system temporary directory.")
 
 	flag.Parse()
 
@@ -59,8 +214,147 @@ func main() {
 		die(mainLogger, errors.Wrap(err, "Error while creating post store"))
 	}
 
+	loadCSVOptions, err := csvOptions(*csvDelimiter, *csvColumns, *csvDateFormat, *csvEncoding)
+
+	if err != nil {
+		die(mainLogger, err)
+	}
+
+	conflicts, err := postservice.ParseConflictPolicy(*loadConflicts)
+
+	if err != nil {
+		die(mainLogger, err)
+	}
+
+	strictness, err := emailaddr.ParseStrictness(*emailStrictness)
+
+	if err != nil {
+		die(mainLogger, err)
+	}
+
+	emailValidator := &emailaddr.Validator{Strictness: strictness}
+
+	if *emailBlocklist != "" {
+		emailValidator.Blocklist, err = emailaddr.LoadBlocklistFile(*emailBlocklist)
+
+		if err != nil {
+			die(mainLogger, errors.Wrap(err, "Error while loading email blocklist"))
+		}
+	}
+
+	var endpointOptions []endpoint.Option
+
+	if *challengeDifficulty > 0 {
+		secret, err := token.NewSecret()
+
+		if err != nil {
+			die(mainLogger, errors.Wrap(err, "Error while generating challenge secret"))
+		}
+
+		config := challenge.DefaultConfig
+		config.BaseDifficulty = *challengeDifficulty
+		config.MaxDifficulty = *challengeMaxDifficulty
+
+		if config.MaxDifficulty < config.BaseDifficulty {
+			config.MaxDifficulty = config.BaseDifficulty
+		}
+
+		endpointOptions = append(endpointOptions, endpoint.UseChallenger(challenge.New(token.NewSigner(secret), config)))
+	}
+
+	if *idempotencyCacheSize > 0 {
+		endpointOptions = append(endpointOptions, endpoint.UseIdempotencyCache(idempotency.NewCache(*idempotencyCacheSize, *idempotencyTTL)))
+	}
+
+	if *feedURL != "" {
+		endpointOptions = append(endpointOptions, endpoint.UseFeeds(endpoint.FeedConfig{
+			Title: *feedTitle,
+			URL:   *feedURL,
+			Size:  *feedSize,
+		}))
+	}
+
+	if *htmlTemplates != "" {
+		templates, err := endpoint.LoadTemplates(*htmlTemplates)
+
+		if err != nil {
+			die(mainLogger, err)
+		}
+
+		endpointOptions = append(endpointOptions, endpoint.UseTemplates(templates))
+	}
+
+	if *htmlBoard {
+		endpointOptions = append(endpointOptions, endpoint.UseHTML(endpoint.HTMLConfig{
+			Title: *htmlTitle,
+		}))
+	}
+
+	if *markdownMessages {
+		endpointOptions = append(endpointOptions, endpoint.UseMarkdown(markdown.NewCache(*markdownCacheSize)))
+	}
+
+	if *adminConsole {
+		endpointOptions = append(endpointOptions, endpoint.UseAdminConsole(endpoint.ConsoleConfig{
+			Title:    *htmlTitle + " moderation",
+			Sessions: session.NewStore(*adminSessionTTL),
+		}))
+	}
+
+	bus := events.NewBus(*eventHistory)
+	endpointOptions = append(endpointOptions, endpoint.UseEventBus(bus))
+
+	serviceLogger := log.With(logger, "module", "postservice")
+
+	serviceOptions := []postservice.Option{
+		postservice.WithEmailValidator(emailValidator),
+		postservice.WithEditWindow(*editWindow),
+		postservice.WithEventBus(bus),
+		postservice.WithSubscriberErrorHandler(func(subscriber postservice.Subscriber, event postservice.Event, err error) {
+			serviceLogger.Log("event", "subscriber_error", "post_id", event.PostID(), "error", err)
+		}),
+	}
+
+	if *confirmURL != "" {
+		m, err := newMailer(*smtpAddr, *smtpUser, *smtpPassword, *maildir, *mailFrom)
+
+		if err != nil {
+			die(mainLogger, errors.Wrap(err, "Error while creating mailer"))
+		}
+
+		secret, err := token.NewSecret()
+
+		if err != nil {
+			die(mainLogger, errors.Wrap(err, "Error while generating confirmation secret"))
+		}
+
+		serviceOptions = append(serviceOptions, postservice.WithConfirmation(postservice.ConfirmationConfig{
+			Mailer: m,
+			Signer: token.NewSigner(secret),
+			URL:    *confirmURL,
+			Expiry: *confirmExpiry,
+		}))
+	}
+
+	service := postservice.New(store, serviceOptions...)
+
+	loadOptions := postservice.ImportOptions{
+		Conflicts:       conflicts,
+		DryRun:          *loadDryRun,
+		ParallelOptions: poststore.ParallelOptions{Workers: *loadWorkers},
+		Bulk:            *loadBulk,
+	}
+
 	if *csvFile != "" {
-		loadCSV(mainLogger, store, *csvFile)
+		load(mainLogger, service, *csvFile, poststore.FormatCSV.Name, loadCSVOptions, loadOptions)
+	}
+
+	if *loadFile != "" {
+		load(mainLogger, service, *loadFile, *loadFormat, loadCSVOptions, loadOptions)
+	}
+
+	if *loadDryRun {
+		return
 	}
 
 	if *adminUser == "" {
@@ -71,7 +365,54 @@ func main() {
 		*adminUser: *adminPassword,
 	}
 
-	ep := endpoint.NewHttpEndpoint(logger, postservice.New(store), adminUsers)
+	if *maxImports > 0 {
+		endpointOptions = append(endpointOptions, endpoint.UseImportManager(importjob.NewManager(service, *importDir, *maxImports, *maxImportSize)))
+	}
+
+	if *webhooksFile != "" {
+		webhooks, err := webhook.LoadConfig(*webhooksFile)
+
+		if err != nil {
+			die(mainLogger, err)
+		}
+
+		if *webhookQueue == "" {
+			*webhookQueue = *webhooksFile + ".queue"
+		}
+
+		dispatcher, err := webhook.NewDispatcher(log.With(logger, "module", "webhook"), webhooks, *webhookQueue, webhook.DefaultOptions)
+
+		if err != nil {
+			die(mainLogger, errors.Wrap(err, "Error while creating webhook dispatcher"))
+		}
+
+		dispatcher.Start(bus)
+		endpointOptions = append(endpointOptions, endpoint.UseWebhookDispatcher(dispatcher))
+	}
+
+	if *confirmURL != "" {
+		go expireUnconfirmed(mainLogger, service, time.Minute)
+	}
+
+	if *grpcListenAddress != "" {
+		listener, err := net.Listen("tcp", *grpcListenAddress)
+
+		if err != nil {
+			die(mainLogger, errors.Wrap(err, "Error while starting gRPC server"))
+		}
+
+		server := grpcendpoint.NewServer(log.With(logger, "module", "grpc"), service, adminUsers, grpcendpoint.UseEventBus(bus))
+
+		mainLogger.Log("grpc_listen", *grpcListenAddress)
+
+		go func() {
+			if err := server.Serve(listener); err != nil {
+				die(mainLogger, errors.Wrap(err, "Error while serving gRPC requests"))
+			}
+		}()
+	}
+
+	ep := endpoint.NewHttpEndpoint(logger, service, adminUsers, endpointOptions...)
 
 	mainLogger.Log("listen", *listenAddress)
 	err = http.ListenAndServe(*listenAddress, ep)
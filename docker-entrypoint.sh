@@ -30,4 +30,8 @@ if [ -n "$LOAD_CSV" ]; then
 	EXTRA_ARGS="-loadCSV $LOAD_CSV"
 fi
 
+if [ -n "$GRPC_LISTEN_ADDRESS" ]; then
+	EXTRA_ARGS="$EXTRA_ARGS -grpcListen $GRPC_LISTEN_ADDRESS"
+fi
+
 exec /home/server/server -listen "$LISTEN_ADDRESS" -adminUser "$ADMIN_USER" -adminPassword "$ADMIN_PASSWORD" $EXTRA_ARGS
@@ -0,0 +1,241 @@
+// Package challenge implements hashcash-style proof-of-work challenges, used to
+// make posting messages costly for bots.
+//
+// A client first requests a challenge, made of a signed token and a difficulty.
+// It then has to find a solution, that is a string such that the SHA-256 hash of
+// "token:solution" starts with at least difficulty zero bits. Each challenge can
+// only be solved once.
+package challenge
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/bits"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/abustany/back-message-board/pkg/token"
+)
+
+// Config holds the tunables of a Challenger.
+type Config struct {
+	// BaseDifficulty is the number of leading zero bits required in a solution
+	// when the posting rate is low.
+	BaseDifficulty uint
+	// MaxDifficulty caps the difficulty, whatever the posting rate.
+	MaxDifficulty uint
+	// RateWindow is the duration over which the posting rate is measured.
+	RateWindow time.Duration
+	// RateStep is the number of posts per RateWindow that increases the
+	// difficulty by one bit.
+	RateStep uint
+	// Lifetime is the duration during which an issued challenge can be solved.
+	Lifetime time.Duration
+}
+
+// DefaultConfig is a sensible configuration for a Challenger. Solving a
+// challenge at the base difficulty takes a few milliseconds on a modern
+// computer.
+var DefaultConfig = Config{
+	BaseDifficulty: 16,
+	MaxDifficulty:  24,
+	RateWindow:     time.Minute,
+	RateStep:       10,
+	Lifetime:       5 * time.Minute,
+}
+
+// Challenge is a challenge issued to a client.
+type Challenge struct {
+	// Signed token identifying the challenge
+	Token string `json:"token"`
+	// Number of leading zero bits required in the solution hash
+	Difficulty uint `json:"difficulty"`
+	// Time after which the challenge cannot be solved anymore
+	Expires time.Time `json:"expires"`
+}
+
+// ErrInvalidChallenge is returned by Challenger.Verify when given a token it did
+// not issue.
+var ErrInvalidChallenge = errors.New("Invalid challenge token")
+
+// ErrChallengeExpired is returned by Challenger.Verify when given a token
+// issued longer than Config.Lifetime ago.
+var ErrChallengeExpired = errors.New("Challenge expired")
+
+// ErrInvalidSolution is returned by Challenger.Verify when the solution does
+// not satisfy the difficulty of the challenge.
+var ErrInvalidSolution = errors.New("Invalid challenge solution")
+
+// ErrSolutionReused is returned by Challenger.Verify when given a challenge
+// that has already been solved.
+var ErrSolutionReused = errors.New("Challenge already solved")
+
+const nonceLength = 16
+
+// payloadLength is the length of the token payload: nonce, difficulty and
+// expiry time.
+const payloadLength = nonceLength + 1 + 8
+
+// Challenger issues and verifies challenges.
+//
+// The difficulty of issued challenges increases with the rate of successfully
+// verified solutions.
+type Challenger struct {
+	sync.Mutex
+	config Config
+	signer *token.Signer
+	// Times at which solutions were verified, in the last RateWindow
+	solved []time.Time
+	// Nonces of solved challenges, mapped to their expiry time
+	used map[string]time.Time
+}
+
+// New returns a new Challenger signing its tokens with the given signer.
+func New(signer *token.Signer, config Config) *Challenger {
+	return &Challenger{
+		config: config,
+		signer: signer,
+		used:   map[string]time.Time{},
+	}
+}
+
+// prune forgets solutions older than the rate window, and solved challenges
+// that expired. It should be called with the lock held.
+func (c *Challenger) prune(now time.Time) {
+	windowStart := now.Add(-c.config.RateWindow)
+	i := 0
+
+	for i < len(c.solved) && c.solved[i].Before(windowStart) {
+		i++
+	}
+
+	c.solved = c.solved[i:]
+
+	for nonce, expires := range c.used {
+		if expires.Before(now) {
+			delete(c.used, nonce)
+		}
+	}
+}
+
+// Difficulty returns the difficulty of challenges issued now.
+func (c *Challenger) Difficulty() uint {
+	c.Lock()
+	defer c.Unlock()
+
+	c.prune(time.Now())
+
+	return c.difficulty()
+}
+
+func (c *Challenger) difficulty() uint {
+	difficulty := c.config.BaseDifficulty
+
+	if c.config.RateStep > 0 {
+		difficulty += uint(len(c.solved)) / c.config.RateStep
+	}
+
+	if difficulty > c.config.MaxDifficulty {
+		difficulty = c.config.MaxDifficulty
+	}
+
+	return difficulty
+}
+
+// Issue returns a new challenge.
+func (c *Challenger) Issue() (Challenge, error) {
+	payload := make([]byte, payloadLength)
+
+	if _, err := rand.Read(payload[:nonceLength]); err != nil {
+		return Challenge{}, errors.Wrap(err, "Error while generating challenge nonce")
+	}
+
+	difficulty := c.Difficulty()
+	expires := time.Now().Add(c.config.Lifetime)
+
+	payload[nonceLength] = byte(difficulty)
+	binary.BigEndian.PutUint64(payload[nonceLength+1:], uint64(expires.UnixNano()))
+
+	return Challenge{
+		Token:      c.signer.Sign(payload),
+		Difficulty: difficulty,
+		Expires:    expires,
+	}, nil
+}
+
+// Verify checks that solution solves the challenge identified by the given
+// token. A challenge can only be solved once, further attempts return
+// ErrSolutionReused.
+func (c *Challenger) Verify(token, solution string) error {
+	payload, err := c.signer.Verify(token)
+
+	if err != nil || len(payload) != payloadLength {
+		return ErrInvalidChallenge
+	}
+
+	nonce := string(payload[:nonceLength])
+	difficulty := uint(payload[nonceLength])
+	expires := time.Unix(0, int64(binary.BigEndian.Uint64(payload[nonceLength+1:])))
+	now := time.Now()
+
+	if expires.Before(now) {
+		return ErrChallengeExpired
+	}
+
+	if !CheckSolution(token, solution, difficulty) {
+		return ErrInvalidSolution
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.prune(now)
+
+	if _, used := c.used[nonce]; used {
+		return ErrSolutionReused
+	}
+
+	c.used[nonce] = expires
+	c.solved = append(c.solved, now)
+
+	return nil
+}
+
+// leadingZeroBits returns the number of leading zero bits in data.
+func leadingZeroBits(data []byte) uint {
+	n := uint(0)
+
+	for _, b := range data {
+		if b != 0 {
+			return n + uint(bits.LeadingZeros8(b))
+		}
+
+		n += 8
+	}
+
+	return n
+}
+
+// CheckSolution returns true if and only if the SHA-256 hash of
+// "token:solution" starts with at least difficulty zero bits.
+func CheckSolution(token, solution string, difficulty uint) bool {
+	hash := sha256.Sum256([]byte(token + ":" + solution))
+
+	return leadingZeroBits(hash[:]) >= difficulty
+}
+
+// Solve finds a solution for the given challenge by brute force. It is mostly
+// useful for writing clients and tests.
+func Solve(challenge Challenge) string {
+	for i := uint64(0); ; i++ {
+		solution := strconv.FormatUint(i, 10)
+
+		if CheckSolution(challenge.Token, solution, challenge.Difficulty) {
+			return solution
+		}
+	}
+}
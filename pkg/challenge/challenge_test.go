@@ -0,0 +1,125 @@
+package challenge_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/abustany/back-message-board/pkg/challenge"
+	"github.com/abustany/back-message-board/pkg/token"
+)
+
+func newChallenger(config challenge.Config) *challenge.Challenger {
+	return challenge.New(token.NewSigner([]byte("secret")), config)
+}
+
+var testConfig = challenge.Config{
+	BaseDifficulty: 4,
+	MaxDifficulty:  6,
+	RateWindow:     time.Minute,
+	RateStep:       2,
+	Lifetime:       time.Minute,
+}
+
+func issue(t *testing.T, challenger *challenge.Challenger) challenge.Challenge {
+	c, err := challenger.Issue()
+
+	if err != nil {
+		t.Fatalf("Issue returned an error: %s", err)
+	}
+
+	return c
+}
+
+func TestChallenger(t *testing.T) {
+	t.Run("Solve", func(t *testing.T) {
+		challenger := newChallenger(testConfig)
+		c := issue(t, challenger)
+
+		if c.Difficulty != testConfig.BaseDifficulty {
+			t.Errorf("Unexpected difficulty: got %d, expected %d", c.Difficulty, testConfig.BaseDifficulty)
+		}
+
+		solution := challenge.Solve(c)
+
+		if err := challenger.Verify(c.Token, solution); err != nil {
+			t.Errorf("Verify returned an error for a valid solution: %s", err)
+		}
+
+		if err := challenger.Verify(c.Token, solution); err != challenge.ErrSolutionReused {
+			t.Errorf("Unexpected error when reusing a solution: got %v, expected %v", err, challenge.ErrSolutionReused)
+		}
+	})
+
+	t.Run("Invalid solution", func(t *testing.T) {
+		challenger := newChallenger(testConfig)
+		c := issue(t, challenger)
+
+		// Find a string that does *not* solve the challenge
+		var invalid string
+
+		for i := 0; ; i++ {
+			invalid = string(rune('a' + i%26))
+
+			if !challenge.CheckSolution(c.Token, invalid, c.Difficulty) {
+				break
+			}
+		}
+
+		if err := challenger.Verify(c.Token, invalid); err != challenge.ErrInvalidSolution {
+			t.Errorf("Unexpected error for an invalid solution: got %v, expected %v", err, challenge.ErrInvalidSolution)
+		}
+	})
+
+	t.Run("Invalid token", func(t *testing.T) {
+		challenger := newChallenger(testConfig)
+		c, err := newChallenger(testConfig).Issue()
+
+		if err != nil {
+			t.Fatalf("Issue returned an error: %s", err)
+		}
+
+		// Signed with the same secret, but not a challenge token
+		forged := token.NewSigner([]byte("secret")).Sign([]byte("hello"))
+
+		for _, tok := range []string{"", "garbage", forged, "x" + c.Token} {
+			if err := challenger.Verify(tok, "0"); err != challenge.ErrInvalidChallenge {
+				t.Errorf("Unexpected error for token %q: got %v, expected %v", tok, err, challenge.ErrInvalidChallenge)
+			}
+		}
+	})
+
+	t.Run("Expired challenge", func(t *testing.T) {
+		config := testConfig
+		config.Lifetime = time.Millisecond
+		challenger := newChallenger(config)
+		c := issue(t, challenger)
+
+		time.Sleep(5 * time.Millisecond)
+
+		if err := challenger.Verify(c.Token, challenge.Solve(c)); err != challenge.ErrChallengeExpired {
+			t.Errorf("Unexpected error for an expired challenge: got %v, expected %v", err, challenge.ErrChallengeExpired)
+		}
+	})
+
+	t.Run("Difficulty scaling", func(t *testing.T) {
+		challenger := newChallenger(testConfig)
+
+		for i := uint(0); i < 10; i++ {
+			expected := testConfig.BaseDifficulty + i/testConfig.RateStep
+
+			if expected > testConfig.MaxDifficulty {
+				expected = testConfig.MaxDifficulty
+			}
+
+			c := issue(t, challenger)
+
+			if c.Difficulty != expected {
+				t.Errorf("Unexpected difficulty after %d solutions: got %d, expected %d", i, c.Difficulty, expected)
+			}
+
+			if err := challenger.Verify(c.Token, challenge.Solve(c)); err != nil {
+				t.Fatalf("Verify returned an error: %s", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,247 @@
+// Package emailaddr validates and normalizes email addresses.
+package emailaddr
+
+import (
+	"bufio"
+	"io"
+	"net/mail"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/idna"
+)
+
+// Strictness tells how strictly a Validator checks addresses.
+type Strictness int
+
+const (
+	// Lax accepts any address that parses as an RFC 5322 addr-spec.
+	Lax Strictness = iota
+
+	// Strict additionally rejects quoted local parts and domain literals, and
+	// requires the domain to be a fully qualified host name.
+	Strict
+)
+
+// ParseStrictness parses the name of a strictness level ("lax" or "strict").
+func ParseStrictness(name string) (Strictness, error) {
+	switch name {
+	case "lax":
+		return Lax, nil
+	case "strict":
+		return Strict, nil
+	}
+
+	return Lax, errors.Errorf("Unknown email strictness %s", name)
+}
+
+// MaxLocalPartLength is the maximum length of the local part of an address, as
+// per RFC 5321.
+const MaxLocalPartLength = 64
+
+// MaxDomainLength is the maximum length of a domain name, in its ASCII form.
+const MaxDomainLength = 253
+
+// MaxLabelLength is the maximum length of a label in a domain name.
+const MaxLabelLength = 63
+
+// ErrMalformed is returned by Validator.Normalize when given a string that
+// cannot be parsed as an address.
+var ErrMalformed = errors.New("not a valid RFC 5322 address")
+
+// ErrDisplayName is returned by Validator.Normalize when given an address with
+// a display name, like "John <john@domain.com>".
+var ErrDisplayName = errors.New("should be a bare address, without a display name")
+
+// ErrQuotedLocalPart is returned by strict validators when given an address
+// with a quoted local part.
+var ErrQuotedLocalPart = errors.New("quoted local parts are not allowed")
+
+// ErrLocalPartTooLong is returned by strict validators when the local part of
+// the address is longer than MaxLocalPartLength.
+var ErrLocalPartTooLong = errors.Errorf("local part should not be longer than %d characters", MaxLocalPartLength)
+
+// ErrDomainLiteral is returned by strict validators when given an address with
+// an IP address as domain.
+var ErrDomainLiteral = errors.New("domain literals are not allowed")
+
+// ErrInvalidDomain is returned by Validator.Normalize when the domain of the
+// address is not a valid host name.
+var ErrInvalidDomain = errors.New("invalid domain name")
+
+// ErrDisposableDomain is returned by Validator.Normalize when the domain of the
+// address is in the blocklist.
+var ErrDisposableDomain = errors.New("disposable email domains are not allowed")
+
+// Validator validates and normalizes addresses.
+type Validator struct {
+	Strictness Strictness
+
+	// Optional list of domains that are not allowed in addresses
+	Blocklist Blocklist
+}
+
+// Normalize validates the given address, and returns it in its normalized form:
+// the domain is converted to its lowercase, ASCII (IDNA) form. The local part
+// is left untouched.
+func (v *Validator) Normalize(address string) (string, error) {
+	parsed, err := mail.ParseAddress(address)
+
+	if err != nil {
+		return "", ErrMalformed
+	}
+
+	if parsed.Name != "" || strings.ContainsAny(address, "<>") {
+		return "", ErrDisplayName
+	}
+
+	at := strings.LastIndexByte(parsed.Address, '@')
+
+	if at < 0 {
+		return "", ErrMalformed
+	}
+
+	localPart, domain := parsed.Address[:at], parsed.Address[at+1:]
+
+	// mail.ParseAddress unquotes the local part, restore the quotes
+	quoted := strings.HasPrefix(strings.TrimSpace(address), `"`)
+
+	if quoted {
+		localPart = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(localPart) + `"`
+	}
+
+	if strings.HasPrefix(domain, "[") {
+		if v.Strictness >= Strict {
+			return "", ErrDomainLiteral
+		}
+
+		return localPart + "@" + domain, nil
+	}
+
+	if v.Strictness >= Strict {
+		if quoted {
+			return "", ErrQuotedLocalPart
+		}
+
+		if len(localPart) > MaxLocalPartLength {
+			return "", ErrLocalPartTooLong
+		}
+	}
+
+	domain, err = idna.Lookup.ToASCII(domain)
+
+	if err != nil {
+		return "", ErrInvalidDomain
+	}
+
+	domain = strings.ToLower(domain)
+
+	if v.Strictness >= Strict && !isHostName(domain) {
+		return "", ErrInvalidDomain
+	}
+
+	if v.Blocklist.Contains(domain) {
+		return "", ErrDisposableDomain
+	}
+
+	return localPart + "@" + domain, nil
+}
+
+// isHostName checks that the given ASCII domain is a fully qualified host name,
+// made of at least two labels.
+func isHostName(domain string) bool {
+	if len(domain) > MaxDomainLength {
+		return false
+	}
+
+	labels := strings.Split(domain, ".")
+
+	if len(labels) < 2 {
+		return false
+	}
+
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > MaxLabelLength {
+			return false
+		}
+
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '-' {
+				return false
+			}
+		}
+	}
+
+	// Top level domains are never all-numeric
+	return strings.Trim(labels[len(labels)-1], "0123456789") != ""
+}
+
+// Blocklist is a set of blocked domains, in their lowercase ASCII form.
+type Blocklist map[string]struct{}
+
+// Contains returns true if the given domain, or one of its parent domains, is
+// in the blocklist.
+func (b Blocklist) Contains(domain string) bool {
+	for domain != "" {
+		if _, blocked := b[domain]; blocked {
+			return true
+		}
+
+		dot := strings.IndexByte(domain, '.')
+
+		if dot < 0 {
+			break
+		}
+
+		domain = domain[dot+1:]
+	}
+
+	return false
+}
+
+// LoadBlocklist reads a blocklist, formatted with one domain per line. Empty
+// lines and lines starting with a # are ignored.
+func LoadBlocklist(data io.Reader) (Blocklist, error) {
+	blocklist := Blocklist{}
+	scanner := bufio.NewScanner(data)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		domain, err := idna.Lookup.ToASCII(line)
+
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid domain %s in blocklist", line)
+		}
+
+		blocklist[strings.ToLower(domain)] = struct{}{}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "Error while reading blocklist")
+	}
+
+	return blocklist, nil
+}
+
+// LoadBlocklistFile reads a blocklist from a file, see LoadBlocklist.
+func LoadBlocklistFile(filename string) (Blocklist, error) {
+	fd, err := os.Open(filename)
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error while opening %s", filename)
+	}
+
+	defer fd.Close()
+
+	return LoadBlocklist(fd)
+}
@@ -0,0 +1,73 @@
+package emailaddr_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/abustany/back-message-board/pkg/emailaddr"
+)
+
+func TestNormalize(t *testing.T) {
+	blocklist, err := emailaddr.LoadBlocklist(strings.NewReader("# Disposable domains\n\nmailinator.com\n"))
+
+	if err != nil {
+		t.Fatalf("LoadBlocklist returned an error: %s", err)
+	}
+
+	lax := &emailaddr.Validator{Strictness: emailaddr.Lax, Blocklist: blocklist}
+	strict := &emailaddr.Validator{Strictness: emailaddr.Strict, Blocklist: blocklist}
+
+	testData := []struct {
+		address     string
+		normalized  string
+		laxError    error
+		strictError error
+	}{
+		{"john@domain.com", "john@domain.com", nil, nil},
+		{"John.Doe@DOMAIN.Com", "John.Doe@domain.com", nil, nil},
+		{"john@bücher.de", "john@xn--bcher-kva.de", nil, nil},
+		{"john@BÜCHER.de", "john@xn--bcher-kva.de", nil, nil},
+		{"", "", emailaddr.ErrMalformed, emailaddr.ErrMalformed},
+		{"john", "", emailaddr.ErrMalformed, emailaddr.ErrMalformed},
+		{"john@", "", emailaddr.ErrMalformed, emailaddr.ErrMalformed},
+		{"john@@domain.com", "", emailaddr.ErrMalformed, emailaddr.ErrMalformed},
+		{"John <john@domain.com>", "", emailaddr.ErrDisplayName, emailaddr.ErrDisplayName},
+		{"<john@domain.com>", "", emailaddr.ErrDisplayName, emailaddr.ErrDisplayName},
+		{`"john doe"@domain.com`, `"john doe"@domain.com`, nil, emailaddr.ErrQuotedLocalPart},
+		{"john@[127.0.0.1]", "john@[127.0.0.1]", nil, emailaddr.ErrDomainLiteral},
+		{"john@localhost", "john@localhost", nil, emailaddr.ErrInvalidDomain},
+		{"john@domain.123", "john@domain.123", nil, emailaddr.ErrInvalidDomain},
+		{"john@-domain.com", "", emailaddr.ErrInvalidDomain, emailaddr.ErrInvalidDomain},
+		{strings.Repeat("j", 65) + "@domain.com", strings.Repeat("j", 65) + "@domain.com", nil, emailaddr.ErrLocalPartTooLong},
+		{"john@mailinator.com", "", emailaddr.ErrDisposableDomain, emailaddr.ErrDisposableDomain},
+		{"john@eu.MAILINATOR.com", "", emailaddr.ErrDisposableDomain, emailaddr.ErrDisposableDomain},
+	}
+
+	check := func(validator *emailaddr.Validator, name string, address, expected string, expectedError error) {
+		normalized, err := validator.Normalize(address)
+
+		if err != expectedError {
+			t.Errorf("Unexpected error from %s validator for %q: got %v, expected %v", name, address, err, expectedError)
+			return
+		}
+
+		if err == nil && normalized != expected {
+			t.Errorf("Unexpected normalized address from %s validator for %q: got %q, expected %q", name, address, normalized, expected)
+		}
+	}
+
+	for _, d := range testData {
+		check(lax, "lax", d.address, d.normalized, d.laxError)
+		check(strict, "strict", d.address, d.normalized, d.strictError)
+	}
+}
+
+func TestParseStrictness(t *testing.T) {
+	if s, err := emailaddr.ParseStrictness("strict"); err != nil || s != emailaddr.Strict {
+		t.Errorf("Unexpected result when parsing strict: got %v (error %v)", s, err)
+	}
+
+	if _, err := emailaddr.ParseStrictness("whatever"); err == nil {
+		t.Errorf("ParseStrictness didn't return an error for an unknown strictness")
+	}
+}
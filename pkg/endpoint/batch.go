@@ -0,0 +1,152 @@
+package endpoint
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/abustany/back-message-board/pkg/postservice"
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+// BatchRequest is the shape of batch requests.
+type BatchRequest struct {
+	// If true, either all operations are applied, or none is
+	Atomic bool `json:"atomic"`
+	// Operations to apply, in order
+	Operations []BatchOperation `json:"operations"`
+}
+
+// BatchOperation is a single operation of a BatchRequest.
+type BatchOperation struct {
+	// "update", "delete" or "set_state"
+	Action postservice.BatchAction `json:"action"`
+	// ID of the post to change
+	ID string `json:"id"`
+	// JSON merge patch of the post, for updates
+	Post json.RawMessage `json:"post,omitempty"`
+	// New state of the post, for state changes
+	State types.PostState `json:"state,omitempty"`
+}
+
+// BatchResult is the result of a single BatchOperation.
+type BatchResult struct {
+	// HTTP status code of the operation
+	Status int `json:"status"`
+	// Post after the operation, for successful updates and state changes
+	Post *types.Post `json:"post,omitempty"`
+	// Error that prevented the operation to be applied, if any
+	Error *Problem `json:"error,omitempty"`
+}
+
+// BatchResponse is the shape of replies to batch requests.
+type BatchResponse struct {
+	// Results of the operations, in the same order as in the request
+	Results []BatchResult `json:"results"`
+}
+
+// MaxBatchBodySize is the maximum size of the body of batch requests.
+const MaxBatchBodySize = 8 << 20
+
+func (e *HttpEndpoint) handleBatch(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxBatchBodySize))
+
+	if err != nil {
+		WriteError(w, r, errInvalidBody)
+		return
+	}
+
+	var request BatchRequest
+
+	if err := json.Unmarshal(data, &request); err != nil {
+		WriteError(w, r, errInvalidJSON)
+		return
+	}
+
+	if len(request.Operations) > postservice.MaxBatchSize {
+		WriteError(w, r, postservice.ErrInvalidBatchSize)
+		return
+	}
+
+	// Operations whose merge patch cannot be decoded fail on their own, and are
+	// not passed to the service
+	patchErrors := make([]error, len(request.Operations))
+	invalid := false
+	operations := make([]postservice.BatchOperation, 0, len(request.Operations))
+
+	for i, op := range request.Operations {
+		operation := postservice.BatchOperation{
+			Action: op.Action,
+			ID:     op.ID,
+			State:  op.State,
+		}
+
+		if op.Action == postservice.BatchUpdate {
+			post, fields, err := types.DecodeMergePatch(op.Post)
+
+			if err != nil {
+				patchErrors[i] = errInvalidJSON
+				invalid = true
+				continue
+			}
+
+			operation.Post = post
+			operation.Fields = fields
+		}
+
+		operations = append(operations, operation)
+	}
+
+	var results []postservice.BatchResult
+
+	// Like the service does for operations failing validation, atomic batches
+	// with an invalid patch are aborted without applying anything
+	if !invalid || (!request.Atomic && len(operations) > 0) {
+		results, err = e.service.Batch(operations, request.Atomic)
+
+		if err != nil {
+			WriteError(w, r, errors.Wrap(err, "Error while applying batch"))
+			return
+		}
+	}
+
+	response := BatchResponse{
+		Results: make([]BatchResult, len(request.Operations)),
+	}
+
+	for i, op := range request.Operations {
+		var result postservice.BatchResult
+
+		switch {
+		case patchErrors[i] != nil:
+			result.Err = patchErrors[i]
+		case results == nil:
+			result.Err = postservice.ErrBatchAborted
+		default:
+			result, results = results[0], results[1:]
+		}
+
+		response.Results[i] = batchResult(r, op.Action, result)
+	}
+
+	w.Header().Set("Content-Type", JsonContentType)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&response)
+}
+
+// batchResult converts the result of a batch operation with the given action.
+func batchResult(r *http.Request, action postservice.BatchAction, result postservice.BatchResult) BatchResult {
+	switch {
+	case result.Err != nil:
+		problem := problemOf(r, result.Err)
+		problem.complete(r)
+		return BatchResult{Status: problem.Status, Error: &problem}
+	case action == postservice.BatchDelete:
+		return BatchResult{Status: http.StatusNoContent}
+	default:
+		post := result.Post
+		return BatchResult{Status: http.StatusOK, Post: &post}
+	}
+}
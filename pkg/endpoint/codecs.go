@@ -0,0 +1,305 @@
+package endpoint
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/abustany/back-message-board/pkg/poststore"
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+// Codec encodes replies and decodes request bodies in a given content type.
+type Codec struct {
+	// MIME type, like "text/csv; charset=utf-8"
+	ContentType string
+	// EncodePost writes a single post
+	EncodePost func(w io.Writer, post *types.Post) error
+	// EncodeList writes a page of posts. Formats that cannot hold the cursor
+	// to the next page only write the posts, clients get the cursor from the
+	// Link header of the reply.
+	EncodeList func(w io.Writer, list *ListResponse) error
+	// DecodePost reads a single post, with the fields that are not set left
+	// empty
+	DecodePost func(r io.Reader) (types.Post, error)
+}
+
+// CodecJSON encodes JSON objects.
+var CodecJSON = Codec{
+	ContentType: JsonContentType,
+	EncodePost: func(w io.Writer, post *types.Post) error {
+		return json.NewEncoder(w).Encode(post)
+	},
+	EncodeList: func(w io.Writer, list *ListResponse) error {
+		return json.NewEncoder(w).Encode(list)
+	},
+	DecodePost: decodeJSONPost,
+}
+
+// CodecCSV encodes posts in the CSV format of exports (see poststore.FormatCSV),
+// with a header record. Posts sent in CSV must have a header record, followed
+// by the record of the post. Columns are looked up by name in the header, and
+// can be omitted.
+var CodecCSV = Codec{
+	ContentType: poststore.FormatCSV.ContentType,
+	EncodePost: func(w io.Writer, post *types.Post) error {
+		return encodePosts(poststore.NewCSVEncoder(w), []types.Post{*post})
+	},
+	EncodeList: func(w io.Writer, list *ListResponse) error {
+		return encodePosts(poststore.NewCSVEncoder(w), list.Posts)
+	},
+	DecodePost: decodeCSVPost,
+}
+
+// CodecNDJSON encodes posts as newline delimited JSON, with one post per line.
+// Posts are sent as a single JSON object.
+var CodecNDJSON = Codec{
+	ContentType: poststore.FormatNDJSON.ContentType,
+	EncodePost: func(w io.Writer, post *types.Post) error {
+		return encodePosts(poststore.NewNDJSONEncoder(w), []types.Post{*post})
+	},
+	EncodeList: func(w io.Writer, list *ListResponse) error {
+		return encodePosts(poststore.NewNDJSONEncoder(w), list.Posts)
+	},
+	DecodePost: decodeJSONPost,
+}
+
+// CodecMessagePack encodes MessagePack maps, with the same keys as the JSON
+// objects. Creation times are MessagePack timestamps, and can also be sent as
+// RFC3339 strings.
+var CodecMessagePack = Codec{
+	ContentType: "application/msgpack",
+	EncodePost: func(w io.Writer, post *types.Post) error {
+		return msgpack.NewEncoder(w).Encode(post)
+	},
+	EncodeList: func(w io.Writer, list *ListResponse) error {
+		return msgpack.NewEncoder(w).Encode(list)
+	},
+	DecodePost: decodeMessagePackPost,
+}
+
+// Codecs lists the supported content types, by order of preference when
+// clients accept several of them equally.
+var Codecs = []*Codec{&CodecJSON, &CodecCSV, &CodecNDJSON, &CodecMessagePack}
+
+// mediaType returns the media type of a content type, without its parameters.
+func mediaType(contentType string) string {
+	t, _, err := mime.ParseMediaType(contentType)
+
+	if err != nil {
+		return ""
+	}
+
+	return t
+}
+
+// CodecByContentType returns the codec of the given content type, or nil if it
+// is not supported. Parameters of the content type (like charset) are ignored.
+func CodecByContentType(contentType string) *Codec {
+	t := mediaType(contentType)
+
+	for _, codec := range Codecs {
+		if t != "" && mediaType(codec.ContentType) == t {
+			return codec
+		}
+	}
+
+	return nil
+}
+
+// codecTypes returns the media types of the supported codecs.
+func codecTypes() []string {
+	names := make([]string, len(Codecs))
+
+	for i, codec := range Codecs {
+		names[i] = mediaType(codec.ContentType)
+	}
+
+	return names
+}
+
+// negotiate returns the codec of the content type preferred by the client
+// among the ones it accepts (see the Accept header), or nil if none of them is
+// supported. Clients that don't send an Accept header get JSON.
+func negotiate(r *http.Request) *Codec {
+	accept := strings.Join(r.Header["Accept"], ",")
+
+	if strings.TrimSpace(accept) == "" {
+		return &CodecJSON
+	}
+
+	var best *Codec
+	bestQuality := 0.0
+
+	for _, codec := range Codecs {
+		codecType := mediaType(codec.ContentType)
+		// Quality of the most specific range matching the codec
+		quality, specificity := 0.0, 0
+
+		for _, part := range strings.Split(accept, ",") {
+			t, params, err := mime.ParseMediaType(part)
+
+			if err != nil {
+				continue
+			}
+
+			s := 0
+
+			switch {
+			case t == codecType:
+				s = 3
+			case strings.HasSuffix(t, "/*") && strings.HasPrefix(codecType, strings.TrimSuffix(t, "*")):
+				s = 2
+			case t == "*/*":
+				s = 1
+			}
+
+			if s <= specificity {
+				continue
+			}
+
+			q := 1.0
+
+			if value, ok := params["q"]; ok {
+				if q, err = strconv.ParseFloat(value, 64); err != nil {
+					q = 0
+				}
+			}
+
+			quality, specificity = q, s
+		}
+
+		if quality > bestQuality {
+			best, bestQuality = codec, quality
+		}
+	}
+
+	return best
+}
+
+// writeNegotiated writes a reply in the content type negotiated by negotiate.
+// Since the response is already started when encode is called, its errors can
+// only be logged.
+func writeNegotiated(w http.ResponseWriter, r *http.Request, codec *Codec, encode func(w io.Writer) error) {
+	w.Header().Set("Content-Type", codec.ContentType)
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(http.StatusOK)
+
+	if err := encode(w); err != nil {
+		logError(r, errors.Wrap(err, "Error while encoding reply"))
+	}
+}
+
+func encodePosts(encoder poststore.Encoder, posts []types.Post) error {
+	for _, post := range posts {
+		if err := encoder.Encode(post); err != nil {
+			return err
+		}
+	}
+
+	return encoder.Close()
+}
+
+func decodeJSONPost(r io.Reader) (types.Post, error) {
+	var post types.Post
+
+	if err := json.NewDecoder(r).Decode(&post); err != nil {
+		return types.Post{}, errInvalidJSON
+	}
+
+	return post, nil
+}
+
+func decodeCSVPost(r io.Reader) (types.Post, error) {
+	records, err := csv.NewReader(r).ReadAll()
+
+	if err != nil || len(records) != 2 {
+		return types.Post{}, errMalformedPost
+	}
+
+	var post types.Post
+
+	for i, name := range records[0] {
+		value := records[1][i]
+
+		switch strings.TrimSpace(name) {
+		case "id":
+			post.ID = value
+		case "name":
+			post.Author = value
+		case "email":
+			post.Email = value
+		case "text":
+			post.Message = value
+		case "created":
+			if value == "" {
+				continue
+			}
+
+			if post.Created, err = time.Parse(time.RFC3339, value); err != nil {
+				return types.Post{}, errMalformedPost
+			}
+		}
+	}
+
+	return post, nil
+}
+
+// messagePackPost is the shape of the posts sent in MessagePack.
+type messagePackPost struct {
+	// Declared before the post, so that it replaces its Created field
+	Created    messagePackTime `msgpack:"created"`
+	types.Post `msgpack:",inline"`
+}
+
+// messagePackTime is a time sent in MessagePack, either as a timestamp or as
+// an RFC3339 string.
+type messagePackTime time.Time
+
+func (t *messagePackTime) DecodeMsgpack(decoder *msgpack.Decoder) error {
+	value, err := decoder.DecodeInterface()
+
+	if err != nil {
+		return err
+	}
+
+	switch value := value.(type) {
+	case nil:
+		*t = messagePackTime{}
+	case time.Time:
+		*t = messagePackTime(value)
+	case string:
+		parsed, err := time.Parse(time.RFC3339, value)
+
+		if err != nil {
+			return err
+		}
+
+		*t = messagePackTime(parsed)
+	default:
+		return errors.Errorf("Invalid time %v", value)
+	}
+
+	return nil
+}
+
+func decodeMessagePackPost(r io.Reader) (types.Post, error) {
+	var body messagePackPost
+
+	if err := msgpack.NewDecoder(r).Decode(&body); err != nil {
+		return types.Post{}, errMalformedPost
+	}
+
+	post := body.Post
+	post.Created = time.Time(body.Created)
+
+	return post, nil
+}
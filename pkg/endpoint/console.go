@@ -0,0 +1,225 @@
+package endpoint
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/abustany/back-message-board/pkg/session"
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+// DefaultConsolePageSize is the number of posts on each page of an admin
+// console whose ConsoleConfig has a PageSize of 0.
+const DefaultConsolePageSize = 50
+
+// ConsoleConfig configures the admin console, see UseAdminConsole.
+type ConsoleConfig struct {
+	// Title of the console pages
+	Title string
+	// Sessions of the users logged in to the console
+	Sessions *session.Store
+	// Number of posts on each page
+	PageSize uint
+}
+
+// UseAdminConsole enables the admin console at /admin/console, a moderation
+// page for browsers. Admins log in at /admin/login with the credentials of the
+// admin API, and get a session cookie that also authenticates the requests of
+// the console to the admin API. Its pages are rendered with the templates set
+// by UseTemplates.
+func UseAdminConsole(config ConsoleConfig) Option {
+	return func(e *HttpEndpoint) {
+		if config.PageSize == 0 {
+			config.PageSize = DefaultConsolePageSize
+		}
+
+		e.console = &config
+	}
+}
+
+// loginPage is the data of the login.html template.
+type loginPage struct {
+	Title    string
+	Username string
+	// Reason why the previous login attempt failed, if any
+	Error string
+	// Token to set in the csrf_token field of the form
+	CSRFToken string
+}
+
+// consolePage is the data of the console.html template.
+type consolePage struct {
+	Title string
+	// Name of the logged in admin
+	User string
+	// Token to send in the X-CSRF-Token header of API requests, and in the
+	// csrf_token field of forms
+	CSRFToken string
+	// Posts of the page, newest first
+	Posts []types.Post
+	// Filters of the page: state of the posts (all states if empty), and text
+	// that their author, email or message contain
+	State types.PostState
+	Query string
+	// States that can be filtered on
+	States []types.PostState
+	// Cursor of the page, empty for the first page, and of the next page,
+	// empty for the last page
+	Cursor string
+	Next   string
+}
+
+// consoleStates are the states the console can filter posts on.
+var consoleStates = []types.PostState{types.StatePublished, types.StateUnconfirmed}
+
+// setSessionCookie sets the session cookie of the console. An empty ID removes
+// the cookie.
+func setSessionCookie(w http.ResponseWriter, r *http.Request, id string) {
+	cookie := &http.Cookie{
+		Name:     SessionCookie,
+		Value:    id,
+		Path:     "/admin",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	}
+
+	if id == "" {
+		cookie.MaxAge = -1
+	}
+
+	http.SetCookie(w, cookie)
+}
+
+func (e *HttpEndpoint) renderLogin(w http.ResponseWriter, r *http.Request, status int, page loginPage) {
+	var err error
+
+	page.Title = e.console.Title
+
+	if page.CSRFToken, err = csrfToken(w, r); err != nil {
+		e.writeHTMLError(w, r, e.console.Title, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	e.renderHTML(w, r, status, "login.html", &page)
+}
+
+func (e *HttpEndpoint) handleLoginPage(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requestSession(e.console.Sessions, r); ok {
+		http.Redirect(w, r, "/admin/console", http.StatusSeeOther)
+		return
+	}
+
+	e.renderLogin(w, r, http.StatusOK, loginPage{})
+}
+
+func (e *HttpEndpoint) handleLogin(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, MaxFormSize)
+
+	if err := r.ParseForm(); err != nil {
+		e.writeHTMLError(w, r, e.console.Title, errInvalidBody)
+		return
+	}
+
+	if err := checkCSRF(r); err != nil {
+		e.writeHTMLError(w, r, e.console.Title, err)
+		return
+	}
+
+	username := r.PostForm.Get("username")
+
+	if !e.authenticator.Check(username, r.PostForm.Get("password")) {
+		e.renderLogin(w, r, http.StatusUnauthorized, loginPage{
+			Username: username,
+			Error:    "Invalid username or password",
+		})
+		return
+	}
+
+	s, err := e.console.Sessions.Create(username)
+
+	if err != nil {
+		e.writeHTMLError(w, r, e.console.Title, err)
+		return
+	}
+
+	setSessionCookie(w, r, s.ID)
+	http.Redirect(w, r, "/admin/console", http.StatusSeeOther)
+}
+
+func (e *HttpEndpoint) handleLogout(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, MaxFormSize)
+
+	if err := r.ParseForm(); err != nil {
+		e.writeHTMLError(w, r, e.console.Title, errInvalidBody)
+		return
+	}
+
+	if s, ok := requestSession(e.console.Sessions, r); ok {
+		if subtle.ConstantTimeCompare([]byte(r.PostForm.Get("csrf_token")), []byte(s.CSRFToken)) != 1 {
+			e.writeHTMLError(w, r, e.console.Title, errInvalidCSRFToken)
+			return
+		}
+
+		e.console.Sessions.Delete(s.ID)
+	}
+
+	setSessionCookie(w, r, "")
+	http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+}
+
+// postMatches returns true if the author, email or message of a post contain
+// the given text, ignoring case.
+func postMatches(post *types.Post, query string) bool {
+	query = strings.ToLower(query)
+
+	for _, field := range []string{post.Author, post.Email, post.Message} {
+		if strings.Contains(strings.ToLower(field), query) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (e *HttpEndpoint) handleConsole(w http.ResponseWriter, r *http.Request) {
+	s, ok := requestSession(e.console.Sessions, r)
+
+	if !ok {
+		http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+		return
+	}
+
+	params := r.URL.Query()
+
+	page := consolePage{
+		Title:     e.console.Title,
+		User:      s.User,
+		CSRFToken: s.CSRFToken,
+		State:     types.PostState(params.Get("state")),
+		Query:     strings.TrimSpace(params.Get("q")),
+		States:    consoleStates,
+		Cursor:    params.Get("cursor"),
+	}
+
+	if page.State != "" && !page.State.Valid() {
+		e.writeHTMLError(w, r, e.console.Title, errInvalidPostState)
+		return
+	}
+
+	var err error
+
+	page.Posts, page.Next, err = e.filterPosts(page.Cursor, e.console.PageSize, func(post *types.Post) bool {
+		return (page.State == "" || post.State == page.State) && (page.Query == "" || postMatches(post, page.Query))
+	})
+
+	if err != nil {
+		e.writeHTMLError(w, r, e.console.Title, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	e.renderHTML(w, r, http.StatusOK, "console.html", &page)
+}
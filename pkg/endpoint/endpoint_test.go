@@ -1,30 +1,49 @@
 package endpoint_test
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
+	"encoding/xml"
+	"html/template"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/net/websocket"
 
+	"github.com/abustany/back-message-board/pkg/challenge"
 	"github.com/abustany/back-message-board/pkg/endpoint"
+	"github.com/abustany/back-message-board/pkg/events"
+	"github.com/abustany/back-message-board/pkg/idempotency"
+	"github.com/abustany/back-message-board/pkg/importjob"
+	"github.com/abustany/back-message-board/pkg/markdown"
 	"github.com/abustany/back-message-board/pkg/postservice"
 	"github.com/abustany/back-message-board/pkg/poststore"
+	"github.com/abustany/back-message-board/pkg/session"
+	"github.com/abustany/back-message-board/pkg/token"
 	"github.com/abustany/back-message-board/pkg/types"
+	"github.com/abustany/back-message-board/pkg/webhook"
 )
 
 const adminUser = "admin"
 const adminPassword = "r00tme"
 
 func TestEndpoint(t *testing.T) {
-	withUrl := func(f func(*testing.T, string)) func(*testing.T) {
+	withUrl := func(f func(*testing.T, string), options ...endpoint.Option) func(*testing.T) {
 		return func(t *testing.T) {
 			//logger := log.NewNopLogger()
 			logger := log.NewJSONLogger(log.NewSyncWriter(os.Stdout))
@@ -38,7 +57,7 @@ func TestEndpoint(t *testing.T) {
 				adminUser: adminPassword,
 			}
 
-			ep := endpoint.NewHttpEndpoint(logger, postservice.New(store), adminUsers)
+			ep := endpoint.NewHttpEndpoint(logger, postservice.New(store), adminUsers, options...)
 			server := httptest.NewServer(ep)
 			defer server.Close()
 
@@ -48,10 +67,35 @@ func TestEndpoint(t *testing.T) {
 
 	t.Run("Add (invalid json)", withUrl(testAddInvalidJson))
 	t.Run("Add", withUrl(testAdd))
+	t.Run("Add (challenge)", withUrl(testAddChallenge, endpoint.UseChallenger(newChallenger())))
+	t.Run("Add (idempotency)", withUrl(testAddIdempotency, endpoint.UseChallenger(newChallenger()), endpoint.UseIdempotencyCache(idempotency.NewCache(10, time.Hour))))
 	t.Run("Update", withUrl(testUpdate))
 	t.Run("List (authentication)", withUrl(testListAuthentication))
 	t.Run("List", withUrl(testList))
 	t.Run("Get", withUrl(testGet))
+	t.Run("Content negotiation", withUrl(testContentNegotiation))
+	t.Run("Confirm", withUrl(testConfirm))
+	t.Run("Author edit", withUrl(testAuthorEdit))
+	t.Run("Errors", withUrl(testErrors))
+	t.Run("Batch", withUrl(testBatch))
+	t.Run("Export", withUrl(testExport))
+	t.Run("Export (store error)", testExportError)
+	t.Run("Imports", testImports)
+	t.Run("Stream", testStream)
+	t.Run("WebSocket", testWebSocket)
+	t.Run("Webhooks", testWebhooks)
+	t.Run("HTML", withUrl(testHTML, endpoint.UseHTML(endpoint.HTMLConfig{Title: "Board"}), endpoint.UseTemplates(customTemplates(t))))
+	t.Run("HTML (challenge)", withUrl(testHTMLChallenge, endpoint.UseHTML(endpoint.HTMLConfig{}), endpoint.UseChallenger(newChallenger())))
+	t.Run("Admin console", withUrl(testAdminConsole, endpoint.UseAdminConsole(endpoint.ConsoleConfig{Title: "Moderation", Sessions: session.NewStore(time.Hour)})))
+	t.Run("Markdown", withUrl(testMarkdown, endpoint.UseHTML(endpoint.HTMLConfig{}), endpoint.UseFeeds(endpoint.FeedConfig{URL: "https://board.domain.com"}), endpoint.UseMarkdown(markdown.NewCache(0))))
+	t.Run("Feeds", withUrl(testFeeds, endpoint.UseFeeds(endpoint.FeedConfig{Title: "Board", URL: "https://board.domain.com/"})))
+}
+
+func newChallenger() *challenge.Challenger {
+	config := challenge.DefaultConfig
+	config.BaseDifficulty = 8
+
+	return challenge.New(token.NewSigner([]byte("secret")), config)
 }
 
 func testAddInvalidJson(t *testing.T, url string) {
@@ -70,14 +114,22 @@ func testAddInvalidJson(t *testing.T, url string) {
 	}
 }
 
-func postPost(t *testing.T, url string, post types.Post, auth bool, expectedStatus int) {
+func postPost(t *testing.T, url string, post types.Post, auth bool, expectedStatus int) []byte {
+	_, body := sendPost(t, "POST", url, post, auth, nil, expectedStatus)
+
+	return body
+}
+
+// sendPost sends the JSON encoded post to the given URL, and returns the
+// headers and body of the response.
+func sendPost(t *testing.T, method, url string, post types.Post, auth bool, headers map[string]string, expectedStatus int) (http.Header, []byte) {
 	buffer := bytes.Buffer{}
 
 	if err := json.NewEncoder(&buffer).Encode(post); err != nil {
 		t.Fatalf("Error while encoding JSON: %s", err)
 	}
 
-	req, err := http.NewRequest("POST", url, &buffer)
+	req, err := http.NewRequest(method, url, &buffer)
 
 	if err != nil {
 		t.Fatalf("Error while creating request: %s", err)
@@ -85,6 +137,10 @@ func postPost(t *testing.T, url string, post types.Post, auth bool, expectedStat
 
 	req.Header.Set("Content-Type", endpoint.JsonContentType)
 
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
 	if auth {
 		req.SetBasicAuth(adminUser, adminPassword)
 	}
@@ -100,6 +156,14 @@ func postPost(t *testing.T, url string, post types.Post, auth bool, expectedStat
 	if res.StatusCode != expectedStatus {
 		t.Errorf("Unexpected HTTP status, got %d, expected %d", res.StatusCode, expectedStatus)
 	}
+
+	body, err := ioutil.ReadAll(res.Body)
+
+	if err != nil {
+		t.Fatalf("Error while reading response: %s", err)
+	}
+
+	return res.Header, body
 }
 
 func listPostsFull(t *testing.T, serverUrl, cursor string, pageSize int, expectedNumber int) ([]types.Post, string) {
@@ -154,18 +218,174 @@ func testAdd(t *testing.T, url string) {
 		Message: "this is my message",
 	}
 
-	postPost(t, url+"/post", post, false, http.StatusCreated)
+	headers, body := sendPost(t, "POST", url+"/post", post, false, nil, http.StatusCreated)
+
+	var created endpoint.CreatedResponse
+
+	if err := json.Unmarshal(body, &created); err != nil {
+		t.Fatalf("Error while decoding creation response: %s", err)
+	}
 
 	posts := listPosts(t, url, 1)
 
+	if !created.Post.Equal(posts[0]) {
+		t.Errorf("Unexpected post in creation response: got %+v, expected %+v", created.Post, posts[0])
+	}
+
+	if location, expected := headers.Get("Location"), "/posts/"+posts[0].ID; location != expected {
+		t.Errorf("Unexpected Location header: got %s, expected %s", location, expected)
+	}
+
 	posts[0].ID = ""
 	posts[0].Created = time.Time{}
+	post.State = types.StatePublished
 
 	if !posts[0].Equal(post) {
 		t.Errorf("Unexpected post returned after adding: got %+v, expected %+v", posts[0], post)
 	}
 }
 
+func getChallenge(t *testing.T, url string) challenge.Challenge {
+	res, err := http.Get(url + "/challenge")
+
+	if err != nil {
+		t.Fatalf("Error while sending request: %s", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status code for challenge response: %d", res.StatusCode)
+	}
+
+	var c challenge.Challenge
+
+	if err := json.NewDecoder(res.Body).Decode(&c); err != nil {
+		t.Fatalf("Decoding challenge response failed: %s", err)
+	}
+
+	return c
+}
+
+func testAddChallenge(t *testing.T, url string) {
+	post := types.Post{
+		Author:  "John",
+		Email:   "john@domain.com",
+		Message: "this is my message",
+	}
+
+	t.Run("No solution", func(t *testing.T) {
+		postPost(t, url+"/post", post, false, http.StatusForbidden)
+	})
+
+	t.Run("Valid solution", func(t *testing.T) {
+		c := getChallenge(t, url)
+		headers := map[string]string{
+			endpoint.ChallengeTokenHeader:    c.Token,
+			endpoint.ChallengeSolutionHeader: challenge.Solve(c),
+		}
+
+		sendPost(t, "POST", url+"/post", post, false, headers, http.StatusCreated)
+
+		// Solutions cannot be reused
+		sendPost(t, "POST", url+"/post", post, false, headers, http.StatusForbidden)
+	})
+
+	listPosts(t, url, 1)
+}
+
+func testAddIdempotency(t *testing.T, url string) {
+	post := types.Post{
+		Author:  "John",
+		Email:   "john@domain.com",
+		Message: "this is my message",
+	}
+
+	c := getChallenge(t, url)
+	headers := map[string]string{
+		endpoint.ChallengeTokenHeader:    c.Token,
+		endpoint.ChallengeSolutionHeader: challenge.Solve(c),
+		endpoint.IdempotencyKeyHeader:    "some key",
+	}
+
+	firstHeaders, firstBody := sendPost(t, "POST", url+"/post", post, false, headers, http.StatusCreated)
+
+	t.Run("Retry", func(t *testing.T) {
+		// The challenge solution cannot be reused, but the response is replayed
+		retryHeaders, retryBody := sendPost(t, "POST", url+"/post", post, false, headers, http.StatusCreated)
+
+		if !bytes.Equal(firstBody, retryBody) {
+			t.Errorf("Unexpected body for retried request: got %s, expected %s", retryBody, firstBody)
+		}
+
+		if retryHeaders.Get("Location") != firstHeaders.Get("Location") {
+			t.Errorf("Unexpected Location for retried request: got %s, expected %s", retryHeaders.Get("Location"), firstHeaders.Get("Location"))
+		}
+
+		if retryHeaders.Get(endpoint.IdempotentReplayedHeader) != "true" {
+			t.Errorf("Retried response should have the %s header set", endpoint.IdempotentReplayedHeader)
+		}
+	})
+
+	t.Run("Other client", func(t *testing.T) {
+		calls := 0
+		handler := endpoint.WithIdempotency(idempotency.NewCache(10, time.Hour), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusCreated)
+		}))
+
+		for i, remoteAddr := range []string{"192.0.2.1:1234", "192.0.2.1:5678", "192.0.2.2:1234"} {
+			req := httptest.NewRequest("POST", "/post", strings.NewReader("{}"))
+			req.RemoteAddr = remoteAddr
+			req.Header.Set(endpoint.IdempotencyKeyHeader, "shared key")
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if replayed := w.Header().Get(endpoint.IdempotentReplayedHeader) == "true"; replayed != (i == 1) {
+				t.Errorf("Unexpected replay for a request from %s: %v", remoteAddr, replayed)
+			}
+		}
+
+		if calls != 2 {
+			t.Errorf("Unexpected number of requests processed: %d", calls)
+		}
+	})
+
+	t.Run("Different body", func(t *testing.T) {
+		other := post
+		other.Message = "this is another message"
+
+		sendPost(t, "POST", url+"/post", other, false, headers, http.StatusUnprocessableEntity)
+	})
+
+	t.Run("Failed challenge", func(t *testing.T) {
+		// The solution of the first request was already used
+		staleHeaders := map[string]string{
+			endpoint.ChallengeTokenHeader:    c.Token,
+			endpoint.ChallengeSolutionHeader: challenge.Solve(c),
+			endpoint.IdempotencyKeyHeader:    "other key",
+		}
+
+		sendPost(t, "POST", url+"/post", post, false, staleHeaders, http.StatusForbidden)
+
+		// Challenge failures are not remembered, so that the request can be
+		// retried with a new solution
+		fresh := getChallenge(t, url)
+		retryHeaders := map[string]string{
+			endpoint.ChallengeTokenHeader:    fresh.Token,
+			endpoint.ChallengeSolutionHeader: challenge.Solve(fresh),
+			endpoint.IdempotencyKeyHeader:    "other key",
+		}
+
+		if responseHeaders, _ := sendPost(t, "POST", url+"/post", post, false, retryHeaders, http.StatusCreated); responseHeaders.Get(endpoint.IdempotentReplayedHeader) != "" {
+			t.Errorf("The retry of a failed challenge should not be a replayed response")
+		}
+	})
+
+	listPosts(t, url, 2)
+}
+
 func testUpdate(t *testing.T, url string) {
 	post := types.Post{
 		Author:  "John",
@@ -185,7 +405,15 @@ func testUpdate(t *testing.T, url string) {
 		oldPost := posts[0]
 		oldPost.Message = "I changed my mind"
 
-		postPost(t, url+"/admin/posts", oldPost, true, http.StatusOK)
+		var updated types.Post
+
+		if err := json.Unmarshal(postPost(t, url+"/admin/posts", oldPost, true, http.StatusOK), &updated); err != nil {
+			t.Fatalf("Error while decoding update response: %s", err)
+		}
+
+		if !updated.Equal(oldPost) {
+			t.Errorf("Unexpected post in update response: got %+v, expected %+v", updated, oldPost)
+		}
 
 		posts = listPosts(t, url, 1)
 
@@ -207,6 +435,75 @@ func testUpdate(t *testing.T, url string) {
 			t.Errorf("Unexpected post after update: got %+v, expected %+v", posts[0], oldPost)
 		}
 	})
+
+	t.Run("Merge patch", func(t *testing.T) {
+		oldPost := posts[0]
+		patchUrl := url + "/admin/posts/" + oldPost.ID
+
+		sendPatch(t, patchUrl, `{"author": "Jane"}`, false, http.StatusUnauthorized)
+
+		oldPost.Author = "Jane"
+		oldPost.Message = ""
+
+		var updated types.Post
+
+		// Explicit nulls clear optional fields, the ID is ignored
+		if err := json.Unmarshal(sendPatch(t, patchUrl, `{"id": "other", "author": "Jane", "message": null}`, true, http.StatusOK), &updated); err != nil {
+			t.Fatalf("Error while decoding patch response: %s", err)
+		}
+
+		if !updated.Equal(oldPost) {
+			t.Errorf("Unexpected post in patch response: got %+v, expected %+v", updated, oldPost)
+		}
+
+		// Required fields cannot be cleared
+		sendPatch(t, patchUrl, `{"author": null}`, true, http.StatusBadRequest)
+		sendPatch(t, patchUrl, `["not", "an", "object"]`, true, http.StatusBadRequest)
+		sendPatch(t, patchUrl, `{"message": "`+strings.Repeat("a", endpoint.MaxPatchSize)+`"}`, true, http.StatusBadRequest)
+		sendPatch(t, url+"/admin/posts/does-not-exist", `{"message": "hello"}`, true, http.StatusNotFound)
+
+		posts = listPosts(t, url, 1)
+
+		if !posts[0].Equal(oldPost) {
+			t.Errorf("Unexpected post after patch: got %+v, expected %+v", posts[0], oldPost)
+		}
+	})
+}
+
+// sendPatch sends the given JSON merge patch to the given URL, and returns the
+// body of the response.
+func sendPatch(t *testing.T, url, patch string, auth bool, expectedStatus int) []byte {
+	req, err := http.NewRequest("PATCH", url, strings.NewReader(patch))
+
+	if err != nil {
+		t.Fatalf("Error while creating request: %s", err)
+	}
+
+	req.Header.Set("Content-Type", endpoint.MergePatchContentType)
+
+	if auth {
+		req.SetBasicAuth(adminUser, adminPassword)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatalf("Error sending request: %s", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != expectedStatus {
+		t.Errorf("Unexpected HTTP status for patch %s, got %d, expected %d", patch, res.StatusCode, expectedStatus)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+
+	if err != nil {
+		t.Fatalf("Error while reading response: %s", err)
+	}
+
+	return body
 }
 
 func testListAuthentication(t *testing.T, url string) {
@@ -227,8 +524,8 @@ func testList(t *testing.T, url string) {
 	listPosts(t, url, 0)
 
 	posts := []types.Post{
-		{Author: "A1", Email: "E1", Message: "M1"},
-		{Author: "A2", Email: "E2", Message: "M2"},
+		{Author: "A1", Email: "e1@domain.com", Message: "M1", State: types.StatePublished},
+		{Author: "A2", Email: "e2@domain.com", Message: "M2", State: types.StatePublished},
 	}
 
 	for _, p := range posts {
@@ -317,6 +614,7 @@ func testGet(t *testing.T, url string) {
 	posts := listPosts(t, url, 1)
 	post.ID = posts[0].ID
 	post.Created = posts[0].Created
+	post.State = posts[0].State
 
 	if fetched := getPost(t, url, post.ID); fetched == nil {
 		t.Errorf("Get returned a 404 on a existing post ID")
@@ -324,3 +622,1775 @@ func testGet(t *testing.T, url string) {
 		t.Errorf("Get returned an unexpected post: got %+v, expected %+v", *fetched, post)
 	}
 }
+
+func testConfirm(t *testing.T, url string) {
+	// Confirmations are disabled, all tokens are invalid
+	res, err := http.Get(url + "/confirm/whatever")
+
+	if err != nil {
+		t.Fatalf("Error while sending request: %s", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Unexpected status code for an invalid confirmation token: got %d, expected %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func deletePost(t *testing.T, url, editToken string, expectedStatus int) {
+	req, err := http.NewRequest("DELETE", url, nil)
+
+	if err != nil {
+		t.Fatalf("Error while creating request: %s", err)
+	}
+
+	req.Header.Set(endpoint.EditTokenHeader, editToken)
+
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatalf("Error while sending request: %s", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != expectedStatus {
+		t.Errorf("Unexpected HTTP status, got %d, expected %d", res.StatusCode, expectedStatus)
+	}
+}
+
+func testAuthorEdit(t *testing.T, url string) {
+	post := types.Post{
+		Author:  "John",
+		Email:   "john@domain.com",
+		Message: "this is my mesage",
+	}
+
+	var created endpoint.CreatedResponse
+
+	if err := json.Unmarshal(postPost(t, url+"/post", post, false, http.StatusCreated), &created); err != nil {
+		t.Fatalf("Error while decoding creation response: %s", err)
+	}
+
+	if created.ID == "" || created.EditToken == "" {
+		t.Fatalf("Creation response should contain an ID and an edit token, got %+v", created)
+	}
+
+	postUrl := url + "/posts/" + created.ID
+	patch := types.Post{Message: "this is my message"}
+
+	t.Run("Invalid token", func(t *testing.T) {
+		sendPost(t, "PATCH", postUrl, patch, false, nil, http.StatusForbidden)
+		sendPost(t, "PATCH", postUrl, patch, false, map[string]string{endpoint.EditTokenHeader: "x" + created.EditToken}, http.StatusForbidden)
+		deletePost(t, postUrl, "", http.StatusForbidden)
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		_, body := sendPost(t, "PATCH", postUrl, patch, false, map[string]string{endpoint.EditTokenHeader: created.EditToken}, http.StatusOK)
+
+		var updated types.Post
+
+		if err := json.Unmarshal(body, &updated); err != nil {
+			t.Fatalf("Error while decoding update response: %s", err)
+		} else if updated.Message != patch.Message {
+			t.Errorf("Unexpected message in update response: got %s, expected %s", updated.Message, patch.Message)
+		}
+
+		if fetched := getPost(t, url, created.ID); fetched == nil {
+			t.Errorf("Get returned a 404 after an author update")
+		} else if fetched.Message != patch.Message {
+			t.Errorf("Unexpected message after author update: got %s, expected %s", fetched.Message, patch.Message)
+		}
+	})
+
+	t.Run("List does not leak the token", func(t *testing.T) {
+		req, err := http.NewRequest("GET", url+"/admin/posts", nil)
+
+		if err != nil {
+			t.Fatalf("Error while creating request: %s", err)
+		}
+
+		req.SetBasicAuth(adminUser, adminPassword)
+
+		res, err := http.DefaultClient.Do(req)
+
+		if err != nil {
+			t.Fatalf("Error while sending request: %s", err)
+		}
+
+		defer res.Body.Close()
+
+		body, err := ioutil.ReadAll(res.Body)
+
+		if err != nil {
+			t.Fatalf("Error while reading response: %s", err)
+		}
+
+		if bytes.Contains(body, []byte("edit_token")) || bytes.Contains(body, []byte("EditToken")) {
+			t.Errorf("List response contains the edit token: %s", body)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		deletePost(t, postUrl, created.EditToken, http.StatusNoContent)
+		listPosts(t, url, 0)
+	})
+}
+
+func getProblem(t *testing.T, method, url, body string, headers map[string]string, expectedStatus int) (*endpoint.Problem, http.Header) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+
+	if err != nil {
+		t.Fatalf("Error while creating request: %s", err)
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatalf("Error while sending request: %s", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != expectedStatus {
+		t.Errorf("Unexpected status code for %s %s: got %d, expected %d", method, url, res.StatusCode, expectedStatus)
+	}
+
+	if contentType := res.Header.Get("Content-Type"); contentType != endpoint.ProblemContentType {
+		t.Fatalf("Unexpected content type for %s %s: %s", method, url, contentType)
+	}
+
+	var problem endpoint.Problem
+
+	if err := json.NewDecoder(res.Body).Decode(&problem); err != nil {
+		t.Fatalf("Error while decoding problem: %s", err)
+	}
+
+	if problem.Status != expectedStatus {
+		t.Errorf("Unexpected status in problem: got %d, expected %d", problem.Status, expectedStatus)
+	}
+
+	if problem.RequestID == "" || problem.RequestID != res.Header.Get(endpoint.RequestIDHeader) {
+		t.Errorf("Problem request ID %s does not match the %s header %s", problem.RequestID, endpoint.RequestIDHeader, res.Header.Get(endpoint.RequestIDHeader))
+	}
+
+	return &problem, res.Header
+}
+
+func testErrors(t *testing.T, url string) {
+	jsonHeaders := map[string]string{"Content-Type": endpoint.JsonContentType}
+
+	problem, _ := getProblem(t, "POST", url+"/post", `{"author": "", "message": "hello"}`, jsonHeaders, http.StatusBadRequest)
+
+	if problem.Code != "invalid_author" || problem.Field != "author" {
+		t.Errorf("Unexpected problem for an invalid author: %+v", problem)
+	}
+
+	problem, _ = getProblem(t, "POST", url+"/post", "not json", jsonHeaders, http.StatusBadRequest)
+
+	if problem.Code != "invalid_json" {
+		t.Errorf("Unexpected problem for invalid JSON: %+v", problem)
+	}
+
+	problem, _ = getProblem(t, "POST", url+"/post", "{}", map[string]string{"Content-Type": "text/plain"}, http.StatusBadRequest)
+
+	if problem.Code != "invalid_content_type" {
+		t.Errorf("Unexpected problem for an invalid content type: %+v", problem)
+	}
+
+	problem, _ = getProblem(t, "GET", url+"/admin/posts?n=abc", "", nil, http.StatusUnauthorized)
+
+	if problem.Code != "unauthorized" {
+		t.Errorf("Unexpected problem for an unauthenticated request: %+v", problem)
+	}
+
+	problem, _ = getProblem(t, "GET", url+"/does/not/exist", "", nil, http.StatusNotFound)
+
+	if problem.Code != "not_found" {
+		t.Errorf("Unexpected problem for an unknown route: %+v", problem)
+	}
+
+	problem, _ = getProblem(t, "PUT", url+"/post", "", nil, http.StatusMethodNotAllowed)
+
+	if problem.Code != "method_not_allowed" {
+		t.Errorf("Unexpected problem for an invalid method: %+v", problem)
+	}
+
+	problem, header := getProblem(t, "GET", url+"/confirm/whatever", "", map[string]string{endpoint.RequestIDHeader: "my-request"}, http.StatusBadRequest)
+
+	if problem.Code != "invalid_confirmation_token" {
+		t.Errorf("Unexpected problem for an invalid confirmation token: %+v", problem)
+	}
+
+	if id := header.Get(endpoint.RequestIDHeader); id != "my-request" {
+		t.Errorf("The request ID sent by the client was not kept: got %s", id)
+	}
+}
+
+func sendBatch(t *testing.T, url string, request endpoint.BatchRequest, expectedStatus int) endpoint.BatchResponse {
+	buffer := bytes.Buffer{}
+
+	if err := json.NewEncoder(&buffer).Encode(&request); err != nil {
+		t.Fatalf("Error while encoding JSON: %s", err)
+	}
+
+	req, err := http.NewRequest("POST", url+"/admin/posts:batch", &buffer)
+
+	if err != nil {
+		t.Fatalf("Error while creating request: %s", err)
+	}
+
+	req.Header.Set("Content-Type", endpoint.JsonContentType)
+	req.SetBasicAuth(adminUser, adminPassword)
+
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatalf("Error sending request: %s", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != expectedStatus {
+		t.Fatalf("Unexpected HTTP status for batch, got %d, expected %d", res.StatusCode, expectedStatus)
+	}
+
+	var response endpoint.BatchResponse
+
+	if expectedStatus == http.StatusOK {
+		if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+			t.Fatalf("Error while decoding batch response: %s", err)
+		}
+	}
+
+	return response
+}
+
+func expectBatchStatus(t *testing.T, response endpoint.BatchResponse, expected []int) {
+	if len(response.Results) != len(expected) {
+		t.Fatalf("Unexpected number of batch results: got %d, expected %d", len(response.Results), len(expected))
+	}
+
+	for i, result := range response.Results {
+		if result.Status != expected[i] {
+			t.Errorf("Unexpected status for batch operation %d: got %d, expected %d (%+v)", i, result.Status, expected[i], result.Error)
+		}
+	}
+}
+
+func testBatch(t *testing.T, url string) {
+	for i := 0; i < 3; i++ {
+		postPost(t, url+"/post", types.Post{Author: "John", Email: "john@domain.com"}, false, http.StatusCreated)
+	}
+
+	posts := listPosts(t, url, 3)
+
+	request := endpoint.BatchRequest{
+		Atomic: true,
+		Operations: []endpoint.BatchOperation{
+			{Action: "update", ID: posts[0].ID, Post: json.RawMessage(`{"message": "cleaned up"}`)},
+			{Action: "set_state", ID: posts[1].ID, State: types.StateUnconfirmed},
+			{Action: "delete", ID: posts[2].ID},
+			{Action: "delete", ID: "does not exist"},
+		},
+	}
+
+	response := sendBatch(t, url, request, http.StatusOK)
+	expectBatchStatus(t, response, []int{http.StatusConflict, http.StatusConflict, http.StatusConflict, http.StatusNotFound})
+
+	if problem := response.Results[3].Error; problem == nil || problem.Code != "post_not_found" {
+		t.Errorf("Unexpected error for a non existing post: %+v", problem)
+	}
+
+	listPosts(t, url, 3)
+
+	request.Atomic = false
+	response = sendBatch(t, url, request, http.StatusOK)
+	expectBatchStatus(t, response, []int{http.StatusOK, http.StatusOK, http.StatusNoContent, http.StatusNotFound})
+
+	if post := response.Results[0].Post; post == nil || post.Message != "cleaned up" {
+		t.Errorf("Unexpected post for an update: %+v", post)
+	}
+
+	if post := response.Results[1].Post; post == nil || post.State != types.StateUnconfirmed {
+		t.Errorf("Unexpected post for a state change: %+v", post)
+	}
+
+	listPosts(t, url, 2)
+
+	request = endpoint.BatchRequest{
+		Atomic: true,
+		Operations: []endpoint.BatchOperation{
+			{Action: "update", ID: posts[0].ID, Post: json.RawMessage(`{"message": "cleaned up again"}`)},
+			{Action: "update", ID: posts[1].ID, Post: json.RawMessage(`["not", "an", "object"]`)},
+			{Action: "update", ID: posts[1].ID},
+		},
+	}
+
+	response = sendBatch(t, url, request, http.StatusOK)
+	expectBatchStatus(t, response, []int{http.StatusConflict, http.StatusBadRequest, http.StatusBadRequest})
+
+	if problem := response.Results[1].Error; problem == nil || problem.Code != "invalid_json" {
+		t.Errorf("Unexpected error for an invalid patch: %+v", problem)
+	}
+
+	request.Atomic = false
+	response = sendBatch(t, url, request, http.StatusOK)
+	expectBatchStatus(t, response, []int{http.StatusOK, http.StatusBadRequest, http.StatusBadRequest})
+
+	if post := response.Results[0].Post; post == nil || post.Message != "cleaned up again" {
+		t.Errorf("Unexpected post for an update next to an invalid patch: %+v", post)
+	}
+
+	request.Operations = request.Operations[1:]
+	response = sendBatch(t, url, request, http.StatusOK)
+	expectBatchStatus(t, response, []int{http.StatusBadRequest, http.StatusBadRequest})
+
+	sendBatch(t, url, endpoint.BatchRequest{}, http.StatusBadRequest)
+	sendBatch(t, url, endpoint.BatchRequest{Operations: make([]endpoint.BatchOperation, postservice.MaxBatchSize+1)}, http.StatusBadRequest)
+	sendBatch(t, url, endpoint.BatchRequest{
+		Operations: []endpoint.BatchOperation{
+			{Action: "update", ID: posts[0].ID, Post: json.RawMessage(`{"message": "` + strings.Repeat("a", endpoint.MaxBatchBodySize) + `"}`)},
+		},
+	}, http.StatusBadRequest)
+}
+
+// getNegotiated sends an authenticated GET request with the given Accept
+// header, and returns the headers and body of the response.
+func getNegotiated(t *testing.T, url, accept string, expectedStatus int) (http.Header, []byte) {
+	req, err := http.NewRequest("GET", url, nil)
+
+	if err != nil {
+		t.Fatalf("Error while creating request: %s", err)
+	}
+
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	req.SetBasicAuth(adminUser, adminPassword)
+
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatalf("Error while sending request: %s", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != expectedStatus {
+		t.Fatalf("Unexpected status code for GET %s with Accept %q: got %d, expected %d", url, accept, res.StatusCode, expectedStatus)
+	}
+
+	data, err := ioutil.ReadAll(res.Body)
+
+	if err != nil {
+		t.Fatalf("Error while reading response: %s", err)
+	}
+
+	return res.Header, data
+}
+
+func testContentNegotiation(t *testing.T, url string) {
+	t.Run("Post bodies", func(t *testing.T) {
+		messagePackBody, err := msgpack.Marshal(map[string]interface{}{
+			"author":  "Jane",
+			"email":   "jane@domain.com",
+			"message": "From MessagePack",
+			"created": "2020-01-02T03:04:05Z",
+		})
+
+		if err != nil {
+			t.Fatalf("Error while encoding MessagePack post: %s", err)
+		}
+
+		bodies := []struct {
+			contentType string
+			body        string
+		}{
+			{endpoint.CodecMessagePack.ContentType, string(messagePackBody)},
+			{"text/csv", "name,email,text\nJane,jane@domain.com,\"From CSV, quoted\"\n"},
+			{endpoint.CodecNDJSON.ContentType, `{"author": "Jane", "email": "jane@domain.com", "message": "From NDJSON"}` + "\n"},
+		}
+
+		for _, body := range bodies {
+			sendImportRequest(t, "POST", url+"/post", body.contentType, body.body, http.StatusCreated)
+		}
+
+		posts := listPosts(t, url, 3)
+		expected := []string{"From NDJSON", "From CSV, quoted", "From MessagePack"}
+
+		for i, post := range posts {
+			if post.Author != "Jane" || post.Email != "jane@domain.com" || post.Message != expected[i] {
+				t.Errorf("Unexpected post %d: %+v", i, post)
+			}
+		}
+
+		problems := []struct {
+			contentType string
+			body        string
+			code        string
+		}{
+			{endpoint.CodecMessagePack.ContentType, "\x81\x01\x02", "malformed_post"},
+			{endpoint.CodecMessagePack.ContentType, "\x81\xa6author\x01", "malformed_post"},
+			{"text/csv", "name,email\n", "malformed_post"},
+			{"text/csv", "name,created\nJane,yesterday\n", "malformed_post"},
+			{"image/png", "", "invalid_content_type"},
+		}
+
+		for _, p := range problems {
+			problem, _ := getProblem(t, "POST", url+"/post", p.body, map[string]string{"Content-Type": p.contentType}, http.StatusBadRequest)
+
+			if problem.Code != p.code {
+				t.Errorf("Unexpected problem for a %s body %q: %+v", p.contentType, p.body, problem)
+			}
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		header, body := getNegotiated(t, url+"/admin/posts?n=2", "text/csv", http.StatusOK)
+
+		if contentType := header.Get("Content-Type"); contentType != endpoint.CodecCSV.ContentType {
+			t.Errorf("Unexpected content type for a CSV list: %s", contentType)
+		}
+
+		if vary := header.Get("Vary"); vary != "Accept" {
+			t.Errorf("Unexpected Vary header: %s", vary)
+		}
+
+		if link := header.Get("Link"); !regexp.MustCompile(`^</admin/posts\?cursor=[^&]+&n=2>; rel="next"$`).MatchString(link) {
+			t.Errorf("Unexpected Link header: %s", link)
+		}
+
+		records, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+
+		if err != nil {
+			t.Fatalf("Error while decoding CSV list: %s", err)
+		}
+
+		if len(records) != 3 || records[0][0] != "id" || records[1][3] != "From NDJSON" {
+			t.Errorf("Unexpected CSV list: %q", records)
+		}
+
+		_, body = getNegotiated(t, url+"/admin/posts", "application/x-ndjson", http.StatusOK)
+
+		if lines := strings.Split(strings.TrimSpace(string(body)), "\n"); len(lines) != 3 {
+			t.Errorf("Unexpected NDJSON list: %s", body)
+		}
+
+		_, body = getNegotiated(t, url+"/admin/posts?n=2", "application/msgpack", http.StatusOK)
+		value, err := msgpack.NewDecoder(bytes.NewReader(body)).DecodeInterface()
+
+		if err != nil {
+			t.Fatalf("Error while decoding MessagePack list: %s", err)
+		}
+
+		list, _ := value.(map[string]interface{})
+		posts, _ := list["posts"].([]interface{})
+
+		if len(posts) != 2 || list["next"] == "" {
+			t.Fatalf("Unexpected MessagePack list: %+v", value)
+		}
+
+		if post, _ := posts[1].(map[string]interface{}); post["message"] != "From CSV, quoted" || post["state"] != string(types.StatePublished) {
+			t.Errorf("Unexpected post in MessagePack list: %+v", posts[1])
+		} else if _, ok := post["created"].(time.Time); !ok {
+			t.Errorf("The creation time of a post is not a timestamp: %+v", post["created"])
+		}
+	})
+
+	t.Run("Accept", func(t *testing.T) {
+		testCases := []struct {
+			accept   string
+			expected *endpoint.Codec
+		}{
+			{"", &endpoint.CodecJSON},
+			{"*/*", &endpoint.CodecJSON},
+			{"text/*", &endpoint.CodecCSV},
+			{"text/csv; q=0.5, application/x-ndjson", &endpoint.CodecNDJSON},
+			{"application/json; q=0, */*", &endpoint.CodecCSV},
+			{"image/png, application/msgpack; q=0.1", &endpoint.CodecMessagePack},
+		}
+
+		for _, testCase := range testCases {
+			header, _ := getNegotiated(t, url+"/admin/posts", testCase.accept, http.StatusOK)
+
+			if contentType := header.Get("Content-Type"); contentType != testCase.expected.ContentType {
+				t.Errorf("Unexpected content type for Accept %q: got %s, expected %s", testCase.accept, contentType, testCase.expected.ContentType)
+			}
+		}
+
+		for _, accept := range []string{"image/png", "text/csv; q=0, application/*; q=0"} {
+			problem, _ := getProblem(t, "GET", url+"/admin/posts", "", map[string]string{"Accept": accept, "Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(adminUser+":"+adminPassword))}, http.StatusNotAcceptable)
+
+			if problem.Code != "not_acceptable" {
+				t.Errorf("Unexpected problem for Accept %q: %+v", accept, problem)
+			}
+		}
+	})
+
+	t.Run("Get", func(t *testing.T) {
+		id := listPosts(t, url, 3)[0].ID
+		header, body := getNegotiated(t, url+"/admin/posts/"+id, "text/csv", http.StatusOK)
+
+		if header.Get("Link") != "" {
+			t.Errorf("Unexpected Link header for a single post: %s", header.Get("Link"))
+		}
+
+		records, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+
+		if err != nil || len(records) != 2 || records[1][0] != id {
+			t.Errorf("Unexpected CSV post: %q (error: %v)", records, err)
+		}
+
+		_, body = getNegotiated(t, url+"/admin/posts/"+id, "application/msgpack", http.StatusOK)
+		value, err := msgpack.NewDecoder(bytes.NewReader(body)).DecodeInterface()
+
+		if post, _ := value.(map[string]interface{}); err != nil || post["id"] != id || post["message"] != "From NDJSON" {
+			t.Errorf("Unexpected MessagePack post: %+v (error: %v)", value, err)
+		}
+	})
+}
+
+func testExport(t *testing.T, url string) {
+	for i := 0; i < 3; i++ {
+		postPost(t, url+"/post", types.Post{Author: "John", Email: "john@domain.com", Message: "Hello, world"}, false, http.StatusCreated)
+	}
+
+	for _, format := range poststore.Formats {
+		req, err := http.NewRequest("GET", url+"/admin/export."+format.Name, nil)
+
+		if err != nil {
+			t.Fatalf("Error while creating request: %s", err)
+		}
+
+		req.SetBasicAuth(adminUser, adminPassword)
+
+		res, err := http.DefaultClient.Do(req)
+
+		if err != nil {
+			t.Fatalf("Error while sending request: %s", err)
+		}
+
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected status code for %s export: %d", format.Name, res.StatusCode)
+		}
+
+		if contentType := res.Header.Get("Content-Type"); contentType != format.ContentType {
+			t.Errorf("Unexpected content type for %s export: %s", format.Name, contentType)
+		}
+
+		store, err := poststore.NewMemoryPostStore()
+
+		if err != nil {
+			t.Fatalf("Error while creating store: %s", err)
+		}
+
+		if report, err := postservice.New(store).Import(format.NewDecoder(res.Body), postservice.ImportOptions{}); err != nil {
+			t.Errorf("Error while importing %s export: %s", format.Name, err)
+		} else if report.Inserted != 3 {
+			t.Errorf("Unexpected number of posts in %s export: got %d, expected 3", format.Name, report.Inserted)
+		}
+	}
+
+	req, err := http.NewRequest("GET", url+"/admin/export.xml", nil)
+
+	if err != nil {
+		t.Fatalf("Error while creating request: %s", err)
+	}
+
+	req.SetBasicAuth(adminUser, adminPassword)
+
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatalf("Error while sending request: %s", err)
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Unexpected status code for an unknown export format: %d", res.StatusCode)
+	}
+}
+
+// failingListStore is a store failing to list posts after the first page.
+type failingListStore struct {
+	poststore.Store
+}
+
+func (s failingListStore) List(c poststore.Cursor, n uint) ([]types.Post, poststore.Cursor, error) {
+	if c != poststore.EmptyCursor {
+		return nil, poststore.EmptyCursor, errors.New("Listing failed")
+	}
+
+	return s.Store.List(c, n)
+}
+
+func testExportError(t *testing.T) {
+	store, err := poststore.NewMemoryPostStore()
+
+	if err != nil {
+		t.Fatalf("Error while creating store: %s", err)
+	}
+
+	for i := 0; i < 300; i++ {
+		post := types.Post{ID: "ID" + strconv.Itoa(i), Author: "John", Email: "john@domain.com", Message: strings.Repeat("Hello, world ", 10), Created: time.Now()}
+
+		if err := store.Add(post); err != nil {
+			t.Fatalf("Error while adding post: %s", err)
+		}
+	}
+
+	ep := endpoint.NewHttpEndpoint(log.NewNopLogger(), postservice.New(failingListStore{store}), map[string]string{adminUser: adminPassword})
+	server := httptest.NewServer(ep)
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"/admin/export.csv", nil)
+
+	if err != nil {
+		t.Fatalf("Error while creating request: %s", err)
+	}
+
+	req.SetBasicAuth(adminUser, adminPassword)
+
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatalf("Error while sending request: %s", err)
+	}
+
+	defer res.Body.Close()
+
+	// The first page was sent before the error
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status code: %d", res.StatusCode)
+	}
+
+	if _, err := ioutil.ReadAll(res.Body); err == nil {
+		t.Errorf("Reading a truncated export did not return an error")
+	}
+}
+
+// sendImportRequest sends an authenticated request to the import API, and
+// returns the response body.
+func sendImportRequest(t *testing.T, method, url, contentType, body string, expectedStatus int) (http.Header, []byte) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+
+	if err != nil {
+		t.Fatalf("Error while creating request: %s", err)
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	req.SetBasicAuth(adminUser, adminPassword)
+
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatalf("Error while sending request: %s", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != expectedStatus {
+		t.Fatalf("Unexpected status code for %s %s: got %d, expected %d", method, url, res.StatusCode, expectedStatus)
+	}
+
+	data, err := ioutil.ReadAll(res.Body)
+
+	if err != nil {
+		t.Fatalf("Error while reading response: %s", err)
+	}
+
+	return res.Header, data
+}
+
+func decodeJob(t *testing.T, data []byte) importjob.Job {
+	var job importjob.Job
+
+	if err := json.Unmarshal(data, &job); err != nil {
+		t.Fatalf("Error while decoding import job: %s", err)
+	}
+
+	return job
+}
+
+func testImports(t *testing.T) {
+	store, err := poststore.NewMemoryPostStore()
+
+	if err != nil {
+		t.Fatalf("Error while creating store: %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "imports")
+
+	if err != nil {
+		t.Fatalf("Error while creating temporary directory: %s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	service := postservice.New(store)
+	manager := importjob.NewManager(service, dir, 10, 1024)
+	ep := endpoint.NewHttpEndpoint(log.NewNopLogger(), service, map[string]string{adminUser: adminPassword}, endpoint.UseImportManager(manager))
+	server := httptest.NewServer(ep)
+	defer server.Close()
+
+	url := server.URL
+	invalid := "ID2,,john@domain.com,Hello,2017-12-14T06:20:33-08:00\n"
+	data := "id,name,email,text,created\nID1,John,john@domain.com,Hello,2017-12-14T06:20:33-08:00\n" + invalid
+
+	header, body := sendImportRequest(t, "POST", url+"/admin/imports?conflicts=overwrite", "text/csv; charset=utf-8", data, http.StatusAccepted)
+	job := decodeJob(t, body)
+
+	if location := header.Get("Location"); location != "/admin/imports/"+job.ID {
+		t.Errorf("Unexpected location for import job: %s", location)
+	}
+
+	for deadline := time.Now().Add(10 * time.Second); job.State == importjob.StateRunning && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		_, body = sendImportRequest(t, "GET", url+"/admin/imports/"+job.ID, "", "", http.StatusOK)
+		job = decodeJob(t, body)
+	}
+
+	if job.State != importjob.StateDone || job.Inserted != 1 || job.Invalid != 1 || len(job.Errors) != 1 || job.Errors[0].Code != "invalid_author" {
+		t.Errorf("Unexpected import job: %+v", job)
+	}
+
+	header, body = sendImportRequest(t, "GET", url+"/admin/imports/"+job.ID+"/failed", "", "", http.StatusOK)
+
+	if contentType := header.Get("Content-Type"); contentType != poststore.FormatCSV.ContentType {
+		t.Errorf("Unexpected content type for failed records: %s", contentType)
+	}
+
+	if expected := "id,name,email,text,created\n" + invalid; string(body) != expected {
+		t.Errorf("Unexpected failed records: got %q, expected %q", body, expected)
+	}
+
+	// Canceling a job that ended does nothing
+	_, body = sendImportRequest(t, "POST", url+"/admin/imports/"+job.ID+":cancel", "", "", http.StatusOK)
+
+	if job = decodeJob(t, body); job.State != importjob.StateDone {
+		t.Errorf("Unexpected state for a canceled job that ended: %s", job.State)
+	}
+
+	auth := map[string]string{"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(adminUser+":"+adminPassword))}
+
+	problem, _ := getProblem(t, "POST", url+"/admin/imports", "", auth, http.StatusUnsupportedMediaType)
+
+	if problem.Code != "unsupported_import_type" {
+		t.Errorf("Unexpected problem for an unsupported import type: %+v", problem)
+	}
+
+	auth["Content-Type"] = poststore.FormatNDJSON.ContentType
+	problem, _ = getProblem(t, "POST", url+"/admin/imports?dry_run=maybe", "", auth, http.StatusBadRequest)
+
+	if problem.Code != "invalid_dry_run" {
+		t.Errorf("Unexpected problem for an invalid dry run option: %+v", problem)
+	}
+
+	problem, _ = getProblem(t, "POST", url+"/admin/imports", strings.Repeat("{}\n", 1000), auth, http.StatusRequestEntityTooLarge)
+
+	if problem.Code != "import_too_large" {
+		t.Errorf("Unexpected problem for a file too large: %+v", problem)
+	}
+
+	problem, _ = getProblem(t, "GET", url+"/admin/imports/whatever", "", auth, http.StatusNotFound)
+
+	if problem.Code != "import_not_found" {
+		t.Errorf("Unexpected problem for an unknown import job: %+v", problem)
+	}
+}
+
+// streamEvent is an event read from the event stream.
+type streamEvent struct {
+	id        string
+	eventType string
+	post      types.Post
+}
+
+// openStream connects to the event stream, and returns a function reading the
+// next event.
+func openStream(t *testing.T, url, lastEventID string) (func() streamEvent, func()) {
+	req, err := http.NewRequest("GET", url, nil)
+
+	if err != nil {
+		t.Fatalf("Error while creating request: %s", err)
+	}
+
+	req.SetBasicAuth(adminUser, adminPassword)
+
+	if lastEventID != "" {
+		req.Header.Set(endpoint.LastEventIDHeader, lastEventID)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatalf("Error while sending request: %s", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		t.Fatalf("Unexpected status code for the event stream: %d", res.StatusCode)
+	}
+
+	if contentType := res.Header.Get("Content-Type"); contentType != endpoint.EventStreamContentType {
+		t.Errorf("Unexpected content type for the event stream: %s", contentType)
+	}
+
+	reader := bufio.NewReader(res.Body)
+
+	next := func() streamEvent {
+		var event streamEvent
+
+		for {
+			line, err := reader.ReadString('\n')
+
+			if err != nil {
+				t.Fatalf("Error while reading event stream: %s", err)
+			}
+
+			line = strings.TrimSuffix(line, "\n")
+
+			switch {
+			case line == "" && event.eventType != "":
+				return event
+			case strings.HasPrefix(line, "id: "):
+				event.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				event.eventType = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event.post); err != nil {
+					t.Fatalf("Error while decoding event data: %s", err)
+				}
+			}
+		}
+	}
+
+	return next, func() { res.Body.Close() }
+}
+
+func testStream(t *testing.T) {
+	store, err := poststore.NewMemoryPostStore()
+
+	if err != nil {
+		t.Fatalf("Error while creating store: %s", err)
+	}
+
+	bus := events.NewBus(0)
+	service := postservice.New(store, postservice.WithEventBus(bus))
+	ep := endpoint.NewHttpEndpoint(log.NewNopLogger(), service, map[string]string{adminUser: adminPassword}, endpoint.UseEventBus(bus))
+	server := httptest.NewServer(ep)
+	defer server.Close()
+
+	streamURL := server.URL + "/admin/stream"
+	next, closeStream := openStream(t, streamURL, "")
+	defer closeStream()
+
+	filteredNext, closeFiltered := openStream(t, streamURL+"?state=unconfirmed", "")
+	defer closeFiltered()
+
+	created, _, err := service.Add(types.Post{Author: "John", Email: "john@domain.com", Message: "Hello"})
+
+	if err != nil {
+		t.Fatalf("Add returned an error: %s", err)
+	}
+
+	if event := next(); event.id != "1" || event.eventType != "created" || !event.post.Equal(created) {
+		t.Errorf("Unexpected event for a created post: %+v", event)
+	}
+
+	created.State = types.StateUnconfirmed
+
+	if _, err := service.Update(created, types.FieldMask{types.FieldState}); err != nil {
+		t.Fatalf("Update returned an error: %s", err)
+	}
+
+	// The creation of the published post was filtered out
+	for _, read := range []func() streamEvent{next, filteredNext} {
+		if event := read(); event.id != "2" || event.eventType != "updated" || event.post.State != types.StateUnconfirmed {
+			t.Errorf("Unexpected event for an updated post: %+v", event)
+		}
+	}
+
+	t.Run("Resume", func(t *testing.T) {
+		next, closeStream := openStream(t, streamURL, "1")
+		defer closeStream()
+
+		if event := next(); event.id != "2" || event.eventType != "updated" {
+			t.Errorf("Unexpected missed event: %+v", event)
+		}
+
+		next, closeStream = openStream(t, streamURL, "42")
+		defer closeStream()
+
+		for _, expected := range []string{endpoint.ResetEvent, "created", "updated"} {
+			if event := next(); event.eventType != expected {
+				t.Errorf("Unexpected event after a reset: got %s, expected %s", event.eventType, expected)
+			}
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		auth := map[string]string{"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(adminUser+":"+adminPassword))}
+
+		problem, _ := getProblem(t, "GET", streamURL+"?state=whatever", "", auth, http.StatusBadRequest)
+
+		if problem.Code != "invalid_state" {
+			t.Errorf("Unexpected problem for an invalid state filter: %+v", problem)
+		}
+
+		auth[endpoint.LastEventIDHeader] = "abc"
+		problem, _ = getProblem(t, "GET", streamURL, "", auth, http.StatusBadRequest)
+
+		if problem.Code != "invalid_last_event_id" {
+			t.Errorf("Unexpected problem for an invalid last event ID: %+v", problem)
+		}
+	})
+}
+
+// dialSocket opens a WebSocket connection to the given path of the server.
+func dialSocket(t *testing.T, serverURL, path, origin string, auth bool) (*websocket.Conn, error) {
+	config, err := websocket.NewConfig(strings.Replace(serverURL, "http://", "ws://", 1)+path, origin)
+
+	if err != nil {
+		t.Fatalf("Error while creating WebSocket config: %s", err)
+	}
+
+	if auth {
+		config.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(adminUser+":"+adminPassword)))
+	}
+
+	return websocket.DialConfig(config)
+}
+
+// exchange sends a message over a WebSocket connection if not nil, and returns
+// the next message received.
+func exchange(t *testing.T, conn *websocket.Conn, message *endpoint.SocketMessage) endpoint.SocketMessage {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if message != nil {
+		if err := websocket.JSON.Send(conn, message); err != nil {
+			t.Fatalf("Error while sending WebSocket message: %s", err)
+		}
+	}
+
+	var received endpoint.SocketMessage
+
+	if err := websocket.JSON.Receive(conn, &received); err != nil {
+		t.Fatalf("Error while receiving WebSocket message: %s", err)
+	}
+
+	return received
+}
+
+func testWebSocket(t *testing.T) {
+	store, err := poststore.NewMemoryPostStore()
+
+	if err != nil {
+		t.Fatalf("Error while creating store: %s", err)
+	}
+
+	bus := events.NewBus(0)
+	service := postservice.New(store, postservice.WithEventBus(bus))
+	ep := endpoint.NewHttpEndpoint(log.NewNopLogger(), service, map[string]string{adminUser: adminPassword}, endpoint.UseEventBus(bus))
+	server := httptest.NewServer(ep)
+	defer server.Close()
+
+	origin := server.URL
+
+	t.Run("Public", func(t *testing.T) {
+		conn, err := dialSocket(t, server.URL, "/ws", "https://elsewhere.com", false)
+
+		if err != nil {
+			t.Fatalf("Error while opening WebSocket connection: %s", err)
+		}
+
+		defer conn.Close()
+
+		if message := exchange(t, conn, &endpoint.SocketMessage{Type: endpoint.SocketPing}); message.Type != endpoint.SocketPong {
+			t.Errorf("Unexpected reply to a ping: %+v", message)
+		}
+
+		if message := exchange(t, conn, &endpoint.SocketMessage{Type: "whatever"}); message.Type != endpoint.SocketError || message.Code != "invalid_message" {
+			t.Errorf("Unexpected reply to an invalid message: %+v", message)
+		}
+
+		subscribe := endpoint.SocketMessage{Type: endpoint.SocketSubscribe, States: []types.PostState{types.StateUnconfirmed}}
+
+		if message := exchange(t, conn, &subscribe); message.Type != endpoint.SocketError || message.Code != "unauthorized" {
+			t.Errorf("Unexpected reply to a subscription to unconfirmed posts: %+v", message)
+		}
+
+		if message := exchange(t, conn, &endpoint.SocketMessage{Type: endpoint.SocketSubscribe}); message.Type != endpoint.SocketSubscribe {
+			t.Errorf("Unexpected reply to a subscription: %+v", message)
+		}
+
+		created, _, err := service.Add(types.Post{Author: "John", Email: "john@domain.com", Message: "Hello"})
+
+		if err != nil {
+			t.Fatalf("Add returned an error: %s", err)
+		}
+
+		if message := exchange(t, conn, nil); message.Type != endpoint.SocketEvent || message.Event != events.Created || message.Post == nil || message.Post.ID != created.ID || message.Post.Email != "" {
+			t.Errorf("Unexpected event for a created post: %+v", message)
+		}
+
+		created.State = types.StateUnconfirmed
+
+		if _, err := service.Update(created, types.FieldMask{types.FieldState}); err != nil {
+			t.Fatalf("Update returned an error: %s", err)
+		}
+
+		// The post is retracted without sending its contents
+		if message := exchange(t, conn, nil); message.Type != endpoint.SocketEvent || message.Event != events.Deleted || message.Post == nil || message.Post.ID != created.ID || message.Post.Author != "" || message.Post.Message != "" {
+			t.Errorf("Unexpected event for an unpublished post: %+v", message)
+		}
+
+		if _, err := service.Update(created, types.FieldMask{types.FieldState}); err != nil {
+			t.Fatalf("Update returned an error: %s", err)
+		}
+
+		// The events of the unconfirmed post are not sent anymore
+		if message := exchange(t, conn, &endpoint.SocketMessage{Type: endpoint.SocketPing}); message.Type != endpoint.SocketPong {
+			t.Errorf("Unexpected message after updating an unconfirmed post: %+v", message)
+		}
+
+		if message := exchange(t, conn, &endpoint.SocketMessage{Type: endpoint.SocketUnsubscribe}); message.Type != endpoint.SocketUnsubscribe {
+			t.Errorf("Unexpected reply to an unsubscription: %+v", message)
+		}
+	})
+
+	t.Run("Privileged", func(t *testing.T) {
+		if _, err := dialSocket(t, server.URL, "/admin/ws", origin, false); err == nil {
+			t.Errorf("Opening a privileged connection without credentials did not fail")
+		}
+
+		if _, err := dialSocket(t, server.URL, "/admin/ws", "https://elsewhere.com", true); err == nil {
+			t.Errorf("Opening a privileged connection from another origin did not fail")
+		}
+
+		conn, err := dialSocket(t, server.URL, "/admin/ws", origin, true)
+
+		if err != nil {
+			t.Fatalf("Error while opening WebSocket connection: %s", err)
+		}
+
+		defer conn.Close()
+
+		if message := exchange(t, conn, &endpoint.SocketMessage{Type: endpoint.SocketSubscribe, LastEventID: 1}); message.Type != endpoint.SocketSubscribe {
+			t.Errorf("Unexpected reply to a subscription: %+v", message)
+		}
+
+		if message := exchange(t, conn, nil); message.ID != 2 || message.Event != events.Updated || message.Post == nil || message.Post.State != types.StateUnconfirmed || message.Post.Email == "" {
+			t.Errorf("Unexpected missed event: %+v", message)
+		}
+
+		if message := exchange(t, conn, nil); message.ID != 3 {
+			t.Errorf("Unexpected missed event: %+v", message)
+		}
+
+		followed, _, err := service.Add(types.Post{Author: "John", Email: "john@domain.com", Message: "Follow me"})
+
+		if err != nil {
+			t.Fatalf("Add returned an error: %s", err)
+		}
+
+		if message := exchange(t, conn, nil); message.Event != events.Created || message.Post == nil || message.Post.ID != followed.ID {
+			t.Errorf("Unexpected event for a created post: %+v", message)
+		}
+
+		if message := exchange(t, conn, &endpoint.SocketMessage{Type: endpoint.SocketSubscribe, PostIDs: []string{followed.ID}}); message.Type != endpoint.SocketSubscribe {
+			t.Errorf("Unexpected reply to a subscription to a post: %+v", message)
+		}
+
+		if _, _, err := service.Add(types.Post{Author: "John", Email: "john@domain.com", Message: "Ignore me"}); err != nil {
+			t.Fatalf("Add returned an error: %s", err)
+		}
+
+		followed.Message = "Still following"
+
+		if _, err := service.Update(followed, types.FieldMask{types.FieldMessage}); err != nil {
+			t.Fatalf("Update returned an error: %s", err)
+		}
+
+		// Only the events of the followed post are sent
+		if message := exchange(t, conn, nil); message.Event != events.Updated || message.Post == nil || message.Post.ID != followed.ID {
+			t.Errorf("Unexpected event for a followed post: %+v", message)
+		}
+	})
+
+	problem, _ := getProblem(t, "GET", server.URL+"/ws", "", nil, http.StatusUpgradeRequired)
+
+	if problem.Code != "websocket_required" {
+		t.Errorf("Unexpected problem for a request without WebSocket upgrade: %+v", problem)
+	}
+}
+
+func testWebhooks(t *testing.T) {
+	store, err := poststore.NewMemoryPostStore()
+
+	if err != nil {
+		t.Fatalf("Error while creating store: %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "webhooks")
+
+	if err != nil {
+		t.Fatalf("Error while creating temporary directory: %s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	webhooks := []webhook.Webhook{{ID: "receiver", URL: receiver.URL, Secret: "s3cr3t"}}
+	dispatcher, err := webhook.NewDispatcher(log.NewNopLogger(), webhooks, dir+"/queue.json", webhook.Options{MaxAttempts: 1, InitialBackoff: time.Hour})
+
+	if err != nil {
+		t.Fatalf("Error while creating webhook dispatcher: %s", err)
+	}
+
+	bus := events.NewBus(0)
+	dispatcher.Start(bus)
+	defer dispatcher.Close()
+
+	service := postservice.New(store, postservice.WithEventBus(bus))
+	ep := endpoint.NewHttpEndpoint(log.NewNopLogger(), service, map[string]string{adminUser: adminPassword}, endpoint.UseWebhookDispatcher(dispatcher))
+	server := httptest.NewServer(ep)
+	defer server.Close()
+
+	url := server.URL + "/admin/webhooks"
+	_, body := sendImportRequest(t, "GET", url, "", "", http.StatusOK)
+
+	var listed []webhook.Webhook
+
+	if err := json.Unmarshal(body, &listed); err != nil {
+		t.Fatalf("Error while decoding webhooks: %s", err)
+	}
+
+	if len(listed) != 1 || listed[0].ID != "receiver" || listed[0].URL != receiver.URL || listed[0].Secret != "" {
+		t.Errorf("Unexpected webhooks: %+v", listed)
+	}
+
+	if _, _, err := service.Add(types.Post{Author: "John", Email: "john@domain.com", Message: "Hello"}); err != nil {
+		t.Fatalf("Add returned an error: %s", err)
+	}
+
+	var failed []webhook.Delivery
+
+	for deadline := time.Now().Add(5 * time.Second); len(failed) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout while waiting for the delivery to fail")
+		}
+
+		_, body := sendImportRequest(t, "GET", url+"/receiver/deliveries?state=failed", "", "", http.StatusOK)
+
+		if err := json.Unmarshal(body, &failed); err != nil {
+			t.Fatalf("Error while decoding deliveries: %s", err)
+		}
+	}
+
+	if delivery := failed[0]; delivery.EventType != events.Created || delivery.LastStatus != http.StatusServiceUnavailable || delivery.Attempts != 1 {
+		t.Errorf("Unexpected failed delivery: %+v", delivery)
+	}
+
+	_, body = sendImportRequest(t, "POST", url+"/receiver/deliveries/"+failed[0].ID+":retry", "", "", http.StatusOK)
+
+	var retried webhook.Delivery
+
+	if err := json.Unmarshal(body, &retried); err != nil {
+		t.Fatalf("Error while decoding delivery: %s", err)
+	}
+
+	if retried.ID != failed[0].ID || retried.State != webhook.StatePending {
+		t.Errorf("Unexpected retried delivery: %+v", retried)
+	}
+
+	auth := map[string]string{"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(adminUser+":"+adminPassword))}
+
+	problem, _ := getProblem(t, "GET", url+"/whatever/deliveries", "", auth, http.StatusNotFound)
+
+	if problem.Code != "webhook_not_found" {
+		t.Errorf("Unexpected problem for an unknown webhook: %+v", problem)
+	}
+
+	problem, _ = getProblem(t, "POST", url+"/receiver/deliveries/whatever:retry", "", auth, http.StatusNotFound)
+
+	if problem.Code != "delivery_not_found" {
+		t.Errorf("Unexpected problem for an unknown delivery: %+v", problem)
+	}
+
+	problem, _ = getProblem(t, "GET", url+"/receiver/deliveries?state=whatever", "", auth, http.StatusBadRequest)
+
+	if problem.Code != "invalid_delivery_state" {
+		t.Errorf("Unexpected problem for an invalid delivery state: %+v", problem)
+	}
+}
+
+// getFeed fetches a feed, and returns the headers and body of the response.
+func getFeed(t *testing.T, url, ifModifiedSince string, expectedStatus int) (http.Header, []byte) {
+	req, err := http.NewRequest("GET", url, nil)
+
+	if err != nil {
+		t.Fatalf("Error while creating request: %s", err)
+	}
+
+	if ifModifiedSince != "" {
+		req.Header.Set("If-Modified-Since", ifModifiedSince)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatalf("Error while sending request: %s", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != expectedStatus {
+		t.Fatalf("Unexpected status code for GET %s: got %d, expected %d", url, res.StatusCode, expectedStatus)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+
+	if err != nil {
+		t.Fatalf("Error while reading response: %s", err)
+	}
+
+	return res.Header, body
+}
+
+func testFeeds(t *testing.T, url string) {
+	var created [3]endpoint.CreatedResponse
+
+	for i, message := range []string{"First", "<b>Second</b>\nline", "Hidden"} {
+		body := postPost(t, url+"/post", types.Post{Author: "John", Email: "john@domain.com", Message: message}, false, http.StatusCreated)
+
+		if err := json.Unmarshal(body, &created[i]); err != nil {
+			t.Fatalf("Error while decoding creation response: %s", err)
+		}
+	}
+
+	sendPatch(t, url+"/admin/posts/"+created[2].ID, `{"state": "unconfirmed"}`, true, http.StatusOK)
+
+	header, body := getFeed(t, url+"/feed.atom", "", http.StatusOK)
+
+	if contentType := header.Get("Content-Type"); contentType != endpoint.AtomContentType {
+		t.Errorf("Unexpected content type for the Atom feed: %s", contentType)
+	}
+
+	var atom struct {
+		ID      string `xml:"id"`
+		Title   string `xml:"title"`
+		Entries []struct {
+			ID      string `xml:"id"`
+			Title   string `xml:"title"`
+			Updated string `xml:"updated"`
+			Author  string `xml:"author>name"`
+			Content string `xml:"content"`
+		} `xml:"entry"`
+	}
+
+	if err := xml.Unmarshal(body, &atom); err != nil {
+		t.Fatalf("Error while decoding Atom feed: %s", err)
+	}
+
+	if atom.ID != "https://board.domain.com/feed.atom" || atom.Title != "Board" || len(atom.Entries) != 2 {
+		t.Fatalf("Unexpected Atom feed: %+v", atom)
+	}
+
+	// Newest first, without unpublished posts
+	entry := atom.Entries[0]
+
+	if entry.ID != "https://board.domain.com/posts/"+created[1].ID || entry.Title != "<b>Second</b>" || entry.Author != "John" || entry.Updated != created[1].Created.UTC().Format(time.RFC3339) {
+		t.Errorf("Unexpected Atom entry: %+v", entry)
+	}
+
+	if entry.Content != "&lt;b&gt;Second&lt;/b&gt;<br>\nline" {
+		t.Errorf("Unexpected content for an Atom entry: %s", entry.Content)
+	}
+
+	header, body = getFeed(t, url+"/feed.rss", "", http.StatusOK)
+
+	var rss struct {
+		Items []struct {
+			GUID        string `xml:"guid"`
+			Description string `xml:"description"`
+		} `xml:"channel>item"`
+	}
+
+	if err := xml.Unmarshal(body, &rss); err != nil {
+		t.Fatalf("Error while decoding RSS feed: %s", err)
+	}
+
+	if len(rss.Items) != 2 || rss.Items[1].GUID != "https://board.domain.com/posts/"+created[0].ID || rss.Items[1].Description != "First" {
+		t.Errorf("Unexpected RSS feed: %+v", rss)
+	}
+
+	lastModified := header.Get("Last-Modified")
+
+	if expected := created[1].Created.UTC().Format(http.TimeFormat); lastModified != expected {
+		t.Errorf("Unexpected Last-Modified header: got %s, expected %s", lastModified, expected)
+	}
+
+	getFeed(t, url+"/feed.rss", lastModified, http.StatusNotModified)
+	getFeed(t, url+"/feed.atom", lastModified, http.StatusNotModified)
+	getFeed(t, url+"/feed.atom", created[1].Created.Add(-time.Hour).UTC().Format(http.TimeFormat), http.StatusOK)
+}
+
+// noRedirectClient is an HTTP client that does not follow redirects.
+var noRedirectClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+var csrfFieldRegexp = regexp.MustCompile(`name="csrf_token" value="([^"]*)"`)
+
+// sendForm submits an HTML form with the given CSRF cookie (if not empty), and
+// returns the response and its body.
+func sendForm(t *testing.T, url, csrfCookie string, form url.Values, expectedStatus int) (*http.Response, string) {
+	req, err := http.NewRequest("POST", url, strings.NewReader(form.Encode()))
+
+	if err != nil {
+		t.Fatalf("Error while creating request: %s", err)
+	}
+
+	req.Header.Set("Content-Type", endpoint.FormContentType)
+
+	if csrfCookie != "" {
+		req.AddCookie(&http.Cookie{Name: endpoint.CSRFCookie, Value: csrfCookie})
+	}
+
+	res, err := noRedirectClient.Do(req)
+
+	if err != nil {
+		t.Fatalf("Error while sending request: %s", err)
+	}
+
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+
+	if err != nil {
+		t.Fatalf("Error while reading response: %s", err)
+	}
+
+	if res.StatusCode != expectedStatus {
+		t.Fatalf("Unexpected status code for POST %s: got %d, expected %d", url, res.StatusCode, expectedStatus)
+	}
+
+	return res, string(body)
+}
+
+// getPage fetches an HTML page, and returns the response and its body.
+func getPage(t *testing.T, url string, expectedStatus int) (*http.Response, string) {
+	res, err := http.Get(url)
+
+	if err != nil {
+		t.Fatalf("Error while sending request: %s", err)
+	}
+
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+
+	if err != nil {
+		t.Fatalf("Error while reading response: %s", err)
+	}
+
+	if res.StatusCode != expectedStatus {
+		t.Fatalf("Unexpected status code for GET %s: got %d, expected %d", url, res.StatusCode, expectedStatus)
+	}
+
+	if contentType := res.Header.Get("Content-Type"); contentType != endpoint.HTMLContentType {
+		t.Errorf("Unexpected content type for GET %s: %s", url, contentType)
+	}
+
+	return res, string(body)
+}
+
+func testHTML(t *testing.T, serverURL string) {
+	res, body := getPage(t, serverURL+"/", http.StatusOK)
+
+	var csrfCookie string
+
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == endpoint.CSRFCookie {
+			csrfCookie = cookie.Value
+		}
+	}
+
+	if match := csrfFieldRegexp.FindStringSubmatch(body); csrfCookie == "" || match == nil || match[1] != csrfCookie {
+		t.Fatalf("The CSRF token of the form does not match the cookie %s", csrfCookie)
+	}
+
+	if !strings.Contains(body, "No messages yet.") || !strings.Contains(body, "custom footer") {
+		t.Errorf("Unexpected empty board: %s", body)
+	}
+
+	form := url.Values{
+		"csrf_token": {csrfCookie},
+		"author":     {""},
+		"email":      {"john@domain.com"},
+		"message":    {"<script>alert(1)</script>"},
+	}
+
+	t.Run("CSRF", func(t *testing.T) {
+		if _, body := sendForm(t, serverURL+"/", "", form, http.StatusForbidden); !strings.Contains(body, "Invalid or missing CSRF token") {
+			t.Errorf("Unexpected page for a form without CSRF cookie: %s", body)
+		}
+
+		if _, body := sendForm(t, serverURL+"/", "whatever", form, http.StatusForbidden); !strings.Contains(body, "Invalid or missing CSRF token") {
+			t.Errorf("Unexpected page for a form with another CSRF token: %s", body)
+		}
+	})
+
+	// The form is shown again with the error, and the values that were sent
+	_, body = sendForm(t, serverURL+"/", csrfCookie, form, http.StatusBadRequest)
+
+	if !strings.Contains(body, `<span class="error">Invalid author`) || !strings.Contains(body, `value="john@domain.com"`) || !strings.Contains(body, "&lt;script&gt;alert(1)&lt;/script&gt;</textarea>") {
+		t.Errorf("Unexpected page for an invalid post: %s", body)
+	}
+
+	form.Set("author", "John")
+	res, _ = sendForm(t, serverURL+"/", csrfCookie, form, http.StatusSeeOther)
+
+	if location := res.Header.Get("Location"); location != "/?posted=published" {
+		t.Fatalf("Unexpected redirection after adding a post: %s", location)
+	}
+
+	var editTokenCookie *http.Cookie
+
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == endpoint.EditTokenCookie {
+			editTokenCookie = cookie
+		}
+	}
+
+	if editTokenCookie == nil || !strings.Contains(editTokenCookie.Value, ":") {
+		t.Fatalf("Unexpected edit token cookie after adding a post: %+v", editTokenCookie)
+	}
+
+	t.Run("Edit token", func(t *testing.T) {
+		req, err := http.NewRequest("GET", serverURL+"/?posted=published", nil)
+
+		if err != nil {
+			t.Fatalf("Error while creating request: %s", err)
+		}
+
+		req.AddCookie(editTokenCookie)
+		res, err := http.DefaultClient.Do(req)
+
+		if err != nil {
+			t.Fatalf("Error while sending request: %s", err)
+		}
+
+		defer res.Body.Close()
+
+		data, err := ioutil.ReadAll(res.Body)
+
+		if err != nil {
+			t.Fatalf("Error while reading response: %s", err)
+		}
+
+		parts := strings.SplitN(editTokenCookie.Value, ":", 2)
+
+		if !strings.Contains(string(data), "<code>"+parts[1]+"</code>") || !strings.Contains(string(data), "<code>/posts/"+parts[0]+"</code>") {
+			t.Errorf("The edit token is not shown after adding a post: %s", data)
+		}
+
+		if cookies := res.Cookies(); len(cookies) == 0 || cookies[0].Name != endpoint.EditTokenCookie || cookies[0].MaxAge >= 0 {
+			t.Errorf("The edit token cookie was not cleared: %+v", cookies)
+		}
+	})
+
+	_, body = getPage(t, serverURL+"/?posted=published", http.StatusOK)
+
+	if strings.Contains(body, "edit token") {
+		t.Errorf("The edit token is shown without cookie: %s", body)
+	}
+
+	if !strings.Contains(body, "Your message was posted.") || !strings.Contains(body, `<div class="message">&lt;script&gt;alert(1)&lt;/script&gt;</div>`) || strings.Contains(body, "john@domain.com") {
+		t.Errorf("Unexpected board after adding a post: %s", body)
+	}
+
+	if _, body := getPage(t, serverURL+"/?cursor=whatever", http.StatusBadRequest); !strings.Contains(body, "400 Bad Request") {
+		t.Errorf("Unexpected page for an invalid cursor: %s", body)
+	}
+}
+
+// customTemplates returns the default templates, with a custom footer.
+func customTemplates(t *testing.T) *template.Template {
+	dir, err := ioutil.TempDir("", "templates")
+
+	if err != nil {
+		t.Fatalf("Error while creating temporary directory: %s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	footer := `{{define "footer"}}<p>custom footer</p></body></html>{{end}}`
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "footer.html"), []byte(footer), 0600); err != nil {
+		t.Fatalf("Error while writing template: %s", err)
+	}
+
+	templates, err := endpoint.LoadTemplates(dir)
+
+	if err != nil {
+		t.Fatalf("LoadTemplates returned an error: %s", err)
+	}
+
+	return templates
+}
+
+var challengeFieldRegexp = regexp.MustCompile(`name="challenge_token" value="([^"]*)"`)
+
+func testHTMLChallenge(t *testing.T, serverURL string) {
+	res, body := getPage(t, serverURL+"/", http.StatusOK)
+	csrfCookie := res.Cookies()[0].Value
+	match := challengeFieldRegexp.FindStringSubmatch(body)
+
+	if match == nil {
+		t.Fatalf("The form has no challenge: %s", body)
+	}
+
+	form := url.Values{
+		"csrf_token":      {csrfCookie},
+		"author":          {"John"},
+		"email":           {"john@domain.com"},
+		"message":         {"Hello"},
+		"challenge_token": {match[1]},
+	}
+
+	if _, body := sendForm(t, serverURL+"/", csrfCookie, form, http.StatusForbidden); !strings.Contains(body, `<p class="error">Invalid challenge solution`) {
+		t.Errorf("Unexpected page for a form without challenge solution: %s", body)
+	}
+
+	c := challenge.Challenge{Token: match[1], Difficulty: newChallenger().Difficulty()}
+	form.Set("challenge_solution", challenge.Solve(c))
+	sendForm(t, serverURL+"/", csrfCookie, form, http.StatusSeeOther)
+}
+
+var consoleCSRFRegexp = regexp.MustCompile(`data-csrf-token="([^"]*)"`)
+
+// sendConsoleRequest sends a request with the given session cookie (if not
+// empty), and returns the response and its body.
+func sendConsoleRequest(t *testing.T, req *http.Request, sessionID string, expectedStatus int) (*http.Response, string) {
+	if sessionID != "" {
+		req.AddCookie(&http.Cookie{Name: endpoint.SessionCookie, Value: sessionID})
+	}
+
+	res, err := noRedirectClient.Do(req)
+
+	if err != nil {
+		t.Fatalf("Error while sending request: %s", err)
+	}
+
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+
+	if err != nil {
+		t.Fatalf("Error while reading response: %s", err)
+	}
+
+	if res.StatusCode != expectedStatus {
+		t.Fatalf("Unexpected status code for %s %s: got %d, expected %d", req.Method, req.URL, res.StatusCode, expectedStatus)
+	}
+
+	return res, string(body)
+}
+
+// getConsole fetches a page of the admin console, and returns its body.
+func getConsole(t *testing.T, url, sessionID string, expectedStatus int) string {
+	req, err := http.NewRequest("GET", url, nil)
+
+	if err != nil {
+		t.Fatalf("Error while creating request: %s", err)
+	}
+
+	_, body := sendConsoleRequest(t, req, sessionID, expectedStatus)
+
+	return body
+}
+
+// patchWithSession sends a merge patch to the admin API, authenticated with a
+// session and the given CSRF token (if not empty).
+func patchWithSession(t *testing.T, url, patch, sessionID, csrfToken string, expectedStatus int) string {
+	req, err := http.NewRequest("PATCH", url, strings.NewReader(patch))
+
+	if err != nil {
+		t.Fatalf("Error while creating request: %s", err)
+	}
+
+	req.Header.Set("Content-Type", endpoint.MergePatchContentType)
+
+	if csrfToken != "" {
+		req.Header.Set(endpoint.CSRFTokenHeader, csrfToken)
+	}
+
+	_, body := sendConsoleRequest(t, req, sessionID, expectedStatus)
+
+	return body
+}
+
+func testAdminConsole(t *testing.T, serverURL string) {
+	var alice, bob types.Post
+
+	json.Unmarshal(postPost(t, serverURL+"/post", types.Post{Author: "Alice", Email: "alice@domain.com", Message: "Hello"}, false, http.StatusCreated), &alice)
+	json.Unmarshal(postPost(t, serverURL+"/post", types.Post{Author: "Bob", Email: "bob@domain.com", Message: "Buy cheap stuff"}, false, http.StatusCreated), &bob)
+	sendPatch(t, serverURL+"/admin/posts/"+bob.ID, `{"state": "unconfirmed"}`, true, http.StatusOK)
+
+	if body := getConsole(t, serverURL+"/admin/console", "", http.StatusSeeOther); strings.Contains(body, "Alice") {
+		t.Errorf("The console was shown without a session: %s", body)
+	}
+
+	res, body := getPage(t, serverURL+"/admin/login", http.StatusOK)
+	csrfCookie := res.Cookies()[0].Value
+
+	if match := csrfFieldRegexp.FindStringSubmatch(body); match == nil || match[1] != csrfCookie {
+		t.Fatalf("The CSRF token of the login form does not match the cookie %s", csrfCookie)
+	}
+
+	form := url.Values{
+		"csrf_token": {csrfCookie},
+		"username":   {adminUser},
+		"password":   {"whatever"},
+	}
+
+	sendForm(t, serverURL+"/admin/login", "", form, http.StatusForbidden)
+
+	if _, body := sendForm(t, serverURL+"/admin/login", csrfCookie, form, http.StatusUnauthorized); !strings.Contains(body, "Invalid username or password") || !strings.Contains(body, `value="admin"`) {
+		t.Errorf("Unexpected page for invalid credentials: %s", body)
+	}
+
+	form.Set("password", adminPassword)
+	res, _ = sendForm(t, serverURL+"/admin/login", csrfCookie, form, http.StatusSeeOther)
+
+	var sessionID string
+
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == endpoint.SessionCookie {
+			sessionID = cookie.Value
+		}
+	}
+
+	if location := res.Header.Get("Location"); location != "/admin/console" || sessionID == "" {
+		t.Fatalf("Unexpected response to a login: redirected to %s with session %s", location, sessionID)
+	}
+
+	body = getConsole(t, serverURL+"/admin/console", sessionID, http.StatusOK)
+	match := consoleCSRFRegexp.FindStringSubmatch(body)
+
+	if match == nil || !strings.Contains(body, `data-id="`+alice.ID+`"`) || !strings.Contains(body, `data-id="`+bob.ID+`"`) {
+		t.Fatalf("Unexpected console page: %s", body)
+	}
+
+	csrfToken := match[1]
+
+	t.Run("Filters", func(t *testing.T) {
+		if body := getConsole(t, serverURL+"/admin/console?state=unconfirmed", sessionID, http.StatusOK); strings.Contains(body, alice.ID) || !strings.Contains(body, bob.ID) {
+			t.Errorf("Unexpected console page for unconfirmed posts: %s", body)
+		}
+
+		if body := getConsole(t, serverURL+"/admin/console?q=CHEAP", sessionID, http.StatusOK); strings.Contains(body, alice.ID) || !strings.Contains(body, bob.ID) {
+			t.Errorf("Unexpected console page for a search: %s", body)
+		}
+
+		getConsole(t, serverURL+"/admin/console?state=whatever", sessionID, http.StatusBadRequest)
+	})
+
+	t.Run("Session authentication", func(t *testing.T) {
+		if body := patchWithSession(t, serverURL+"/admin/posts/"+bob.ID, `{"state": "published"}`, sessionID, "", http.StatusForbidden); !strings.Contains(body, "invalid_csrf_token") {
+			t.Errorf("Unexpected response to a patch without CSRF token: %s", body)
+		}
+
+		patchWithSession(t, serverURL+"/admin/posts/"+bob.ID, `{"state": "published"}`, sessionID, "whatever", http.StatusForbidden)
+		patchWithSession(t, serverURL+"/admin/posts/"+bob.ID, `{"state": "published"}`, sessionID, csrfToken, http.StatusOK)
+
+		if post := getPost(t, serverURL, bob.ID); post.State != types.StatePublished {
+			t.Errorf("The post was not approved: %+v", post)
+		}
+
+		// Scripts keep using Basic Auth
+		sendPatch(t, serverURL+"/admin/posts/"+bob.ID, `{"message": "Edited"}`, true, http.StatusOK)
+	})
+
+	// Logging out requires the CSRF token of the session
+	logout := func(token string, expectedStatus int) {
+		req, err := http.NewRequest("POST", serverURL+"/admin/logout", strings.NewReader(url.Values{"csrf_token": {token}}.Encode()))
+
+		if err != nil {
+			t.Fatalf("Error while creating request: %s", err)
+		}
+
+		req.Header.Set("Content-Type", endpoint.FormContentType)
+		sendConsoleRequest(t, req, sessionID, expectedStatus)
+	}
+
+	logout("whatever", http.StatusForbidden)
+	logout(csrfToken, http.StatusSeeOther)
+
+	getConsole(t, serverURL+"/admin/console", sessionID, http.StatusSeeOther)
+	patchWithSession(t, serverURL+"/admin/posts/"+bob.ID, `{"state": "published"}`, sessionID, csrfToken, http.StatusUnauthorized)
+}
+
+func testMarkdown(t *testing.T, serverURL string) {
+	var created endpoint.CreatedResponse
+	body := postPost(t, serverURL+"/post", types.Post{Author: "John", Email: "john@domain.com", Message: "Hello *world*\n\n<script>alert(1)</script> https://domain.com"}, false, http.StatusCreated)
+
+	if err := json.Unmarshal(body, &created); err != nil {
+		t.Fatalf("Error while decoding creation response: %s", err)
+	}
+
+	// Messages are stored as Markdown
+	if created.Message != "Hello *world*\n\n<script>alert(1)</script> https://domain.com" {
+		t.Errorf("Unexpected message in creation response: %s", created.Message)
+	}
+
+	const expected = "<p>Hello <em>world</em></p>\n" + `<p>&lt;script&gt;alert(1)&lt;/script&gt; <a href="https://domain.com" rel="nofollow ugc">https://domain.com</a></p>` + "\n"
+
+	if _, body := getPage(t, serverURL+"/", http.StatusOK); !strings.Contains(body, `<div class="message markdown">`+expected+`</div>`) {
+		t.Errorf("Unexpected board: %s", body)
+	}
+
+	_, data := getFeed(t, serverURL+"/feed.atom", "", http.StatusOK)
+
+	var feed struct {
+		Entries []struct {
+			Content string `xml:"content"`
+		} `xml:"entry"`
+	}
+
+	if err := xml.Unmarshal(data, &feed); err != nil {
+		t.Fatalf("Error while decoding Atom feed: %s", err)
+	}
+
+	if len(feed.Entries) != 1 || feed.Entries[0].Content != expected {
+		t.Errorf("Unexpected Atom feed: %s", data)
+	}
+
+	// New versions of the message are rendered again
+	sendPatch(t, serverURL+"/admin/posts/"+created.ID, `{"message": "**Edited**"}`, true, http.StatusOK)
+
+	if _, body := getPage(t, serverURL+"/", http.StatusOK); !strings.Contains(body, `<div class="message markdown"><p><strong>Edited</strong></p>`) {
+		t.Errorf("Unexpected board after an edit: %s", body)
+	}
+}
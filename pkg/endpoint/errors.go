@@ -0,0 +1,279 @@
+package endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/abustany/back-message-board/pkg/challenge"
+	"github.com/abustany/back-message-board/pkg/idempotency"
+	"github.com/abustany/back-message-board/pkg/importjob"
+	"github.com/abustany/back-message-board/pkg/postservice"
+	"github.com/abustany/back-message-board/pkg/webhook"
+)
+
+// ProblemContentType is the MIME type of error responses, as defined by RFC
+// 7807.
+const ProblemContentType = "application/problem+json"
+
+// RequestIDHeader is the HTTP header carrying the ID of a request. Clients can
+// set it to their own ID, else the server generates one. It is always set on
+// responses.
+const RequestIDHeader = "X-Request-ID"
+
+// MaxRequestIDLength is the maximum length of request IDs sent by clients.
+// Longer IDs are replaced by a generated one.
+const MaxRequestIDLength = 128
+
+// Problem is the body of error responses.
+type Problem struct {
+	// Always "about:blank", problems are identified by their code
+	Type string `json:"type"`
+	// Text of the HTTP status
+	Title string `json:"title"`
+	// HTTP status code
+	Status int `json:"status"`
+	// Human readable description of the error
+	Detail string `json:"detail,omitempty"`
+	// Machine readable error code, like "invalid_author"
+	Code string `json:"code"`
+	// Name of the post field that caused the error, if any
+	Field string `json:"field,omitempty"`
+	// ID of the request, as set in the X-Request-ID header
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// apiError is an error detected by the endpoint itself, before reaching the
+// service.
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+// Errors returned by the endpoint itself
+var (
+	errInvalidJSON        = &apiError{http.StatusBadRequest, "invalid_json", "Malformed JSON input"}
+	errInvalidContentType = &apiError{http.StatusBadRequest, "invalid_content_type", "Invalid content type (should be " + JsonContentType + ")"}
+	errInvalidPageSize    = &apiError{http.StatusBadRequest, "invalid_page_size", "Invalid page size"}
+	errUnauthorized       = &apiError{http.StatusUnauthorized, "unauthorized", "Invalid or missing credentials"}
+	errNotFound           = &apiError{http.StatusNotFound, "not_found", "No such resource"}
+	errMethodNotAllowed   = &apiError{http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed on this resource"}
+	errInternal           = &apiError{http.StatusInternalServerError, "internal_error", "Internal server error"}
+
+	errIdempotencyKeyTooLong  = &apiError{http.StatusBadRequest, "idempotency_key_too_long", "Idempotency key too long"}
+	errInvalidBody            = &apiError{http.StatusBadRequest, "invalid_body", "Error while reading request body"}
+	errIdempotencyKeyMismatch = &apiError{http.StatusUnprocessableEntity, "idempotency_key_mismatch", idempotency.ErrMismatch.Error()}
+	errIdempotencyKeyInFlight = &apiError{http.StatusConflict, "idempotency_key_in_flight", idempotency.ErrInFlight.Error()}
+
+	errUnsupportedImportType = &apiError{http.StatusUnsupportedMediaType, "unsupported_import_type", "Unsupported content type (should be text/csv or application/x-ndjson)"}
+	errInvalidDryRun         = &apiError{http.StatusBadRequest, "invalid_dry_run", "Invalid dry_run parameter (should be true or false)"}
+
+	errWebSocketRequired    = &apiError{http.StatusUpgradeRequired, "websocket_required", "This endpoint only accepts WebSocket connections"}
+	errInvalidDeliveryState = &apiError{http.StatusBadRequest, "invalid_delivery_state", "Invalid state parameter (should be pending or failed)"}
+	errInvalidLastEventID   = &apiError{http.StatusBadRequest, "invalid_last_event_id", "Invalid " + LastEventIDHeader + " header (should be an event ID)"}
+
+	errInvalidCSRFToken = &apiError{http.StatusForbidden, "invalid_csrf_token", "Invalid or missing CSRF token, please reload the page and try again"}
+	errInvalidPostState = &apiError{http.StatusBadRequest, "invalid_post_state", "Invalid state parameter (should be published or unconfirmed)"}
+
+	errInvalidPostContentType = &apiError{http.StatusBadRequest, "invalid_content_type", "Invalid content type (should be one of " + strings.Join(codecTypes(), ", ") + ")"}
+	errMalformedPost          = &apiError{http.StatusBadRequest, "malformed_post", "Malformed post in request body"}
+	errNotAcceptable          = &apiError{http.StatusNotAcceptable, "not_acceptable", "None of the accepted content types is supported (should be one of " + strings.Join(codecTypes(), ", ") + ")"}
+)
+
+// importErrors maps the errors returned by importjob.Manager to API errors.
+var importErrors = map[error]*apiError{
+	importjob.ErrJobNotFound:     {http.StatusNotFound, "import_not_found", importjob.ErrJobNotFound.Error()},
+	importjob.ErrTooManyJobs:     {http.StatusTooManyRequests, "too_many_imports", importjob.ErrTooManyJobs.Error()},
+	importjob.ErrJobRunning:      {http.StatusConflict, "import_running", importjob.ErrJobRunning.Error()},
+	importjob.ErrNoFailedRecords: {http.StatusNotFound, "failed_records_unavailable", importjob.ErrNoFailedRecords.Error()},
+	importjob.ErrUploadTooLarge:  {http.StatusRequestEntityTooLarge, "import_too_large", importjob.ErrUploadTooLarge.Error()},
+}
+
+// webhookErrors maps the errors returned by webhook.Dispatcher to API errors.
+var webhookErrors = map[error]*apiError{
+	webhook.ErrWebhookNotFound:  {http.StatusNotFound, "webhook_not_found", webhook.ErrWebhookNotFound.Error()},
+	webhook.ErrDeliveryNotFound: {http.StatusNotFound, "delivery_not_found", webhook.ErrDeliveryNotFound.Error()},
+}
+
+// challengeErrorCodes maps the errors returned by challenge.Challenger.Verify
+// to error codes.
+var challengeErrorCodes = map[error]string{
+	challenge.ErrInvalidChallenge: "invalid_challenge",
+	challenge.ErrChallengeExpired: "challenge_expired",
+	challenge.ErrInvalidSolution:  "invalid_challenge_solution",
+	challenge.ErrSolutionReused:   "challenge_solution_reused",
+}
+
+// userErrorStatus returns the HTTP status code to use for the given
+// postservice error code.
+func userErrorStatus(code string) int {
+	switch code {
+	case "post_not_found":
+		return http.StatusNotFound
+	case "invalid_edit_token", "edit_window_closed":
+		return http.StatusForbidden
+	case "batch_aborted", "duplicate_id":
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	requestErrorKey
+)
+
+// RequestID returns the ID of the given request, or an empty string if the
+// request was not handled by an HttpEndpoint.
+func RequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > MaxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		if c > unicode.MaxASCII || !unicode.IsPrint(c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// WithRequestID wraps an http.Handler, assigning an ID to each request. The ID
+// is read from the X-Request-ID header if valid, else generated, and is sent
+// back in the X-Request-ID header of the response.
+func WithRequestID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+
+		if !validRequestID(id) {
+			id = uuid.NewV4().String()
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// requestError holds the internal error that occurred while handling a
+// request, so that WithLogging can log it.
+type requestError struct {
+	err error
+}
+
+func withRequestError(r *http.Request) (*http.Request, *requestError) {
+	holder := &requestError{}
+	return r.WithContext(context.WithValue(r.Context(), requestErrorKey, holder)), holder
+}
+
+// logError records an internal error that occurred while handling the request,
+// so that WithLogging logs it.
+func logError(r *http.Request, err error) {
+	if holder, ok := r.Context().Value(requestErrorKey).(*requestError); ok {
+		holder.err = err
+	}
+}
+
+// WriteProblem writes an error response with the given HTTP status, code and
+// details.
+func WriteProblem(w http.ResponseWriter, r *http.Request, problem Problem) {
+	problem.complete(r)
+
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(&problem)
+}
+
+// WriteError writes the given error to the ResponseWriter as a Problem, using
+// the appropriate HTTP status code depending on whether the error is a user or
+// an internal error. The details of internal errors are not sent back to the
+// client, but logged by WithLogging.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	WriteProblem(w, r, problemOf(r, err))
+}
+
+// complete fills the fields of the problem that do not depend on the error:
+// its type, title and request ID.
+func (p *Problem) complete(r *http.Request) {
+	p.Type = "about:blank"
+	p.Title = http.StatusText(p.Status)
+	p.RequestID = RequestID(r)
+}
+
+// problemOf returns the status, code, detail and field of the Problem
+// describing the given error. The other fields are filled by WriteProblem.
+func problemOf(r *http.Request, err error) Problem {
+	problem := userProblemOf(err)
+
+	if problem == nil {
+		logError(r, err)
+		problem = &Problem{Status: errInternal.status, Code: errInternal.code, Detail: errInternal.message}
+	}
+
+	return *problem
+}
+
+// userProblemOf returns the Problem describing the given error, or nil if it is
+// an internal error.
+func userProblemOf(err error) *Problem {
+	cause := errors.Cause(err)
+
+	if apiErr, ok := cause.(*apiError); ok {
+		return &Problem{Status: apiErr.status, Code: apiErr.code, Detail: apiErr.message}
+	}
+
+	if apiErr, ok := importErrors[cause]; ok {
+		return &Problem{Status: apiErr.status, Code: apiErr.code, Detail: apiErr.message}
+	}
+
+	if apiErr, ok := webhookErrors[cause]; ok {
+		return &Problem{Status: apiErr.status, Code: apiErr.code, Detail: apiErr.message}
+	}
+
+	if code, ok := challengeErrorCodes[cause]; ok {
+		return &Problem{Status: http.StatusForbidden, Code: code, Detail: cause.Error()}
+	}
+
+	if userError := postservice.UserError(err); userError != nil {
+		code := postservice.ErrorCode(err)
+
+		return &Problem{
+			Status: userErrorStatus(code),
+			Code:   code,
+			Field:  postservice.ErrorField(err),
+			Detail: userError.Error(),
+		}
+	}
+
+	return nil
+}
+
+// handleNotFound replies to requests that don't match any route.
+func handleNotFound(w http.ResponseWriter, r *http.Request) {
+	WriteError(w, r, errNotFound)
+}
+
+// handleMethodNotAllowed replies to requests that match a route, but not its
+// method.
+func handleMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	WriteError(w, r, errMethodNotAllowed)
+}
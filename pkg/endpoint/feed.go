@@ -0,0 +1,234 @@
+package endpoint
+
+import (
+	"encoding/xml"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+// AtomContentType is the MIME type of Atom feeds.
+const AtomContentType = "application/atom+xml; charset=utf-8"
+
+// RSSContentType is the MIME type of RSS feeds.
+const RSSContentType = "application/rss+xml; charset=utf-8"
+
+// DefaultFeedSize is the number of posts in the feeds of an endpoint whose
+// FeedConfig has a Size of 0.
+const DefaultFeedSize = 50
+
+// maxFeedTitleLength is the maximum length (in characters) of the titles of
+// feed entries, taken from the first line of the messages.
+const maxFeedTitleLength = 80
+
+// FeedConfig configures the feeds of published posts, see UseFeeds.
+type FeedConfig struct {
+	// Title of the feeds
+	Title string
+	// Public URL of the board, like https://board.domain.com. The IDs of the
+	// feed entries are derived from it, so it should not change.
+	URL string
+	// Number of posts in the feeds, the newest ones
+	Size uint
+}
+
+// UseFeeds enables the Atom (GET /feed.atom) and RSS (GET /feed.rss) feeds of
+// the newest published posts.
+func UseFeeds(config FeedConfig) Option {
+	return func(e *HttpEndpoint) {
+		if config.Size == 0 {
+			config.Size = DefaultFeedSize
+		}
+
+		config.URL = strings.TrimSuffix(config.URL, "/")
+		e.feed = &config
+	}
+}
+
+// feedEntryID returns the ID of the feed entry of a post.
+func (e *HttpEndpoint) feedEntryID(post *types.Post) string {
+	return e.feed.URL + "/posts/" + url.PathEscape(post.ID)
+}
+
+// feedEntryTitle returns the title of the feed entry of a post: the first line
+// of its message, shortened if needed.
+func feedEntryTitle(post *types.Post) string {
+	title := strings.TrimSpace(strings.SplitN(post.Message, "\n", 2)[0])
+
+	if runes := []rune(title); len(runes) > maxFeedTitleLength {
+		title = string(runes[:maxFeedTitleLength-1]) + "…"
+	}
+
+	if title == "" {
+		title = "Message from " + post.Author
+	}
+
+	return title
+}
+
+// feedEntryContent returns the HTML content of the feed entry of a post.
+func (e *HttpEndpoint) feedEntryContent(post *types.Post) string {
+	if e.markdown != nil {
+		return e.markdown.Render(post.ID, post.Message)
+	}
+
+	return strings.Replace(html.EscapeString(post.Message), "\n", "<br>\n", -1)
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Published string      `xml:"published"`
+	Updated   string      `xml:"updated"`
+	Author    atomAuthor  `xml:"author"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	DC      string     `xml:"xmlns:dc,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	GUID        rssGUID `xml:"guid"`
+	Title       string  `xml:"title"`
+	Creator     string  `xml:"dc:creator"`
+	PubDate     string  `xml:"pubDate"`
+	Description string  `xml:"description"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	ID          string `xml:",chardata"`
+}
+
+// atomFeed builds the Atom feed of the given posts.
+func (e *HttpEndpoint) atomFeed(posts []types.Post, updated time.Time) interface{} {
+	feed := atomFeed{
+		ID:      e.feed.URL + "/feed.atom",
+		Title:   e.feed.Title,
+		Updated: updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "self", Type: AtomContentType, Href: e.feed.URL + "/feed.atom"},
+			{Rel: "alternate", Href: e.feed.URL + "/"},
+		},
+	}
+
+	for i := range posts {
+		post := &posts[i]
+		created := post.Created.UTC().Format(time.RFC3339)
+
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:        e.feedEntryID(post),
+			Title:     feedEntryTitle(post),
+			Published: created,
+			Updated:   created,
+			Author:    atomAuthor{Name: post.Author},
+			Content:   atomContent{Type: "html", Body: e.feedEntryContent(post)},
+		})
+	}
+
+	return &feed
+}
+
+// rssFeed builds the RSS feed of the given posts.
+func (e *HttpEndpoint) rssFeed(posts []types.Post, updated time.Time) interface{} {
+	feed := rssFeed{
+		Version: "2.0",
+		DC:      "http://purl.org/dc/elements/1.1/",
+		Channel: rssChannel{
+			Title:         e.feed.Title,
+			Link:          e.feed.URL + "/",
+			Description:   e.feed.Title,
+			LastBuildDate: updated.UTC().Format(time.RFC1123Z),
+		},
+	}
+
+	for i := range posts {
+		post := &posts[i]
+
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			GUID:        rssGUID{ID: e.feedEntryID(post)},
+			Title:       feedEntryTitle(post),
+			Creator:     post.Author,
+			PubDate:     post.Created.UTC().Format(time.RFC1123Z),
+			Description: e.feedEntryContent(post),
+		})
+	}
+
+	return &feed
+}
+
+// feedHandler returns the handler of a feed, built by the given function.
+// Conditional requests with If-Modified-Since get an HTTP 304 if no post newer
+// than the given time was published.
+func (e *HttpEndpoint) feedHandler(contentType string, build func(posts []types.Post, updated time.Time) interface{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts, _, err := e.publishedPosts("", e.feed.Size)
+
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		// Posts are listed newest first
+		updated := time.Now()
+
+		if len(posts) > 0 {
+			updated = posts[0].Created.Truncate(time.Second)
+			w.Header().Set("Last-Modified", updated.UTC().Format(http.TimeFormat))
+
+			if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !updated.After(since) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, xml.Header)
+
+		if err := xml.NewEncoder(w).Encode(build(posts, updated)); err != nil {
+			logError(r, err)
+		}
+	})
+}
@@ -0,0 +1,361 @@
+package endpoint
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/abustany/back-message-board/pkg/challenge"
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+// HTMLContentType is the MIME type of HTML pages.
+const HTMLContentType = "text/html; charset=utf-8"
+
+// FormContentType is the MIME type of HTML form submissions.
+const FormContentType = "application/x-www-form-urlencoded"
+
+// CSRFCookie is the name of the cookie holding the CSRF token of a browser. Forms
+// must carry the same token in their csrf_token field.
+const CSRFCookie = "csrf_token"
+
+// EditTokenCookie is the cookie holding the ID and edit token of a post added
+// from the board, until the page shown after the redirection displays them.
+const EditTokenCookie = "edit_token"
+
+// editTokenCookieTTL is the lifetime of the EditTokenCookie.
+const editTokenCookieTTL = 5 * time.Minute
+
+// DefaultBoardPageSize is the number of posts on each page of an HTML board
+// whose HTMLConfig has a PageSize of 0.
+const DefaultBoardPageSize = 20
+
+// MaxFormSize is the maximum size of the forms submitted to the HTML board.
+const MaxFormSize = 64 << 10
+
+// csrfTokenLength is the number of random bytes of CSRF tokens.
+const csrfTokenLength = 32
+
+// HTMLConfig configures the HTML board, see UseHTML.
+type HTMLConfig struct {
+	// Title of the board
+	Title string
+	// Number of posts on each page
+	PageSize uint
+}
+
+// UseHTML enables the HTML board: GET / shows the published posts and a form
+// to add a post, which is submitted to POST /. Its pages are rendered with the
+// templates set by UseTemplates.
+func UseHTML(config HTMLConfig) Option {
+	return func(e *HttpEndpoint) {
+		if config.PageSize == 0 {
+			config.PageSize = DefaultBoardPageSize
+		}
+
+		e.html = &config
+	}
+}
+
+// UseTemplates sets the templates of the HTML pages of the board and of the
+// admin console, see LoadTemplates. The default templates are used if this
+// option is not given.
+func UseTemplates(templates *template.Template) Option {
+	return func(e *HttpEndpoint) {
+		e.templates = templates
+	}
+}
+
+// LoadTemplates returns the templates of the HTML pages. The default templates,
+// which are embedded in the binary, are replaced by the files of dir with the
+// same names (like board.html), if dir is not empty. Since templates are
+// looked up by name, a file can also redefine the templates defined by
+// another one, like "header" or "footer".
+func LoadTemplates(dir string) (*template.Template, error) {
+	t := template.New("")
+	names := make([]string, 0, len(defaultTemplates))
+
+	for name := range defaultTemplates {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, err := t.New(name).Parse(defaultTemplates[name]); err != nil {
+			return nil, errors.Wrapf(err, "Error while parsing default template %s", name)
+		}
+	}
+
+	if dir == "" {
+		return t, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while listing templates")
+	}
+
+	for _, filename := range files {
+		data, err := ioutil.ReadFile(filename)
+
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error while reading template %s", filename)
+		}
+
+		if _, err := t.New(filepath.Base(filename)).Parse(string(data)); err != nil {
+			return nil, errors.Wrapf(err, "Error while parsing template %s", filename)
+		}
+	}
+
+	return t, nil
+}
+
+// boardForm is the state of the form adding a post.
+type boardForm struct {
+	Author  string
+	Email   string
+	Message string
+	// Error of each invalid field, by JSON name
+	Errors map[string]string
+	// Error not related to a field
+	Error string
+}
+
+// boardPage is the data of the board.html template.
+type boardPage struct {
+	Title string
+	// Published posts of the page, newest first
+	Posts []RenderedPost
+	// Cursor of the page, empty for the first page, and of the next page,
+	// empty for the last page
+	Cursor string
+	Next   string
+	// Message shown above the form, after adding a post
+	Notice string
+	Form   boardForm
+	// ID and edit token of the post just added, shown once
+	PostID    string
+	EditToken string
+	// Token to set in the csrf_token field of forms
+	CSRFToken string
+	// Challenge to solve before adding a post, if challenges are enabled
+	Challenge *challenge.Challenge
+}
+
+// errorPage is the data of the error.html template.
+type errorPage struct {
+	// Title of the board or of the console
+	Title string
+	// HTTP status code and text
+	Status     int
+	StatusText string
+	// Human readable description of the error, and ID of the request
+	Detail    string
+	RequestID string
+}
+
+// Notices shown after adding a post, by state of the post.
+var boardNotices = map[types.PostState]string{
+	types.StatePublished:   "Your message was posted.",
+	types.StateUnconfirmed: "Your message will be published once you open the link sent to your email address.",
+}
+
+// renderHTML executes a template and writes its result to the response.
+func (e *HttpEndpoint) renderHTML(w http.ResponseWriter, r *http.Request, status int, name string, data interface{}) {
+	w.Header().Set("Content-Type", HTMLContentType)
+	w.WriteHeader(status)
+
+	// The response is already started, errors can only be logged
+	if err := e.templates.ExecuteTemplate(w, name, data); err != nil {
+		logError(r, errors.Wrapf(err, "Error while rendering template %s", name))
+	}
+}
+
+// writeHTMLError writes an error as an HTML page with the given title, like
+// WriteError does for API clients.
+func (e *HttpEndpoint) writeHTMLError(w http.ResponseWriter, r *http.Request, title string, err error) {
+	problem := problemOf(r, err)
+
+	e.renderHTML(w, r, problem.Status, "error.html", &errorPage{
+		Title:      title,
+		Status:     problem.Status,
+		StatusText: http.StatusText(problem.Status),
+		Detail:     problem.Detail,
+		RequestID:  RequestID(r),
+	})
+}
+
+// csrfToken returns the CSRF token of the browser, setting a new one in a
+// cookie if it has none.
+func csrfToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(CSRFCookie); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+
+	data := make([]byte, csrfTokenLength)
+
+	if _, err := rand.Read(data); err != nil {
+		return "", errors.Wrap(err, "Error while generating CSRF token")
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(data)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	return token, nil
+}
+
+// checkCSRF checks that the csrf_token field of a parsed form matches the
+// CSRF cookie of the browser.
+func checkCSRF(r *http.Request) error {
+	cookie, err := r.Cookie(CSRFCookie)
+
+	if err != nil || cookie.Value == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(r.PostForm.Get("csrf_token"))) != 1 {
+		return errInvalidCSRFToken
+	}
+
+	return nil
+}
+
+// renderBoard renders a page of the board, with the given state of the form.
+func (e *HttpEndpoint) renderBoard(w http.ResponseWriter, r *http.Request, status int, page boardPage) {
+	var err error
+
+	page.Title = e.html.Title
+
+	posts, next, err := e.publishedPosts(page.Cursor, e.html.PageSize)
+
+	if err != nil {
+		e.writeHTMLError(w, r, e.html.Title, err)
+		return
+	}
+
+	page.Posts, page.Next = renderPosts(e.markdown, posts), next
+
+	if page.CSRFToken, err = csrfToken(w, r); err != nil {
+		e.writeHTMLError(w, r, e.html.Title, err)
+		return
+	}
+
+	if e.challenger != nil {
+		c, err := e.challenger.Issue()
+
+		if err != nil {
+			e.writeHTMLError(w, r, e.html.Title, err)
+			return
+		}
+
+		page.Challenge = &c
+	}
+
+	// Pages embed a CSRF token and a challenge
+	w.Header().Set("Cache-Control", "no-store")
+	e.renderHTML(w, r, status, "board.html", &page)
+}
+
+func (e *HttpEndpoint) handleBoard(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	page := boardPage{
+		Cursor: params.Get("cursor"),
+		Notice: boardNotices[types.PostState(params.Get("posted"))],
+	}
+
+	// The edit token is only shown once
+	if cookie, err := r.Cookie(EditTokenCookie); err == nil {
+		if parts := strings.SplitN(cookie.Value, ":", 2); len(parts) == 2 {
+			page.PostID, page.EditToken = parts[0], parts[1]
+		}
+
+		http.SetCookie(w, &http.Cookie{Name: EditTokenCookie, Path: "/", MaxAge: -1})
+	}
+
+	e.renderBoard(w, r, http.StatusOK, page)
+}
+
+func (e *HttpEndpoint) handleBoardPost(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, MaxFormSize)
+
+	if err := r.ParseForm(); err != nil {
+		e.writeHTMLError(w, r, e.html.Title, errInvalidBody)
+		return
+	}
+
+	if err := checkCSRF(r); err != nil {
+		e.writeHTMLError(w, r, e.html.Title, err)
+		return
+	}
+
+	form := boardForm{
+		Author:  r.PostForm.Get("author"),
+		Email:   r.PostForm.Get("email"),
+		Message: r.PostForm.Get("message"),
+		Errors:  map[string]string{},
+	}
+
+	var err error
+
+	if e.challenger != nil {
+		err = e.challenger.Verify(r.PostForm.Get("challenge_token"), r.PostForm.Get("challenge_solution"))
+	}
+
+	var created types.Post
+	var editToken string
+
+	if err == nil {
+		created, editToken, err = e.service.Add(types.Post{Author: form.Author, Email: form.Email, Message: form.Message})
+	}
+
+	if err != nil {
+		problem := userProblemOf(err)
+
+		if problem == nil {
+			e.writeHTMLError(w, r, e.html.Title, err)
+			return
+		}
+
+		if problem.Field != "" {
+			form.Errors[problem.Field] = problem.Detail
+		} else {
+			form.Error = problem.Detail
+		}
+
+		e.renderBoard(w, r, problem.Status, boardPage{Form: form})
+		return
+	}
+
+	// The edit token is passed to the next page in a cookie rather than in
+	// the URL, so that it does not end up in the history or in the logs
+	http.SetCookie(w, &http.Cookie{
+		Name:     EditTokenCookie,
+		Value:    created.ID + ":" + editToken,
+		Path:     "/",
+		MaxAge:   int(editTokenCookieTTL / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	// Redirecting prevents browsers from submitting the form again when the
+	// page is reloaded
+	http.Redirect(w, r, "/?posted="+url.QueryEscape(string(created.State)), http.StatusSeeOther)
+}
@@ -3,86 +3,264 @@ package endpoint
 
 import (
 	"encoding/json"
+	"html/template"
 	"io"
 	"net/http"
+	"net/url"
 	"strconv"
 
 	"github.com/go-kit/kit/log"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 
+	"github.com/abustany/back-message-board/pkg/challenge"
+	"github.com/abustany/back-message-board/pkg/events"
+	"github.com/abustany/back-message-board/pkg/idempotency"
+	"github.com/abustany/back-message-board/pkg/importjob"
+	"github.com/abustany/back-message-board/pkg/markdown"
 	"github.com/abustany/back-message-board/pkg/postservice"
 	"github.com/abustany/back-message-board/pkg/poststore"
 	"github.com/abustany/back-message-board/pkg/types"
+	"github.com/abustany/back-message-board/pkg/webhook"
 )
 
 // HttpEndpoint exposes the functionality of postervice.Service over HTTP
 type HttpEndpoint struct {
-	router  *mux.Router
-	service postservice.Service
+	router        *mux.Router
+	handler       http.Handler
+	service       postservice.Service
+	authenticator *BasicAuthenticator
+	challenger    *challenge.Challenger
+	idempotent    *idempotency.Cache
+	imports       *importjob.Manager
+	events        *events.Bus
+	webhooks      *webhook.Dispatcher
+	feed          *FeedConfig
+	html          *HTMLConfig
+	console       *ConsoleConfig
+	templates     *template.Template
+	markdown      *markdown.Cache
+}
+
+// Option configures optional features of an HttpEndpoint.
+type Option func(e *HttpEndpoint)
+
+// UseChallenger requires clients to solve a proof-of-work challenge issued by
+// the given challenger before creating a post.
+func UseChallenger(challenger *challenge.Challenger) Option {
+	return func(e *HttpEndpoint) {
+		e.challenger = challenger
+	}
 }
 
 // ListResponse is the shape of List replies.
 type ListResponse struct {
 	// List of posts on that result page
-	Posts []types.Post `json:"posts"`
+	Posts []types.Post `json:"posts" msgpack:"posts"`
 	// Cursor to the next result page
-	Next string `json:"next,omitempty"`
+	Next string `json:"next,omitempty" msgpack:"next,omitempty"`
 }
 
+// CreatedResponse is the shape of replies to post creations.
+type CreatedResponse struct {
+	// The new post, as stored
+	types.Post
+	// Secret token allowing the author to edit or delete the post
+	EditToken string `json:"edit_token"`
+}
+
+// EditTokenHeader is the HTTP header carrying the edit token of a post, for
+// requests from its author.
+const EditTokenHeader = "X-Edit-Token"
+
 // Type assertion
 var _ http.Handler = &HttpEndpoint{}
 
+// UseIdempotencyCache lets clients retry post creations safely, by sending the
+// same Idempotency-Key header with each attempt. Responses are remembered in
+// the given cache.
+func UseIdempotencyCache(cache *idempotency.Cache) Option {
+	return func(e *HttpEndpoint) {
+		e.idempotent = cache
+	}
+}
+
 // NewHttpEndpoint returns a new instance of HttpEndpoint backed by the given
 // service.
 //
 // HTTP requests will be logged to the given logger, and adminUsers will be used
 // to authenticate users accessing the admin API. It should be a map where keys
 // are usernames, and values the password for each username.
-func NewHttpEndpoint(logger log.Logger, service postservice.Service, adminUsers map[string]string) *HttpEndpoint {
+func NewHttpEndpoint(logger log.Logger, service postservice.Service, adminUsers map[string]string, options ...Option) *HttpEndpoint {
 	endpoint := &HttpEndpoint{
 		router:  mux.NewRouter(),
 		service: service,
 	}
 
+	for _, option := range options {
+		option(endpoint)
+	}
+
+	if (endpoint.html != nil || endpoint.console != nil) && endpoint.templates == nil {
+		endpoint.templates = template.Must(LoadTemplates(""))
+	}
+
 	logger = log.With(logger, "module", "http")
 
-	endpoint.router.Methods("POST").Path("/post").Handler(WithLogging(logger, WithPost(endpoint.handlePost)))
+	postHandler := WithPost(endpoint.handlePost)
+
+	if endpoint.challenger != nil {
+		postHandler = WithChallenge(endpoint.challenger, postHandler)
+		endpoint.router.Methods("GET").Path("/challenge").Handler(WithLogging(logger, http.HandlerFunc(endpoint.handleChallenge)))
+	}
+
+	if endpoint.idempotent != nil {
+		// Retries are replayed before checking the challenge, since its
+		// solution cannot be reused
+		postHandler = WithIdempotency(endpoint.idempotent, postHandler)
+	}
+
+	endpoint.router.Methods("POST").Path("/post").Handler(WithLogging(logger, postHandler))
+	endpoint.router.Methods("GET").Path("/confirm/{token}").Handler(WithLogging(logger, http.HandlerFunc(endpoint.handleConfirm)))
+	endpoint.router.Methods("PATCH").Path("/posts/{id}").Handler(WithLogging(logger, WithPost(endpoint.handleAuthorEdit)))
+	endpoint.router.Methods("DELETE").Path("/posts/{id}").Handler(WithLogging(logger, http.HandlerFunc(endpoint.handleAuthorDelete)))
+
+	if endpoint.feed != nil {
+		endpoint.router.Methods("GET").Path("/feed.atom").Handler(WithLogging(logger, endpoint.feedHandler(AtomContentType, endpoint.atomFeed)))
+		endpoint.router.Methods("GET").Path("/feed.rss").Handler(WithLogging(logger, endpoint.feedHandler(RSSContentType, endpoint.rssFeed)))
+	}
+
+	if endpoint.html != nil {
+		endpoint.router.Methods("GET").Path("/").Handler(WithLogging(logger, http.HandlerFunc(endpoint.handleBoard)))
+		endpoint.router.Methods("POST").Path("/").Handler(WithLogging(logger, http.HandlerFunc(endpoint.handleBoardPost)))
+	}
 
 	adminRouter := endpoint.router.PathPrefix("/admin").Subrouter()
 
-	authenticator := BasicAuthenticator{
+	endpoint.authenticator = &BasicAuthenticator{
 		Users: adminUsers,
 	}
 
+	var authenticator RequestAuthenticator = endpoint.authenticator
+
+	if endpoint.console != nil {
+		// Scripts keep using Basic Auth, while the console relies on the
+		// session cookie
+		authenticator = AnyAuthenticator{endpoint.authenticator, &SessionAuthenticator{Sessions: endpoint.console.Sessions}}
+
+		adminRouter.Methods("GET").Path("/login").Handler(WithLogging(logger, http.HandlerFunc(endpoint.handleLoginPage)))
+		adminRouter.Methods("POST").Path("/login").Handler(WithLogging(logger, http.HandlerFunc(endpoint.handleLogin)))
+		adminRouter.Methods("POST").Path("/logout").Handler(WithLogging(logger, http.HandlerFunc(endpoint.handleLogout)))
+		adminRouter.Methods("GET").Path("/console").Handler(WithLogging(logger, http.HandlerFunc(endpoint.handleConsole)))
+	}
+
 	adminHandler := func(handler http.Handler) http.Handler {
-		return WithLogging(logger, WithAuthentication(&authenticator, handler))
+		return WithLogging(logger, WithAuthentication(authenticator, handler))
 	}
 
 	adminRouter.Methods("GET").Path("/posts/{id}").Handler(adminHandler(http.HandlerFunc(endpoint.handleGet)))
 	adminRouter.Methods("GET").Path("/posts").Handler(adminHandler(http.HandlerFunc(endpoint.handleList)))
 	adminRouter.Methods("POST").Path("/posts").Handler(adminHandler(WithPost(endpoint.handleEdit)))
+	adminRouter.Methods("PATCH").Path("/posts/{id}").Handler(adminHandler(WithPostPatch(endpoint.handlePatch)))
+	adminRouter.Methods("GET").Path("/export.{format}").Handler(adminHandler(http.HandlerFunc(endpoint.handleExport)))
+	adminRouter.Methods("POST").Path("/posts:batch").Handler(adminHandler(WithContentType(JsonContentType, http.HandlerFunc(endpoint.handleBatch))))
+
+	if endpoint.imports != nil {
+		adminRouter.Methods("POST").Path("/imports").Handler(adminHandler(http.HandlerFunc(endpoint.handleStartImport)))
+		adminRouter.Methods("GET").Path("/imports/{id}").Handler(adminHandler(http.HandlerFunc(endpoint.handleGetImport)))
+		adminRouter.Methods("POST").Path("/imports/{id}:cancel").Handler(adminHandler(http.HandlerFunc(endpoint.handleCancelImport)))
+		adminRouter.Methods("GET").Path("/imports/{id}/failed").Handler(adminHandler(http.HandlerFunc(endpoint.handleFailedImportRecords)))
+	}
+
+	if endpoint.events != nil {
+		adminRouter.Methods("GET").Path("/stream").Handler(adminHandler(http.HandlerFunc(endpoint.handleStream)))
+		adminRouter.Methods("GET").Path("/ws").Handler(adminHandler(endpoint.socketHandler(true)))
+		endpoint.router.Methods("GET").Path("/ws").Handler(WithLogging(logger, endpoint.socketHandler(false)))
+	}
+
+	if endpoint.webhooks != nil {
+		adminRouter.Methods("GET").Path("/webhooks").Handler(adminHandler(http.HandlerFunc(endpoint.handleListWebhooks)))
+		adminRouter.Methods("GET").Path("/webhooks/{id}/deliveries").Handler(adminHandler(http.HandlerFunc(endpoint.handleListDeliveries)))
+		adminRouter.Methods("POST").Path("/webhooks/{id}/deliveries/{delivery}:retry").Handler(adminHandler(http.HandlerFunc(endpoint.handleRetryDelivery)))
+	}
 
 	endpoint.router.Methods("GET").Path("/health").Handler(WithLogging(logger, http.HandlerFunc(endpoint.handleHealth)))
 
+	endpoint.router.NotFoundHandler = WithLogging(logger, http.HandlerFunc(handleNotFound))
+	endpoint.router.MethodNotAllowedHandler = WithLogging(logger, http.HandlerFunc(handleMethodNotAllowed))
+	endpoint.handler = WithRequestID(endpoint.router)
+
 	return endpoint
 }
 
 func (e *HttpEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	e.router.ServeHTTP(w, r)
+	e.handler.ServeHTTP(w, r)
+}
+
+func (e *HttpEndpoint) handlePost(w http.ResponseWriter, r *http.Request, post types.Post) (int, interface{}, error) {
+	created, editToken, err := e.service.Add(post)
+
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "Error while adding post")
+	}
+
+	w.Header().Set("Location", "/posts/"+url.PathEscape(created.ID))
+
+	return http.StatusCreated, &CreatedResponse{Post: created, EditToken: editToken}, nil
 }
 
-func (e *HttpEndpoint) handlePost(post types.Post) (int, error) {
-	err := e.service.Add(post)
+func (e *HttpEndpoint) handleAuthorEdit(w http.ResponseWriter, r *http.Request, post types.Post) (int, interface{}, error) {
+	updated, err := e.service.AuthorUpdate(mux.Vars(r)["id"], r.Header.Get(EditTokenHeader), post, types.NonZeroFields(post))
 
 	if err != nil {
-		return 0, errors.Wrap(err, "Error while adding post")
+		return 0, nil, errors.Wrap(err, "Error while editing post")
 	}
 
-	return http.StatusCreated, nil
+	return http.StatusOK, &updated, nil
+}
+
+func (e *HttpEndpoint) handleAuthorDelete(w http.ResponseWriter, r *http.Request) {
+	if err := e.service.AuthorDelete(mux.Vars(r)["id"], r.Header.Get(EditTokenHeader)); err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (e *HttpEndpoint) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	c, err := e.challenger.Issue()
+
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", JsonContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&c)
+}
+
+func (e *HttpEndpoint) handleConfirm(w http.ResponseWriter, r *http.Request) {
+	if err := e.service.Confirm(mux.Vars(r)["token"]); err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, "Thank you, your message is now published.\n")
 }
 
 func (e *HttpEndpoint) handleList(w http.ResponseWriter, r *http.Request) {
+	codec := negotiate(r)
+
+	if codec == nil {
+		WriteError(w, r, errNotAcceptable)
+		return
+	}
+
 	params := r.URL.Query()
 	cursor := params.Get("cursor")
 	pageSizeStr := params.Get("n")
@@ -94,15 +272,14 @@ func (e *HttpEndpoint) handleList(w http.ResponseWriter, r *http.Request) {
 	pageSize, err := strconv.ParseUint(pageSizeStr, 10, 32)
 
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		io.WriteString(w, "Invalid page size")
+		WriteError(w, r, errInvalidPageSize)
 		return
 	}
 
 	posts, next, err := e.service.List(cursor, uint(pageSize))
 
 	if err != nil {
-		WriteError(w, err)
+		WriteError(w, r, err)
 		return
 	}
 
@@ -111,45 +288,138 @@ func (e *HttpEndpoint) handleList(w http.ResponseWriter, r *http.Request) {
 		Next:  next,
 	}
 
-	w.Header().Set("Content-Type", JsonContentType)
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	if next != "" {
+		// Formats other than JSON and MessagePack have no room for the cursor
+		query := url.Values{"cursor": {next}}
+
+		if pageSize != 0 {
+			query.Set("n", strconv.FormatUint(pageSize, 10))
+		}
+
+		nextURL := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+		w.Header().Set("Link", "<"+nextURL.String()+`>; rel="next"`)
+	}
+
+	writeNegotiated(w, r, codec, func(w io.Writer) error {
+		return codec.EncodeList(w, &response)
+	})
+}
+
+// publishedPosts returns up to n published posts, newest first, starting at
+// the given cursor (see Service.List). The returned cursor points to the post
+// following the last returned one, and is empty if there are no more posts.
+func (e *HttpEndpoint) publishedPosts(cursor string, n uint) ([]types.Post, string, error) {
+	return e.filterPosts(cursor, n, func(post *types.Post) bool {
+		return post.State == types.StatePublished
+	})
+}
+
+// filterPosts is like publishedPosts, but returns the posts for which keep
+// returns true.
+func (e *HttpEndpoint) filterPosts(cursor string, n uint, keep func(post *types.Post) bool) ([]types.Post, string, error) {
+	var posts []types.Post
+
+	for uint(len(posts)) < n {
+		// Only asking for the missing posts makes the cursor of the page
+		// point right after the last returned post
+		pageSize := n - uint(len(posts))
+
+		if pageSize > postservice.MaxPageSize {
+			pageSize = postservice.MaxPageSize
+		}
+
+		page, next, err := e.service.List(cursor, pageSize)
+
+		if err != nil {
+			return nil, "", errors.Wrap(err, "Error while listing posts")
+		}
+
+		for i := range page {
+			if keep(&page[i]) {
+				posts = append(posts, page[i])
+			}
+		}
+
+		cursor = next
+
+		if next == "" {
+			break
+		}
+	}
+
+	return posts, cursor, nil
 }
 
 func (e *HttpEndpoint) handleGet(w http.ResponseWriter, r *http.Request) {
+	codec := negotiate(r)
+
+	if codec == nil {
+		WriteError(w, r, errNotAcceptable)
+		return
+	}
+
 	vars := mux.Vars(r)
 	postId := vars["id"]
 
 	if postId == "" {
-		w.WriteHeader(http.StatusNotFound)
+		WriteError(w, r, errNotFound)
 		return
 	}
 
 	post, err := e.service.Get(postId)
 
-	if postservice.UserError(err) == poststore.ErrIDNotFound {
-		w.WriteHeader(http.StatusNotFound)
+	if err != nil {
+		WriteError(w, r, err)
 		return
 	}
 
+	writeNegotiated(w, r, codec, func(w io.Writer) error {
+		return codec.EncodePost(w, &post)
+	})
+}
+
+func (e *HttpEndpoint) handleEdit(w http.ResponseWriter, r *http.Request, post types.Post) (int, interface{}, error) {
+	updated, err := e.service.Update(post, types.NonZeroFields(post))
+
 	if err != nil {
-		WriteError(w, err)
-		return
+		return 0, nil, errors.Wrap(err, "Error while editing post")
 	}
 
-	w.Header().Set("Content-Type", JsonContentType)
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(&post)
+	return http.StatusOK, &updated, nil
 }
 
-func (e *HttpEndpoint) handleEdit(post types.Post) (int, error) {
-	err := e.service.Update(post)
+func (e *HttpEndpoint) handlePatch(w http.ResponseWriter, r *http.Request, post types.Post, fields types.FieldMask) (int, interface{}, error) {
+	post.ID = mux.Vars(r)["id"]
+
+	updated, err := e.service.Update(post, fields)
 
 	if err != nil {
-		return 0, errors.Wrap(err, "Error while editing post")
+		return 0, nil, errors.Wrap(err, "Error while patching post")
 	}
 
-	return http.StatusOK, nil
+	return http.StatusOK, &updated, nil
+}
+
+func (e *HttpEndpoint) handleExport(w http.ResponseWriter, r *http.Request) {
+	format, err := poststore.FormatByName(mux.Vars(r)["format"])
+
+	if err != nil {
+		WriteError(w, r, errNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.ContentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="posts.`+format.Extensions[0]+`"`)
+	w.WriteHeader(http.StatusOK)
+
+	// The export is streamed, so errors cannot be reported to the client
+	// anymore. Aborting the handler closes the connection without ending the
+	// response properly, so that clients see the download failed instead of
+	// getting a truncated file.
+	if _, err := e.service.Export(format, w); err != nil {
+		logError(r, err)
+		panic(http.ErrAbortHandler)
+	}
 }
 
 func (e *HttpEndpoint) handleHealth(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,142 @@
+package endpoint
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+
+	"github.com/abustany/back-message-board/pkg/importjob"
+	"github.com/abustany/back-message-board/pkg/postservice"
+	"github.com/abustany/back-message-board/pkg/poststore"
+)
+
+// importFormats lists the formats accepted by POST /admin/imports, identified by
+// the content type of the request.
+var importFormats = []*poststore.Format{&poststore.FormatCSV, &poststore.FormatNDJSON}
+
+// UseImportManager enables the import API, which runs the imports with the
+// given manager. The manager should import posts into the same service as the
+// endpoint.
+func UseImportManager(manager *importjob.Manager) Option {
+	return func(e *HttpEndpoint) {
+		e.imports = manager
+	}
+}
+
+// importFormat returns the import format matching the given content type, or
+// nil.
+func importFormat(contentType string) *poststore.Format {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+
+	if err != nil {
+		return nil
+	}
+
+	for _, format := range importFormats {
+		if formatType, _, _ := mime.ParseMediaType(format.ContentType); formatType == mediaType {
+			return format
+		}
+	}
+
+	return nil
+}
+
+// importOptions reads the options of an import from the query parameters.
+func importOptions(params url.Values) (postservice.ImportOptions, error) {
+	var options postservice.ImportOptions
+	var err error
+
+	if conflicts := params.Get("conflicts"); conflicts != "" {
+		if options.Conflicts, err = postservice.ParseConflictPolicy(conflicts); err != nil {
+			return options, err
+		}
+	}
+
+	if dryRun := params.Get("dry_run"); dryRun != "" {
+		if options.DryRun, err = strconv.ParseBool(dryRun); err != nil {
+			return options, errInvalidDryRun
+		}
+	}
+
+	return options, nil
+}
+
+func (e *HttpEndpoint) handleStartImport(w http.ResponseWriter, r *http.Request) {
+	format := importFormat(r.Header.Get("Content-Type"))
+
+	if format == nil {
+		WriteError(w, r, errUnsupportedImportType)
+		return
+	}
+
+	options, err := importOptions(r.URL.Query())
+
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	job, err := e.imports.Start(format, r.Body, options)
+
+	if errors.Cause(err) == importjob.ErrUploadTooLarge {
+		// Don't read the rest of the file
+		w.Header().Set("Connection", "close")
+	}
+
+	if err != nil {
+		WriteError(w, r, errors.Wrap(err, "Error while starting import"))
+		return
+	}
+
+	w.Header().Set("Location", "/admin/imports/"+url.PathEscape(job.ID))
+	writeResult(w, r, http.StatusAccepted, &job, nil)
+}
+
+func (e *HttpEndpoint) handleGetImport(w http.ResponseWriter, r *http.Request) {
+	job, err := e.imports.Get(mux.Vars(r)["id"])
+	writeResult(w, r, http.StatusOK, &job, err)
+}
+
+func (e *HttpEndpoint) handleCancelImport(w http.ResponseWriter, r *http.Request) {
+	job, err := e.imports.Cancel(mux.Vars(r)["id"])
+	writeResult(w, r, http.StatusOK, &job, err)
+}
+
+func (e *HttpEndpoint) handleFailedImportRecords(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	job, err := e.imports.Get(id)
+
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	format, err := poststore.FormatByName(job.Format)
+
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	failed, err := e.imports.OpenFailed(id)
+
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	defer failed.Close()
+
+	w.Header().Set("Content-Type", format.ContentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="failed.`+format.Extensions[0]+`"`)
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := io.Copy(w, failed); err != nil {
+		logError(r, errors.Wrap(err, "Error while sending failed records"))
+	}
+}
@@ -0,0 +1,51 @@
+package endpoint
+
+import (
+	"html/template"
+
+	"github.com/abustany/back-message-board/pkg/markdown"
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+// RenderedPost is the shape of the posts served to the public, with their
+// message rendered from Markdown to HTML when enabled, see UseMarkdown.
+type RenderedPost struct {
+	types.Post
+	// Sanitized HTML rendering of the message, empty if Markdown rendering
+	// is disabled
+	MessageHTML template.HTML `json:"message_html,omitempty"`
+}
+
+// UseMarkdown renders the messages of the posts served to the public (by the
+// HTML board, the feeds and WebSocket connections) from Markdown to HTML. The
+// HTML is only rendered again when the message of a post changes, and is kept
+// in the given cache meanwhile. Messages are still stored and edited as
+// Markdown.
+func UseMarkdown(cache *markdown.Cache) Option {
+	return func(e *HttpEndpoint) {
+		e.markdown = cache
+	}
+}
+
+// renderPost returns a post along with the rendering of its message, if the
+// given cache is not nil.
+func renderPost(cache *markdown.Cache, post types.Post) RenderedPost {
+	rendered := RenderedPost{Post: post}
+
+	if cache != nil {
+		rendered.MessageHTML = template.HTML(cache.Render(post.ID, post.Message))
+	}
+
+	return rendered
+}
+
+// renderPosts is like renderPost, for a list of posts.
+func renderPosts(cache *markdown.Cache, posts []types.Post) []RenderedPost {
+	rendered := make([]RenderedPost, len(posts))
+
+	for i, post := range posts {
+		rendered[i] = renderPost(cache, post)
+	}
+
+	return rendered
+}
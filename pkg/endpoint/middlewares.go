@@ -1,14 +1,24 @@
 package endpoint
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
 
-	"github.com/abustany/back-message-board/pkg/postservice"
+	"github.com/abustany/back-message-board/pkg/challenge"
+	"github.com/abustany/back-message-board/pkg/idempotency"
+	"github.com/abustany/back-message-board/pkg/session"
 	"github.com/abustany/back-message-board/pkg/types"
 )
 
@@ -42,76 +52,323 @@ func (c *capturingResponseWriter) WriteHeader(statusCode int) {
 	c.w.WriteHeader(statusCode)
 }
 
+// Flush implements http.Flusher, for the handlers streaming their response.
+func (c *capturingResponseWriter) Flush() {
+	if flusher, ok := c.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker, for the handlers taking over the connection
+// like WebSocket ones.
+func (c *capturingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := c.w.(http.Hijacker)
+
+	if !ok {
+		return nil, nil, errors.New("The response writer does not support hijacking")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+
+	if err == nil && c.code == 0 {
+		c.code = http.StatusSwitchingProtocols
+	}
+
+	return conn, rw, err
+}
+
 // WithLogging wraps a http.Handler, writing a log message to the given logger
 // at the end of each request with the URL, returned status code, elapsed time
-// etc.
+// etc. Internal errors written with WriteError are logged as well.
 func WithLogging(logger log.Logger, handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		writer := capturingResponseWriter{w: w}
+		r, requestErr := withRequestError(r)
 
 		defer func(start time.Time) {
-			logger.Log(
+			keyvals := []interface{}{
 				"event", "api_request",
+				"request_id", RequestID(r),
 				"method", r.Method,
 				"url", r.URL.String(),
 				"status", writer.code,
 				"elapsed", time.Since(start),
-			)
+			}
+
+			if requestErr.err != nil {
+				keyvals = append(keyvals, "error", requestErr.err)
+			}
+
+			logger.Log(keyvals...)
 		}(time.Now())
 
 		handler.ServeHTTP(&writer, r)
 	})
 }
 
-// WithContentType wraps a http.Handler, rejecting requests that don't have a
-// JSON content type.
+// MergePatchContentType is the MIME type of JSON merge patches (RFC 7396).
+const MergePatchContentType = "application/merge-patch+json"
+
+// WithContentType wraps a http.Handler, rejecting requests that don't have the
+// given content type.
 func WithContentType(contentType string, handler http.Handler) http.Handler {
+	return WithContentTypes([]string{contentType}, handler)
+}
+
+// WithContentTypes wraps a http.Handler, rejecting requests that don't have
+// one of the given content types.
+func WithContentTypes(contentTypes []string, handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Header.Get("Content-Type") != JsonContentType {
-			w.WriteHeader(http.StatusBadRequest)
-			io.WriteString(w, "Invalid content type")
+		requestType := r.Header.Get("Content-Type")
+
+		for _, contentType := range contentTypes {
+			if requestType == contentType {
+				handler.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		WriteError(w, r, errInvalidContentType)
+	})
+}
+
+// WithPost adapts an http.Handler to a function handling an HTTP request where
+// the request body is a single types.Post object, decoded by the codec of the
+// request content type (see Codecs). The error returned by the function is
+// written back to the response using WriteError. If the function returns a non
+// nil body, it is written back to the response as JSON. The function can set
+// extra response headers on the ResponseWriter, but should not write to it.
+func WithPost(do func(w http.ResponseWriter, r *http.Request, post types.Post) (int, interface{}, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		codec := CodecByContentType(r.Header.Get("Content-Type"))
+
+		if codec == nil {
+			WriteError(w, r, errInvalidPostContentType)
+			return
+		}
+
+		post, err := codec.DecodePost(r.Body)
+
+		if _, ok := err.(*apiError); err != nil && !ok {
+			err = errMalformedPost
+		}
+
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		statusCode, body, err := do(w, r, post)
+		writeResult(w, r, statusCode, body, err)
+	})
+}
+
+// MaxPatchSize is the maximum size of the merge patches read by WithPostPatch.
+const MaxPatchSize = 1 << 20
+
+// WithPostPatch is like WithPost, but the request body is a JSON merge patch
+// (RFC 7396) of a post, passed to the function as the patched fields and their
+// mask. Both the merge patch and the JSON content types are accepted. Patches
+// larger than MaxPatchSize are rejected.
+func WithPostPatch(do func(w http.ResponseWriter, r *http.Request, post types.Post, fields types.FieldMask) (int, interface{}, error)) http.Handler {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxPatchSize))
+
+		if err != nil {
+			WriteError(w, r, errInvalidBody)
+			return
+		}
+
+		post, fields, err := types.DecodeMergePatch(data)
+
+		if err != nil {
+			WriteError(w, r, errInvalidJSON)
+			return
+		}
+
+		statusCode, body, err := do(w, r, post, fields)
+		writeResult(w, r, statusCode, body, err)
+	}
+
+	return WithContentTypes([]string{MergePatchContentType, JsonContentType}, http.HandlerFunc(handler))
+}
+
+// writeResult writes the result of the functions wrapped by WithPost and
+// WithPostPatch to the response.
+func writeResult(w http.ResponseWriter, r *http.Request, statusCode int, body interface{}, err error) {
+	if err != nil {
+		WriteError(w, r, err)
+	} else if body != nil {
+		w.Header().Set("Content-Type", JsonContentType)
+		w.WriteHeader(statusCode)
+		json.NewEncoder(w).Encode(body)
+	} else {
+		w.WriteHeader(statusCode)
+	}
+}
+
+// ChallengeTokenHeader is the HTTP header carrying the token of the solved
+// challenge.
+const ChallengeTokenHeader = "X-Challenge-Token"
+
+// ChallengeSolutionHeader is the HTTP header carrying the solution of the
+// challenge.
+const ChallengeSolutionHeader = "X-Challenge-Solution"
+
+// WithChallenge wraps an http.Handler, rejecting requests that don't carry a
+// valid solution to a challenge issued by the given challenger.
+func WithChallenge(challenger *challenge.Challenger, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := challenger.Verify(r.Header.Get(ChallengeTokenHeader), r.Header.Get(ChallengeSolutionHeader))
+
+		if err != nil {
+			WriteError(w, r, err)
+			return
 		}
 
 		handler.ServeHTTP(w, r)
 	})
 }
 
-// WriteError write the given error to the ResponseWriter, using the
-// appropriate HTTP status code depending on whether the error is a user or an
-// internal error.
-func WriteError(w http.ResponseWriter, err error) {
-	if userError := postservice.UserError(err); userError != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		io.WriteString(w, userError.Error())
-		return
+// IdempotencyKeyHeader is the HTTP header carrying the idempotency key of a
+// request.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotentReplayedHeader is set on responses replayed from the idempotency
+// cache.
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+// MaxIdempotencyKeyLength is the maximum length of idempotency keys.
+const MaxIdempotencyKeyLength = 255
+
+// MaxIdempotentBodySize is the maximum size of the body of requests carrying an
+// idempotency key.
+const MaxIdempotentBodySize = 1 << 20
+
+// recordingResponseWriter copies the response written to the underlying
+// ResponseWriter.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	response idempotency.Response
+	body     bytes.Buffer
+}
+
+func (r *recordingResponseWriter) WriteHeader(statusCode int) {
+	if r.response.StatusCode == 0 {
+		r.response.StatusCode = statusCode
+		r.response.Header = http.Header{}
+
+		for k, v := range r.Header() {
+			r.response.Header[k] = append([]string(nil), v...)
+		}
 	}
 
-	w.WriteHeader(http.StatusInternalServerError)
+	r.ResponseWriter.WriteHeader(statusCode)
 }
 
-// WithPost adapts an http.Handler to a function handling an HTTP request where
-// the request body is a single types.Post object. The error returned by the
-// function is written back to the response using WriteError.
-func WithPost(do func(post types.Post) (int, error)) http.Handler {
-	handler := func(w http.ResponseWriter, r *http.Request) {
-		post := types.Post{}
+func (r *recordingResponseWriter) Write(data []byte) (int, error) {
+	if r.response.StatusCode == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+
+	r.body.Write(data)
+
+	return r.ResponseWriter.Write(data)
+}
+
+// WithIdempotency wraps an http.Handler, replaying the response sent to previous
+// requests with the same idempotency key instead of processing them again.
+//
+// Requests reusing a key with a different method, path or body are rejected with
+// an HTTP 422, and requests reusing the key of a request that is still being
+// processed with an HTTP 409. Responses with a 5xx status code are not
+// remembered, so that the request can be retried. Neither are authentication
+// and challenge failures (HTTP 401 and 403), since the credentials or challenge
+// solution of a retry are not part of the fingerprint of the request, and may
+// differ.
+//
+// Keys are scoped by the address of the client, so that a client reusing the
+// key of another one does not get its response (and the edit token in it).
+func WithIdempotency(cache *idempotency.Cache, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+
+		if key == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
 
-		if err := json.NewDecoder(r.Body).Decode(&post); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			io.WriteString(w, "Malformed JSON input")
+		if len(key) > MaxIdempotencyKeyLength {
+			WriteError(w, r, errIdempotencyKeyTooLong)
 			return
 		}
 
-		statusCode, err := do(post)
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxIdempotentBodySize))
 
 		if err != nil {
-			WriteError(w, err)
-		} else {
-			w.WriteHeader(statusCode)
+			WriteError(w, r, errInvalidBody)
+			return
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		key = idempotencyScope(r) + " " + key
+
+		hash := sha256.New()
+		io.WriteString(hash, r.Method+" "+r.URL.Path+"\n")
+		hash.Write(body)
+		fingerprint := hex.EncodeToString(hash.Sum(nil))
+
+		response, err := cache.Begin(key, fingerprint)
+
+		switch err {
+		case idempotency.ErrMismatch:
+			WriteError(w, r, errIdempotencyKeyMismatch)
+			return
+		case idempotency.ErrInFlight:
+			WriteError(w, r, errIdempotencyKeyInFlight)
+			return
+		}
+
+		if response != nil {
+			for k, v := range response.Header {
+				w.Header()[k] = v
+			}
+
+			w.Header().Set(IdempotentReplayedHeader, "true")
+			w.WriteHeader(response.StatusCode)
+			w.Write(response.Body)
+			return
 		}
+
+		recorder := recordingResponseWriter{ResponseWriter: w}
+
+		defer func() {
+			status := recorder.response.StatusCode
+
+			if status == 0 || status >= 500 || status == http.StatusUnauthorized || status == http.StatusForbidden {
+				cache.Abort(key)
+				return
+			}
+
+			recorder.response.Body = recorder.body.Bytes()
+			cache.Complete(key, recorder.response)
+		}()
+
+		handler.ServeHTTP(&recorder, r)
+	})
+}
+
+// idempotencyScope returns the scope of the idempotency keys of a request: the
+// IP address of the client.
+func idempotencyScope(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
 	}
 
-	return WithContentType(JsonContentType, http.HandlerFunc(handler))
+	return host
 }
 
 // RequestAuthenticator is a common interface to all HTTP request authentication
@@ -129,12 +386,12 @@ func WithAuthentication(authenticator RequestAuthenticator, handler http.Handler
 		ok, err := authenticator.Authenticate(r)
 
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			WriteError(w, r, errors.Wrap(err, "Error while authenticating request"))
 			return
 		}
 
 		if !ok {
-			w.WriteHeader(http.StatusUnauthorized)
+			WriteError(w, r, errUnauthorized)
 			return
 		}
 
@@ -158,9 +415,67 @@ func (a *BasicAuthenticator) Authenticate(r *http.Request) (bool, error) {
 		return false, nil
 	}
 
-	if realPassword, knownUser := a.Users[username]; !knownUser || password != realPassword {
+	return a.Check(username, password), nil
+}
+
+// Check returns true if and only if the given credentials are valid.
+func (a *BasicAuthenticator) Check(username, password string) bool {
+	realPassword, knownUser := a.Users[username]
+
+	return knownUser && password == realPassword
+}
+
+// SessionCookie is the name of the cookie holding the ID of the session of a
+// user logged in to the admin console.
+const SessionCookie = "admin_session"
+
+// CSRFTokenHeader is the HTTP header carrying the CSRF token of a session, see
+// SessionAuthenticator.
+const CSRFTokenHeader = "X-CSRF-Token"
+
+// SessionAuthenticator authenticates the requests carrying the cookie of a
+// session of the given store. Since browsers send cookies with the requests
+// made by other sites, requests with other methods than GET and HEAD must also
+// carry the CSRF token of the session in the X-CSRF-Token header.
+type SessionAuthenticator struct {
+	Sessions *session.Store
+}
+
+// requestSession returns the session of a request, if any.
+func requestSession(sessions *session.Store, r *http.Request) (session.Session, bool) {
+	cookie, err := r.Cookie(SessionCookie)
+
+	if err != nil {
+		return session.Session{}, false
+	}
+
+	return sessions.Get(cookie.Value)
+}
+
+func (a *SessionAuthenticator) Authenticate(r *http.Request) (bool, error) {
+	s, ok := requestSession(a.Sessions, r)
+
+	if !ok {
 		return false, nil
 	}
 
+	if r.Method != "GET" && r.Method != "HEAD" && subtle.ConstantTimeCompare([]byte(r.Header.Get(CSRFTokenHeader)), []byte(s.CSRFToken)) != 1 {
+		return false, errInvalidCSRFToken
+	}
+
 	return true, nil
 }
+
+// AnyAuthenticator authenticates the requests accepted by any of its
+// authenticators, which are tried in order.
+type AnyAuthenticator []RequestAuthenticator
+
+func (a AnyAuthenticator) Authenticate(r *http.Request) (bool, error) {
+	for _, authenticator := range a {
+		if ok, err := authenticator.Authenticate(r); ok || err != nil {
+			return ok, err
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,177 @@
+package endpoint
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/abustany/back-message-board/pkg/events"
+	"github.com/abustany/back-message-board/pkg/postservice"
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+// EventStreamContentType is the MIME type of Server-Sent Events streams.
+const EventStreamContentType = "text/event-stream"
+
+// LastEventIDHeader is the HTTP header carrying the ID of the last event
+// received by a client reconnecting to an event stream.
+const LastEventIDHeader = "Last-Event-ID"
+
+// ResetEvent is the type of the event sent to clients reconnecting to the event
+// stream after missing events that were forgotten. They should reload the
+// posts.
+const ResetEvent = "reset"
+
+// streamKeepAlive is the interval at which comments are sent on idle event
+// streams, so that proxies don't close them.
+var streamKeepAlive = 15 * time.Second
+
+// UseEventBus enables the live feed of the admin API, which sends the events of
+// the given bus. The service of the endpoint should publish its events on that
+// bus, see postservice.WithEventBus.
+func UseEventBus(bus *events.Bus) Option {
+	return func(e *HttpEndpoint) {
+		e.events = bus
+	}
+}
+
+// stateFilter returns the set of the given post states, or nil if no state is
+// given.
+func stateFilter(states []types.PostState) (map[types.PostState]bool, error) {
+	var filter map[types.PostState]bool
+
+	for _, state := range states {
+		if !state.Valid() {
+			return nil, postservice.ErrInvalidState
+		}
+
+		if filter == nil {
+			filter = map[types.PostState]bool{}
+		}
+
+		filter[state] = true
+	}
+
+	return filter, nil
+}
+
+// streamStates reads the post states wanted by a client of the event stream. A
+// nil map means all states.
+func streamStates(params url.Values) (map[types.PostState]bool, error) {
+	var states []types.PostState
+
+	for _, param := range params["state"] {
+		for _, name := range strings.Split(param, ",") {
+			states = append(states, types.PostState(name))
+		}
+	}
+
+	return stateFilter(states)
+}
+
+// writeEvent writes an event in the Server-Sent Events format.
+func writeEvent(w io.Writer, event events.Event) error {
+	data, err := json.Marshal(&event.Post)
+
+	if err != nil {
+		return errors.Wrap(err, "Error while encoding event")
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+
+	return err
+}
+
+func (e *HttpEndpoint) handleStream(w http.ResponseWriter, r *http.Request) {
+	states, err := streamStates(r.URL.Query())
+
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		WriteError(w, r, errors.New("The response writer does not support streaming"))
+		return
+	}
+
+	var subscription *events.Subscription
+	var missed []events.Event
+	complete := true
+
+	if lastEventID := r.Header.Get(LastEventIDHeader); lastEventID != "" {
+		lastID, err := strconv.ParseUint(lastEventID, 10, 64)
+
+		if err != nil {
+			WriteError(w, r, errInvalidLastEventID)
+			return
+		}
+
+		subscription, missed, complete = e.events.SubscribeSince(lastID)
+	} else {
+		subscription = e.events.Subscribe()
+	}
+
+	defer subscription.Close()
+
+	w.Header().Set("Content-Type", EventStreamContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	if !complete {
+		fmt.Fprintf(w, "event: %s\ndata: {}\n\n", ResetEvent)
+	}
+
+	send := func(event events.Event) error {
+		if states != nil && !states[event.Post.State] {
+			return nil
+		}
+
+		return writeEvent(w, event)
+	}
+
+	for _, event := range missed {
+		if err := send(event); err != nil {
+			logError(r, err)
+			return
+		}
+	}
+
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event, ok := <-subscription.C:
+			if !ok {
+				// Too slow to keep up, the client will reconnect and
+				// get the events it missed
+				return
+			}
+
+			err = send(event)
+		case <-keepAlive.C:
+			_, err = io.WriteString(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+
+		if err != nil {
+			// The client is gone
+			return
+		}
+
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,335 @@
+package endpoint
+
+// defaultTemplates are the templates of the HTML board and of the admin
+// console, by file name. They can be overridden by files with the same names,
+// see LoadTemplates.
+var defaultTemplates = map[string]string{
+	"head.html": `{{define "head"}}<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 0 auto; padding: 1em; color: #222; }
+form p { margin: 0.5em 0; }
+label { display: block; font-weight: bold; }
+input[type=text], input[type=email], textarea { width: 100%; box-sizing: border-box; }
+textarea { height: 6em; }
+.error { color: #b00; }
+.notice { background: #efe; padding: 0.5em; }
+.post { border-top: 1px solid #ddd; padding: 0.5em 0; }
+.post .meta { color: #666; font-size: 0.9em; }
+.post .message { white-space: pre-wrap; }
+.post .message.markdown { white-space: normal; }
+.console { max-width: none; }
+.console table { border-collapse: collapse; width: 100%; }
+.console th, .console td { border-bottom: 1px solid #ddd; padding: 0.3em; text-align: left; vertical-align: top; }
+.console td.message { white-space: pre-wrap; }
+.console tr.current { background: #eef; }
+.console tr.unconfirmed { color: #666; }
+.console .toolbar { display: flex; gap: 1em; align-items: center; margin: 0.5em 0; }
+</style>
+</head>
+{{end}}`,
+
+	"header.html": `{{define "header"}}{{template "head" .}}
+<body>
+<h1><a href="/">{{.Title}}</a></h1>
+{{end}}`,
+
+	"footer.html": `{{define "footer"}}</body>
+</html>
+{{end}}`,
+
+	"board.html": `{{template "header" .}}
+{{if .Notice}}<p class="notice">{{.Notice}}</p>{{end}}
+{{if .EditToken}}<p class="notice">Keep the edit token of your message, it is not shown again: <code>{{.EditToken}}</code>. It lets you edit or delete the message <code>{{.PostID}}</code> through <code>/posts/{{.PostID}}</code>, in the X-Edit-Token header.</p>{{end}}
+<form id="post-form" method="post" action="/">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+{{with .Form.Error}}<p class="error">{{.}}</p>{{end}}
+<p>
+<label for="author">Name</label>
+<input type="text" id="author" name="author" value="{{.Form.Author}}" required>
+{{with index .Form.Errors "author"}}<span class="error">{{.}}</span>{{end}}
+</p>
+<p>
+<label for="email">Email (not shown)</label>
+<input type="email" id="email" name="email" value="{{.Form.Email}}" required>
+{{with index .Form.Errors "email"}}<span class="error">{{.}}</span>{{end}}
+</p>
+<p>
+<label for="message">Message</label>
+<textarea id="message" name="message">{{.Form.Message}}</textarea>
+{{with index .Form.Errors "message"}}<span class="error">{{.}}</span>{{end}}
+</p>
+{{with .Challenge}}
+<input type="hidden" name="challenge_token" value="{{.Token}}">
+<input type="hidden" name="challenge_solution" value="">
+<script>
+(function() {
+  var form = document.getElementById("post-form");
+  var difficulty = {{.Difficulty}};
+
+  function zeroBits(bytes) {
+    var n = 0;
+    for (var i = 0; i < bytes.length; i++) {
+      if (bytes[i] === 0) { n += 8; continue; }
+      for (var b = bytes[i]; !(b & 0x80); b <<= 1) { n++; }
+      break;
+    }
+    return n;
+  }
+
+  form.addEventListener("submit", function(event) {
+    if (form.challenge_solution.value) { return; }
+    event.preventDefault();
+    var encoder = new TextEncoder(), token = form.challenge_token.value, n = 0;
+    (function attempt() {
+      crypto.subtle.digest("SHA-256", encoder.encode(token + ":" + n)).then(function(hash) {
+        if (zeroBits(new Uint8Array(hash)) >= difficulty) {
+          form.challenge_solution.value = String(n);
+          form.submit();
+        } else {
+          n++;
+          attempt();
+        }
+      });
+    })();
+  });
+})();
+</script>
+{{end}}
+<p><button type="submit">Post</button></p>
+</form>
+{{range .Posts}}
+<div class="post" id="post-{{.ID}}">
+<div class="meta"><strong>{{.Author}}</strong>, <time datetime="{{.Created.UTC.Format "2006-01-02T15:04:05Z07:00"}}">{{.Created.UTC.Format "2 Jan 2006 15:04 MST"}}</time></div>
+{{if .MessageHTML}}<div class="message markdown">{{.MessageHTML}}</div>{{else}}<div class="message">{{.Message}}</div>{{end}}
+</div>
+{{else}}
+<p>No messages yet.</p>
+{{end}}
+<p>
+{{if .Cursor}}<a href="/">Newest messages</a>{{end}}
+{{if .Next}}<a href="/?cursor={{.Next}}">Older messages</a>{{end}}
+</p>
+{{template "footer" .}}`,
+
+	"error.html": `{{template "header" .}}
+<h2>{{.Status}} {{.StatusText}}</h2>
+<p>{{.Detail}}</p>
+<p><small>Request ID: {{.RequestID}}</small></p>
+{{template "footer" .}}`,
+
+	"login.html": `{{template "head" .}}
+<body>
+<h1>{{.Title}}</h1>
+<form method="post" action="/admin/login">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+{{with .Error}}<p class="error">{{.}}</p>{{end}}
+<p>
+<label for="username">Username</label>
+<input type="text" id="username" name="username" value="{{.Username}}" required autofocus>
+</p>
+<p>
+<label for="password">Password</label>
+<input type="password" id="password" name="password" required>
+</p>
+<p><button type="submit">Log in</button></p>
+</form>
+{{template "footer" .}}`,
+
+	"console.html": `{{template "head" .}}
+<body class="console" data-csrf-token="{{.CSRFToken}}">
+<div class="toolbar">
+<h1>{{.Title}}</h1>
+<span>{{.User}}</span>
+<form method="post" action="/admin/logout">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<button type="submit">Log out</button>
+</form>
+</div>
+<form class="toolbar" method="get" action="/admin/console">
+<select name="state">
+<option value="">All states</option>
+{{range .States}}<option value="{{.}}"{{if eq . $.State}} selected{{end}}>{{.}}</option>{{end}}
+</select>
+<input type="search" name="q" value="{{.Query}}" placeholder="Author, email or message">
+<button type="submit">Filter</button>
+</form>
+<div class="toolbar">
+<button type="button" data-bulk="approve">Approve selected</button>
+<button type="button" data-bulk="unpublish">Unpublish selected</button>
+<button type="button" data-bulk="reject">Reject selected</button>
+<small>Keys: j/k move, x select, a approve, r reject, e edit, Esc cancel</small>
+</div>
+<p class="error" id="console-error"></p>
+<table>
+<thead><tr><th></th><th>Date</th><th>Author</th><th>Email</th><th>State</th><th>Message</th><th></th></tr></thead>
+<tbody>
+{{range .Posts}}
+<tr class="post-row {{.State}}" data-id="{{.ID}}">
+<td><input type="checkbox" class="select"></td>
+<td><time datetime="{{.Created.UTC.Format "2006-01-02T15:04:05Z07:00"}}">{{.Created.UTC.Format "2006-01-02 15:04"}}</time></td>
+<td>{{.Author}}</td>
+<td>{{.Email}}</td>
+<td class="state">{{.State}}</td>
+<td class="message">{{.Message}}</td>
+<td>
+<button type="button" data-action="edit">Edit</button>
+<button type="button" data-action="approve">Approve</button>
+<button type="button" data-action="reject">Reject</button>
+</td>
+</tr>
+{{else}}
+<tr><td colspan="7">No matching posts.</td></tr>
+{{end}}
+</tbody>
+</table>
+<p>
+{{if .Cursor}}<a href="/admin/console?state={{.State}}&amp;q={{.Query}}">Newest posts</a>{{end}}
+{{if .Next}}<a href="/admin/console?state={{.State}}&amp;q={{.Query}}&amp;cursor={{.Next}}">Older posts</a>{{end}}
+</p>
+<script>
+(function() {
+  var csrfToken = document.body.dataset.csrfToken;
+  var rows = Array.prototype.slice.call(document.querySelectorAll("tr.post-row"));
+  var current = rows.length > 0 ? 0 : -1;
+  var editing = null;
+
+  function showError(message) {
+    document.getElementById("console-error").textContent = message || "";
+  }
+
+  function request(method, path, contentType, body) {
+    return fetch(path, {
+      method: method,
+      credentials: "same-origin",
+      headers: {"Content-Type": contentType, "X-CSRF-Token": csrfToken},
+      body: JSON.stringify(body)
+    }).then(function(response) {
+      return response.json().then(function(result) {
+        if (!response.ok) { throw new Error(result.detail || result.title); }
+        return result;
+      });
+    });
+  }
+
+  function setCurrent(index) {
+    if (index < 0 || index >= rows.length) { return; }
+    if (current >= 0) { rows[current].classList.remove("current"); }
+    current = index;
+    rows[current].classList.add("current");
+    rows[current].scrollIntoView({block: "nearest"});
+  }
+
+  function removeRow(row) {
+    var index = rows.indexOf(row);
+    row.parentNode.removeChild(row);
+    rows.splice(index, 1);
+    current = -1;
+    setCurrent(Math.min(index, rows.length - 1));
+  }
+
+  function showPost(row, post) {
+    row.className = "post-row " + post.state + (rows[current] === row ? " current" : "");
+    row.querySelector(".state").textContent = post.state;
+    row.querySelector(".message").textContent = post.message;
+  }
+
+  // batch applies an action ("approve", "unpublish" or "reject") to rows
+  function batch(action, targets) {
+    if (targets.length === 0) { return; }
+    if (action === "reject" && !confirm("Delete " + targets.length + " post(s)?")) { return; }
+
+    var operations = targets.map(function(row) {
+      if (action === "reject") { return {action: "delete", id: row.dataset.id}; }
+      return {action: "set_state", id: row.dataset.id, state: action === "approve" ? "published" : "unconfirmed"};
+    });
+
+    request("POST", "/admin/posts:batch", "application/json", {operations: operations}).then(function(response) {
+      var errors = [];
+      response.results.forEach(function(result, i) {
+        if (result.error) {
+          errors.push(result.error.detail);
+        } else if (action === "reject") {
+          removeRow(targets[i]);
+        } else {
+          showPost(targets[i], result.post);
+        }
+      });
+      showError(errors.join(", "));
+    }, function(err) { showError(err.message); });
+  }
+
+  function edit(row) {
+    if (editing) { return; }
+    var cell = row.querySelector(".message");
+    var textarea = document.createElement("textarea");
+    textarea.value = cell.textContent;
+    editing = {row: row, original: cell.textContent};
+    cell.textContent = "";
+    cell.appendChild(textarea);
+    textarea.focus();
+    textarea.addEventListener("keydown", function(event) {
+      if (event.key === "Enter" && (event.ctrlKey || event.metaKey)) {
+        event.preventDefault();
+        save();
+      }
+    });
+  }
+
+  function cancelEdit() {
+    if (!editing) { return; }
+    editing.row.querySelector(".message").textContent = editing.original;
+    editing = null;
+  }
+
+  function save() {
+    var row = editing.row;
+    var message = row.querySelector(".message textarea").value;
+    request("PATCH", "/admin/posts/" + encodeURIComponent(row.dataset.id), "application/merge-patch+json", {message: message}).then(function(post) {
+      editing = null;
+      showPost(row, post);
+      showError("");
+    }, function(err) { showError(err.message); });
+  }
+
+  function selected() {
+    return rows.filter(function(row) { return row.querySelector(".select").checked; });
+  }
+
+  document.querySelectorAll("button[data-bulk]").forEach(function(button) {
+    button.addEventListener("click", function() { batch(button.dataset.bulk, selected()); });
+  });
+
+  rows.forEach(function(row) {
+    row.addEventListener("click", function() { setCurrent(rows.indexOf(row)); });
+    row.querySelectorAll("button[data-action]").forEach(function(button) {
+      button.addEventListener("click", function() {
+        if (button.dataset.action === "edit") { edit(row); } else { batch(button.dataset.action, [row]); }
+      });
+    });
+  });
+
+  document.addEventListener("keydown", function(event) {
+    if (event.key === "Escape") { cancelEdit(); return; }
+    if (editing || event.ctrlKey || event.metaKey || event.altKey || /^(INPUT|TEXTAREA|SELECT)$/.test(event.target.tagName)) { return; }
+    var row = rows[current];
+    switch (event.key) {
+    case "j": setCurrent(current + 1); break;
+    case "k": setCurrent(current - 1); break;
+    case "x": if (row) { var box = row.querySelector(".select"); box.checked = !box.checked; } break;
+    case "a": batch("approve", selected().length > 0 ? selected() : row ? [row] : []); break;
+    case "r": batch("reject", selected().length > 0 ? selected() : row ? [row] : []); break;
+    case "e": if (row) { event.preventDefault(); edit(row); } break;
+    default: return;
+    }
+  });
+
+  setCurrent(current);
+})();
+</script>
+{{template "footer" .}}`,
+}
@@ -0,0 +1,45 @@
+package endpoint
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/abustany/back-message-board/pkg/webhook"
+)
+
+// UseWebhookDispatcher enables the webhook API, which shows the webhooks of the
+// given dispatcher and their deliveries.
+func UseWebhookDispatcher(dispatcher *webhook.Dispatcher) Option {
+	return func(e *HttpEndpoint) {
+		e.webhooks = dispatcher
+	}
+}
+
+func (e *HttpEndpoint) handleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhooks := e.webhooks.Webhooks()
+
+	if webhooks == nil {
+		webhooks = []webhook.Webhook{}
+	}
+
+	writeResult(w, r, http.StatusOK, webhooks, nil)
+}
+
+func (e *HttpEndpoint) handleListDeliveries(w http.ResponseWriter, r *http.Request) {
+	state := webhook.State(r.URL.Query().Get("state"))
+
+	if state != "" && state != webhook.StatePending && state != webhook.StateFailed {
+		WriteError(w, r, errInvalidDeliveryState)
+		return
+	}
+
+	deliveries, err := e.webhooks.Deliveries(mux.Vars(r)["id"], state)
+	writeResult(w, r, http.StatusOK, deliveries, err)
+}
+
+func (e *HttpEndpoint) handleRetryDelivery(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	delivery, err := e.webhooks.Retry(vars["id"], vars["delivery"])
+	writeResult(w, r, http.StatusOK, &delivery, err)
+}
@@ -0,0 +1,322 @@
+package endpoint
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/websocket"
+
+	"github.com/abustany/back-message-board/pkg/events"
+	"github.com/abustany/back-message-board/pkg/markdown"
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+// Types of the messages exchanged over WebSocket connections, see
+// SocketMessage.
+const (
+	// Sent by clients to start receiving events, and by the server to
+	// acknowledge it
+	SocketSubscribe = "subscribe"
+	// Sent by clients to stop receiving events, and by the server to
+	// acknowledge it
+	SocketUnsubscribe = "unsubscribe"
+	// Sent by clients to keep the connection open
+	SocketPing = "ping"
+	// Sent by the server in reply to pings
+	SocketPong = "pong"
+	// Sent by the server for each event
+	SocketEvent = "event"
+	// Sent by the server when the client missed events that were forgotten,
+	// see GET /admin/stream
+	SocketReset = "reset"
+	// Sent by the server when a message is invalid, or before closing the
+	// connection of a client that is too slow
+	SocketError = "error"
+)
+
+// SocketMessage is a JSON message exchanged over WebSocket connections.
+type SocketMessage struct {
+	// One of the Socket* constants
+	Type string `json:"type"`
+	// States of the posts whose events are sent, for subscribe messages sent
+	// by clients. Public clients can only receive events of published posts,
+	// which is also the default for them. Privileged clients receive the
+	// events of all posts by default.
+	States []types.PostState `json:"states,omitempty"`
+	// IDs of the posts whose events are sent, for subscribe messages sent by
+	// clients, all posts if empty. The message board is a single board
+	// without threads, so following a set of posts is the closest to
+	// subscribing to a thread.
+	PostIDs []string `json:"post_ids,omitempty"`
+	// ID of the last event received, for subscribe messages sent by clients
+	// reconnecting, or ID of the event for event messages
+	LastEventID uint64 `json:"last_event_id,omitempty"`
+	ID          uint64 `json:"id,omitempty"`
+	// Type of the event, and post after the change (before it for deleted
+	// posts), for event messages. The email address of the post is only sent
+	// to privileged clients. Posts leaving the states the client subscribed
+	// to are sent as deleted events, with only their ID.
+	Event events.Type   `json:"event,omitempty"`
+	Post  *RenderedPost `json:"post,omitempty"`
+	// Error code and description, for error messages
+	Code  string `json:"code,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// MaxSocketMessageSize is the maximum size of the messages sent by clients over
+// WebSocket connections.
+const MaxSocketMessageSize = 4096
+
+// SocketIdleTimeout is the duration after which WebSocket connections are
+// closed if the client sent nothing. Clients should send pings more often than
+// that.
+const SocketIdleTimeout = time.Minute
+
+// socketWriteTimeout is the maximum duration of a write to a WebSocket
+// connection.
+var socketWriteTimeout = 10 * time.Second
+
+// socketSession is a WebSocket connection, along with its subscription.
+type socketSession struct {
+	conn       *websocket.Conn
+	bus        *events.Bus
+	markdown   *markdown.Cache
+	privileged bool
+	// Events of the subscription, nil when not subscribed
+	subscription *events.Subscription
+	updates      <-chan events.Event
+	states       map[types.PostState]bool
+	// IDs of the posts whose events are sent, nil for all posts
+	postIDs map[string]bool
+}
+
+// socketHandler returns the handler of WebSocket connections. Privileged
+// connections get the events of all posts, while public ones only get the
+// events of published posts. Public connections can come from any origin.
+func (e *HttpEndpoint) socketHandler(privileged bool) http.Handler {
+	server := websocket.Server{
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			if !privileged {
+				return nil
+			}
+
+			// Prevents other sites from using the credentials cached by
+			// the browser
+			origin, err := websocket.Origin(config, r)
+
+			if err == nil && origin != nil && origin.Host != r.Host {
+				err = errors.Errorf("Origin %s not allowed", origin)
+			}
+
+			return err
+		},
+		Handler: func(conn *websocket.Conn) {
+			session := socketSession{conn: conn, bus: e.events, markdown: e.markdown, privileged: privileged}
+			session.serve()
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			WriteError(w, r, errWebSocketRequired)
+			return
+		}
+
+		server.ServeHTTP(w, r)
+	})
+}
+
+// send writes a message to the connection.
+func (s *socketSession) send(message SocketMessage) error {
+	s.conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+	return websocket.JSON.Send(s.conn, &message)
+}
+
+// sendError writes an error message to the connection.
+func (s *socketSession) sendError(code, description string) error {
+	return s.send(SocketMessage{Type: SocketError, Code: code, Error: description})
+}
+
+// sendEvent writes an event to the connection, if the client wants it. Clients
+// that got the post before an update moved it out of the states they want get
+// a deleted event instead, whose post only carries the ID.
+func (s *socketSession) sendEvent(event events.Event) error {
+	if s.postIDs != nil && !s.postIDs[event.Post.ID] {
+		return nil
+	}
+
+	if !s.states[event.Post.State] {
+		if event.Type != events.Updated || !s.states[event.PreviousState] {
+			return nil
+		}
+
+		post := RenderedPost{Post: types.Post{ID: event.Post.ID}}
+
+		return s.send(SocketMessage{Type: SocketEvent, ID: event.ID, Event: events.Deleted, Post: &post})
+	}
+
+	if !s.privileged {
+		event.Post.Email = ""
+	}
+
+	post := renderPost(s.markdown, event.Post)
+
+	return s.send(SocketMessage{Type: SocketEvent, ID: event.ID, Event: event.Type, Post: &post})
+}
+
+// receive reads the messages sent by the client, until the connection is
+// closed or done is closed. Messages that are not valid JSON are passed as
+// messages without type.
+func (s *socketSession) receive(messages chan<- SocketMessage, done <-chan struct{}) {
+	defer close(messages)
+
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(SocketIdleTimeout))
+
+		var message SocketMessage
+		err := websocket.JSON.Receive(s.conn, &message)
+
+		switch err.(type) {
+		case nil:
+		case *json.SyntaxError, *json.UnmarshalTypeError:
+			message = SocketMessage{}
+		default:
+			return
+		}
+
+		select {
+		case messages <- message:
+		case <-done:
+			return
+		}
+	}
+}
+
+// serve handles the connection until it is closed.
+func (s *socketSession) serve() {
+	defer s.conn.Close()
+	defer s.unsubscribe()
+
+	s.conn.MaxPayloadBytes = MaxSocketMessageSize
+
+	messages := make(chan SocketMessage)
+	done := make(chan struct{})
+	defer close(done)
+
+	go s.receive(messages, done)
+
+	for {
+		var err error
+
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+
+			err = s.handle(message)
+		case event, ok := <-s.updates:
+			if !ok {
+				// The client will reconnect and get the events it missed
+				s.sendError("too_slow", "Events were sent faster than they were read")
+				return
+			}
+
+			err = s.sendEvent(event)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handle handles a message sent by the client.
+func (s *socketSession) handle(message SocketMessage) error {
+	switch message.Type {
+	case SocketPing:
+		return s.send(SocketMessage{Type: SocketPong})
+	case SocketSubscribe:
+		return s.subscribe(message)
+	case SocketUnsubscribe:
+		s.unsubscribe()
+		return s.send(SocketMessage{Type: SocketUnsubscribe})
+	}
+
+	return s.sendError("invalid_message", "Invalid message (should be a JSON object with a type of subscribe, unsubscribe or ping)")
+}
+
+// subscribe handles a subscribe message, replacing the current subscription if
+// any.
+func (s *socketSession) subscribe(message SocketMessage) error {
+	states, err := stateFilter(message.States)
+
+	if err != nil {
+		return s.sendError("invalid_state", "Invalid state")
+	}
+
+	if states == nil {
+		states = map[types.PostState]bool{types.StatePublished: true}
+
+		if s.privileged {
+			states[types.StateUnconfirmed] = true
+		}
+	}
+
+	if !s.privileged && (len(states) != 1 || !states[types.StatePublished]) {
+		return s.sendError("unauthorized", "Only the events of published posts can be received without credentials")
+	}
+
+	s.unsubscribe()
+	s.states = states
+	s.postIDs = nil
+
+	if len(message.PostIDs) > 0 {
+		s.postIDs = make(map[string]bool, len(message.PostIDs))
+
+		for _, id := range message.PostIDs {
+			s.postIDs[id] = true
+		}
+	}
+
+	var missed []events.Event
+	complete := true
+
+	if message.LastEventID > 0 {
+		s.subscription, missed, complete = s.bus.SubscribeSince(message.LastEventID)
+	} else {
+		s.subscription = s.bus.Subscribe()
+	}
+
+	s.updates = s.subscription.C
+
+	if err := s.send(SocketMessage{Type: SocketSubscribe}); err != nil {
+		return err
+	}
+
+	if !complete {
+		if err := s.send(SocketMessage{Type: SocketReset}); err != nil {
+			return err
+		}
+	}
+
+	for _, event := range missed {
+		if err := s.sendEvent(event); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unsubscribe closes the current subscription, if any.
+func (s *socketSession) unsubscribe() {
+	if s.subscription != nil {
+		s.subscription.Close()
+		s.subscription = nil
+		s.updates = nil
+	}
+}
@@ -0,0 +1,203 @@
+// Package events broadcasts the changes made to posts to the parties
+// interested in them, like the live feed of the admin API.
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+// Type is the kind of change described by an Event.
+type Type string
+
+const (
+	// Created is the type of events published when a post is added.
+	Created Type = "created"
+
+	// Updated is the type of events published when a post is modified.
+	Updated Type = "updated"
+
+	// Deleted is the type of events published when a post is removed.
+	Deleted Type = "deleted"
+)
+
+// Event describes a change made to a post.
+type Event struct {
+	// Identifies the event, events published later have greater IDs
+	ID   uint64
+	Type Type
+	Time time.Time
+	// Post after the change, or before it for deleted posts
+	Post types.Post
+	// State of the post before the change, for updated events
+	PreviousState types.PostState
+}
+
+// DefaultHistorySize is the number of events remembered by a Bus created with
+// a size of 0.
+const DefaultHistorySize = 1000
+
+// SubscriptionBuffer is the number of events that can wait for a subscriber
+// before it is considered too slow, and its subscription closed.
+const SubscriptionBuffer = 256
+
+// Subscription receives the events published on a Bus after it was created.
+type Subscription struct {
+	bus *Bus
+	// Closed when the subscription is closed, by the subscriber or because it
+	// could not keep up with the events
+	C <-chan Event
+	c chan Event
+}
+
+// Close stops the subscription. The events that were already sent to C can
+// still be read.
+func (s *Subscription) Close() {
+	s.bus.Lock()
+	defer s.bus.Unlock()
+
+	s.bus.unsubscribe(s)
+}
+
+// Bus sends the events published on it to its subscribers, and remembers a
+// bounded number of past events so that subscribers can catch up with the
+// events they missed.
+type Bus struct {
+	sync.Mutex
+	// Past events, in a ring buffer starting at first
+	history []Event
+	first   int
+	lastID  uint64
+	// Subscriptions that are not closed
+	subscriptions map[*Subscription]struct{}
+}
+
+// NewBus returns a Bus remembering the last historySize events, or
+// DefaultHistorySize if historySize is 0.
+func NewBus(historySize int) *Bus {
+	if historySize <= 0 {
+		historySize = DefaultHistorySize
+	}
+
+	return &Bus{
+		history:       make([]Event, 0, historySize),
+		subscriptions: map[*Subscription]struct{}{},
+	}
+}
+
+// Publish sends a new event to the subscribers, and returns it. Subscribers
+// whose buffer is full are unsubscribed instead of blocking the publisher.
+func (b *Bus) Publish(eventType Type, post types.Post) Event {
+	return b.publish(Event{Type: eventType, Post: post})
+}
+
+// PublishUpdate is like Publish for an updated post, remembering the state of
+// the post before the change.
+func (b *Bus) PublishUpdate(before, after types.Post) Event {
+	return b.publish(Event{Type: Updated, Post: after, PreviousState: before.State})
+}
+
+// publish numbers an event and sends it to the subscribers.
+func (b *Bus) publish(event Event) Event {
+	b.Lock()
+	defer b.Unlock()
+
+	b.lastID++
+
+	event.ID = b.lastID
+	event.Time = time.Now()
+	event.Post.EditTokenHash = ""
+
+	if len(b.history) < cap(b.history) {
+		b.history = append(b.history, event)
+	} else {
+		b.history[b.first] = event
+		b.first = (b.first + 1) % len(b.history)
+	}
+
+	for s := range b.subscriptions {
+		select {
+		case s.c <- event:
+		default:
+			b.unsubscribe(s)
+		}
+	}
+
+	return event
+}
+
+// unsubscribe closes a subscription. It should be called with the lock held.
+func (b *Bus) unsubscribe(s *Subscription) {
+	if _, subscribed := b.subscriptions[s]; subscribed {
+		delete(b.subscriptions, s)
+		close(s.c)
+	}
+}
+
+// subscribe registers a new subscription. It should be called with the lock
+// held.
+func (b *Bus) subscribe() *Subscription {
+	c := make(chan Event, SubscriptionBuffer)
+	s := &Subscription{bus: b, C: c, c: c}
+	b.subscriptions[s] = struct{}{}
+
+	return s
+}
+
+// Subscribe returns a new subscription to the events published from now on.
+func (b *Bus) Subscribe() *Subscription {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.subscribe()
+}
+
+// SubscribeSince returns a new subscription to the events published from now
+// on, along with the remembered events published after the one with the given
+// ID. complete is false if some of the events after lastID were forgotten (or
+// if lastID was not published by this bus), in which case all the remembered
+// events are returned.
+func (b *Bus) SubscribeSince(lastID uint64) (s *Subscription, missed []Event, complete bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	s = b.subscribe()
+
+	if lastID > b.lastID {
+		// The bus was probably recreated since, the subscriber missed
+		// everything
+		return s, b.since(0), false
+	}
+
+	missed = b.since(lastID)
+	// Events are numbered without gaps, so the history is complete if it
+	// holds the event following lastID
+	complete = lastID == b.lastID || (len(missed) > 0 && missed[0].ID == lastID+1)
+
+	return s, missed, complete
+}
+
+// since returns the remembered events published after the one with the given
+// ID. It should be called with the lock held.
+func (b *Bus) since(lastID uint64) []Event {
+	var events []Event
+
+	for i := range b.history {
+		if event := b.history[(b.first+i)%len(b.history)]; event.ID > lastID {
+			events = append(events, event)
+		}
+	}
+
+	return events
+}
+
+// LastID returns the ID of the last published event, or 0 if no event was
+// published yet.
+func (b *Bus) LastID() uint64 {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.lastID
+}
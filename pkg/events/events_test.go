@@ -0,0 +1,120 @@
+package events_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/abustany/back-message-board/pkg/events"
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+func publish(bus *events.Bus, n int) {
+	for i := 0; i < n; i++ {
+		bus.Publish(events.Created, types.Post{ID: fmt.Sprintf("ID%d", i), EditTokenHash: "hash"})
+	}
+}
+
+func checkIDs(t *testing.T, events []events.Event, first, last uint64) {
+	if len(events) != int(last-first+1) {
+		t.Fatalf("Unexpected number of events: got %d, expected %d", len(events), last-first+1)
+	}
+
+	for i, event := range events {
+		if event.ID != first+uint64(i) {
+			t.Errorf("Unexpected event ID at index %d: got %d, expected %d", i, event.ID, first+uint64(i))
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	bus := events.NewBus(10)
+	publish(bus, 3)
+
+	subscription := bus.Subscribe()
+	publish(bus, 2)
+	subscription.Close()
+
+	var received []events.Event
+
+	for event := range subscription.C {
+		received = append(received, event)
+	}
+
+	checkIDs(t, received, 4, 5)
+
+	if received[0].Type != events.Created || received[0].Post.ID != "ID0" || received[0].Post.EditTokenHash != "" {
+		t.Errorf("Unexpected event: %+v", received[0])
+	}
+
+	// Closing twice does nothing
+	subscription.Close()
+
+	if bus.LastID() != 5 {
+		t.Errorf("Unexpected last ID: %d", bus.LastID())
+	}
+
+	before := types.Post{ID: "ID0", State: types.StatePublished}
+	after := types.Post{ID: "ID0", State: types.StateUnconfirmed, EditTokenHash: "hash"}
+
+	if event := bus.PublishUpdate(before, after); event.ID != 6 || event.Type != events.Updated || event.Post.State != types.StateUnconfirmed || event.PreviousState != types.StatePublished || event.Post.EditTokenHash != "" {
+		t.Errorf("Unexpected update event: %+v", event)
+	}
+}
+
+func TestSubscribeSince(t *testing.T) {
+	bus := events.NewBus(10)
+	publish(bus, 15)
+
+	testData := []struct {
+		lastID      uint64
+		first, last uint64
+		complete    bool
+	}{
+		{15, 16, 15, true},
+		{10, 11, 15, true},
+		{5, 6, 15, true},
+		{4, 6, 15, false},
+		{0, 6, 15, false},
+		{20, 6, 15, false},
+	}
+
+	for _, d := range testData {
+		subscription, missed, complete := bus.SubscribeSince(d.lastID)
+		subscription.Close()
+
+		if complete != d.complete {
+			t.Errorf("Unexpected completeness for last ID %d: %v", d.lastID, complete)
+		}
+
+		checkIDs(t, missed, d.first, d.last)
+	}
+
+	subscription, missed, complete := events.NewBus(10).SubscribeSince(0)
+	subscription.Close()
+
+	if len(missed) != 0 || !complete {
+		t.Errorf("Unexpected result for an empty bus: %v, %v", missed, complete)
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	bus := events.NewBus(0)
+	slow := bus.Subscribe()
+	fast := bus.Subscribe()
+	defer fast.Close()
+
+	for i := 0; i < events.SubscriptionBuffer+1; i++ {
+		publish(bus, 1)
+		<-fast.C
+	}
+
+	n := 0
+
+	for range slow.C {
+		n++
+	}
+
+	if n != events.SubscriptionBuffer {
+		t.Errorf("Unexpected number of events received by a slow subscriber: %d", n)
+	}
+}
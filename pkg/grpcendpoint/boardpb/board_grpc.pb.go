@@ -0,0 +1,300 @@
+// gRPC API of the message board. It mirrors the admin REST API, see the
+// README for the semantics of each call.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: board.proto
+
+package boardpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	MessageBoard_Get_FullMethodName    = "/messageboard.v1.MessageBoard/Get"
+	MessageBoard_Add_FullMethodName    = "/messageboard.v1.MessageBoard/Add"
+	MessageBoard_Update_FullMethodName = "/messageboard.v1.MessageBoard/Update"
+	MessageBoard_List_FullMethodName   = "/messageboard.v1.MessageBoard/List"
+	MessageBoard_Watch_FullMethodName  = "/messageboard.v1.MessageBoard/Watch"
+)
+
+// MessageBoardClient is the client API for MessageBoard service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type MessageBoardClient interface {
+	// Get returns the post with the given ID, or a NOT_FOUND error.
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*Post, error)
+	// Add creates a new post. The ID and creation time of the post are set by
+	// the server.
+	Add(ctx context.Context, in *AddRequest, opts ...grpc.CallOption) (*AddResponse, error)
+	// Update updates the fields of a post given by the update mask.
+	Update(ctx context.Context, in *UpdateRequest, opts ...grpc.CallOption) (*Post, error)
+	// List returns a page of posts, most recent first.
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error)
+	// Watch streams the events of the posts as they happen.
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (MessageBoard_WatchClient, error)
+}
+
+type messageBoardClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMessageBoardClient(cc grpc.ClientConnInterface) MessageBoardClient {
+	return &messageBoardClient{cc}
+}
+
+func (c *messageBoardClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*Post, error) {
+	out := new(Post)
+	err := c.cc.Invoke(ctx, MessageBoard_Get_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *messageBoardClient) Add(ctx context.Context, in *AddRequest, opts ...grpc.CallOption) (*AddResponse, error) {
+	out := new(AddResponse)
+	err := c.cc.Invoke(ctx, MessageBoard_Add_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *messageBoardClient) Update(ctx context.Context, in *UpdateRequest, opts ...grpc.CallOption) (*Post, error) {
+	out := new(Post)
+	err := c.cc.Invoke(ctx, MessageBoard_Update_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *messageBoardClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error) {
+	out := new(ListResponse)
+	err := c.cc.Invoke(ctx, MessageBoard_List_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *messageBoardClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (MessageBoard_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &MessageBoard_ServiceDesc.Streams[0], MessageBoard_Watch_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &messageBoardWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type MessageBoard_WatchClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type messageBoardWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *messageBoardWatchClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// MessageBoardServer is the server API for MessageBoard service.
+// All implementations must embed UnimplementedMessageBoardServer
+// for forward compatibility
+type MessageBoardServer interface {
+	// Get returns the post with the given ID, or a NOT_FOUND error.
+	Get(context.Context, *GetRequest) (*Post, error)
+	// Add creates a new post. The ID and creation time of the post are set by
+	// the server.
+	Add(context.Context, *AddRequest) (*AddResponse, error)
+	// Update updates the fields of a post given by the update mask.
+	Update(context.Context, *UpdateRequest) (*Post, error)
+	// List returns a page of posts, most recent first.
+	List(context.Context, *ListRequest) (*ListResponse, error)
+	// Watch streams the events of the posts as they happen.
+	Watch(*WatchRequest, MessageBoard_WatchServer) error
+	mustEmbedUnimplementedMessageBoardServer()
+}
+
+// UnimplementedMessageBoardServer must be embedded to have forward compatible implementations.
+type UnimplementedMessageBoardServer struct {
+}
+
+func (UnimplementedMessageBoardServer) Get(context.Context, *GetRequest) (*Post, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedMessageBoardServer) Add(context.Context, *AddRequest) (*AddResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Add not implemented")
+}
+func (UnimplementedMessageBoardServer) Update(context.Context, *UpdateRequest) (*Post, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Update not implemented")
+}
+func (UnimplementedMessageBoardServer) List(context.Context, *ListRequest) (*ListResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedMessageBoardServer) Watch(*WatchRequest, MessageBoard_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedMessageBoardServer) mustEmbedUnimplementedMessageBoardServer() {}
+
+// UnsafeMessageBoardServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to MessageBoardServer will
+// result in compilation errors.
+type UnsafeMessageBoardServer interface {
+	mustEmbedUnimplementedMessageBoardServer()
+}
+
+func RegisterMessageBoardServer(s grpc.ServiceRegistrar, srv MessageBoardServer) {
+	s.RegisterService(&MessageBoard_ServiceDesc, srv)
+}
+
+func _MessageBoard_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MessageBoardServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MessageBoard_Get_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MessageBoardServer).Get(ctx, req.(*GetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MessageBoard_Add_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MessageBoardServer).Add(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MessageBoard_Add_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MessageBoardServer).Add(ctx, req.(*AddRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MessageBoard_Update_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MessageBoardServer).Update(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MessageBoard_Update_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MessageBoardServer).Update(ctx, req.(*UpdateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MessageBoard_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MessageBoardServer).List(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MessageBoard_List_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MessageBoardServer).List(ctx, req.(*ListRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MessageBoard_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MessageBoardServer).Watch(m, &messageBoardWatchServer{stream})
+}
+
+type MessageBoard_WatchServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type messageBoardWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *messageBoardWatchServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// MessageBoard_ServiceDesc is the grpc.ServiceDesc for MessageBoard service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var MessageBoard_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "messageboard.v1.MessageBoard",
+	HandlerType: (*MessageBoardServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Get",
+			Handler:    _MessageBoard_Get_Handler,
+		},
+		{
+			MethodName: "Add",
+			Handler:    _MessageBoard_Add_Handler,
+		},
+		{
+			MethodName: "Update",
+			Handler:    _MessageBoard_Update_Handler,
+		},
+		{
+			MethodName: "List",
+			Handler:    _MessageBoard_List_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       _MessageBoard_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "board.proto",
+}
@@ -0,0 +1,5 @@
+// Package boardpb holds the messages and the gRPC service of the message
+// board, generated from board.proto.
+package boardpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative board.proto
@@ -0,0 +1,270 @@
+package grpcendpoint_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+
+	"github.com/abustany/back-message-board/pkg/events"
+	"github.com/abustany/back-message-board/pkg/grpcendpoint"
+	"github.com/abustany/back-message-board/pkg/grpcendpoint/boardpb"
+	"github.com/abustany/back-message-board/pkg/postservice"
+	"github.com/abustany/back-message-board/pkg/poststore"
+)
+
+const adminUser = "admin"
+const adminPassword = "r00tme"
+
+func TestServer(t *testing.T) {
+	withClient := func(f func(*testing.T, boardpb.MessageBoardClient, context.Context), historySize int) func(*testing.T) {
+		return func(t *testing.T) {
+			store, err := poststore.NewMemoryPostStore()
+
+			if err != nil {
+				t.Fatalf("Error while creating store: %s", err)
+			}
+
+			bus := events.NewBus(historySize)
+			service := postservice.New(store, postservice.WithEventBus(bus))
+			server := grpcendpoint.NewServer(log.NewNopLogger(), service, map[string]string{adminUser: adminPassword}, grpcendpoint.UseEventBus(bus))
+			listener := bufconn.Listen(1 << 20)
+
+			go server.Serve(listener)
+			defer server.Stop()
+
+			dialer := func(ctx context.Context, address string) (net.Conn, error) {
+				return listener.DialContext(ctx)
+			}
+
+			conn, err := grpc.NewClient("passthrough:///bufnet", grpc.WithContextDialer(dialer), grpc.WithTransportCredentials(insecure.NewCredentials()))
+
+			if err != nil {
+				t.Fatalf("Error while connecting to server: %s", err)
+			}
+
+			defer conn.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			f(t, boardpb.NewMessageBoardClient(conn), metadata.NewOutgoingContext(ctx, grpcendpoint.BasicAuthMetadata(adminUser, adminPassword)))
+		}
+	}
+
+	t.Run("Authentication", withClient(testAuthentication, 0))
+	t.Run("Posts", withClient(testPosts, 0))
+	t.Run("Errors", withClient(testErrors, 0))
+	t.Run("Watch", withClient(testWatch, 0))
+	t.Run("Watch (reset)", withClient(testWatchReset, 1))
+}
+
+func expectCode(t *testing.T, err error, expected codes.Code, what string) {
+	t.Helper()
+
+	if code := status.Code(err); code != expected {
+		t.Errorf("Unexpected status for %s: got %s, expected %s (error: %v)", what, code, expected, err)
+	}
+}
+
+func addPost(t *testing.T, client boardpb.MessageBoardClient, ctx context.Context, message string) *boardpb.Post {
+	t.Helper()
+
+	response, err := client.Add(ctx, &boardpb.AddRequest{Post: &boardpb.Post{Author: "John", Email: "john@domain.com", Message: message}})
+
+	if err != nil {
+		t.Fatalf("Error while adding post: %s", err)
+	}
+
+	return response.Post
+}
+
+func testAuthentication(t *testing.T, client boardpb.MessageBoardClient, ctx context.Context) {
+	anonymous := metadata.NewOutgoingContext(ctx, metadata.MD{})
+	_, err := client.List(anonymous, &boardpb.ListRequest{})
+	expectCode(t, err, codes.Unauthenticated, "an unauthenticated call")
+
+	wrong := metadata.NewOutgoingContext(ctx, grpcendpoint.BasicAuthMetadata(adminUser, "wrong"))
+	_, err = client.List(wrong, &boardpb.ListRequest{})
+	expectCode(t, err, codes.Unauthenticated, "a call with a wrong password")
+
+	stream, err := client.Watch(wrong, &boardpb.WatchRequest{})
+
+	if err == nil {
+		_, err = stream.Recv()
+	}
+
+	expectCode(t, err, codes.Unauthenticated, "an unauthenticated watch")
+
+	if _, err := client.List(ctx, &boardpb.ListRequest{}); err != nil {
+		t.Errorf("Authenticated call failed: %s", err)
+	}
+}
+
+func testPosts(t *testing.T, client boardpb.MessageBoardClient, ctx context.Context) {
+	response, err := client.Add(ctx, &boardpb.AddRequest{Post: &boardpb.Post{Author: "John", Email: "john@domain.com", Message: "Hello"}})
+
+	if err != nil {
+		t.Fatalf("Error while adding post: %s", err)
+	}
+
+	if response.Post.Id == "" || response.Post.Created == nil || response.Post.State != "published" || response.EditToken == "" {
+		t.Errorf("Unexpected added post: %+v", response)
+	}
+
+	post, err := client.Get(ctx, &boardpb.GetRequest{Id: response.Post.Id})
+
+	if err != nil {
+		t.Fatalf("Error while getting post: %s", err)
+	}
+
+	if post.Message != "Hello" || !post.Created.AsTime().Equal(response.Post.Created.AsTime()) {
+		t.Errorf("Unexpected post: %+v", post)
+	}
+
+	// Without a mask, only the non empty fields are updated
+	post, err = client.Update(ctx, &boardpb.UpdateRequest{Post: &boardpb.Post{Id: post.Id, Author: "Jane"}})
+
+	if err != nil {
+		t.Fatalf("Error while updating post: %s", err)
+	}
+
+	if post.Author != "Jane" || post.Message != "Hello" {
+		t.Errorf("Unexpected post after a partial update: %+v", post)
+	}
+
+	post, err = client.Update(ctx, &boardpb.UpdateRequest{
+		Post:       &boardpb.Post{Id: post.Id, Author: "ignored"},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"message"}},
+	})
+
+	if err != nil {
+		t.Fatalf("Error while updating post with a mask: %s", err)
+	}
+
+	if post.Author != "Jane" || post.Message != "" {
+		t.Errorf("Unexpected post after an update with a mask: %+v", post)
+	}
+
+	addPost(t, client, ctx, "Second")
+
+	list, err := client.List(ctx, &boardpb.ListRequest{PageSize: 1})
+
+	if err != nil {
+		t.Fatalf("Error while listing posts: %s", err)
+	}
+
+	if len(list.Posts) != 1 || list.Posts[0].Message != "Second" || list.NextCursor == "" {
+		t.Fatalf("Unexpected first page: %+v", list)
+	}
+
+	list, err = client.List(ctx, &boardpb.ListRequest{Cursor: list.NextCursor, PageSize: 1})
+
+	if err != nil {
+		t.Fatalf("Error while listing posts: %s", err)
+	}
+
+	if len(list.Posts) != 1 || list.Posts[0].Id != post.Id {
+		t.Errorf("Unexpected second page: %+v", list)
+	}
+}
+
+func testErrors(t *testing.T, client boardpb.MessageBoardClient, ctx context.Context) {
+	_, err := client.Get(ctx, &boardpb.GetRequest{Id: "not-exist"})
+	expectCode(t, err, codes.NotFound, "a missing post")
+
+	_, err = client.Update(ctx, &boardpb.UpdateRequest{Post: &boardpb.Post{Id: "not-exist", Author: "John"}})
+	expectCode(t, err, codes.NotFound, "an update of a missing post")
+
+	_, err = client.Add(ctx, &boardpb.AddRequest{Post: &boardpb.Post{Email: "john@domain.com"}})
+	expectCode(t, err, codes.InvalidArgument, "a post without author")
+
+	post := addPost(t, client, ctx, "Hello")
+
+	_, err = client.Update(ctx, &boardpb.UpdateRequest{Post: &boardpb.Post{Id: post.Id}, UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"id"}}})
+	expectCode(t, err, codes.InvalidArgument, "an invalid update mask")
+
+	_, err = client.Update(ctx, &boardpb.UpdateRequest{Post: &boardpb.Post{Id: post.Id, State: "hidden"}})
+	expectCode(t, err, codes.InvalidArgument, "an invalid state")
+
+	_, err = client.List(ctx, &boardpb.ListRequest{PageSize: postservice.MaxPageSize + 1})
+	expectCode(t, err, codes.InvalidArgument, "a page size too large")
+
+	_, err = client.List(ctx, &boardpb.ListRequest{Cursor: "invalid"})
+	expectCode(t, err, codes.InvalidArgument, "an invalid cursor")
+
+	stream, err := client.Watch(ctx, &boardpb.WatchRequest{States: []string{"hidden"}})
+
+	if err == nil {
+		_, err = stream.Recv()
+	}
+
+	expectCode(t, err, codes.InvalidArgument, "a watch with an invalid state")
+}
+
+func receiveEvent(t *testing.T, stream boardpb.MessageBoard_WatchClient) *boardpb.Event {
+	t.Helper()
+
+	event, err := stream.Recv()
+
+	if err != nil {
+		t.Fatalf("Error while receiving event: %s", err)
+	}
+
+	return event
+}
+
+func testWatch(t *testing.T, client boardpb.MessageBoardClient, ctx context.Context) {
+	addPost(t, client, ctx, "First")
+	second := addPost(t, client, ctx, "Second")
+
+	// Resuming after the first event makes the test independent of when the
+	// server subscribes
+	stream, err := client.Watch(ctx, &boardpb.WatchRequest{LastEventId: 1})
+
+	if err != nil {
+		t.Fatalf("Error while watching: %s", err)
+	}
+
+	if event := receiveEvent(t, stream); event.Id != 2 || event.Type != boardpb.Event_CREATED || event.Post.Id != second.Id || event.Time == nil {
+		t.Errorf("Unexpected missed event: %+v", event)
+	}
+
+	if _, err := client.Update(ctx, &boardpb.UpdateRequest{Post: &boardpb.Post{Id: second.Id, Message: "Edited"}}); err != nil {
+		t.Fatalf("Error while updating post: %s", err)
+	}
+
+	if event := receiveEvent(t, stream); event.Id != 3 || event.Type != boardpb.Event_UPDATED || event.Post.Message != "Edited" {
+		t.Errorf("Unexpected live event: %+v", event)
+	}
+}
+
+func testWatchReset(t *testing.T, client boardpb.MessageBoardClient, ctx context.Context) {
+	for _, message := range []string{"First", "Second", "Third"} {
+		addPost(t, client, ctx, message)
+	}
+
+	// The bus only remembers the last event
+	stream, err := client.Watch(ctx, &boardpb.WatchRequest{LastEventId: 1})
+
+	if err != nil {
+		t.Fatalf("Error while watching: %s", err)
+	}
+
+	if event := receiveEvent(t, stream); event.Type != boardpb.Event_RESET {
+		t.Errorf("Unexpected first event after missing events: %+v", event)
+	}
+
+	if event := receiveEvent(t, stream); event.Id != 3 || event.Post.Message != "Third" {
+		t.Errorf("Unexpected remembered event: %+v", event)
+	}
+}
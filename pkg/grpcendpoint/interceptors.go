@@ -0,0 +1,153 @@
+package grpcendpoint
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/abustany/back-message-board/pkg/endpoint"
+	"github.com/abustany/back-message-board/pkg/postservice"
+)
+
+// AuthorizationMetadata is the metadata key carrying the credentials of a
+// call, in the same format as the HTTP Authorization header.
+const AuthorizationMetadata = "authorization"
+
+// BasicAuthMetadata returns the metadata authenticating calls with the given
+// credentials, using HTTP Basic Auth.
+func BasicAuthMetadata(username, password string) metadata.MD {
+	credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+
+	return metadata.Pairs(AuthorizationMetadata, "Basic "+credentials)
+}
+
+var errUnauthenticated = status.Error(codes.Unauthenticated, "Admin credentials are missing or invalid")
+
+// parseBasicAuth parses the credentials of an Authorization header value, like
+// http.Request.BasicAuth.
+func parseBasicAuth(value string) (username, password string, ok bool) {
+	const prefix = "basic "
+
+	if len(value) < len(prefix) || !strings.EqualFold(value[:len(prefix)], prefix) {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(value[len(prefix):])
+
+	if err != nil {
+		return "", "", false
+	}
+
+	credentials := strings.SplitN(string(decoded), ":", 2)
+
+	if len(credentials) != 2 {
+		return "", "", false
+	}
+
+	return credentials[0], credentials[1], true
+}
+
+func authenticate(ctx context.Context, authenticator *endpoint.BasicAuthenticator) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	for _, value := range md.Get(AuthorizationMetadata) {
+		if username, password, ok := parseBasicAuth(value); ok && authenticator.Check(username, password) {
+			return nil
+		}
+	}
+
+	return errUnauthenticated
+}
+
+func unaryAuthentication(authenticator *endpoint.BasicAuthenticator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := authenticate(ctx, authenticator); err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, request)
+	}
+}
+
+func streamAuthentication(authenticator *endpoint.BasicAuthenticator) grpc.StreamServerInterceptor {
+	return func(server interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := authenticate(stream.Context(), authenticator); err != nil {
+			return err
+		}
+
+		return handler(server, stream)
+	}
+}
+
+// statusOf returns the gRPC status describing the given error. User errors of
+// postservice become NOT_FOUND or INVALID_ARGUMENT errors, and other errors
+// without a status are internal errors, whose details are not sent to the
+// client. The second return value is true for internal errors.
+func statusOf(err error) (*status.Status, bool) {
+	if err == nil {
+		return nil, false
+	}
+
+	if s, ok := status.FromError(err); ok {
+		return s, false
+	}
+
+	if userErr := postservice.UserError(err); userErr != nil {
+		code := codes.InvalidArgument
+
+		if errors.Cause(err) == postservice.ErrPostNotFound {
+			code = codes.NotFound
+		}
+
+		return status.New(code, userErr.Error()), false
+	}
+
+	return status.New(codes.Internal, "Internal server error"), true
+}
+
+// logCall logs a call that returned the given error, and returns the error to
+// send to the client.
+func logCall(logger log.Logger, method string, start time.Time, err error) error {
+	s, internal := statusOf(err)
+
+	keyvals := []interface{}{
+		"event", "rpc_request",
+		"method", method,
+		"code", s.Code().String(),
+		"elapsed", time.Since(start),
+	}
+
+	if internal {
+		keyvals = append(keyvals, "error", err)
+	}
+
+	logger.Log(keyvals...)
+
+	return s.Err()
+}
+
+func unaryLogging(logger log.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		response, err := handler(ctx, request)
+
+		return response, logCall(logger, info.FullMethod, start, err)
+	}
+}
+
+func streamLogging(logger log.Logger) grpc.StreamServerInterceptor {
+	return func(server interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(server, stream)
+
+		return logCall(logger, info.FullMethod, start, err)
+	}
+}
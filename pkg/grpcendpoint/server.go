@@ -0,0 +1,169 @@
+// Package grpcendpoint implements a gRPC endpoint to the message board service,
+// mirroring the admin API of the HTTP endpoint (see package endpoint).
+package grpcendpoint
+
+import (
+	"context"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/abustany/back-message-board/pkg/endpoint"
+	"github.com/abustany/back-message-board/pkg/events"
+	"github.com/abustany/back-message-board/pkg/grpcendpoint/boardpb"
+	"github.com/abustany/back-message-board/pkg/postservice"
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+// Server exposes the functionality of postservice.Service over gRPC
+type Server struct {
+	boardpb.UnimplementedMessageBoardServer
+
+	service       postservice.Service
+	authenticator *endpoint.BasicAuthenticator
+	events        *events.Bus
+}
+
+// Option configures optional features of a Server.
+type Option func(*Server)
+
+// UseEventBus enables the Watch call, which streams the events of the given
+// bus. The service of the server should publish its events on that bus, see
+// postservice.WithEventBus.
+func UseEventBus(bus *events.Bus) Option {
+	return func(s *Server) {
+		s.events = bus
+	}
+}
+
+// NewServer returns a gRPC server serving the MessageBoard service of
+// boardpb. Calls are logged to the given logger, and must carry the
+// credentials of one of the adminUsers in their metadata, like HTTP requests
+// to the admin API (see BasicAuthMetadata).
+func NewServer(logger log.Logger, service postservice.Service, adminUsers map[string]string, options ...Option) *grpc.Server {
+	s := &Server{
+		service: service,
+		authenticator: &endpoint.BasicAuthenticator{
+			Users: adminUsers,
+		},
+	}
+
+	for _, option := range options {
+		option(s)
+	}
+
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(unaryLogging(logger), unaryAuthentication(s.authenticator)),
+		grpc.ChainStreamInterceptor(streamLogging(logger), streamAuthentication(s.authenticator)),
+	)
+
+	boardpb.RegisterMessageBoardServer(server, s)
+
+	return server
+}
+
+func postToProto(post *types.Post) *boardpb.Post {
+	message := &boardpb.Post{
+		Id:      post.ID,
+		Author:  post.Author,
+		Email:   post.Email,
+		Message: post.Message,
+		State:   string(post.State),
+	}
+
+	if !post.Created.IsZero() {
+		message.Created = timestamppb.New(post.Created)
+	}
+
+	return message
+}
+
+func postFromProto(message *boardpb.Post) types.Post {
+	post := types.Post{
+		ID:      message.GetId(),
+		Author:  message.GetAuthor(),
+		Email:   message.GetEmail(),
+		Message: message.GetMessage(),
+		State:   types.PostState(message.GetState()),
+	}
+
+	if message.GetCreated() != nil {
+		post.Created = message.GetCreated().AsTime()
+	}
+
+	return post
+}
+
+// Get implements boardpb.MessageBoardServer.
+func (s *Server) Get(ctx context.Context, request *boardpb.GetRequest) (*boardpb.Post, error) {
+	post, err := s.service.Get(request.GetId())
+
+	if err != nil {
+		return nil, err
+	}
+
+	return postToProto(&post), nil
+}
+
+// Add implements boardpb.MessageBoardServer.
+func (s *Server) Add(ctx context.Context, request *boardpb.AddRequest) (*boardpb.AddResponse, error) {
+	post, editToken, err := s.service.Add(postFromProto(request.GetPost()))
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while adding post")
+	}
+
+	return &boardpb.AddResponse{Post: postToProto(&post), EditToken: editToken}, nil
+}
+
+// Update implements boardpb.MessageBoardServer.
+func (s *Server) Update(ctx context.Context, request *boardpb.UpdateRequest) (*boardpb.Post, error) {
+	post := postFromProto(request.GetPost())
+	fields := types.NonZeroFields(post)
+
+	if request.GetUpdateMask() != nil {
+		fields = nil
+
+		for _, path := range request.GetUpdateMask().GetPaths() {
+			field := types.PostField(path)
+
+			if !types.AllFields.Has(field) {
+				return nil, status.Errorf(codes.InvalidArgument, "Invalid field %q in update mask (should be one of %v)", path, types.AllFields)
+			}
+
+			fields = append(fields, field)
+		}
+	}
+
+	updated, err := s.service.Update(post, fields)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while updating post")
+	}
+
+	return postToProto(&updated), nil
+}
+
+// List implements boardpb.MessageBoardServer.
+func (s *Server) List(ctx context.Context, request *boardpb.ListRequest) (*boardpb.ListResponse, error) {
+	posts, next, err := s.service.List(request.GetCursor(), uint(request.GetPageSize()))
+
+	if err != nil {
+		return nil, err
+	}
+
+	response := &boardpb.ListResponse{
+		Posts:      make([]*boardpb.Post, len(posts)),
+		NextCursor: next,
+	}
+
+	for i := range posts {
+		response.Posts[i] = postToProto(&posts[i])
+	}
+
+	return response, nil
+}
@@ -0,0 +1,111 @@
+package grpcendpoint
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/abustany/back-message-board/pkg/events"
+	"github.com/abustany/back-message-board/pkg/grpcendpoint/boardpb"
+	"github.com/abustany/back-message-board/pkg/postservice"
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+var eventTypes = map[events.Type]boardpb.Event_Type{
+	events.Created: boardpb.Event_CREATED,
+	events.Updated: boardpb.Event_UPDATED,
+	events.Deleted: boardpb.Event_DELETED,
+}
+
+func eventToProto(event *events.Event) *boardpb.Event {
+	return &boardpb.Event{
+		Id:   event.ID,
+		Type: eventTypes[event.Type],
+		Time: timestamppb.New(event.Time),
+		Post: postToProto(&event.Post),
+	}
+}
+
+// watchStates reads the post states wanted by a client of Watch. A nil map
+// means all states.
+func watchStates(names []string) (map[types.PostState]bool, error) {
+	var states map[types.PostState]bool
+
+	for _, name := range names {
+		state := types.PostState(name)
+
+		if !state.Valid() {
+			return nil, postservice.ErrInvalidState
+		}
+
+		if states == nil {
+			states = map[types.PostState]bool{}
+		}
+
+		states[state] = true
+	}
+
+	return states, nil
+}
+
+// Watch implements boardpb.MessageBoardServer.
+func (s *Server) Watch(request *boardpb.WatchRequest, stream boardpb.MessageBoard_WatchServer) error {
+	if s.events == nil {
+		return status.Error(codes.Unimplemented, "Watch is not enabled on this server")
+	}
+
+	states, err := watchStates(request.GetStates())
+
+	if err != nil {
+		return err
+	}
+
+	var subscription *events.Subscription
+	var missed []events.Event
+	complete := true
+
+	if request.GetLastEventId() != 0 {
+		subscription, missed, complete = s.events.SubscribeSince(request.GetLastEventId())
+	} else {
+		subscription = s.events.Subscribe()
+	}
+
+	defer subscription.Close()
+
+	if !complete {
+		if err := stream.Send(&boardpb.Event{Type: boardpb.Event_RESET}); err != nil {
+			return err
+		}
+	}
+
+	send := func(event events.Event) error {
+		if states != nil && !states[event.Post.State] {
+			return nil
+		}
+
+		return stream.Send(eventToProto(&event))
+	}
+
+	for _, event := range missed {
+		if err := send(event); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case event, ok := <-subscription.C:
+			if !ok {
+				// Too slow to keep up, the client should call Watch
+				// again to get the events it missed
+				return status.Error(codes.Unavailable, "Too many pending events, watch again from the last received event")
+			}
+
+			if err := send(event); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		}
+	}
+}
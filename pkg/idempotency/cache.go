@@ -0,0 +1,137 @@
+// Package idempotency remembers the responses sent to requests carrying an
+// idempotency key, so that retried requests can be answered without being
+// processed again.
+package idempotency
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Response is a response remembered by the cache.
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// ErrInFlight is returned by Cache.Begin when a request with the same key is
+// still being processed.
+var ErrInFlight = errors.New("A request with this idempotency key is still being processed")
+
+// ErrMismatch is returned by Cache.Begin when the key was already used for a
+// different request.
+var ErrMismatch = errors.New("This idempotency key was already used for a different request")
+
+type entry struct {
+	key string
+	// Identifies the request the key was first used with
+	fingerprint string
+	expires     time.Time
+	// nil until the request is processed
+	response *Response
+}
+
+// Cache maps idempotency keys to responses. It holds a bounded number of keys,
+// and forgets them after a given duration.
+type Cache struct {
+	sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	entries    map[string]*list.Element
+	// Entries ordered by expiry time, oldest first
+	order *list.List
+}
+
+// NewCache returns a new Cache holding at most maxEntries keys, each key
+// being remembered for the given duration. When the cache is full, the oldest
+// keys are forgotten first.
+func NewCache(maxEntries int, ttl time.Duration) *Cache {
+	return &Cache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		entries:    map[string]*list.Element{},
+		order:      list.New(),
+	}
+}
+
+func (c *Cache) remove(element *list.Element) {
+	delete(c.entries, element.Value.(*entry).key)
+	c.order.Remove(element)
+}
+
+// prune forgets expired keys. It should be called with the lock held.
+func (c *Cache) prune(now time.Time) {
+	for element := c.order.Front(); element != nil && element.Value.(*entry).expires.Before(now); element = c.order.Front() {
+		c.remove(element)
+	}
+}
+
+// Begin should be called before processing a request with an idempotency key.
+// fingerprint identifies the contents of the request, a given key can only be
+// used for requests with the same fingerprint.
+//
+// If the key is unknown, Begin reserves it and returns a nil response. The
+// caller should then process the request, and call either Complete or Abort.
+//
+// If the request was already processed, Begin returns the response that was
+// sent back then. If the key was used for a different request, it returns
+// ErrMismatch, and if the request is still being processed, ErrInFlight.
+func (c *Cache) Begin(key, fingerprint string) (*Response, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	c.prune(now)
+
+	if element, exists := c.entries[key]; exists {
+		e := element.Value.(*entry)
+
+		if e.fingerprint != fingerprint {
+			return nil, ErrMismatch
+		}
+
+		if e.response == nil {
+			return nil, ErrInFlight
+		}
+
+		return e.response, nil
+	}
+
+	for len(c.entries) >= c.maxEntries && c.order.Len() > 0 {
+		c.remove(c.order.Front())
+	}
+
+	c.entries[key] = c.order.PushBack(&entry{
+		key:         key,
+		fingerprint: fingerprint,
+		expires:     now.Add(c.ttl),
+	})
+
+	return nil, nil
+}
+
+// Complete remembers the response sent for the key reserved by Begin.
+func (c *Cache) Complete(key string, response Response) {
+	c.Lock()
+	defer c.Unlock()
+
+	if element, exists := c.entries[key]; exists {
+		element.Value.(*entry).response = &response
+	}
+}
+
+// Abort releases a key reserved by Begin without remembering any response, so
+// that the request can be retried.
+func (c *Cache) Abort(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if element, exists := c.entries[key]; exists && element.Value.(*entry).response == nil {
+		c.remove(element)
+	}
+}
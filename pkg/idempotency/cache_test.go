@@ -0,0 +1,90 @@
+package idempotency_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/abustany/back-message-board/pkg/idempotency"
+)
+
+func begin(t *testing.T, cache *idempotency.Cache, key, fingerprint string, expectedError error) *idempotency.Response {
+	response, err := cache.Begin(key, fingerprint)
+
+	if err != expectedError {
+		t.Errorf("Unexpected error from Begin for key %s: got %v, expected %v", key, err, expectedError)
+	}
+
+	return response
+}
+
+func TestCache(t *testing.T) {
+	response := idempotency.Response{
+		StatusCode: http.StatusCreated,
+		Header:     http.Header{"Location": []string{"/posts/ID"}},
+		Body:       []byte("hello"),
+	}
+
+	t.Run("Replay", func(t *testing.T) {
+		cache := idempotency.NewCache(10, time.Hour)
+
+		if r := begin(t, cache, "key", "fp", nil); r != nil {
+			t.Errorf("Begin returned a response for an unknown key")
+		}
+
+		begin(t, cache, "key", "fp", idempotency.ErrInFlight)
+
+		cache.Complete("key", response)
+
+		if r := begin(t, cache, "key", "fp", nil); r == nil {
+			t.Errorf("Begin didn't return a response for a completed key")
+		} else if r.StatusCode != response.StatusCode || string(r.Body) != string(response.Body) || r.Header.Get("Location") != "/posts/ID" {
+			t.Errorf("Begin returned an unexpected response: got %+v, expected %+v", r, response)
+		}
+
+		begin(t, cache, "key", "other fp", idempotency.ErrMismatch)
+	})
+
+	t.Run("Abort", func(t *testing.T) {
+		cache := idempotency.NewCache(10, time.Hour)
+
+		begin(t, cache, "key", "fp", nil)
+		cache.Abort("key")
+
+		if r := begin(t, cache, "key", "other fp", nil); r != nil {
+			t.Errorf("Begin returned a response for an aborted key")
+		}
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		cache := idempotency.NewCache(10, time.Millisecond)
+
+		begin(t, cache, "key", "fp", nil)
+		cache.Complete("key", response)
+
+		time.Sleep(5 * time.Millisecond)
+
+		if r := begin(t, cache, "key", "other fp", nil); r != nil {
+			t.Errorf("Begin returned a response for an expired key")
+		}
+	})
+
+	t.Run("Capacity", func(t *testing.T) {
+		cache := idempotency.NewCache(2, time.Hour)
+
+		for _, key := range []string{"key1", "key2", "key3"} {
+			begin(t, cache, key, "fp", nil)
+			cache.Complete(key, response)
+		}
+
+		// key1 was evicted to make room for key3
+		if r := begin(t, cache, "key1", "other fp", nil); r != nil {
+			t.Errorf("Begin returned a response for an evicted key")
+		}
+
+		// key2 was evicted to make room for key1
+		if r := begin(t, cache, "key3", "fp", nil); r == nil {
+			t.Errorf("Begin didn't return a response for a recent key")
+		}
+	})
+}
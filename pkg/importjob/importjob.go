@@ -0,0 +1,422 @@
+// Package importjob runs imports of posts in the background, and tracks their
+// progress.
+package importjob
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/satori/go.uuid"
+
+	"github.com/abustany/back-message-board/pkg/postservice"
+	"github.com/abustany/back-message-board/pkg/poststore"
+)
+
+// State is the state of a job.
+type State string
+
+const (
+	// StateRunning is the state of jobs that are still importing posts.
+	StateRunning State = "running"
+
+	// StateDone is the state of jobs that read their whole file.
+	StateDone State = "done"
+
+	// StateFailed is the state of jobs stopped by an error.
+	StateFailed State = "failed"
+
+	// StateCanceled is the state of jobs stopped by Manager.Cancel.
+	StateCanceled State = "canceled"
+)
+
+// RecordError is the error of a record that could not be imported.
+type RecordError struct {
+	// Index of the record in the file, starting at 1 (not counting headers)
+	Record uint `json:"record"`
+	// Human readable description of the error
+	Error string `json:"error"`
+	// Machine readable error code, see postservice.ErrorCode
+	Code string `json:"code,omitempty"`
+}
+
+// Job describes an import job.
+type Job struct {
+	// Unique ID of the job
+	ID string `json:"id"`
+	// Name of the format of the imported file
+	Format string `json:"format"`
+	State  State  `json:"state"`
+	// Start and end times of the job
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// Number of records read so far
+	Processed uint `json:"processed"`
+	// Number of records that were skipped or invalid
+	Failed uint `json:"failed"`
+	// Details of the processed records, see postservice.ImportReport
+	Inserted    uint `json:"inserted"`
+	Overwritten uint `json:"overwritten"`
+	Skipped     uint `json:"skipped"`
+	Invalid     uint `json:"invalid"`
+	// Errors of the first poststore.MaxReportedErrors failed records
+	Errors []RecordError `json:"errors,omitempty"`
+	// Error that stopped the job, for failed jobs
+	Error     string `json:"error,omitempty"`
+	ErrorCode string `json:"error_code,omitempty"`
+}
+
+// ErrJobNotFound is returned by the Manager methods when given an unknown job
+// ID.
+var ErrJobNotFound = errors.New("No import job has this ID")
+
+// ErrTooManyJobs is returned by Manager.Start when the maximum number of jobs
+// are running.
+var ErrTooManyJobs = errors.New("Too many import jobs are running")
+
+// ErrUploadTooLarge is returned by Manager.Start when the data to import is
+// larger than the maximum upload size of the manager.
+var ErrUploadTooLarge = errors.New("The file to import is too large")
+
+// ErrJobRunning is returned by Manager.OpenFailed for jobs that did not end
+// yet.
+var ErrJobRunning = errors.New("The import job is still running")
+
+// ErrNoFailedRecords is returned by Manager.OpenFailed for jobs whose format
+// cannot write back the failed records.
+var ErrNoFailedRecords = errors.New("The failed records of this job are not available")
+
+// job is a Job along with its internal state.
+type job struct {
+	Job
+	format *poststore.Format
+	// Closed to cancel the job
+	cancel chan struct{}
+	// Closed when the job ends
+	done chan struct{}
+	// Uploaded data, and file where the failed records are written. The
+	// failed records file is empty if the format is not supported.
+	upload     string
+	failedFile string
+}
+
+// Manager runs import jobs, and remembers a bounded number of them.
+type Manager struct {
+	sync.Mutex
+	service postservice.Service
+	dir     string
+	maxJobs int
+	// Maximum size of the uploaded files, no limit if 0
+	maxUploadSize int64
+	jobs          map[string]*job
+	// IDs of the jobs, oldest first
+	order []string
+}
+
+// NewManager returns a Manager importing posts into the given service. The
+// uploaded files and the failed records of the jobs are kept in dir. The
+// manager remembers at most maxJobs jobs, forgetting the oldest finished ones
+// first. Files larger than maxUploadSize bytes are rejected, unless
+// maxUploadSize is 0.
+func NewManager(service postservice.Service, dir string, maxJobs int, maxUploadSize int64) *Manager {
+	return &Manager{
+		service:       service,
+		dir:           dir,
+		maxJobs:       maxJobs,
+		maxUploadSize: maxUploadSize,
+		jobs:          map[string]*job{},
+	}
+}
+
+// forgetOldest forgets the oldest finished job, and returns false if all jobs
+// are running. It should be called with the lock held.
+func (m *Manager) forgetOldest() bool {
+	for i, id := range m.order {
+		j := m.jobs[id]
+
+		if j.State == StateRunning {
+			continue
+		}
+
+		os.Remove(j.failedFile)
+		delete(m.jobs, id)
+		m.order = append(m.order[:i], m.order[i+1:]...)
+
+		return true
+	}
+
+	return false
+}
+
+// add registers a new job, making room for it if needed.
+func (m *Manager) add(j *job) error {
+	m.Lock()
+	defer m.Unlock()
+
+	for len(m.jobs) >= m.maxJobs {
+		if !m.forgetOldest() {
+			return ErrTooManyJobs
+		}
+	}
+
+	m.jobs[j.ID] = j
+	m.order = append(m.order, j.ID)
+
+	return nil
+}
+
+// Start reads data, and imports it in the background with the given options.
+// The data is copied to a file before Start returns, so that the caller can
+// close it. If data is larger than the maximum upload size, Start returns
+// ErrUploadTooLarge after reading one byte more than that size.
+func (m *Manager) Start(format *poststore.Format, data io.Reader, options postservice.ImportOptions) (Job, error) {
+	j := &job{
+		Job: Job{
+			ID:      uuid.NewV4().String(),
+			Format:  format.Name,
+			State:   StateRunning,
+			Started: time.Now(),
+		},
+		format: format,
+		cancel: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	upload, err := ioutil.TempFile(m.dir, "import-*.upload")
+
+	if err != nil {
+		return Job{}, errors.Wrap(err, "Error while creating upload file")
+	}
+
+	j.upload = upload.Name()
+
+	if m.maxUploadSize > 0 {
+		data = io.LimitReader(data, m.maxUploadSize+1)
+	}
+
+	n, err := io.Copy(upload, data)
+
+	if closeErr := upload.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(j.upload)
+		return Job{}, errors.Wrap(err, "Error while writing upload file")
+	}
+
+	if m.maxUploadSize > 0 && n > m.maxUploadSize {
+		os.Remove(j.upload)
+		return Job{}, ErrUploadTooLarge
+	}
+
+	if err := m.add(j); err != nil {
+		os.Remove(j.upload)
+		return Job{}, err
+	}
+
+	go m.run(j, options)
+
+	return m.Get(j.ID)
+}
+
+// run imports the uploaded file of a job.
+func (m *Manager) run(j *job, options postservice.ImportOptions) {
+	defer close(j.done)
+	defer os.Remove(j.upload)
+
+	report, err := m.importUpload(j, options)
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.update(j, report)
+
+	finished := time.Now()
+	j.Finished = &finished
+
+	switch {
+	case err == nil:
+		j.State = StateDone
+	case errors.Cause(err) == postservice.ErrImportCanceled:
+		j.State = StateCanceled
+	default:
+		j.State = StateFailed
+		j.Error = err.Error()
+		j.ErrorCode = postservice.ErrorCode(err)
+	}
+}
+
+// importUpload imports the uploaded file of a job, and writes the failed
+// records if the format supports it.
+func (m *Manager) importUpload(j *job, options postservice.ImportOptions) (postservice.ImportReport, error) {
+	upload, err := os.Open(j.upload)
+
+	if err != nil {
+		return postservice.ImportReport{}, errors.Wrap(err, "Error while opening upload file")
+	}
+
+	defer upload.Close()
+
+	var failed poststore.RecordEncoder
+
+	if f, err := ioutil.TempFile(m.dir, "import-*.failed."+j.format.Extensions[0]); err != nil {
+		return postservice.ImportReport{}, errors.Wrap(err, "Error while creating failed records file")
+	} else if encoder, ok := j.format.NewEncoder(f).(poststore.RecordEncoder); ok {
+		defer f.Close()
+
+		m.Lock()
+		j.failedFile = f.Name()
+		m.Unlock()
+
+		failed = encoder
+	} else {
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	options.Cancel = j.cancel
+
+	options.Progress = func(report postservice.ImportReport) {
+		m.Lock()
+		m.update(j, report)
+		m.Unlock()
+	}
+
+	options.Rejected = func(record poststore.DecodedRecord) {
+		// Records that could not be read at all cannot be written back
+		if failed != nil && record.Raw != nil {
+			if err := failed.EncodeRecord(record.Raw); err != nil {
+				failed = nil
+			}
+		}
+	}
+
+	report, err := m.service.Import(j.format.NewDecoder(upload), options)
+
+	if failed != nil {
+		failed.Close()
+	}
+
+	return report, err
+}
+
+// update copies the progress of an import to its job. It should be called
+// with the lock held.
+func (m *Manager) update(j *job, report postservice.ImportReport) {
+	j.Inserted = report.Inserted
+	j.Overwritten = report.Overwritten
+	j.Skipped = report.Skipped
+	j.Invalid = report.Invalid
+	j.Failed = report.Skipped + report.Invalid
+	j.Processed = report.Inserted + report.Overwritten + j.Failed
+
+	for _, err := range report.Errors[len(j.Errors):] {
+		j.Errors = append(j.Errors, RecordError{
+			Record: err.Record,
+			Error:  err.Err.Error(),
+			Code:   postservice.ErrorCode(err.Err),
+		})
+	}
+}
+
+// get returns the job with the given ID.
+func (m *Manager) get(id string) (*job, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	j, exists := m.jobs[id]
+
+	if !exists {
+		return nil, ErrJobNotFound
+	}
+
+	return j, nil
+}
+
+// copyJob returns a copy of a job that can be used without holding the lock.
+func (m *Manager) copyJob(j *job) Job {
+	m.Lock()
+	defer m.Unlock()
+
+	copied := j.Job
+	copied.Errors = append([]RecordError(nil), j.Errors...)
+
+	return copied
+}
+
+// Get returns the job with the given ID.
+func (m *Manager) Get(id string) (Job, error) {
+	j, err := m.get(id)
+
+	if err != nil {
+		return Job{}, err
+	}
+
+	return m.copyJob(j), nil
+}
+
+// Cancel stops the job with the given ID, and waits for it to end. Canceling a
+// job that already ended does nothing.
+func (m *Manager) Cancel(id string) (Job, error) {
+	j, err := m.get(id)
+
+	if err != nil {
+		return Job{}, err
+	}
+
+	m.Lock()
+
+	select {
+	case <-j.cancel:
+	default:
+		close(j.cancel)
+	}
+
+	m.Unlock()
+
+	<-j.done
+
+	return m.copyJob(j), nil
+}
+
+// Wait waits for the job with the given ID to end, and returns it.
+func (m *Manager) Wait(id string) (Job, error) {
+	j, err := m.get(id)
+
+	if err != nil {
+		return Job{}, err
+	}
+
+	<-j.done
+
+	return m.copyJob(j), nil
+}
+
+// OpenFailed opens the records of a finished job that were skipped or invalid,
+// written in the format of the job. Records that could not be read at all
+// (like malformed CSV records) are not included.
+func (m *Manager) OpenFailed(id string) (io.ReadCloser, error) {
+	j, err := m.get(id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-j.done:
+	default:
+		return nil, ErrJobRunning
+	}
+
+	if j.failedFile == "" {
+		return nil, ErrNoFailedRecords
+	}
+
+	f, err := os.Open(j.failedFile)
+
+	return f, errors.Wrap(err, "Error while opening failed records file")
+}
@@ -0,0 +1,242 @@
+package importjob_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/abustany/back-message-board/pkg/importjob"
+	"github.com/abustany/back-message-board/pkg/postservice"
+	"github.com/abustany/back-message-board/pkg/poststore"
+)
+
+func newManager(t *testing.T, maxJobs int, maxUploadSize int64) (*importjob.Manager, string) {
+	store, err := poststore.NewMemoryPostStore()
+
+	if err != nil {
+		t.Fatalf("Error while creating post store: %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "importjob")
+
+	if err != nil {
+		t.Fatalf("Error while creating temporary directory: %s", err)
+	}
+
+	return importjob.NewManager(postservice.New(store), dir, maxJobs, maxUploadSize), dir
+}
+
+func csvRecord(id, author string) string {
+	return id + "," + author + ",john@domain.com,Hello,2017-12-14T06:20:33-08:00\n"
+}
+
+func TestImport(t *testing.T) {
+	manager, dir := newManager(t, 10, 0)
+	defer os.RemoveAll(dir)
+
+	data := "id,name,email,text,created\n" +
+		csvRecord("ID1", "John") +
+		csvRecord("ID2", "") +
+		csvRecord("ID1", "Jane") +
+		"ID3,\"John\n" +
+		csvRecord("ID4", "John")
+
+	job, err := manager.Start(&poststore.FormatCSV, strings.NewReader(data), postservice.ImportOptions{})
+
+	if err != nil {
+		t.Fatalf("Start returned an error: %s", err)
+	}
+
+	if job.ID == "" || job.Format != "csv" {
+		t.Errorf("Unexpected job: %+v", job)
+	}
+
+	if _, err := manager.OpenFailed(job.ID); err != nil && err != importjob.ErrJobRunning {
+		t.Errorf("Unexpected OpenFailed error for a running job: %s", err)
+	}
+
+	job, err = manager.Wait(job.ID)
+
+	if err != nil {
+		t.Fatalf("Wait returned an error: %s", err)
+	}
+
+	if job.State != importjob.StateDone || job.Finished == nil {
+		t.Errorf("Unexpected job state: %+v", job)
+	}
+
+	// The malformed record swallows the last one
+	if job.Processed != 4 || job.Failed != 3 || job.Inserted != 1 || job.Skipped != 1 || job.Invalid != 2 {
+		t.Errorf("Unexpected job counts: %+v", job)
+	}
+
+	if len(job.Errors) != 3 || job.Errors[0].Code != "invalid_author" || job.Errors[1].Code != "duplicate_id" || job.Errors[1].Record != 3 {
+		t.Errorf("Unexpected job errors: %+v", job.Errors)
+	}
+
+	failed, err := manager.OpenFailed(job.ID)
+
+	if err != nil {
+		t.Fatalf("OpenFailed returned an error: %s", err)
+	}
+
+	defer failed.Close()
+
+	content, err := ioutil.ReadAll(failed)
+
+	if err != nil {
+		t.Fatalf("Error while reading failed records: %s", err)
+	}
+
+	// Records that could not be parsed at all are not included
+	expected := "id,name,email,text,created\n" + csvRecord("ID2", "") + csvRecord("ID1", "Jane")
+
+	if string(content) != expected {
+		t.Errorf("Unexpected failed records: got %q, expected %q", content, expected)
+	}
+
+	if _, err := manager.Get("whatever"); err != importjob.ErrJobNotFound {
+		t.Errorf("Unexpected error for an unknown job: %v", err)
+	}
+}
+
+func TestFailedJob(t *testing.T) {
+	manager, dir := newManager(t, 10, 0)
+	defer os.RemoveAll(dir)
+
+	data := `{"id": "ID1"}` + "\n" + `{"id": "ID1"}` + "\n"
+	job, err := manager.Start(&poststore.FormatNDJSON, strings.NewReader(data), postservice.ImportOptions{Conflicts: postservice.ConflictFail})
+
+	if err != nil {
+		t.Fatalf("Start returned an error: %s", err)
+	}
+
+	job, err = manager.Wait(job.ID)
+
+	if err != nil {
+		t.Fatalf("Wait returned an error: %s", err)
+	}
+
+	// The first post is invalid (no author), so the conflict is on the
+	// second one which is invalid too
+	if job.State != importjob.StateDone || job.Invalid != 2 {
+		t.Errorf("Unexpected job: %+v", job)
+	}
+
+	data = `{"id": "ID1", "author": "John", "email": "john@domain.com", "created": "2017-12-14T06:20:33-08:00"}` + "\n"
+	data += data
+
+	job, err = manager.Start(&poststore.FormatNDJSON, strings.NewReader(data), postservice.ImportOptions{Conflicts: postservice.ConflictFail})
+
+	if err != nil {
+		t.Fatalf("Start returned an error: %s", err)
+	}
+
+	job, err = manager.Wait(job.ID)
+
+	if err != nil {
+		t.Fatalf("Wait returned an error: %s", err)
+	}
+
+	if job.State != importjob.StateFailed || job.ErrorCode != "duplicate_id" || job.Error == "" {
+		t.Errorf("Unexpected job: %+v", job)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	manager, dir := newManager(t, 10, 0)
+	defer os.RemoveAll(dir)
+
+	const nRecords = 100000
+
+	var data bytes.Buffer
+
+	for i := 0; i < nRecords; i++ {
+		data.WriteString(csvRecord(fmt.Sprintf("ID%d", i), "John"))
+	}
+
+	options := postservice.ImportOptions{ParallelOptions: poststore.ParallelOptions{Workers: 1, BatchSize: 1}}
+	job, err := manager.Start(&poststore.FormatCSV, &data, options)
+
+	if err != nil {
+		t.Fatalf("Start returned an error: %s", err)
+	}
+
+	job, err = manager.Cancel(job.ID)
+
+	if err != nil {
+		t.Fatalf("Cancel returned an error: %s", err)
+	}
+
+	// The job could have ended before being canceled on a very fast machine
+	if job.State != importjob.StateCanceled && job.State != importjob.StateDone {
+		t.Errorf("Unexpected job state after cancellation: %+v", job)
+	}
+
+	if job.State == importjob.StateCanceled && job.Processed >= nRecords {
+		t.Errorf("Canceled job processed all the records: %+v", job)
+	}
+
+	// Canceling again does nothing
+	if again, err := manager.Cancel(job.ID); err != nil || again.State != job.State {
+		t.Errorf("Unexpected result when canceling again: %+v, %v", again, err)
+	}
+}
+
+func TestMaxJobs(t *testing.T) {
+	manager, dir := newManager(t, 2, 0)
+	defer os.RemoveAll(dir)
+
+	ids := make([]string, 3)
+
+	for i := range ids {
+		job, err := manager.Start(&poststore.FormatNDJSON, strings.NewReader(""), postservice.ImportOptions{})
+
+		if err != nil {
+			t.Fatalf("Start returned an error: %s", err)
+		}
+
+		ids[i] = job.ID
+
+		if _, err := manager.Wait(job.ID); err != nil {
+			t.Fatalf("Wait returned an error: %s", err)
+		}
+	}
+
+	// The oldest job is forgotten
+	if _, err := manager.Get(ids[0]); err != importjob.ErrJobNotFound {
+		t.Errorf("Unexpected error for a forgotten job: %v", err)
+	}
+
+	for _, id := range ids[1:] {
+		if _, err := manager.Get(id); err != nil {
+			t.Errorf("Get returned an error for a recent job: %s", err)
+		}
+	}
+}
+
+func TestMaxUploadSize(t *testing.T) {
+	manager, dir := newManager(t, 10, 10)
+	defer os.RemoveAll(dir)
+
+	if _, err := manager.Start(&poststore.FormatNDJSON, strings.NewReader(strings.Repeat("{}\n", 4)), postservice.ImportOptions{}); err != importjob.ErrUploadTooLarge {
+		t.Errorf("Unexpected error for a file too large: %v", err)
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("The upload of a file too large was not removed")
+	}
+
+	job, err := manager.Start(&poststore.FormatNDJSON, strings.NewReader(strings.Repeat("{}\n", 3)), postservice.ImportOptions{})
+
+	if err != nil {
+		t.Fatalf("Start returned an error for a file of the maximum size: %s", err)
+	}
+
+	if _, err := manager.Wait(job.ID); err != nil {
+		t.Fatalf("Wait returned an error: %s", err)
+	}
+}
@@ -0,0 +1,169 @@
+// Package mailer sends emails.
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Message is a plain text email.
+type Message struct {
+	// Recipient address
+	To string
+	// Subject, can contain any UTF-8 character
+	Subject string
+	// Plain text body
+	Body string
+}
+
+// Mailer is the common interface to all mail senders.
+type Mailer interface {
+	// Send sends the given message.
+	Send(msg Message) error
+}
+
+// ErrInvalidHeader is returned when trying to send a message whose address or
+// subject contains line breaks.
+var ErrInvalidHeader = errors.New("Message headers cannot contain line breaks")
+
+func randomHex(n int) (string, error) {
+	data := make([]byte, n)
+
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(data), nil
+}
+
+// format formats the message in RFC 5322 format.
+func (m Message) format(from string) ([]byte, error) {
+	for _, header := range []string{from, m.To, m.Subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return nil, ErrInvalidHeader
+		}
+	}
+
+	messageID, err := randomHex(16)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while generating message ID")
+	}
+
+	domain := "localhost"
+
+	if at := strings.LastIndexByte(from, '@'); at >= 0 {
+		domain = from[at+1:]
+	}
+
+	buffer := bytes.Buffer{}
+	fmt.Fprintf(&buffer, "From: %s\r\n", from)
+	fmt.Fprintf(&buffer, "To: %s\r\n", m.To)
+	fmt.Fprintf(&buffer, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&buffer, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buffer, "Message-ID: <%s@%s>\r\n", messageID, domain)
+	buffer.WriteString("MIME-Version: 1.0\r\n")
+	buffer.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buffer.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	buffer.WriteString("\r\n")
+	buffer.WriteString(strings.Replace(m.Body, "\n", "\r\n", -1))
+
+	return buffer.Bytes(), nil
+}
+
+// SMTPMailer sends messages through an SMTP server.
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTPMailer returns a Mailer sending messages through the SMTP server
+// listening on addr (in host:port format), using from as sender address. auth
+// can be nil if the server does not require authentication.
+func NewSMTPMailer(addr, from string, auth smtp.Auth) *SMTPMailer {
+	return &SMTPMailer{addr, from, auth}
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	data, err := msg.format(m.from)
+
+	if err != nil {
+		return errors.Wrap(err, "Error while formatting message")
+	}
+
+	return errors.Wrap(smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, data), "Error while sending message")
+}
+
+// MaildirMailer delivers messages to a local Maildir directory instead of
+// sending them. It is mostly useful for testing.
+type MaildirMailer struct {
+	dir  string
+	from string
+}
+
+// NewMaildirMailer returns a Mailer delivering messages to the Maildir in dir,
+// using from as sender address. The tmp, new and cur subdirectories of dir are
+// created if needed.
+func NewMaildirMailer(dir, from string) (*MaildirMailer, error) {
+	for _, subdir := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, subdir), 0700); err != nil {
+			return nil, errors.Wrapf(err, "Error while creating Maildir directory %s", subdir)
+		}
+	}
+
+	return &MaildirMailer{dir, from}, nil
+}
+
+func (m *MaildirMailer) Send(msg Message) error {
+	data, err := msg.format(m.from)
+
+	if err != nil {
+		return errors.Wrap(err, "Error while formatting message")
+	}
+
+	unique, err := randomHex(8)
+
+	if err != nil {
+		return errors.Wrap(err, "Error while generating file name")
+	}
+
+	hostname, err := os.Hostname()
+
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	// Messages are written in tmp, and then moved atomically to new
+	filename := fmt.Sprintf("%d.%s.%s", time.Now().UnixNano(), unique, hostname)
+	tmpPath := filepath.Join(m.dir, "tmp", filename)
+
+	fd, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+
+	if err != nil {
+		return errors.Wrap(err, "Error while creating message file")
+	}
+
+	_, err = fd.Write(data)
+
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmpPath)
+		return errors.Wrap(err, "Error while writing message file")
+	}
+
+	return errors.Wrap(os.Rename(tmpPath, filepath.Join(m.dir, "new", filename)), "Error while delivering message file")
+}
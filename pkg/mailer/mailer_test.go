@@ -0,0 +1,86 @@
+package mailer_test
+
+import (
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/abustany/back-message-board/pkg/mailer"
+)
+
+func TestMaildirMailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildir")
+
+	if err != nil {
+		t.Fatalf("Error while creating temporary directory: %s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	m, err := mailer.NewMaildirMailer(dir, "board@domain.com")
+
+	if err != nil {
+		t.Fatalf("NewMaildirMailer returned an error: %s", err)
+	}
+
+	msg := mailer.Message{
+		To:      "john@domain.com",
+		Subject: "Héllo",
+		Body:    "First line\nSecond line\n",
+	}
+
+	if err := m.Send(msg); err != nil {
+		t.Fatalf("Send returned an error: %s", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "new", "*"))
+
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected exactly one message in the Maildir, got %v (error %v)", files, err)
+	}
+
+	fd, err := os.Open(files[0])
+
+	if err != nil {
+		t.Fatalf("Error while opening message: %s", err)
+	}
+
+	defer fd.Close()
+
+	parsed, err := mail.ReadMessage(fd)
+
+	if err != nil {
+		t.Fatalf("Error while parsing message: %s", err)
+	}
+
+	if to := parsed.Header.Get("To"); to != msg.To {
+		t.Errorf("Unexpected recipient: got %s, expected %s", to, msg.To)
+	}
+
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject")); err != nil || decoded != msg.Subject {
+		t.Errorf("Unexpected subject: got %s (error %v), expected %s", decoded, err, msg.Subject)
+	}
+
+	body, err := ioutil.ReadAll(parsed.Body)
+
+	if err != nil {
+		t.Fatalf("Error while reading body: %s", err)
+	}
+
+	if string(body) != strings.Replace(msg.Body, "\n", "\r\n", -1) {
+		t.Errorf("Unexpected body: got %q, expected %q", body, msg.Body)
+	}
+
+	t.Run("Header injection", func(t *testing.T) {
+		msg := msg
+		msg.To = "john@domain.com\r\nBcc: everyone@domain.com"
+
+		if err := m.Send(msg); err == nil {
+			t.Errorf("Send should have refused a recipient with a line break")
+		}
+	})
+}
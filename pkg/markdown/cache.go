@@ -0,0 +1,91 @@
+package markdown
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+)
+
+// DefaultCacheSize is the number of rendered messages held by a Cache created
+// with a size of 0.
+const DefaultCacheSize = 10000
+
+type entry struct {
+	id string
+	// Hash of the rendered version of the message
+	hash [sha256.Size]byte
+	html string
+}
+
+// Cache remembers the rendered messages of a bounded number of posts, so that
+// messages are only rendered again when they change.
+type Cache struct {
+	sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	// Entries ordered by last use, most recent first
+	order *list.List
+}
+
+// NewCache returns a new Cache holding the messages of at most maxEntries
+// posts (or DefaultCacheSize if 0). When the cache is full, the least recently
+// used messages are forgotten first.
+func NewCache(maxEntries int) *Cache {
+	if maxEntries <= 0 {
+		maxEntries = DefaultCacheSize
+	}
+
+	return &Cache{
+		maxEntries: maxEntries,
+		entries:    map[string]*list.Element{},
+		order:      list.New(),
+	}
+}
+
+// Render returns the HTML of the message of the post with the given ID, see
+// the Render function. Each post only has its latest version cached.
+func (c *Cache) Render(id, message string) string {
+	hash := sha256.Sum256([]byte(message))
+
+	c.Lock()
+
+	if element, ok := c.entries[id]; ok && element.Value.(*entry).hash == hash {
+		c.order.MoveToFront(element)
+		c.Unlock()
+
+		return element.Value.(*entry).html
+	}
+
+	c.Unlock()
+
+	// Rendering can take a while, other messages can be looked up meanwhile
+	html := Render(message)
+
+	c.Lock()
+	defer c.Unlock()
+
+	if element, ok := c.entries[id]; ok {
+		element.Value = &entry{id: id, hash: hash, html: html}
+		c.order.MoveToFront(element)
+
+		return html
+	}
+
+	c.entries[id] = c.order.PushFront(&entry{id: id, hash: hash, html: html})
+
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		delete(c.entries, oldest.Value.(*entry).id)
+		c.order.Remove(oldest)
+	}
+
+	return html
+}
+
+// Len returns the number of messages in the cache.
+func (c *Cache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.order.Len()
+}
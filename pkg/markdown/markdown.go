@@ -0,0 +1,113 @@
+// Package markdown renders the messages of posts written in Markdown to HTML
+// that is safe to include in web pages.
+//
+// Messages are parsed as CommonMark by goldmark. Like on GitHub, bare http(s)
+// URLs are also turned into links. Images are rendered as links to the image,
+// so that pages do not load content from other sites. Raw HTML is never
+// interpreted: it is shown as text. The output is passed through Sanitize in
+// any case.
+package markdown
+
+import (
+	"bytes"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/util"
+)
+
+// blockParsers are the default block parsers of goldmark, except for the HTML
+// block parser: lines starting with a tag are paragraphs like others, whose
+// tags are shown as text by renderRawHTML.
+var blockParsers = []util.PrioritizedValue{
+	util.Prioritized(parser.NewSetextHeadingParser(), 100),
+	util.Prioritized(parser.NewThematicBreakParser(), 200),
+	util.Prioritized(parser.NewListParser(), 300),
+	util.Prioritized(parser.NewListItemParser(), 400),
+	util.Prioritized(parser.NewCodeBlockParser(), 500),
+	util.Prioritized(parser.NewATXHeadingParser(), 600),
+	util.Prioritized(parser.NewFencedCodeBlockParser(), 700),
+	util.Prioritized(parser.NewBlockquoteParser(), 800),
+	util.Prioritized(parser.NewParagraphParser(), 1000),
+}
+
+// converter renders Markdown with the default HTML renderer of goldmark, except
+// for the nodes handled by safeRenderer.
+var converter = goldmark.New(
+	goldmark.WithParser(parser.NewParser(
+		parser.WithBlockParsers(blockParsers...),
+		parser.WithInlineParsers(parser.DefaultInlineParsers()...),
+		parser.WithParagraphTransformers(parser.DefaultParagraphTransformers()...),
+	)),
+	goldmark.WithExtensions(extension.Linkify),
+	goldmark.WithRendererOptions(
+		// Renderers with lower values take precedence over the default
+		// one, which has a priority of 1000
+		renderer.WithNodeRenderers(util.Prioritized(safeRenderer{}, 100)),
+	),
+)
+
+// Render converts a Markdown document to sanitized HTML.
+func Render(source string) string {
+	var b bytes.Buffer
+
+	// Rendering can only fail when writing fails, which a bytes.Buffer
+	// never does
+	converter.Convert([]byte(source), &b)
+
+	return Sanitize(b.String())
+}
+
+// safeRenderer renders the nodes that would load content from other sites or
+// inject HTML in the page.
+type safeRenderer struct{}
+
+func (safeRenderer) RegisterFuncs(registerer renderer.NodeRendererFuncRegisterer) {
+	registerer.Register(ast.KindImage, renderImage)
+	registerer.Register(ast.KindRawHTML, renderRawHTML)
+}
+
+// renderImage renders images as links to the image, with the description of
+// the image as text.
+func renderImage(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		w.WriteString("</a>")
+		return ast.WalkContinue, nil
+	}
+
+	image := node.(*ast.Image)
+
+	w.WriteString(`<a href="`)
+	w.Write(util.EscapeHTML(util.URLEscape(image.Destination, true)))
+	w.WriteString(`"`)
+
+	if image.Title != nil {
+		w.WriteString(` title="`)
+		html.DefaultWriter.Write(w, image.Title)
+		w.WriteString(`"`)
+	}
+
+	w.WriteString(">")
+
+	return ast.WalkContinue, nil
+}
+
+// renderRawHTML renders inline HTML as text.
+func renderRawHTML(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+
+	segments := node.(*ast.RawHTML).Segments
+
+	for i := 0; i < segments.Len(); i++ {
+		segment := segments.At(i)
+		w.Write(util.EscapeHTML(segment.Value(source)))
+	}
+
+	return ast.WalkSkipChildren, nil
+}
@@ -0,0 +1,93 @@
+package markdown_test
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/abustany/back-message-board/pkg/markdown"
+)
+
+func TestRender(t *testing.T) {
+	testCases := []struct {
+		source   string
+		expected string
+	}{
+		{"Hello *world*, **bold** and ***both***", "<p>Hello <em>world</em>, <strong>bold</strong> and <em><strong>both</strong></em></p>\n"},
+		{"snake_case and _em_ and __strong__", "<p>snake_case and <em>em</em> and <strong>strong</strong></p>\n"},
+		{"**unclosed and \\*escaped\\*", "<p>**unclosed and *escaped*</p>\n"},
+		{"# Title #\n\nSome `<code>`\nsoft  \nhard", "<h1>Title</h1>\n<p>Some <code>&lt;code&gt;</code>\nsoft<br>\nhard</p>\n"},
+		{"Title\n===", "<h1>Title</h1>\n"},
+		{"- a\n- b\n  continued\n\n3. three\n4. four", "<ul>\n<li>a</li>\n<li>b\ncontinued</li>\n</ul>\n<ol start=\"3\">\n<li>three</li>\n<li>four</li>\n</ol>\n"},
+		{"> quote\nlazy\n\n***", "<blockquote>\n<p>quote\nlazy</p>\n</blockquote>\n<hr>\n"},
+		{"```go\nif a < b {}\n```", "<pre><code class=\"language-go\">if a &lt; b {}\n</code></pre>\n"},
+		{"    indented", "<pre><code>indented\n</code></pre>\n"},
+		{`[link](http://domain.com/a_(b) "title")`, `<p><a href="http://domain.com/a_(b)" title="title" rel="nofollow ugc">link</a></p>` + "\n"},
+		{"<https://domain.com> <john@domain.com>", `<p><a href="https://domain.com" rel="nofollow ugc">https://domain.com</a> <a href="mailto:john@domain.com" rel="nofollow ugc">john@domain.com</a></p>` + "\n"},
+		{"See https://domain.com/path.", `<p>See <a href="https://domain.com/path" rel="nofollow ugc">https://domain.com/path</a>.</p>` + "\n"},
+		{"![image](https://domain.com/image.png)", `<p><a href="https://domain.com/image.png" rel="nofollow ugc">image</a></p>` + "\n"},
+		{"[click](javascript:alert(1))", "<p>click</p>\n"},
+		{"<script>alert(1)</script> <b onclick=\"x\">", "<p>&lt;script&gt;alert(1)&lt;/script&gt; &lt;b onclick=&#34;x&#34;&gt;</p>\n"},
+		{"Hello <b>world</b>", "<p>Hello &lt;b&gt;world&lt;/b&gt;</p>\n"},
+		{"a &amp; b &copy; &lt;", "<p>a &amp; b © &lt;</p>\n"},
+		{"[foo][bar] and [bar]\n\n[bar]: https://domain.com \"title\"", `<p><a href="https://domain.com" title="title" rel="nofollow ugc">foo</a> and <a href="https://domain.com" title="title" rel="nofollow ugc">bar</a></p>` + "\n"},
+		{"hard  \nbreak  ", "<p>hard<br>\nbreak</p>\n"},
+	}
+
+	for _, testCase := range testCases {
+		if html := markdown.Render(testCase.source); html != testCase.expected {
+			t.Errorf("Unexpected rendering of %q: got %q, expected %q", testCase.source, html, testCase.expected)
+		}
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	testCases := []struct {
+		html     string
+		expected string
+	}{
+		{`<p>Hello <b>world</b></p>`, `<p>Hello world</p>`},
+		{`<a href="https://domain.com" rel="follow" target="_blank" onclick="x">link</a>`, `<a href="https://domain.com" rel="nofollow ugc">link</a>`},
+		{`<a href="javascript:alert(1)">link</a>`, `link`},
+		{`<a href=" javascript:alert(1)">link</a>`, `link`},
+		{`<a>link</a>`, `link`},
+		{`<a href="">link</a>`, `link`},
+		{`<script>alert("<p>")</script><style>p {}</style>text`, `text`},
+		{`<template><template></template><p>hidden</p></template>shown`, `shown`},
+		{`<em><strong>unclosed`, `<em><strong>unclosed</strong></em>`},
+		{`<p>stray</div></em></p>`, `<p>stray</p>`},
+		{`<ol start="3" class="x"><li>item</ol>`, `<ol start="3"><li>item</li></ol>`},
+		{`<code class="language-go">code</code><code class="x">code</code>`, `<code class="language-go">code</code><code>code</code>`},
+		{`<!-- comment -->&lt;escaped&gt;`, `&lt;escaped&gt;`},
+	}
+
+	for _, testCase := range testCases {
+		if html := markdown.Sanitize(testCase.html); html != testCase.expected {
+			t.Errorf("Unexpected sanitization of %q: got %q, expected %q", testCase.html, html, testCase.expected)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	cache := markdown.NewCache(2)
+
+	if html := cache.Render("1", "*v1*"); html != "<p><em>v1</em></p>\n" {
+		t.Errorf("Unexpected rendering: %q", html)
+	}
+
+	// New versions of a post replace the old one
+	if html := cache.Render("1", "*v2*"); html != "<p><em>v2</em></p>\n" || cache.Len() != 1 {
+		t.Errorf("Unexpected rendering of a new version: %q", html)
+	}
+
+	if html := cache.Render("1", "*v2*"); html != "<p><em>v2</em></p>\n" {
+		t.Errorf("Unexpected rendering of a cached version: %q", html)
+	}
+
+	for i := 2; i <= 4; i++ {
+		cache.Render(strconv.Itoa(i), "message")
+	}
+
+	if cache.Len() != 2 {
+		t.Errorf("Unexpected number of cached messages: %d", cache.Len())
+	}
+}
@@ -0,0 +1,196 @@
+package markdown
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+
+	xhtml "golang.org/x/net/html"
+)
+
+// allowedTags maps the tags kept by Sanitize to their allowed attributes.
+var allowedTags = map[string]map[string]bool{
+	"a":          {"href": true, "title": true},
+	"blockquote": {},
+	"br":         {},
+	"code":       {"class": true},
+	"em":         {},
+	"h1":         {},
+	"h2":         {},
+	"h3":         {},
+	"h4":         {},
+	"h5":         {},
+	"h6":         {},
+	"hr":         {},
+	"li":         {},
+	"ol":         {"start": true},
+	"p":          {},
+	"pre":        {},
+	"strong":     {},
+	"ul":         {},
+}
+
+// droppedTags are the tags whose content is removed along with them.
+var droppedTags = map[string]bool{
+	"iframe":   true,
+	"noscript": true,
+	"object":   true,
+	"script":   true,
+	"style":    true,
+	"template": true,
+	"textarea": true,
+	"title":    true,
+}
+
+// voidTags are the allowed tags without content nor end tag.
+var voidTags = map[string]bool{
+	"br": true,
+	"hr": true,
+}
+
+// allowedSchemes are the URL schemes allowed in links. Links without scheme
+// are relative to the page, and always allowed.
+var allowedSchemes = map[string]bool{
+	"http":   true,
+	"https":  true,
+	"mailto": true,
+}
+
+// LinkRel is the rel attribute of all the links, telling search engines that
+// they were added by users and should not be followed.
+const LinkRel = "nofollow ugc"
+
+var (
+	classRegexp = regexp.MustCompile(`^language-[A-Za-z0-9_+\-]+$`)
+	startRegexp = regexp.MustCompile(`^[0-9]{1,9}$`)
+)
+
+// safeURL returns true if the given URL can be linked to. Empty URLs, which
+// goldmark writes in place of dangerous ones, are not.
+func safeURL(value string) bool {
+	u, err := url.Parse(value)
+
+	return err == nil && value != "" && (u.Scheme == "" || allowedSchemes[strings.ToLower(u.Scheme)])
+}
+
+// safeAttribute returns true if the given attribute of an allowed tag can be
+// kept.
+func safeAttribute(tag string, attribute xhtml.Attribute) bool {
+	if attribute.Namespace != "" || !allowedTags[tag][attribute.Key] {
+		return false
+	}
+
+	switch attribute.Key {
+	case "href":
+		return safeURL(attribute.Val)
+	case "class":
+		return classRegexp.MatchString(attribute.Val)
+	case "start":
+		return startRegexp.MatchString(attribute.Val)
+	}
+
+	return true
+}
+
+// Sanitize removes from an HTML fragment all the tags and attributes that are
+// not explicitly allowed: only basic formatting, lists, code and links to
+// http(s) and mailto URLs are kept. The content of removed tags is kept as
+// text, except for scripts and the like. All links get a rel attribute of
+// LinkRel. Unclosed tags are closed, and stray end tags removed, so that the
+// fragment can be embedded in a page without changing its structure.
+func Sanitize(fragment string) string {
+	var b strings.Builder
+	var open []string
+	// Name and depth of the dropped tag whose content is being skipped
+	var dropped string
+	depth := 0
+
+	tokenizer := xhtml.NewTokenizer(strings.NewReader(fragment))
+
+	for {
+		tokenType := tokenizer.Next()
+
+		if tokenType == xhtml.ErrorToken {
+			break
+		}
+
+		token := tokenizer.Token()
+
+		if depth > 0 {
+			switch {
+			case tokenType == xhtml.StartTagToken && token.Data == dropped:
+				depth++
+			case tokenType == xhtml.EndTagToken && token.Data == dropped:
+				depth--
+			}
+
+			continue
+		}
+
+		switch tokenType {
+		case xhtml.TextToken:
+			b.WriteString(html.EscapeString(token.Data))
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken:
+			if droppedTags[token.Data] {
+				if tokenType == xhtml.StartTagToken {
+					dropped, depth = token.Data, 1
+				}
+
+				continue
+			}
+
+			if _, ok := allowedTags[token.Data]; !ok {
+				continue
+			}
+
+			var attributes strings.Builder
+
+			for _, attribute := range token.Attr {
+				if safeAttribute(token.Data, attribute) {
+					attributes.WriteString(" " + attribute.Key + `="` + html.EscapeString(attribute.Val) + `"`)
+				} else if token.Data == "a" && attribute.Key == "href" {
+					// Links to unsafe URLs are removed, and their
+					// content kept as text
+					attributes.Reset()
+					break
+				}
+			}
+
+			if token.Data == "a" {
+				if !strings.Contains(attributes.String(), " href=") {
+					continue
+				}
+
+				attributes.WriteString(` rel="` + LinkRel + `"`)
+			}
+
+			b.WriteString("<" + token.Data + attributes.String() + ">")
+
+			if !voidTags[token.Data] {
+				open = append(open, token.Data)
+			}
+		case xhtml.EndTagToken:
+			// End tags close all the tags opened after the matching
+			// start tag, and are ignored without start tag
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] != token.Data {
+					continue
+				}
+
+				for j := len(open) - 1; j >= i; j-- {
+					b.WriteString("</" + open[j] + ">")
+				}
+
+				open = open[:i]
+				break
+			}
+		}
+	}
+
+	for i := len(open) - 1; i >= 0; i-- {
+		b.WriteString("</" + open[i] + ">")
+	}
+
+	return b.String()
+}
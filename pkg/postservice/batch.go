@@ -0,0 +1,192 @@
+package postservice
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/abustany/back-message-board/pkg/poststore"
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+// BatchAction is the kind of change made by a BatchOperation.
+type BatchAction string
+
+const (
+	// BatchUpdate updates the fields of a post, like Service.Update.
+	BatchUpdate BatchAction = "update"
+
+	// BatchDelete deletes a post.
+	BatchDelete BatchAction = "delete"
+
+	// BatchSetState changes the state of a post.
+	BatchSetState BatchAction = "set_state"
+)
+
+// BatchOperation is a single change in a batch, see Service.Batch.
+type BatchOperation struct {
+	Action BatchAction
+	// ID of the post to change
+	ID string
+	// Fields to update, for BatchUpdate
+	Post   types.Post
+	Fields types.FieldMask
+	// New state of the post, for BatchSetState
+	State types.PostState
+}
+
+// BatchResult is the result of a single BatchOperation.
+type BatchResult struct {
+	// Post after the operation, empty for deletions or when Err is set
+	Post types.Post
+	// Error that prevented the operation to be applied, if any
+	Err error
+}
+
+// MaxBatchSize is the maximum number of operations in a batch.
+const MaxBatchSize = 1000
+
+// ErrInvalidBatchSize is returned by Service.Batch when given no operations, or
+// more than MaxBatchSize.
+var ErrInvalidBatchSize = &userError{errors.Errorf("Invalid batch size (should contain between 1 and %d operations)", MaxBatchSize), "invalid_batch_size", ""}
+
+// ErrInvalidAction is the error of batch operations with an unknown action.
+var ErrInvalidAction = &userError{errors.New("Invalid batch action (should be update, delete or set_state)"), "invalid_action", ""}
+
+// ErrBatchAborted is the error of the operations of an atomic batch that were
+// not applied because another operation failed.
+var ErrBatchAborted = &userError{errors.New("Operation not applied because another operation of the batch failed"), "batch_aborted", ""}
+
+// errBatchFailed aborts the transaction of an atomic batch.
+var errBatchFailed = errors.New("An operation of the batch failed")
+
+// validateOperation checks a batch operation before it is applied.
+func (s *postService) validateOperation(op *BatchOperation) error {
+	if op.ID == "" {
+		return ErrInvalidID
+	}
+
+	switch op.Action {
+	case BatchUpdate:
+		return s.validatePost(&op.Post, op.Fields)
+	case BatchDelete:
+		return nil
+	case BatchSetState:
+		if !op.State.Valid() {
+			return ErrInvalidState
+		}
+
+		return nil
+	}
+
+	return ErrInvalidAction
+}
+
+// applyOperation applies a validated batch operation in the given transaction.
+func applyOperation(tx poststore.Tx, op BatchOperation) (types.Post, error) {
+	var err error
+
+	switch op.Action {
+	case BatchUpdate:
+		op.Post.ID = op.ID
+		err = tx.Update(op.Post, op.Fields)
+	case BatchDelete:
+		err = tx.Delete(op.ID)
+	case BatchSetState:
+		err = tx.Update(types.Post{ID: op.ID, State: op.State}, types.FieldMask{types.FieldState})
+	}
+
+	if err == poststore.ErrIDNotFound {
+		return types.Post{}, ErrPostNotFound
+	}
+
+	if err != nil || op.Action == BatchDelete {
+		return types.Post{}, err
+	}
+
+	post, err := tx.Get(op.ID)
+	post.EditTokenHash = ""
+
+	return post, err
+}
+
+// abortBatch marks the successful operations of a batch as aborted.
+func abortBatch(results []BatchResult) {
+	for i := range results {
+		if results[i].Err == nil {
+			results[i] = BatchResult{Err: ErrBatchAborted}
+		}
+	}
+}
+
+func (s *postService) Batch(operations []BatchOperation, atomic bool) ([]BatchResult, error) {
+	if len(operations) == 0 || len(operations) > MaxBatchSize {
+		return nil, ErrInvalidBatchSize
+	}
+
+	results := make([]BatchResult, len(operations))
+	invalid := false
+
+	for i := range operations {
+		if err := s.validateOperation(&operations[i]); err != nil {
+			results[i].Err = errors.Wrap(err, "Invalid batch operation")
+			invalid = true
+		}
+	}
+
+	if invalid && atomic {
+		abortBatch(results)
+		return results, nil
+	}
+
+	// Posts before the batch, for the events
+	before := make([]types.Post, len(operations))
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	err := s.store.Transaction(func(tx poststore.Tx) error {
+		for i, op := range operations {
+			if results[i].Err != nil {
+				continue
+			}
+
+			before[i], _ = tx.Get(op.ID)
+
+			post, err := applyOperation(tx, op)
+
+			if err != nil && !IsUserError(err) {
+				return errors.Wrapf(err, "Error while applying batch operation %d", i)
+			}
+
+			results[i] = BatchResult{Post: post, Err: err}
+
+			if err != nil && atomic {
+				return errBatchFailed
+			}
+		}
+
+		return nil
+	})
+
+	if err == errBatchFailed {
+		abortBatch(results)
+		return results, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i, result := range results {
+		if result.Err != nil {
+			continue
+		}
+
+		if operations[i].Action == BatchDelete {
+			s.dispatch(PostDeleted{before[i]})
+		} else {
+			s.dispatch(PostUpdated{Before: before[i], After: result.Post})
+		}
+	}
+
+	return results, nil
+}
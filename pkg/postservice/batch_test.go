@@ -0,0 +1,147 @@
+package postservice_test
+
+import (
+	"testing"
+
+	"github.com/abustany/back-message-board/pkg/postservice"
+	"github.com/abustany/back-message-board/pkg/poststore"
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+func TestBatch(t *testing.T) {
+	withService := func(f func(*testing.T, postservice.Service)) func(*testing.T) {
+		return func(t *testing.T) {
+			store, err := poststore.NewMemoryPostStore()
+
+			if err != nil {
+				t.Fatalf("Error while creating post store: %s", err)
+			}
+
+			f(t, postservice.New(store))
+		}
+	}
+
+	t.Run("Validation", withService(testBatchValidation))
+	t.Run("Partial", withService(testBatchPartial))
+	t.Run("Atomic", withService(testBatchAtomic))
+}
+
+func batchOperations(posts []types.Post) []postservice.BatchOperation {
+	return []postservice.BatchOperation{
+		{Action: postservice.BatchUpdate, ID: posts[0].ID, Post: types.Post{Author: "Jane"}, Fields: types.FieldMask{types.FieldAuthor}},
+		{Action: postservice.BatchDelete, ID: posts[1].ID},
+		{Action: postservice.BatchSetState, ID: posts[2].ID, State: types.StateUnconfirmed},
+		{Action: postservice.BatchDelete, ID: "does not exist"},
+	}
+}
+
+func expectBatchErrors(t *testing.T, results []postservice.BatchResult, expected []error) {
+	if len(results) != len(expected) {
+		t.Fatalf("Unexpected number of results: got %d, expected %d", len(results), len(expected))
+	}
+
+	for i := range expected {
+		expectError(t, results[i].Err, expected[i])
+	}
+}
+
+func testBatchValidation(t *testing.T, service postservice.Service) {
+	expectError(t, errorOfBatch(service.Batch(nil, false)), postservice.ErrInvalidBatchSize)
+	expectError(t, errorOfBatch(service.Batch(make([]postservice.BatchOperation, postservice.MaxBatchSize+1), false)), postservice.ErrInvalidBatchSize)
+
+	results, err := service.Batch([]postservice.BatchOperation{
+		{Action: "whatever", ID: "ID"},
+		{Action: postservice.BatchDelete},
+		{Action: postservice.BatchSetState, ID: "ID", State: "whatever"},
+		{Action: postservice.BatchUpdate, ID: "ID", Fields: types.FieldMask{types.FieldAuthor}},
+	}, false)
+
+	if err != nil {
+		t.Fatalf("Batch returned an error: %s", err)
+	}
+
+	expectBatchErrors(t, results, []error{
+		postservice.ErrInvalidAction,
+		postservice.ErrInvalidID,
+		postservice.ErrInvalidState,
+		postservice.ErrInvalidAuthor,
+	})
+}
+
+func errorOfBatch(_ []postservice.BatchResult, err error) error {
+	return err
+}
+
+func addPosts(t *testing.T, service postservice.Service, n int) []types.Post {
+	posts := make([]types.Post, n)
+
+	for i := range posts {
+		posts[i], _ = addPost(t, service)
+	}
+
+	return posts
+}
+
+func testBatchPartial(t *testing.T, service postservice.Service) {
+	posts := addPosts(t, service, 3)
+
+	results, err := service.Batch(batchOperations(posts), false)
+
+	if err != nil {
+		t.Fatalf("Batch returned an error: %s", err)
+	}
+
+	expectBatchErrors(t, results, []error{nil, nil, nil, postservice.ErrPostNotFound})
+
+	posts[0].Author = "Jane"
+	posts[2].State = types.StateUnconfirmed
+
+	for _, i := range []int{0, 2} {
+		if !results[i].Post.Equal(posts[i]) {
+			t.Errorf("Unexpected post in result %d: got %+v, expected %+v", i, results[i].Post, posts[i])
+		}
+	}
+
+	listPosts(t, service, 2)
+
+	if _, err := service.Get(posts[1].ID); err != postservice.ErrPostNotFound {
+		t.Errorf("Unexpected error when getting a deleted post: got %v, expected %v", err, postservice.ErrPostNotFound)
+	}
+}
+
+func testBatchAtomic(t *testing.T, service postservice.Service) {
+	posts := addPosts(t, service, 3)
+
+	results, err := service.Batch(batchOperations(posts), true)
+
+	if err != nil {
+		t.Fatalf("Batch returned an error: %s", err)
+	}
+
+	expectBatchErrors(t, results, []error{
+		postservice.ErrBatchAborted,
+		postservice.ErrBatchAborted,
+		postservice.ErrBatchAborted,
+		postservice.ErrPostNotFound,
+	})
+
+	// Nothing was applied
+	for _, post := range posts {
+		stored, err := service.Get(post.ID)
+
+		if err != nil {
+			t.Errorf("Get returned an error: %s", err)
+		} else if !stored.Equal(post) {
+			t.Errorf("Post modified by an aborted batch: got %+v, expected %+v", stored, post)
+		}
+	}
+
+	results, err = service.Batch(batchOperations(posts)[:3], true)
+
+	if err != nil {
+		t.Fatalf("Batch returned an error: %s", err)
+	}
+
+	expectBatchErrors(t, results, []error{nil, nil, nil})
+	listPosts(t, service, 2)
+}
@@ -0,0 +1,231 @@
+package postservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/abustany/back-message-board/pkg/mailer"
+	"github.com/abustany/back-message-board/pkg/poststore"
+	"github.com/abustany/back-message-board/pkg/token"
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+// ConfirmationConfig configures the confirmation of email addresses.
+type ConfirmationConfig struct {
+	// Mailer used to send confirmation links
+	Mailer mailer.Mailer
+	// Signer used to sign confirmation tokens
+	Signer *token.Signer
+	// Prefix of confirmation links, the confirmation token is appended to it
+	URL string
+	// Duration after which unconfirmed posts expire
+	Expiry time.Duration
+}
+
+// WithConfirmation makes new posts unconfirmed until their author opens the
+// confirmation link sent to their email address.
+func WithConfirmation(config ConfirmationConfig) Option {
+	return func(s *postService) {
+		s.confirmation = &config
+	}
+}
+
+// ErrInvalidConfirmationToken is returned by Service.Confirm when given an
+// invalid or expired token.
+var ErrInvalidConfirmationToken = &userError{errors.New("Invalid or expired confirmation token"), "invalid_confirmation_token", ""}
+
+// confirmationPurpose distinguishes confirmation tokens from other tokens signed
+// with the same secret.
+const confirmationPurpose = "confirm"
+
+type confirmationToken struct {
+	Purpose string `json:"p"`
+	ID      string `json:"id"`
+	Expires int64  `json:"exp"`
+}
+
+func (s *postService) sendConfirmation(post types.Post) error {
+	payload, err := json.Marshal(confirmationToken{
+		Purpose: confirmationPurpose,
+		ID:      post.ID,
+		Expires: post.Created.Add(s.confirmation.Expiry).Unix(),
+	})
+
+	if err != nil {
+		return errors.Wrap(err, "Error while encoding confirmation token")
+	}
+
+	link := s.confirmation.URL + s.confirmation.Signer.Sign(payload)
+
+	body := fmt.Sprintf(`Hello %s,
+
+Please confirm your message on the message board by opening the following link:
+
+%s
+
+If you did not post this message, you can ignore this email. The message will be
+deleted if it is not confirmed within %s.
+`, post.Author, link, s.confirmation.Expiry)
+
+	return s.confirmation.Mailer.Send(mailer.Message{
+		To:      post.Email,
+		Subject: "Please confirm your message",
+		Body:    body,
+	})
+}
+
+func (s *postService) Confirm(confirmation string) error {
+	if s.confirmation == nil {
+		return ErrInvalidConfirmationToken
+	}
+
+	payload, err := s.confirmation.Signer.Verify(confirmation)
+
+	if err != nil {
+		return ErrInvalidConfirmationToken
+	}
+
+	var decoded confirmationToken
+
+	if err := json.Unmarshal(payload, &decoded); err != nil || decoded.Purpose != confirmationPurpose {
+		return ErrInvalidConfirmationToken
+	}
+
+	if time.Now().After(time.Unix(decoded.Expires, 0)) {
+		return ErrInvalidConfirmationToken
+	}
+
+	var post types.Post
+	confirmed := false
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	// The post is read and published under a single transaction, so that it
+	// cannot be deleted or edited in between
+	err = s.store.Transaction(func(tx poststore.Tx) error {
+		var err error
+
+		if post, err = tx.Get(decoded.ID); err != nil {
+			return err
+		}
+
+		if post.State != types.StateUnconfirmed {
+			// Confirmation links can be opened several times
+			return nil
+		}
+
+		confirmed = true
+
+		return tx.Update(types.Post{ID: post.ID, State: types.StatePublished}, types.FieldMask{types.FieldState})
+	})
+
+	if errors.Cause(err) == poststore.ErrIDNotFound {
+		return ErrInvalidConfirmationToken
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "Error while publishing post")
+	}
+
+	if confirmed {
+		published := post
+		published.State = types.StatePublished
+		s.dispatch(PostUpdated{Before: post, After: published})
+	}
+
+	return nil
+}
+
+func (s *postService) ExpireUnconfirmed() (uint, error) {
+	if s.confirmation == nil {
+		return 0, nil
+	}
+
+	deadline := time.Now().Add(-s.confirmation.Expiry)
+	var expired []types.Post
+
+	cursor := poststore.EmptyCursor
+
+	for {
+		posts, next, err := s.store.List(cursor, MaxPageSize)
+
+		if err != nil {
+			return 0, errors.Wrap(err, "Error while listing posts")
+		}
+
+		for _, post := range posts {
+			if post.State == types.StateUnconfirmed && post.Created.Before(deadline) {
+				expired = append(expired, post)
+			}
+		}
+
+		if next == poststore.EmptyCursor {
+			break
+		}
+
+		cursor = next
+	}
+
+	deleted := uint(0)
+
+	for _, candidate := range expired {
+		deletedNow, err := s.expire(candidate.ID, deadline)
+
+		if err != nil {
+			return deleted, err
+		}
+
+		if deletedNow {
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+// expire deletes the post with the given ID if it is still unconfirmed and was
+// created before the deadline, and returns whether it was deleted.
+func (s *postService) expire(id string, deadline time.Time) (bool, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	var post types.Post
+	expiredNow := false
+
+	// The post is checked again under the transaction, since it could have
+	// been confirmed, edited or deleted since it was listed
+	err := s.store.Transaction(func(tx poststore.Tx) error {
+		var err error
+
+		if post, err = tx.Get(id); err != nil {
+			return err
+		}
+
+		if post.State != types.StateUnconfirmed || !post.Created.Before(deadline) {
+			return nil
+		}
+
+		expiredNow = true
+
+		return tx.Delete(post.ID)
+	})
+
+	if errors.Cause(err) == poststore.ErrIDNotFound {
+		// Deleted in the meantime
+		return false, nil
+	}
+
+	if err != nil {
+		return false, errors.Wrapf(err, "Error while deleting expired post %s", id)
+	}
+
+	if expiredNow {
+		s.dispatch(PostDeleted{post})
+	}
+
+	return expiredNow, nil
+}
@@ -0,0 +1,228 @@
+package postservice_test
+
+import (
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/abustany/back-message-board/pkg/mailer"
+	"github.com/abustany/back-message-board/pkg/postservice"
+	"github.com/abustany/back-message-board/pkg/poststore"
+	"github.com/abustany/back-message-board/pkg/token"
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+const confirmationURL = "https://board.domain.com/confirm/"
+
+var confirmationLinkRegexp = regexp.MustCompile(regexp.QuoteMeta(confirmationURL) + `(\S+)`)
+
+func TestConfirmation(t *testing.T) {
+	withService := func(expiry time.Duration, f func(*testing.T, postservice.Service, string)) func(*testing.T) {
+		return func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "maildir")
+
+			if err != nil {
+				t.Fatalf("Error while creating temporary directory: %s", err)
+			}
+
+			defer os.RemoveAll(dir)
+
+			m, err := mailer.NewMaildirMailer(dir, "board@domain.com")
+
+			if err != nil {
+				t.Fatalf("NewMaildirMailer returned an error: %s", err)
+			}
+
+			store, err := poststore.NewMemoryPostStore()
+
+			if err != nil {
+				t.Fatalf("Error while creating post store: %s", err)
+			}
+
+			service := postservice.New(store, postservice.WithConfirmation(postservice.ConfirmationConfig{
+				Mailer: m,
+				Signer: token.NewSigner([]byte("secret")),
+				URL:    confirmationURL,
+				Expiry: expiry,
+			}))
+
+			f(t, service, dir)
+		}
+	}
+
+	t.Run("Confirm", withService(time.Hour, testConfirm))
+	t.Run("Expiry", withService(time.Millisecond, testConfirmExpiry))
+	t.Run("Concurrent changes", testConfirmConcurrentChanges)
+}
+
+// interferingStore calls a function before the next transaction, simulating a
+// change made concurrently.
+type interferingStore struct {
+	poststore.Store
+	before func()
+}
+
+func (s *interferingStore) Transaction(f func(tx poststore.Tx) error) error {
+	if before := s.before; before != nil {
+		s.before = nil
+		before()
+	}
+
+	return s.Store.Transaction(f)
+}
+
+func testConfirmConcurrentChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildir")
+
+	if err != nil {
+		t.Fatalf("Error while creating temporary directory: %s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	m, err := mailer.NewMaildirMailer(dir, "board@domain.com")
+
+	if err != nil {
+		t.Fatalf("NewMaildirMailer returned an error: %s", err)
+	}
+
+	memoryStore, err := poststore.NewMemoryPostStore()
+
+	if err != nil {
+		t.Fatalf("Error while creating post store: %s", err)
+	}
+
+	store := &interferingStore{Store: memoryStore}
+	service := postservice.New(store, postservice.WithConfirmation(postservice.ConfirmationConfig{
+		Mailer: m,
+		Signer: token.NewSigner([]byte("secret")),
+		URL:    confirmationURL,
+		Expiry: time.Hour,
+	}))
+
+	post, _, err := service.Add(types.Post{Author: validAuthor, Email: validEmail})
+
+	if err != nil {
+		t.Fatalf("Add returned an error: %s", err)
+	}
+
+	confirmation := readConfirmationToken(t, dir, validEmail)
+
+	// Makes the post expire, while keeping its token valid
+	memoryStore.Update(types.Post{ID: post.ID, Created: post.Created.Add(-2 * time.Hour)}, types.FieldMask{types.FieldCreated})
+
+	// Confirmed after being listed for expiry
+	store.before = func() {
+		memoryStore.Update(types.Post{ID: post.ID, State: types.StatePublished}, types.FieldMask{types.FieldState})
+	}
+
+	if n, err := service.ExpireUnconfirmed(); err != nil || n != 0 {
+		t.Errorf("ExpireUnconfirmed deleted %d posts (error %v), expected 0", n, err)
+	}
+
+	listPosts(t, service, 1)
+
+	// Deleted before being confirmed
+	memoryStore.Update(types.Post{ID: post.ID, State: types.StateUnconfirmed}, types.FieldMask{types.FieldState})
+	store.before = func() { memoryStore.Delete(post.ID) }
+
+	expectError(t, service.Confirm(confirmation), postservice.ErrInvalidConfirmationToken)
+}
+
+// readConfirmationToken extracts the confirmation token from the only message in
+// the Maildir.
+func readConfirmationToken(t *testing.T, dir, expectedRecipient string) string {
+	files, err := filepath.Glob(filepath.Join(dir, "new", "*"))
+
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected exactly one message in the Maildir, got %v (error %v)", files, err)
+	}
+
+	fd, err := os.Open(files[0])
+
+	if err != nil {
+		t.Fatalf("Error while opening message: %s", err)
+	}
+
+	defer fd.Close()
+
+	msg, err := mail.ReadMessage(fd)
+
+	if err != nil {
+		t.Fatalf("Error while parsing message: %s", err)
+	}
+
+	if to := msg.Header.Get("To"); to != expectedRecipient {
+		t.Errorf("Unexpected recipient: got %s, expected %s", to, expectedRecipient)
+	}
+
+	body, err := ioutil.ReadAll(msg.Body)
+
+	if err != nil {
+		t.Fatalf("Error while reading message: %s", err)
+	}
+
+	match := confirmationLinkRegexp.FindSubmatch(body)
+
+	if match == nil {
+		t.Fatalf("Could not find confirmation link in message: %s", body)
+	}
+
+	return string(match[1])
+}
+
+func testConfirm(t *testing.T, service postservice.Service, dir string) {
+	if _, _, err := service.Add(types.Post{Author: validAuthor, Email: validEmail}); err != nil {
+		t.Fatalf("Add returned an error: %s", err)
+	}
+
+	posts := listPosts(t, service, 1)
+
+	if posts[0].State != types.StateUnconfirmed {
+		t.Errorf("Unexpected state for new post: got %s, expected %s", posts[0].State, types.StateUnconfirmed)
+	}
+
+	confirmation := readConfirmationToken(t, dir, validEmail)
+
+	expectError(t, service.Confirm("x"+confirmation), postservice.ErrInvalidConfirmationToken)
+
+	// Confirming several times is fine
+	for i := 0; i < 2; i++ {
+		if err := service.Confirm(confirmation); err != nil {
+			t.Errorf("Confirm returned an error: %s", err)
+		}
+	}
+
+	posts = listPosts(t, service, 1)
+
+	if posts[0].State != types.StatePublished {
+		t.Errorf("Unexpected state for confirmed post: got %s, expected %s", posts[0].State, types.StatePublished)
+	}
+
+	// Confirmed posts never expire
+	if n, err := service.ExpireUnconfirmed(); err != nil || n != 0 {
+		t.Errorf("ExpireUnconfirmed deleted %d posts (error %v), expected 0", n, err)
+	}
+}
+
+func testConfirmExpiry(t *testing.T, service postservice.Service, dir string) {
+	if _, _, err := service.Add(types.Post{Author: validAuthor, Email: validEmail}); err != nil {
+		t.Fatalf("Add returned an error: %s", err)
+	}
+
+	confirmation := readConfirmationToken(t, dir, validEmail)
+
+	time.Sleep(10 * time.Millisecond)
+
+	if n, err := service.ExpireUnconfirmed(); err != nil || n != 1 {
+		t.Errorf("ExpireUnconfirmed deleted %d posts (error %v), expected 1", n, err)
+	}
+
+	listPosts(t, service, 0)
+
+	expectError(t, service.Confirm(confirmation), postservice.ErrInvalidConfirmationToken)
+}
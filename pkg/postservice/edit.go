@@ -0,0 +1,150 @@
+package postservice
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/abustany/back-message-board/pkg/poststore"
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+// DefaultEditWindow is the default duration after the creation of a post during
+// which its author can edit or delete it.
+const DefaultEditWindow = 15 * time.Minute
+
+// editTokenLength is the number of random bytes in edit tokens.
+const editTokenLength = 32
+
+// WithEditWindow sets the duration after the creation of a post during which its
+// author can edit or delete it, see Service.AuthorUpdate. Setting it to 0
+// disables author edits.
+func WithEditWindow(window time.Duration) Option {
+	return func(s *postService) {
+		s.editWindow = window
+	}
+}
+
+// ErrInvalidEditToken is returned by Service.AuthorUpdate and
+// Service.AuthorDelete when given a token that does not match the post.
+var ErrInvalidEditToken = &userError{errors.New("Invalid edit token"), "invalid_edit_token", ""}
+
+// ErrEditWindowClosed is returned by Service.AuthorUpdate and
+// Service.AuthorDelete when the post was created too long ago to be edited by
+// its author.
+var ErrEditWindowClosed = &userError{errors.New("This post cannot be edited anymore"), "edit_window_closed", ""}
+
+// newEditToken returns a new random edit token, and its hash that should be
+// stored in the post.
+func newEditToken() (string, string, error) {
+	data := make([]byte, editTokenLength)
+
+	if _, err := rand.Read(data); err != nil {
+		return "", "", errors.Wrap(err, "Error while generating edit token")
+	}
+
+	editToken := base64.RawURLEncoding.EncodeToString(data)
+
+	return editToken, hashEditToken(editToken), nil
+}
+
+func hashEditToken(editToken string) string {
+	hash := sha256.Sum256([]byte(editToken))
+
+	return hex.EncodeToString(hash[:])
+}
+
+// checkEditToken retrieves the post with the given ID, and checks that its author
+// can still edit it with the given token.
+func (s *postService) checkEditToken(id, editToken string) (types.Post, error) {
+	post, err := s.store.Get(id)
+
+	if err == poststore.ErrIDNotFound {
+		return types.Post{}, ErrInvalidEditToken
+	}
+
+	if err != nil {
+		return types.Post{}, errors.Wrap(err, "Error while retrieving post")
+	}
+
+	if post.EditTokenHash == "" || editToken == "" {
+		return types.Post{}, ErrInvalidEditToken
+	}
+
+	if subtle.ConstantTimeCompare([]byte(post.EditTokenHash), []byte(hashEditToken(editToken))) != 1 {
+		return types.Post{}, ErrInvalidEditToken
+	}
+
+	if time.Since(post.Created) > s.editWindow {
+		return types.Post{}, ErrEditWindowClosed
+	}
+
+	return post, nil
+}
+
+// authorFields is the mask of the fields that authors can update.
+var authorFields = types.FieldMask{types.FieldAuthor, types.FieldEmail, types.FieldMessage}
+
+func (s *postService) AuthorUpdate(id, editToken string, post types.Post, fields types.FieldMask) (types.Post, error) {
+	existing, err := s.checkEditToken(id, editToken)
+
+	if err != nil {
+		return types.Post{}, err
+	}
+
+	var allowed types.FieldMask
+
+	for _, field := range fields {
+		if authorFields.Has(field) {
+			allowed = append(allowed, field)
+		}
+	}
+
+	patch := types.Post{
+		ID:      id,
+		Author:  post.Author,
+		Email:   post.Email,
+		Message: post.Message,
+	}
+
+	if err := s.validatePost(&patch, allowed); err != nil {
+		return types.Post{}, errors.Wrap(err, "Invalid post data")
+	}
+
+	if allowed.Has(types.FieldEmail) && patch.Email != existing.Email && s.confirmation != nil {
+		return types.Post{}, &reasonError{ErrInvalidEmail, "cannot be changed when email addresses need to be confirmed"}
+	}
+
+	return s.update(patch, allowed)
+}
+
+func (s *postService) AuthorDelete(id, editToken string) error {
+	post, err := s.checkEditToken(id, editToken)
+
+	if err != nil {
+		return err
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	err = s.store.Delete(id)
+
+	if err == poststore.ErrIDNotFound {
+		// Deleted in the meantime
+		return ErrInvalidEditToken
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "Error while deleting post from store")
+	}
+
+	s.dispatch(PostDeleted{post})
+
+	return nil
+}
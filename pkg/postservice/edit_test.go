@@ -0,0 +1,133 @@
+package postservice_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/abustany/back-message-board/pkg/postservice"
+	"github.com/abustany/back-message-board/pkg/poststore"
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+func TestAuthorEdit(t *testing.T) {
+	withService := func(window time.Duration, f func(*testing.T, postservice.Service)) func(*testing.T) {
+		return func(t *testing.T) {
+			store, err := poststore.NewMemoryPostStore()
+
+			if err != nil {
+				t.Fatalf("Error while creating post store: %s", err)
+			}
+
+			f(t, postservice.New(store, postservice.WithEditWindow(window)))
+		}
+	}
+
+	t.Run("Update", withService(time.Hour, testAuthorUpdate))
+	t.Run("Delete", withService(time.Hour, testAuthorDelete))
+	t.Run("Window", withService(time.Millisecond, testAuthorEditWindow))
+}
+
+func addPost(t *testing.T, service postservice.Service) (types.Post, string) {
+	post := types.Post{
+		Author:  validAuthor,
+		Email:   validEmail,
+		Message: validMessage,
+	}
+
+	created, editToken, err := service.Add(post)
+
+	if err != nil {
+		t.Fatalf("Add returned an error: %s", err)
+	}
+
+	if editToken == "" {
+		t.Fatalf("Add returned an empty edit token")
+	}
+
+	post, err = service.Get(created.ID)
+
+	if err != nil {
+		t.Fatalf("Get returned an error: %s", err)
+	}
+
+	if post.EditTokenHash != "" {
+		t.Errorf("Get should not return the hash of the edit token")
+	}
+
+	return post, editToken
+}
+
+func testAuthorUpdate(t *testing.T, service postservice.Service) {
+	post, editToken := addPost(t, service)
+
+	expectError(t, errorOf(service.AuthorUpdate(post.ID, "", types.Post{Message: "x"}, types.FieldMask{types.FieldMessage})), postservice.ErrInvalidEditToken)
+	expectError(t, errorOf(service.AuthorUpdate(post.ID, "x"+editToken, types.Post{Message: "x"}, types.FieldMask{types.FieldMessage})), postservice.ErrInvalidEditToken)
+	expectError(t, errorOf(service.AuthorUpdate("does not exist", editToken, types.Post{Message: "x"}, types.FieldMask{types.FieldMessage})), postservice.ErrInvalidEditToken)
+	expectError(t, errorOf(service.AuthorUpdate(post.ID, editToken, types.Post{Message: tooLongMessage}, types.FieldMask{types.FieldMessage})), postservice.ErrInvalidMessage)
+
+	// Only the author, email and message can be updated
+	patch := types.Post{
+		ID:      "other ID",
+		Message: "Fixed a typo",
+		Created: time.Now().Add(time.Hour),
+		State:   types.StateUnconfirmed,
+	}
+
+	updated, err := service.AuthorUpdate(post.ID, editToken, patch, types.NonZeroFields(patch))
+
+	if err != nil {
+		t.Fatalf("AuthorUpdate returned an error: %s", err)
+	}
+
+	post.Message = patch.Message
+
+	if !updated.Equal(post) {
+		t.Errorf("AuthorUpdate returned an unexpected post: got %+v, expected %+v", updated, post)
+	}
+
+	posts := listPosts(t, service, 1)
+
+	if !posts[0].Equal(post) {
+		t.Errorf("Unexpected post after author update: got %+v, expected %+v", posts[0], post)
+	}
+
+	if posts[0].EditTokenHash != "" {
+		t.Errorf("List should not return the hash of the edit token")
+	}
+
+	// The admin updating the post does not invalidate the token
+	if _, err := service.Update(types.Post{ID: post.ID, Author: "Admin"}, types.FieldMask{types.FieldAuthor}); err != nil {
+		t.Fatalf("Update returned an error: %s", err)
+	}
+
+	if _, err := service.AuthorUpdate(post.ID, editToken, types.Post{Author: "John"}, types.FieldMask{types.FieldAuthor}); err != nil {
+		t.Errorf("AuthorUpdate returned an error after an admin update: %s", err)
+	}
+}
+
+func testAuthorDelete(t *testing.T, service postservice.Service) {
+	post, editToken := addPost(t, service)
+
+	expectError(t, service.AuthorDelete(post.ID, "x"+editToken), postservice.ErrInvalidEditToken)
+
+	listPosts(t, service, 1)
+
+	if err := service.AuthorDelete(post.ID, editToken); err != nil {
+		t.Fatalf("AuthorDelete returned an error: %s", err)
+	}
+
+	listPosts(t, service, 0)
+
+	expectError(t, service.AuthorDelete(post.ID, editToken), postservice.ErrInvalidEditToken)
+}
+
+func testAuthorEditWindow(t *testing.T, service postservice.Service) {
+	post, editToken := addPost(t, service)
+
+	time.Sleep(5 * time.Millisecond)
+
+	expectError(t, errorOf(service.AuthorUpdate(post.ID, editToken, types.Post{Message: "x"}, types.FieldMask{types.FieldMessage})), postservice.ErrEditWindowClosed)
+	expectError(t, service.AuthorDelete(post.ID, editToken), postservice.ErrEditWindowClosed)
+
+	listPosts(t, service, 1)
+}
@@ -1,13 +1,14 @@
 package postservice
 
-import (
-	"github.com/pkg/errors"
-)
-
 // userError is used to mark errors caused by a wrong input from the user (as
 // opposed to runtime errors).
+//
+// Each user error has a stable, machine readable code, and optionally the name
+// of the post field that caused it.
 type userError struct {
-	err error
+	err   error
+	code  string
+	field string
 }
 
 func (e *userError) Error() string {
@@ -17,29 +18,89 @@ func (e *userError) Error() string {
 // Type assertion to make sure we implement error correctly...
 var _ error = &userError{}
 
+// reasonError gives a more specific reason for a user error, while keeping it
+// as its cause.
+type reasonError struct {
+	cause  *userError
+	reason string
+}
+
+func (e *reasonError) Error() string {
+	return e.cause.Error() + ": " + e.reason
+}
+
+func (e *reasonError) Cause() error {
+	return e.cause
+}
+
+type causer interface {
+	Cause() error
+}
+
 // IsUserError checks if the given error is flagged as an error caused by a
 // malformed user input or if it is a "normal" runtime error.
 func IsUserError(e error) bool {
 	return UserError(e) != nil
 }
 
-// UserError returns the user error inside the given error if any, or nil if e
-// is nil or not a user error.
-func UserError(e error) error {
+// findUserError walks the chain of causes of e, and returns the first user error
+// found, or nil.
+func findUserError(e error) error {
 	for e != nil {
-		if uerror, ok := e.(*userError); ok {
-			return uerror.err
+		switch e.(type) {
+		case *userError, *reasonError:
+			return e
 		}
 
-		cause := errors.Cause(e)
+		cause, ok := e.(causer)
 
-		if cause == e {
-			// e didn't implement errors.causer
+		if !ok {
 			return nil
 		}
 
-		e = cause
+		e = cause.Cause()
+	}
+
+	return nil
+}
+
+// UserError returns the user error inside the given error if any, or nil if e
+// is nil or not a user error.
+func UserError(e error) error {
+	switch uerror := findUserError(e).(type) {
+	case *userError:
+		return uerror.err
+	case *reasonError:
+		return uerror
 	}
 
 	return nil
 }
+
+// ErrorCode returns the machine readable code of the user error inside the given
+// error, like "invalid_author", or an empty string if e is not a user error.
+// Each user error exported by this package has its own code.
+func ErrorCode(e error) string {
+	switch uerror := findUserError(e).(type) {
+	case *userError:
+		return uerror.code
+	case *reasonError:
+		return uerror.cause.code
+	}
+
+	return ""
+}
+
+// ErrorField returns the name of the post field (as serialized in JSON) that
+// caused the user error inside the given error. It returns an empty string if
+// e is not a user error, or if the error is not related to a specific field.
+func ErrorField(e error) string {
+	switch uerror := findUserError(e).(type) {
+	case *userError:
+		return uerror.field
+	case *reasonError:
+		return uerror.cause.field
+	}
+
+	return ""
+}
@@ -0,0 +1,65 @@
+package postservice_test
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/abustany/back-message-board/pkg/postservice"
+	"github.com/abustany/back-message-board/pkg/poststore"
+)
+
+func TestErrorCodes(t *testing.T) {
+	userErrors := []error{
+		postservice.ErrInvalidID,
+		postservice.ErrInvalidAuthor,
+		postservice.ErrInvalidEmail,
+		postservice.ErrInvalidMessage,
+		postservice.ErrInvalidCreated,
+		postservice.ErrPostNotFound,
+		postservice.ErrInvalidState,
+		postservice.ErrInvalidCursor,
+		postservice.ErrInvalidPageSize,
+		postservice.ErrInvalidConfirmationToken,
+		postservice.ErrInvalidEditToken,
+		postservice.ErrEditWindowClosed,
+		postservice.ErrInvalidBatchSize,
+		postservice.ErrInvalidAction,
+		postservice.ErrBatchAborted,
+		postservice.ErrDuplicateID,
+		postservice.ErrInvalidConflictPolicy,
+	}
+
+	seen := map[string]error{}
+
+	for _, err := range userErrors {
+		code := postservice.ErrorCode(err)
+
+		if code == "" {
+			t.Errorf("Error %v has no code", err)
+			continue
+		}
+
+		if other, exists := seen[code]; exists {
+			t.Errorf("Errors %v and %v have the same code %s", other, err, code)
+		}
+
+		seen[code] = err
+
+		if wrapped := errors.Wrap(err, "context"); postservice.ErrorCode(wrapped) != code {
+			t.Errorf("Wrapping error %v changed its code from %s to %s", err, code, postservice.ErrorCode(wrapped))
+		}
+	}
+
+	if code := postservice.ErrorCode(errors.New("runtime error")); code != "" {
+		t.Errorf("Unexpected code for a runtime error: %s", code)
+	}
+
+	if field := postservice.ErrorField(postservice.ErrInvalidAuthor); field != "author" {
+		t.Errorf("Unexpected field for ErrInvalidAuthor: %s", field)
+	}
+
+	if postservice.UserError(postservice.ErrPostNotFound) != poststore.ErrIDNotFound {
+		t.Errorf("UserError should return poststore.ErrIDNotFound for ErrPostNotFound")
+	}
+}
@@ -0,0 +1,28 @@
+package postservice
+
+import (
+	"github.com/abustany/back-message-board/pkg/events"
+)
+
+// WithEventBus publishes an event on the given bus after each change made to
+// the posts in the store, see the events package. The bus is a synchronous
+// subscriber, see WithSubscriber.
+func WithEventBus(bus *events.Bus) Option {
+	return WithSubscriber(&busSubscriber{bus})
+}
+
+// busSubscriber publishes the events of the service on an events.Bus.
+type busSubscriber struct {
+	bus *events.Bus
+}
+
+func (b *busSubscriber) HandleEvent(event Event) {
+	switch e := event.(type) {
+	case PostCreated:
+		b.bus.Publish(events.Created, e.Post)
+	case PostUpdated:
+		b.bus.PublishUpdate(e.Before, e.After)
+	case PostDeleted:
+		b.bus.Publish(events.Deleted, e.Post)
+	}
+}
@@ -0,0 +1,130 @@
+package postservice_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/abustany/back-message-board/pkg/events"
+	"github.com/abustany/back-message-board/pkg/postservice"
+	"github.com/abustany/back-message-board/pkg/poststore"
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+// expectEvents reads the events waiting in the subscription, and checks their
+// types and post IDs.
+func expectEvents(t *testing.T, subscription *events.Subscription, expectedTypes []events.Type, expectedIDs []string) {
+	for i := range expectedTypes {
+		select {
+		case event := <-subscription.C:
+			if event.Type != expectedTypes[i] || event.Post.ID != expectedIDs[i] {
+				t.Errorf("Unexpected event %d: got %s %s, expected %s %s", i, event.Type, event.Post.ID, expectedTypes[i], expectedIDs[i])
+			}
+
+			if event.Post.EditTokenHash != "" {
+				t.Errorf("Event %d leaks the hash of the edit token", i)
+			}
+		default:
+			t.Fatalf("Missing event %d: expected %s %s", i, expectedTypes[i], expectedIDs[i])
+		}
+	}
+
+	select {
+	case event := <-subscription.C:
+		t.Errorf("Unexpected event: %+v", event)
+	default:
+	}
+}
+
+func TestEvents(t *testing.T) {
+	store, err := poststore.NewMemoryPostStore()
+
+	if err != nil {
+		t.Fatalf("Error while creating post store: %s", err)
+	}
+
+	bus := events.NewBus(0)
+	service := postservice.New(store, postservice.WithEventBus(bus))
+	subscription := bus.Subscribe()
+	defer subscription.Close()
+
+	post, editToken := addPost(t, service)
+	expectEvents(t, subscription, []events.Type{events.Created}, []string{post.ID})
+
+	post.Message = "Updated"
+
+	if _, err := service.Update(post, types.FieldMask{types.FieldMessage}); err != nil {
+		t.Fatalf("Update returned an error: %s", err)
+	}
+
+	// Failed changes publish nothing
+	if _, err := service.Update(types.Post{ID: "whatever"}, types.FieldMask{types.FieldMessage}); err == nil {
+		t.Fatalf("Update of an unknown post did not return an error")
+	}
+
+	expectEvents(t, subscription, []events.Type{events.Updated}, []string{post.ID})
+
+	if err := service.AuthorDelete(post.ID, editToken); err != nil {
+		t.Fatalf("AuthorDelete returned an error: %s", err)
+	}
+
+	expectEvents(t, subscription, []events.Type{events.Deleted}, []string{post.ID})
+
+	posts := addPosts(t, service, 2)
+	expectEvents(t, subscription, []events.Type{events.Created, events.Created}, []string{posts[0].ID, posts[1].ID})
+
+	operations := []postservice.BatchOperation{
+		{Action: postservice.BatchSetState, ID: posts[0].ID, State: types.StateUnconfirmed},
+		{Action: postservice.BatchDelete, ID: posts[1].ID},
+		{Action: postservice.BatchDelete, ID: "whatever"},
+	}
+
+	if _, err := service.Batch(operations, false); err != nil {
+		t.Fatalf("Batch returned an error: %s", err)
+	}
+
+	expectEvents(t, subscription, []events.Type{events.Updated, events.Deleted}, []string{posts[0].ID, posts[1].ID})
+
+	// Nothing is published for aborted batches
+	if _, err := service.Batch(operations, true); err != nil {
+		t.Fatalf("Batch returned an error: %s", err)
+	}
+
+	expectEvents(t, subscription, nil, nil)
+
+	data := `{"id": "ID1", "author": "John", "email": "john@domain.com", "created": "2017-12-14T06:20:33-08:00"}
+{"id": "` + posts[0].ID + `", "author": "John", "email": "john@domain.com", "created": "2017-12-14T06:20:33-08:00"}
+`
+
+	if _, err := service.Import(poststore.NewNDJSONDecoder(strings.NewReader(data)), postservice.ImportOptions{Conflicts: postservice.ConflictOverwrite}); err != nil {
+		t.Fatalf("Import returned an error: %s", err)
+	}
+
+	expectEvents(t, subscription, []events.Type{events.Created, events.Updated}, []string{"ID1", posts[0].ID})
+
+	// Nothing is published for imports aborted on a conflict, even for the
+	// posts added before it
+	data = `{"id": "ID2", "author": "John", "email": "john@domain.com", "created": "2017-12-14T06:20:33-08:00"}
+{"id": "ID1", "author": "John", "email": "john@domain.com", "created": "2017-12-14T06:20:33-08:00"}
+`
+
+	if _, err := service.Import(poststore.NewNDJSONDecoder(strings.NewReader(data)), postservice.ImportOptions{Conflicts: postservice.ConflictFail, ParallelOptions: poststore.ParallelOptions{BatchSize: 1}}); err == nil {
+		t.Fatalf("Import did not return an error for a conflict")
+	}
+
+	expectEvents(t, subscription, nil, nil)
+
+	data = `{"id": "ID3", "author": "John", "email": "john@domain.com", "created": "2017-12-14T06:20:33-08:00"}
+`
+
+	if _, err := service.Import(poststore.NewNDJSONDecoder(strings.NewReader(data)), postservice.ImportOptions{Conflicts: postservice.ConflictFail}); err != nil {
+		t.Fatalf("Import returned an error: %s", err)
+	}
+
+	expectEvents(t, subscription, []events.Type{events.Created}, []string{"ID3"})
+
+	if _, err := service.Import(poststore.NewNDJSONDecoder(strings.NewReader(data)), postservice.ImportOptions{Conflicts: postservice.ConflictOverwrite, DryRun: true}); err != nil {
+		t.Fatalf("Import returned an error: %s", err)
+	}
+
+	expectEvents(t, subscription, nil, nil)
+}
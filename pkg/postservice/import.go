@@ -0,0 +1,372 @@
+package postservice
+
+import (
+	"github.com/pkg/errors"
+	"github.com/satori/go.uuid"
+
+	"github.com/abustany/back-message-board/pkg/poststore"
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+// ConflictPolicy tells what Service.Import does with imported posts whose ID
+// already exists in the store.
+type ConflictPolicy string
+
+const (
+	// ConflictSkip keeps the existing post, and reports the imported one as
+	// skipped.
+	ConflictSkip ConflictPolicy = "skip"
+
+	// ConflictOverwrite replaces the existing post with the imported one. The
+	// edit token of the existing post stays valid.
+	ConflictOverwrite ConflictPolicy = "overwrite"
+
+	// ConflictFail aborts the import, and removes the posts it already added.
+	// No PostCreated event is dispatched before the import succeeds.
+	ConflictFail ConflictPolicy = "fail"
+)
+
+// ParseConflictPolicy parses the name of a conflict policy, like "skip".
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(s); policy {
+	case ConflictSkip, ConflictOverwrite, ConflictFail:
+		return policy, nil
+	}
+
+	return "", ErrInvalidConflictPolicy
+}
+
+// ImportOptions configures Service.Import.
+type ImportOptions struct {
+	// What to do with posts whose ID already exists, ConflictSkip if empty
+	Conflicts ConflictPolicy
+	// If true, the posts are checked but the store is left untouched. The
+	// report tells what would have been imported.
+	DryRun bool
+	// Records are parsed and validated in parallel, and added to the store in
+	// batches
+	poststore.ParallelOptions
+	// If true, all the posts are added to the store in a single batch once the
+	// whole file is decoded, which lets the store build its indexes at once
+	// (see poststore.Store.AddBatch). This is faster when loading a large file
+	// into an empty store, but the whole file is kept in memory, and Progress
+	// is only called at the end.
+	Bulk bool
+	// If not nil, closing this channel stops the import, which then returns
+	// ErrImportCanceled. The posts imported until then are kept.
+	Cancel <-chan struct{}
+	// If not nil, called after each batch of records with the report so far
+	Progress func(report ImportReport)
+	// If not nil, called with each record that was skipped or invalid, in the
+	// order of the file. The error of the record is set.
+	Rejected func(record poststore.DecodedRecord)
+}
+
+// ErrImportCanceled is returned by Service.Import when the import is canceled,
+// see ImportOptions.Cancel.
+var ErrImportCanceled = errors.New("Import canceled")
+
+// ImportReport summarizes the result of Service.Import.
+type ImportReport struct {
+	// Number of posts added to the store
+	Inserted uint
+	// Number of existing posts replaced, with ConflictOverwrite
+	Overwritten uint
+	// Number of posts not imported because their ID already exists, with
+	// ConflictSkip
+	Skipped uint
+	// Number of records that could not be decoded, or failed validation
+	Invalid uint
+	// Errors of the first poststore.MaxReportedErrors skipped or invalid
+	// records
+	Errors []*poststore.RecordError
+}
+
+func (r *ImportReport) addError(counter *uint, err *poststore.RecordError) {
+	*counter++
+
+	if len(r.Errors) < poststore.MaxReportedErrors {
+		r.Errors = append(r.Errors, err)
+	}
+}
+
+// ErrDuplicateID is the error of imported posts whose ID already exists in the
+// store. UserError returns poststore.ErrIDAlreadyExists for this error.
+var ErrDuplicateID = &userError{poststore.ErrIDAlreadyExists, "duplicate_id", "id"}
+
+// ErrInvalidConflictPolicy is returned by Service.Import when given an unknown
+// conflict policy.
+var ErrInvalidConflictPolicy = &userError{errors.New("Invalid conflict policy (should be skip, overwrite or fail)"), "invalid_conflict_policy", ""}
+
+// importer holds the state of a running import.
+type importer struct {
+	service *postService
+	options ImportOptions
+	// IDs of the posts checked in dry run mode
+	seen map[string]struct{}
+	// Posts added to the store, to remove them if the import fails
+	inserted []types.Post
+	// Events of the posts added with ConflictFail, dispatched once the
+	// import succeeds. They come after the events of the changes made to
+	// these posts during the import.
+	pending []Event
+}
+
+// exists tells whether a post with the given ID already exists in the store, or
+// was already checked in dry run mode.
+func (im *importer) exists(id string) (bool, error) {
+	if _, seen := im.seen[id]; seen {
+		return true, nil
+	}
+
+	im.seen[id] = struct{}{}
+
+	_, err := im.service.store.Get(id)
+
+	if err == poststore.ErrIDNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// addBatch adds a batch of validated posts to the store, and returns the error
+// of each post like Store.AddBatch.
+func (im *importer) addBatch(posts []types.Post) ([]error, error) {
+	if !im.options.DryRun {
+		errs := im.service.store.AddBatch(posts)
+
+		if im.options.Conflicts == ConflictFail {
+			for i, post := range posts {
+				if errs == nil || errs[i] == nil {
+					im.inserted = append(im.inserted, post)
+				}
+			}
+		}
+
+		return errs, nil
+	}
+
+	errs := make([]error, len(posts))
+
+	for i, post := range posts {
+		exists, err := im.exists(post.ID)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if exists {
+			errs[i] = poststore.ErrIDAlreadyExists
+		}
+	}
+
+	return errs, nil
+}
+
+// importBatch imports a batch of decoded records, and updates the report.
+func (im *importer) importBatch(batch []poststore.DecodedRecord, report *ImportReport) error {
+	select {
+	case <-im.options.Cancel:
+		return ErrImportCanceled
+	default:
+	}
+
+	im.service.writeLock.Lock()
+	defer im.service.writeLock.Unlock()
+
+	posts := make([]types.Post, 0, len(batch))
+
+	for _, record := range batch {
+		if record.Err == nil {
+			posts = append(posts, record.Post)
+		}
+	}
+
+	errs, err := im.addBatch(posts)
+
+	if err != nil {
+		return errors.Wrapf(err, "Error while importing posts for records %d to %d", batch[0].Record, batch[len(batch)-1].Record)
+	}
+
+	// Index of the current record in posts
+	i := 0
+
+	for _, record := range batch {
+		if record.Err != nil {
+			report.addError(&report.Invalid, &poststore.RecordError{Record: record.Record, Err: record.Err})
+			im.reject(record)
+			continue
+		}
+
+		var err error
+
+		if errs != nil {
+			err = errs[i]
+		}
+
+		i++
+
+		if err == nil {
+			if !im.options.DryRun {
+				im.dispatch(PostCreated{record.Post})
+			}
+
+			report.Inserted++
+			continue
+		}
+
+		if err != poststore.ErrIDAlreadyExists {
+			return errors.Wrapf(err, "Error while importing post for record %d", record.Record)
+		}
+
+		switch im.options.Conflicts {
+		case ConflictOverwrite:
+			if !im.options.DryRun {
+				before, err := im.overwrite(record.Post)
+
+				if err != nil {
+					return errors.Wrapf(err, "Error while overwriting post for record %d", record.Record)
+				}
+
+				im.service.dispatch(PostUpdated{Before: before, After: record.Post})
+			}
+
+			report.Overwritten++
+		case ConflictFail:
+			return &poststore.RecordError{Record: record.Record, Err: ErrDuplicateID}
+		default:
+			report.addError(&report.Skipped, &poststore.RecordError{Record: record.Record, Err: ErrDuplicateID})
+			record.Err = ErrDuplicateID
+			im.reject(record)
+		}
+	}
+
+	if im.options.Progress != nil {
+		im.options.Progress(*report)
+	}
+
+	return nil
+}
+
+// overwrite replaces an existing post with an imported one, and returns the
+// replaced post.
+func (im *importer) overwrite(post types.Post) (types.Post, error) {
+	var before types.Post
+
+	err := im.service.store.Transaction(func(tx poststore.Tx) error {
+		var err error
+
+		if before, err = tx.Get(post.ID); err != nil {
+			return err
+		}
+
+		return tx.Update(post, types.AllFields)
+	})
+
+	return before, err
+}
+
+// dispatch sends the event of an imported post to the subscribers. With
+// ConflictFail, the event is held back until the import succeeds, so that
+// subscribers don't see posts that are removed when it fails.
+func (im *importer) dispatch(event Event) {
+	if im.options.Conflicts == ConflictFail {
+		im.pending = append(im.pending, event)
+		return
+	}
+
+	im.service.dispatch(event)
+}
+
+// flush dispatches the events held back by dispatch.
+func (im *importer) flush() {
+	for _, event := range im.pending {
+		im.service.dispatch(event)
+	}
+
+	im.pending = nil
+}
+
+// reject passes a skipped or invalid record to the Rejected callback.
+func (im *importer) reject(record poststore.DecodedRecord) {
+	if im.options.Rejected != nil {
+		im.options.Rejected(record)
+	}
+}
+
+// rollback removes the posts added to the store by the import. No event is
+// dispatched, since the events of the added posts were held back.
+func (im *importer) rollback() {
+	for _, post := range im.inserted {
+		// Nothing more can be done if that fails
+		im.service.store.Delete(post.ID)
+	}
+
+	im.pending = nil
+}
+
+// checkImported sets the defaults of an imported post, and validates it.
+func (s *postService) checkImported(post *types.Post) error {
+	if post.ID == "" {
+		post.ID = uuid.NewV4().String()
+	}
+
+	if post.State == "" {
+		post.State = types.StatePublished
+	}
+
+	return s.validatePost(post, types.AllFields)
+}
+
+func (s *postService) Import(decoder poststore.Decoder, options ImportOptions) (ImportReport, error) {
+	if options.Conflicts == "" {
+		options.Conflicts = ConflictSkip
+	}
+
+	if _, err := ParseConflictPolicy(string(options.Conflicts)); err != nil {
+		return ImportReport{}, err
+	}
+
+	im := &importer{
+		service: s,
+		options: options,
+		seen:    map[string]struct{}{},
+	}
+
+	var report ImportReport
+	// Records of the whole file, in bulk mode
+	var records []poststore.DecodedRecord
+
+	err := poststore.DecodeParallel(decoder, options.ParallelOptions, s.checkImported, func(batch []poststore.DecodedRecord) error {
+		if !options.Bulk {
+			return im.importBatch(batch, &report)
+		}
+
+		select {
+		case <-options.Cancel:
+			return ErrImportCanceled
+		default:
+		}
+
+		records = append(records, batch...)
+
+		return nil
+	})
+
+	if err == nil && len(records) > 0 {
+		err = im.importBatch(records, &report)
+	}
+
+	if errors.Cause(err) == ErrDuplicateID {
+		im.rollback()
+		report.Inserted = 0
+
+		return report, errors.Wrap(err, "Import aborted")
+	}
+
+	// Posts added before other errors are kept
+	im.flush()
+
+	return report, err
+}
@@ -0,0 +1,258 @@
+package postservice_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abustany/back-message-board/pkg/postservice"
+	"github.com/abustany/back-message-board/pkg/poststore"
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+// importData has a post conflicting with the one added by testImport, an
+// invalid post, a post without ID and a record that cannot be decoded.
+const importData = `{"id": "ID1", "author": "Jane", "email": "jane@domain.com", "message": "Replaced", "created": "2017-12-14T06:20:33-08:00"}
+{"id": "ID2", "author": "", "email": "john@domain.com", "message": "Hello", "created": "2017-12-14T06:20:33-08:00"}
+{"id": "ID3", "author": "John", "email": "john@domain.com", "message": "Hello", "created": "2017-12-14T06:20:33-08:00"}
+{"author": "John", "email": "john@domain.com", "message": "Hello", "created": "2017-12-14T06:20:33-08:00"}
+{"id": "ID4", "author": 42}
+`
+
+func TestImport(t *testing.T) {
+	testData := []struct {
+		options  postservice.ImportOptions
+		expected postservice.ImportReport
+		// Expected author of ID1 after the import
+		author string
+		// Expected number of posts after the import
+		nPosts int
+	}{
+		{
+			postservice.ImportOptions{},
+			postservice.ImportReport{Inserted: 2, Skipped: 1, Invalid: 2},
+			"John",
+			3,
+		},
+		{
+			postservice.ImportOptions{Conflicts: postservice.ConflictOverwrite},
+			postservice.ImportReport{Inserted: 2, Overwritten: 1, Invalid: 2},
+			"Jane",
+			3,
+		},
+		{
+			postservice.ImportOptions{Conflicts: postservice.ConflictOverwrite, ParallelOptions: poststore.ParallelOptions{Workers: 2, BatchSize: 1}},
+			postservice.ImportReport{Inserted: 2, Overwritten: 1, Invalid: 2},
+			"Jane",
+			3,
+		},
+		{
+			postservice.ImportOptions{Conflicts: postservice.ConflictOverwrite, Bulk: true, ParallelOptions: poststore.ParallelOptions{BatchSize: 2}},
+			postservice.ImportReport{Inserted: 2, Overwritten: 1, Invalid: 2},
+			"Jane",
+			3,
+		},
+		{
+			postservice.ImportOptions{Conflicts: postservice.ConflictOverwrite, DryRun: true},
+			postservice.ImportReport{Inserted: 2, Overwritten: 1, Invalid: 2},
+			"John",
+			1,
+		},
+	}
+
+	for _, d := range testData {
+		service := newImportService(t)
+		report, err := service.Import(poststore.NewNDJSONDecoder(strings.NewReader(importData)), d.options)
+
+		if err != nil {
+			t.Errorf("Import returned an error with options %+v: %s", d.options, err)
+			continue
+		}
+
+		if report.Inserted != d.expected.Inserted || report.Overwritten != d.expected.Overwritten || report.Skipped != d.expected.Skipped || report.Invalid != d.expected.Invalid {
+			t.Errorf("Unexpected report with options %+v: got %+v, expected %+v", d.options, report, d.expected)
+		}
+
+		if len(report.Errors) != int(report.Skipped+report.Invalid) {
+			t.Errorf("Unexpected number of errors with options %+v: %+v", d.options, report.Errors)
+		}
+
+		checkImport(t, service, d.author, d.nPosts)
+	}
+
+	t.Run("Validation", func(t *testing.T) {
+		service := newImportService(t)
+		report, err := service.Import(poststore.NewNDJSONDecoder(strings.NewReader(importData)), postservice.ImportOptions{})
+
+		if err != nil {
+			t.Fatalf("Import returned an error: %s", err)
+		}
+
+		expectError(t, report.Errors[0].Err, postservice.ErrDuplicateID)
+		expectError(t, report.Errors[1].Err, postservice.ErrInvalidAuthor)
+
+		if report.Errors[1].Record != 2 || report.Errors[2].Record != 5 {
+			t.Errorf("Unexpected error records: %+v", report.Errors)
+		}
+
+		_, err = service.Import(poststore.NewNDJSONDecoder(strings.NewReader("")), postservice.ImportOptions{Conflicts: "whatever"})
+		expectError(t, err, postservice.ErrInvalidConflictPolicy)
+	})
+
+	t.Run("Dry run", func(t *testing.T) {
+		service := newImportService(t)
+		// Duplicate IDs in the file are detected too
+		data := `{"id": "ID1", "author": "John", "email": "john@domain.com", "created": "2017-12-14T06:20:33-08:00"}
+{"id": "ID2", "author": "John", "email": "john@domain.com", "created": "2017-12-14T06:20:33-08:00"}
+{"id": "ID2", "author": "John", "email": "john@domain.com", "created": "2017-12-14T06:20:33-08:00"}
+{"author": "John", "email": "john@domain.com", "created": "2017-12-14T06:20:33-08:00"}
+{"id": "ID3", "author": "John", "email": "john@domain.com", "created": "2017-12-14T06:20:33-08:00", "state": "whatever"}
+`
+
+		report, err := service.Import(poststore.NewNDJSONDecoder(strings.NewReader(data)), postservice.ImportOptions{DryRun: true})
+
+		if err != nil {
+			t.Fatalf("Import returned an error: %s", err)
+		}
+
+		if report.Inserted != 2 || report.Skipped != 2 || report.Invalid != 1 {
+			t.Errorf("Unexpected dry run report: %+v", report)
+		}
+
+		for i, record := range []uint{1, 3} {
+			if report.Errors[i].Record != record || report.Errors[i].Err != postservice.ErrDuplicateID {
+				t.Errorf("Unexpected error %d: got %s, expected a duplicate ID on record %d", i, report.Errors[i], record)
+			}
+		}
+
+		checkImport(t, service, "John", 1)
+	})
+
+	t.Run("Fail on conflict", func(t *testing.T) {
+		service := newImportService(t)
+		data := `{"id": "ID5", "author": "John", "email": "john@domain.com", "message": "Hello", "created": "2017-12-14T06:20:33-08:00"}
+` + importData
+
+		report, err := service.Import(poststore.NewNDJSONDecoder(strings.NewReader(data)), postservice.ImportOptions{Conflicts: postservice.ConflictFail})
+		expectError(t, err, postservice.ErrDuplicateID)
+
+		if report.Inserted != 0 {
+			t.Errorf("Unexpected report for a failed import: %+v", report)
+		}
+
+		// The post added before the conflict was removed
+		checkImport(t, service, "John", 1)
+	})
+
+	t.Run("Progress", func(t *testing.T) {
+		service := newImportService(t)
+		var reports []postservice.ImportReport
+		var rejected []uint
+
+		options := postservice.ImportOptions{
+			ParallelOptions: poststore.ParallelOptions{BatchSize: 2},
+			Progress: func(report postservice.ImportReport) {
+				reports = append(reports, report)
+			},
+			Rejected: func(record poststore.DecodedRecord) {
+				rejected = append(rejected, record.Record)
+			},
+		}
+
+		if _, err := service.Import(poststore.NewNDJSONDecoder(strings.NewReader(importData)), options); err != nil {
+			t.Fatalf("Import returned an error: %s", err)
+		}
+
+		if len(reports) != 3 || reports[0].Skipped != 1 || reports[0].Invalid != 1 || reports[2].Inserted != 2 {
+			t.Errorf("Unexpected progress reports: %+v", reports)
+		}
+
+		if len(rejected) != 3 || rejected[0] != 1 || rejected[1] != 2 || rejected[2] != 5 {
+			t.Errorf("Unexpected rejected records: %v", rejected)
+		}
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		service := newImportService(t)
+		cancel := make(chan struct{})
+		close(cancel)
+
+		_, err := service.Import(poststore.NewNDJSONDecoder(strings.NewReader(importData)), postservice.ImportOptions{Cancel: cancel})
+		expectError(t, err, postservice.ErrImportCanceled)
+		checkImport(t, service, "John", 1)
+	})
+}
+
+func newImportService(t *testing.T) postservice.Service {
+	store, err := poststore.NewMemoryPostStore()
+
+	if err != nil {
+		t.Fatalf("Error while creating post store: %s", err)
+	}
+
+	post := types.Post{ID: "ID1", Author: "John", Email: "john@domain.com", State: types.StatePublished}
+
+	if err := store.Add(post); err != nil {
+		t.Fatalf("Add returned an error: %s", err)
+	}
+
+	return postservice.New(store)
+}
+
+func checkImport(t *testing.T, service postservice.Service, author string, nPosts int) {
+	if post, err := service.Get("ID1"); err != nil {
+		t.Errorf("Get returned an error: %s", err)
+	} else if post.Author != author {
+		t.Errorf("Unexpected author after import: got %s, expected %s", post.Author, author)
+	}
+
+	posts, _, err := service.List("", 0)
+
+	if err != nil {
+		t.Fatalf("List returned an error: %s", err)
+	}
+
+	if len(posts) != nPosts {
+		t.Errorf("Unexpected number of posts after import: got %d, expected %d", len(posts), nPosts)
+	}
+}
+
+func BenchmarkImport(b *testing.B) {
+	const nPosts = 100000
+
+	var buffer bytes.Buffer
+	created := time.Date(2017, 12, 14, 6, 20, 33, 0, time.UTC)
+
+	buffer.WriteString("id,name,email,text,created\n")
+
+	for i := 0; i < nPosts; i++ {
+		fmt.Fprintf(&buffer, "ID%d,John,john@domain.com,Message %d,%s\n", i, i, created.Add(time.Duration(i)*time.Second).Format(time.RFC3339))
+	}
+
+	data := buffer.Bytes()
+
+	load := func(options postservice.ImportOptions) func(b *testing.B) {
+		return func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				store, err := poststore.NewMemoryPostStore()
+
+				if err != nil {
+					b.Fatalf("Error while creating post store: %s", err)
+				}
+
+				report, err := postservice.New(store).Import(poststore.NewCSVDecoder(bytes.NewReader(data), true), options)
+
+				if err != nil {
+					b.Fatalf("Import returned an error: %s", err)
+				} else if report.Inserted != nPosts {
+					b.Fatalf("Unexpected report: %+v", report)
+				}
+			}
+		}
+	}
+
+	b.Run("Batches", load(postservice.ImportOptions{}))
+	b.Run("Bulk", load(postservice.ImportOptions{Bulk: true}))
+}
@@ -4,11 +4,14 @@ package postservice
 import (
 	"encoding/base64"
 	"encoding/json"
+	"io"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/satori/go.uuid"
 
+	"github.com/abustany/back-message-board/pkg/emailaddr"
 	"github.com/abustany/back-message-board/pkg/poststore"
 	"github.com/abustany/back-message-board/pkg/types"
 )
@@ -19,23 +22,104 @@ type Service interface {
 	// error is returned.
 	Get(id string) (types.Post, error)
 
-	// Add adds a new post to the store.
-	Add(post types.Post) error
+	// Add adds a new post to the store. The post is published, or
+	// unconfirmed if confirmations are enabled.
+	//
+	// Add returns the post as stored, and a secret token allowing its author to
+	// edit or delete it, see AuthorUpdate and AuthorDelete. Only a hash of the
+	// token is stored, so it cannot be retrieved later.
+	Add(post types.Post) (created types.Post, editToken string, err error)
+
+	// Update updates the given fields of an existing post (identified by its
+	// ID) in the store, and returns the updated post. Fields that are not in
+	// the mask are left untouched, fields in the mask are set to their value in
+	// post, even if empty. Use types.NonZeroFields to only update the fields
+	// set in post.
+	Update(post types.Post, fields types.FieldMask) (types.Post, error)
+
+	// AuthorUpdate updates an existing post on behalf of its author, who
+	// proves their identity with the edit token returned by Add. Only the
+	// author, email and message of the post can be updated. Authors can only
+	// edit their posts for a limited time after creating them, see
+	// WithEditWindow.
+	//
+	// Partial updates are supported like with Update. Other fields in the
+	// mask are ignored.
+	AuthorUpdate(id, editToken string, post types.Post, fields types.FieldMask) (types.Post, error)
 
-	// Update updates an existing post (identified by its ID) in the store.
+	// AuthorDelete deletes an existing post on behalf of its author, see
+	// AuthorUpdate.
+	AuthorDelete(id, editToken string) error
+
+	// Batch applies a list of operations to the store under a single
+	// transaction, and returns the result of each operation.
 	//
-	// Partial updates are supported by only setting the fields that should be
-	// updated in the post.
-	Update(post types.Post) error
+	// Operations that fail (for example because of invalid data) do not
+	// prevent the other ones from being applied, unless atomic is true: in
+	// that case, either all operations are applied, or none is, and the
+	// operations that did not fail have ErrBatchAborted as error.
+	Batch(operations []BatchOperation, atomic bool) ([]BatchResult, error)
 
 	// List returns the n most recent posts in the store, starting at the given
 	// cursor. If the cursor is an empty string, the first page is returned.
 	// n can be set to 0 to get the default page size.
 	List(cursor string, n uint) (posts []types.Post, nextCursor string, err error)
+
+	// Import adds the posts read by the decoder to the store, after validating
+	// them like Update does. Posts without an ID get a new one, and posts
+	// without a state are published. Records that cannot be decoded or are
+	// invalid are skipped and reported, and posts whose ID already exists are
+	// handled according to the conflict policy of the options. Records are
+	// parsed and validated in parallel, and added to the store in batches,
+	// see poststore.DecodeParallel.
+	//
+	// The returned report is filled even when an error is returned, and
+	// describes the records read until then.
+	Import(decoder poststore.Decoder, options ImportOptions) (ImportReport, error)
+
+	// Export writes all the posts in the store to w in the given format, and
+	// returns the number of posts written. See poststore.Format.Export.
+	Export(format *poststore.Format, w io.Writer) (uint, error)
+
+	// Confirm publishes the post identified by the given confirmation token. See
+	// WithConfirmation.
+	Confirm(token string) error
+
+	// ExpireUnconfirmed deletes the posts that were not confirmed in time, and
+	// returns how many were deleted. It should be called periodically when
+	// confirmations are enabled.
+	ExpireUnconfirmed() (uint, error)
 }
 
 type postService struct {
-	store poststore.Store
+	store          poststore.Store
+	emailValidator *emailaddr.Validator
+	confirmation   *ConfirmationConfig
+	editWindow     time.Duration
+	// See WithSubscriber and WithAsyncSubscriber
+	subscribers            []Subscriber
+	asyncSubscribers       []*asyncSubscriber
+	subscriberErrorHandler func(subscriber Subscriber, event Event, err error)
+	// Protects the queues of the asynchronous subscribers, which are closed
+	// by Close
+	asyncLock   sync.RWMutex
+	asyncClosed bool
+	asyncWg     sync.WaitGroup
+	// Held while changing the store and dispatching the events of the
+	// change, so that subscribers get the events in the order of the changes
+	writeLock sync.Mutex
+}
+
+// Option configures optional features of a Service.
+type Option func(s *postService)
+
+// WithEmailValidator sets the validator used to check and normalize the email
+// addresses of posts. By default, addresses are validated with
+// emailaddr.Lax strictness, without blocklist.
+func WithEmailValidator(validator *emailaddr.Validator) Option {
+	return func(s *postService) {
+		s.emailValidator = validator
+	}
 }
 
 // DefaultPageSize is the default page size used by Service.List, in case n = 0.
@@ -54,48 +138,97 @@ const MaxMessageLength = 2048
 const MaxPageSize = 100
 
 // ErrInvalidID is returned by Store.Update when given a post with en empty ID.
-var ErrInvalidID = &userError{errors.New("Invalid ID (should not be empty)")}
+var ErrInvalidID = &userError{errors.New("Invalid ID (should not be empty)"), "invalid_id", "id"}
 
 // ErrInvalidAuthor is returned by Store.Add or Store.Update when given a post with an invalid author.
-var ErrInvalidAuthor = &userError{errors.Errorf("Invalid author (should not be empty or longer than %d characters)", MaxAuthorLength)}
+var ErrInvalidAuthor = &userError{errors.Errorf("Invalid author (should not be empty or longer than %d characters)", MaxAuthorLength), "invalid_author", "author"}
 
-// ErrInvalidAuthor is returned by Store.Add or Store.Update when given a post with an invalid email.
-var ErrInvalidEmail = &userError{errors.Errorf("Invalid email (should not be empty or longer than %d characters)", MaxEmailLength)}
+// ErrInvalidEmail is returned by Store.Add or Store.Update when given a post with an invalid email.
+//
+// The returned error carries a more specific reason, but its cause is always
+// ErrInvalidEmail.
+var ErrInvalidEmail = &userError{errors.Errorf("Invalid email (should be a valid address not longer than %d characters)", MaxEmailLength), "invalid_email", "email"}
 
 // ErrInvalidAuthor is returned by Store.Add or Store.Update when given a post with an invalid message.
-var ErrInvalidMessage = &userError{errors.Errorf("Invalid message (should not be longer than %d characters)", MaxMessageLength)}
+var ErrInvalidMessage = &userError{errors.Errorf("Invalid message (should not be longer than %d characters)", MaxMessageLength), "invalid_message", "message"}
+
+// ErrPostNotFound is returned by Service.Get or Service.Update when given the ID
+// of a post that does not exist. UserError returns poststore.ErrIDNotFound for
+// this error.
+var ErrPostNotFound = &userError{poststore.ErrIDNotFound, "post_not_found", ""}
+
+// ErrInvalidCreated is returned by Service.Update when trying to clear the
+// creation time of a post.
+var ErrInvalidCreated = &userError{errors.New("Invalid creation time (should not be empty)"), "invalid_created", "created"}
+
+// ErrInvalidState is returned by Store.Update when given a post with an unknown state.
+var ErrInvalidState = &userError{errors.New("Invalid state"), "invalid_state", "state"}
 
 // ErrInvalidCursor is returned by Store.List when given an invalid cursor.
 //
 // Cursors returned by the Store.List method are always valid.
-var ErrInvalidCursor = &userError{errors.New("Invalid cursor")}
+var ErrInvalidCursor = &userError{errors.New("Invalid cursor"), "invalid_cursor", ""}
 
 // ErrInvalidPageSize is returned by Store.List when given an invalid page size.
-var ErrInvalidPageSize = &userError{errors.Errorf("Invalid page size (should not be larger than %d)", MaxPageSize)}
+var ErrInvalidPageSize = &userError{errors.Errorf("Invalid page size (should not be larger than %d)", MaxPageSize), "invalid_page_size", ""}
 
 // New returns a new Service backed by the given store.
-func New(store poststore.Store) Service {
-	return &postService{store}
-}
+func New(store poststore.Store, options ...Option) Service {
+	s := &postService{
+		store:          store,
+		emailValidator: &emailaddr.Validator{Strictness: emailaddr.Lax},
+		editWindow:     DefaultEditWindow,
+	}
 
-func validatePost(post types.Post, newPost bool) error {
-	if !newPost && post.ID == "" {
-		return ErrInvalidID
+	for _, option := range options {
+		option(s)
 	}
 
-	if (newPost && post.Author == "") || len(post.Author) > MaxAuthorLength {
+	s.startSubscribers()
+
+	return s
+}
+
+// newPostFields is the mask of the fields set by users when creating a post.
+var newPostFields = types.FieldMask{types.FieldAuthor, types.FieldEmail, types.FieldMessage}
+
+// validatePost checks the given fields of the post, and normalizes its email
+// address.
+func (s *postService) validatePost(post *types.Post, fields types.FieldMask) error {
+	if fields.Has(types.FieldAuthor) && (post.Author == "" || len(post.Author) > MaxAuthorLength) {
 		return ErrInvalidAuthor
 	}
 
-	// FIXME: not really a proper email address validation...
-	if (newPost && post.Email == "") || len(post.Email) > MaxEmailLength {
-		return ErrInvalidEmail
+	if fields.Has(types.FieldEmail) {
+		if post.Email == "" || len(post.Email) > MaxEmailLength {
+			return ErrInvalidEmail
+		}
+
+		normalized, err := s.emailValidator.Normalize(post.Email)
+
+		if err != nil {
+			return &reasonError{ErrInvalidEmail, err.Error()}
+		}
+
+		if len(normalized) > MaxEmailLength {
+			return ErrInvalidEmail
+		}
+
+		post.Email = normalized
+	}
+
+	if fields.Has(types.FieldCreated) && post.Created.IsZero() {
+		return ErrInvalidCreated
 	}
 
-	if len(post.Message) > MaxMessageLength {
+	if fields.Has(types.FieldMessage) && len(post.Message) > MaxMessageLength {
 		return ErrInvalidMessage
 	}
 
+	if fields.Has(types.FieldState) && !post.State.Valid() {
+		return ErrInvalidState
+	}
+
 	return nil
 }
 
@@ -103,35 +236,114 @@ func (s *postService) Get(id string) (types.Post, error) {
 	post, err := s.store.Get(id)
 
 	if err == poststore.ErrIDNotFound {
-		err = &userError{err}
+		err = ErrPostNotFound
 	}
 
+	post.EditTokenHash = ""
+
 	return post, err
 }
 
-func (s *postService) Add(post types.Post) error {
-	if err := validatePost(post, true); err != nil {
-		return errors.Wrap(err, "Invalid post data")
+func (s *postService) Add(post types.Post) (types.Post, string, error) {
+	if err := s.validatePost(&post, newPostFields); err != nil {
+		return types.Post{}, "", errors.Wrap(err, "Invalid post data")
+	}
+
+	editToken, editTokenHash, err := newEditToken()
+
+	if err != nil {
+		return types.Post{}, "", err
 	}
 
 	post.ID = uuid.NewV4().String()
 	post.Created = time.Now()
+	post.State = types.StatePublished
+	post.EditTokenHash = editTokenHash
 
-	return errors.Wrap(s.store.Add(post), "Error while adding post to store")
+	if s.confirmation != nil {
+		post.State = types.StateUnconfirmed
+	}
+
+	s.writeLock.Lock()
+
+	if err := s.store.Add(post); err != nil {
+		s.writeLock.Unlock()
+		return types.Post{}, "", errors.Wrap(err, "Error while adding post to store")
+	}
+
+	s.dispatch(PostCreated{post})
+	s.writeLock.Unlock()
+
+	if s.confirmation != nil {
+		if err := s.sendConfirmation(post); err != nil {
+			// Nobody would be able to confirm that post
+			s.writeLock.Lock()
+
+			if s.store.Delete(post.ID) == nil {
+				s.dispatch(PostDeleted{post})
+			}
+
+			s.writeLock.Unlock()
+
+			return types.Post{}, "", errors.Wrap(err, "Error while sending confirmation email")
+		}
+	}
+
+	post.EditTokenHash = ""
+
+	return post, editToken, nil
 }
 
-func (s *postService) Update(post types.Post) error {
-	if err := validatePost(post, false); err != nil {
-		return errors.Wrap(err, "Invalid post data")
+func (s *postService) Update(post types.Post, fields types.FieldMask) (types.Post, error) {
+	if post.ID == "" {
+		return types.Post{}, ErrInvalidID
 	}
 
-	err := s.store.Update(post)
+	if err := s.validatePost(&post, fields); err != nil {
+		return types.Post{}, errors.Wrap(err, "Invalid post data")
+	}
 
-	if err == poststore.ErrIDNotFound {
-		err = &userError{err}
+	return s.update(post, fields)
+}
+
+// update applies the given (validated) partial update to the store, and returns
+// the updated post.
+func (s *postService) update(post types.Post, fields types.FieldMask) (types.Post, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	var before, updated types.Post
+
+	err := s.store.Transaction(func(tx poststore.Tx) error {
+		var err error
+
+		if before, err = tx.Get(post.ID); err != nil {
+			return err
+		}
+
+		if err := tx.Update(post, fields); err != nil {
+			return err
+		}
+
+		if updated, err = tx.Get(post.ID); err != nil {
+			return errors.Wrap(err, "Error while retrieving updated post")
+		}
+
+		return nil
+	})
+
+	if errors.Cause(err) == poststore.ErrIDNotFound {
+		err = ErrPostNotFound
+	}
+
+	if err != nil {
+		return types.Post{}, errors.Wrap(err, "Error while updating post in store")
 	}
 
-	return errors.Wrap(err, "Error while updating post in store")
+	s.dispatch(PostUpdated{Before: before, After: updated})
+	updated.EditTokenHash = ""
+
+	return updated, nil
 }
 
 func encodeCursor(cursor poststore.Cursor) (string, error) {
@@ -193,6 +405,10 @@ func (s *postService) List(cursor string, n uint) ([]types.Post, string, error)
 		return nil, "", errors.Wrap(err, "Error while listing posts")
 	}
 
+	for i := range posts {
+		posts[i].EditTokenHash = ""
+	}
+
 	nextCursorStr, err := encodeCursor(nextCursor)
 
 	if err != nil {
@@ -201,3 +417,9 @@ func (s *postService) List(cursor string, n uint) ([]types.Post, string, error)
 
 	return posts, nextCursorStr, nil
 }
+
+func (s *postService) Export(format *poststore.Format, w io.Writer) (uint, error) {
+	n, err := format.Export(s.store, w)
+
+	return n, errors.Wrap(err, "Error while exporting posts")
+}
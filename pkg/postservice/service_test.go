@@ -3,11 +3,13 @@ package postservice_test
 import (
 	"bytes"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/pkg/errors"
 
+	"github.com/abustany/back-message-board/pkg/emailaddr"
 	"github.com/abustany/back-message-board/pkg/postservice"
 	"github.com/abustany/back-message-board/pkg/poststore"
 	"github.com/abustany/back-message-board/pkg/types"
@@ -28,6 +30,7 @@ func TestPostService(t *testing.T) {
 
 	t.Run("Add (validation)", withService(testAddInvalid))
 	t.Run("Add", withService(testAdd))
+	t.Run("Add (email validation)", testAddEmailValidation)
 
 	t.Run("Update (validation)", withService(testUpdateInvalid))
 	t.Run("Update", withService(testUpdate))
@@ -48,6 +51,11 @@ func repeatStringUntil(s string, sizeAtLeast int) string {
 	return buffer.String()
 }
 
+// errorOf returns the error returned by functions that also return a post.
+func errorOf(_ types.Post, err error) error {
+	return err
+}
+
 func expectError(t *testing.T, e, expected error) {
 	for {
 		cause := errors.Cause(e)
@@ -133,7 +141,8 @@ func testValidation(t *testing.T, service postservice.Service, testEmpty bool, f
 
 func testAddInvalid(t *testing.T, service postservice.Service) {
 	testValidation(t, service, true, func(t *testing.T, post types.Post) error {
-		return service.Add(post)
+		_, _, err := service.Add(post)
+		return err
 	})
 }
 
@@ -165,13 +174,23 @@ func testAdd(t *testing.T, service postservice.Service) {
 		Message: validMessage,
 	}
 
-	if err := service.Add(post); err != nil {
+	created, _, err := service.Add(post)
+
+	if err != nil {
 		t.Errorf("Add returned an error: %s", err)
 	}
 
 	posts := listPosts(t, service, 1)
 	saved := posts[0]
 
+	if !created.Equal(saved) {
+		t.Errorf("Add returned an unexpected post: got %+v, expected %+v", created, saved)
+	}
+
+	if created.EditTokenHash != "" {
+		t.Errorf("Add should not return the hash of the edit token")
+	}
+
 	if saved.ID == post.ID {
 		t.Errorf("Provided ID should have been ignored")
 	}
@@ -191,19 +210,86 @@ func testAdd(t *testing.T, service postservice.Service) {
 	if saved.Message != post.Message {
 		t.Errorf("Unexpected message, got %s, expected %s", saved.Message, post.Message)
 	}
+
+	if saved.State != types.StatePublished {
+		t.Errorf("Unexpected state, got %s, expected %s", saved.State, types.StatePublished)
+	}
+}
+
+func testAddEmailValidation(t *testing.T) {
+	store, err := poststore.NewMemoryPostStore()
+
+	if err != nil {
+		t.Fatalf("Error while creating post store: %s", err)
+	}
+
+	validator := &emailaddr.Validator{
+		Strictness: emailaddr.Strict,
+		Blocklist:  emailaddr.Blocklist{"mailinator.com": {}},
+	}
+
+	service := postservice.New(store, postservice.WithEmailValidator(validator))
+
+	t.Run("Invalid addresses", func(t *testing.T) {
+		invalid := map[string]error{
+			"not an address":        emailaddr.ErrMalformed,
+			"john@localhost":        emailaddr.ErrInvalidDomain,
+			"john@mailinator.com":   emailaddr.ErrDisposableDomain,
+			"John <john@gmail.com>": emailaddr.ErrDisplayName,
+		}
+
+		for address, reason := range invalid {
+			_, _, err := service.Add(types.Post{Author: validAuthor, Email: address})
+			expectError(t, err, postservice.ErrInvalidEmail)
+
+			if userError := postservice.UserError(err); userError == nil {
+				t.Errorf("Invalid email %s should be a user error", address)
+			} else if !strings.Contains(userError.Error(), reason.Error()) {
+				t.Errorf("User error for %s does not contain the reason: got %s, expected %s", address, userError, reason)
+			}
+		}
+	})
+
+	t.Run("Normalization", func(t *testing.T) {
+		if _, _, err := service.Add(types.Post{Author: validAuthor, Email: "John@BÜCHER.de"}); err != nil {
+			t.Fatalf("Add returned an error: %s", err)
+		}
+
+		posts := listPosts(t, service, 1)
+		expected := "John@xn--bcher-kva.de"
+
+		if posts[0].Email != expected {
+			t.Errorf("Unexpected email after normalization: got %s, expected %s", posts[0].Email, expected)
+		}
+	})
 }
 
 func testUpdateInvalid(t *testing.T, service postservice.Service) {
-	testValidation(t, service, false, func(t *testing.T, post types.Post) error {
+	// Required fields cannot be cleared
+	testValidation(t, service, true, func(t *testing.T, post types.Post) error {
 		post.ID = "ID"
-		return service.Update(post)
+		return errorOf(service.Update(post, types.FieldMask{types.FieldAuthor, types.FieldEmail, types.FieldMessage}))
+	})
+
+	t.Run("Empty ID", func(t *testing.T) {
+		expectError(t, errorOf(service.Update(types.Post{Author: validAuthor}, types.FieldMask{types.FieldAuthor})), postservice.ErrInvalidID)
+	})
+
+	t.Run("Invalid state", func(t *testing.T) {
+		expectError(t, errorOf(service.Update(types.Post{ID: "ID", State: "whatever"}, types.FieldMask{types.FieldState})), postservice.ErrInvalidState)
+		expectError(t, errorOf(service.Update(types.Post{ID: "ID"}, types.FieldMask{types.FieldState})), postservice.ErrInvalidState)
+	})
+
+	t.Run("Empty creation time", func(t *testing.T) {
+		expectError(t, errorOf(service.Update(types.Post{ID: "ID"}, types.FieldMask{types.FieldCreated})), postservice.ErrInvalidCreated)
 	})
 
 	post := types.Post{
-		ID: "does not exist",
+		ID:     "does not exist",
+		Author: validAuthor,
 	}
 
-	if err := service.Update(post); err == nil {
+	if _, err := service.Update(post, types.NonZeroFields(post)); err == nil {
 		t.Errorf("Expected an error when updating a non existing post")
 	} else if !postservice.IsUserError(err) {
 		t.Errorf("Updating a non existing post should be a user error")
@@ -217,13 +303,14 @@ func testUpdate(t *testing.T, service postservice.Service) {
 		Message: validMessage,
 	}
 
-	if err := service.Add(post); err != nil {
+	if _, _, err := service.Add(post); err != nil {
 		t.Fatalf("Add returned an error: %s", err)
 	}
 
 	posts := listPosts(t, service, 1)
 	post.ID = posts[0].ID
 	post.Created = posts[0].Created
+	post.State = posts[0].State
 
 	t.Run("Update all fields", func(t *testing.T) {
 		post.Author = post.Author + "x"
@@ -231,10 +318,16 @@ func testUpdate(t *testing.T, service postservice.Service) {
 		post.Created = post.Created.Add(time.Hour)
 		post.Message = post.Message + "x"
 
-		if err := service.Update(post); err != nil {
+		updated, err := service.Update(post, types.AllFields)
+
+		if err != nil {
 			t.Errorf("Update returned an error: %s", err)
 		}
 
+		if !updated.Equal(post) {
+			t.Errorf("Update returned an unexpected post: got %+v, expected %+v", updated, post)
+		}
+
 		posts := listPosts(t, service, 1)
 
 		if !posts[0].Equal(post) {
@@ -250,16 +343,36 @@ func testUpdate(t *testing.T, service postservice.Service) {
 			Author: post.Author,
 		}
 
-		if err := service.Update(patch); err != nil {
+		updated, err := service.Update(patch, types.NonZeroFields(patch))
+
+		if err != nil {
 			t.Errorf("Update returned an error: %s", err)
 		}
 
+		if !updated.Equal(post) {
+			t.Errorf("Partial update returned an unexpected post: got %+v, expected %+v", updated, post)
+		}
+
 		posts := listPosts(t, service, 1)
 
 		if !posts[0].Equal(post) {
 			t.Errorf("Partial update didn't update: got %+v, expected %+v", posts[0], post)
 		}
 	})
+
+	t.Run("Clear message", func(t *testing.T) {
+		post.Message = ""
+
+		updated, err := service.Update(types.Post{ID: post.ID}, types.FieldMask{types.FieldMessage})
+
+		if err != nil {
+			t.Errorf("Update returned an error: %s", err)
+		}
+
+		if !updated.Equal(post) {
+			t.Errorf("Clearing the message returned an unexpected post: got %+v, expected %+v", updated, post)
+		}
+	})
 }
 
 func testListValidation(t *testing.T, service postservice.Service) {
@@ -301,6 +414,7 @@ func makePost(idx uint) types.Post {
 		Author:  validAuthor + idxStr,
 		Email:   validEmail + idxStr,
 		Message: validMessage + idxStr,
+		State:   types.StatePublished,
 	}
 }
 
@@ -348,7 +462,7 @@ func testList(t *testing.T, service postservice.Service) {
 	const nPosts = 100
 
 	for i := uint(0); i < nPosts; i++ {
-		if err := service.Add(makePost(i)); err != nil {
+		if _, _, err := service.Add(makePost(i)); err != nil {
 			t.Fatalf("Add returned an error: %s", err)
 		}
 	}
@@ -415,7 +529,7 @@ func testGet(t *testing.T, service postservice.Service) {
 		t.Errorf("Get on a non existing ID should return a user error")
 	}
 
-	if err := service.Add(post); err != nil {
+	if _, _, err := service.Add(post); err != nil {
 		t.Fatalf("Add returned an error: %s", err)
 	}
 
@@ -426,6 +540,7 @@ func testGet(t *testing.T, service postservice.Service) {
 	} else {
 		post.ID = fetched.ID
 		post.Created = fetched.Created
+		post.State = types.StatePublished
 
 		if !post.Equal(fetched) {
 			t.Errorf("Get returned an unexpected post: got %+v, expected %+v", fetched, post)
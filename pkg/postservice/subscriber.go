@@ -0,0 +1,208 @@
+package postservice
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+// Event is a change made to the posts of the store by the service: a
+// PostCreated, PostUpdated or PostDeleted. Events are dispatched to the
+// subscribers after the change is applied, and never for failed changes or dry
+// runs. The posts of events never carry the hash of their edit token.
+type Event interface {
+	// PostID returns the ID of the changed post.
+	PostID() string
+}
+
+// PostCreated is dispatched after a post is added, by Add or Import.
+type PostCreated struct {
+	Post types.Post
+}
+
+// PostUpdated is dispatched after a post is modified, by Update, AuthorUpdate,
+// Batch, Confirm or an Import overwriting it.
+type PostUpdated struct {
+	Before types.Post
+	After  types.Post
+}
+
+// PostDeleted is dispatched after a post is removed, by AuthorDelete, Batch or
+// ExpireUnconfirmed. Post is the post before it was removed.
+type PostDeleted struct {
+	Post types.Post
+}
+
+func (e PostCreated) PostID() string {
+	return e.Post.ID
+}
+
+func (e PostUpdated) PostID() string {
+	return e.After.ID
+}
+
+func (e PostDeleted) PostID() string {
+	return e.Post.ID
+}
+
+// Subscriber handles the events of a Service, see WithSubscriber and
+// WithAsyncSubscriber.
+type Subscriber interface {
+	HandleEvent(event Event)
+}
+
+// SubscriberFunc adapts a function to the Subscriber interface.
+type SubscriberFunc func(event Event)
+
+func (f SubscriberFunc) HandleEvent(event Event) {
+	f(event)
+}
+
+// ErrSubscriberPanicked is the cause of the errors passed to the handler set by
+// WithSubscriberErrorHandler when a subscriber panics.
+var ErrSubscriberPanicked = errors.New("Subscriber panicked")
+
+// ErrSubscriberTooSlow is passed to the handler set by
+// WithSubscriberErrorHandler when an event is dropped because the queue of an
+// asynchronous subscriber is full.
+var ErrSubscriberTooSlow = errors.New("Subscriber is too slow, event dropped")
+
+// DefaultSubscriberQueueSize is the number of events waiting for an
+// asynchronous subscriber created with a queue size of 0.
+const DefaultSubscriberQueueSize = 1024
+
+// WithSubscriber registers a subscriber called synchronously for each event:
+// the method making the change only returns after HandleEvent does, so
+// subscribers should be fast. Events are dispatched in the order of the
+// changes, and the next change waits for the subscribers, so they must not
+// change posts through the service. Subscribers are called in the order they
+// are registered, and a panicking subscriber does not prevent the other ones
+// from getting the event.
+func WithSubscriber(subscriber Subscriber) Option {
+	return func(s *postService) {
+		s.subscribers = append(s.subscribers, subscriber)
+	}
+}
+
+// WithAsyncSubscriber registers a subscriber called for each event from its own
+// goroutine, in the order the events were dispatched. Up to queueSize events
+// (or DefaultSubscriberQueueSize if 0) can wait for the subscriber, further
+// events are dropped until it catches up. The goroutine runs until the service
+// is closed: the services returned by New implement io.Closer.
+func WithAsyncSubscriber(subscriber Subscriber, queueSize int) Option {
+	return func(s *postService) {
+		if queueSize <= 0 {
+			queueSize = DefaultSubscriberQueueSize
+		}
+
+		s.asyncSubscribers = append(s.asyncSubscribers, &asyncSubscriber{
+			subscriber: subscriber,
+			queue:      make(chan Event, queueSize),
+		})
+	}
+}
+
+// WithSubscriberErrorHandler sets a function called when a subscriber panics
+// (with an error whose cause is ErrSubscriberPanicked), or misses an event
+// (with ErrSubscriberTooSlow). By default, these errors are ignored. The
+// function can be called concurrently.
+func WithSubscriberErrorHandler(handler func(subscriber Subscriber, event Event, err error)) Option {
+	return func(s *postService) {
+		s.subscriberErrorHandler = handler
+	}
+}
+
+// asyncSubscriber is a subscriber registered with WithAsyncSubscriber.
+type asyncSubscriber struct {
+	subscriber Subscriber
+	queue      chan Event
+}
+
+// startSubscribers starts the goroutines of the asynchronous subscribers.
+func (s *postService) startSubscribers() {
+	for _, async := range s.asyncSubscribers {
+		s.asyncWg.Add(1)
+
+		go func(async *asyncSubscriber) {
+			defer s.asyncWg.Done()
+
+			for event := range async.queue {
+				s.handleEvent(async.subscriber, event)
+			}
+		}(async)
+	}
+}
+
+// Close waits for the asynchronous subscribers to handle the events dispatched
+// so far, and stops their goroutines. Events of the changes made after Close
+// are not dispatched to them anymore.
+func (s *postService) Close() error {
+	s.asyncLock.Lock()
+
+	if !s.asyncClosed {
+		s.asyncClosed = true
+
+		for _, async := range s.asyncSubscribers {
+			close(async.queue)
+		}
+	}
+
+	s.asyncLock.Unlock()
+	s.asyncWg.Wait()
+
+	return nil
+}
+
+// handleEvent passes an event to a subscriber, recovering from its panics.
+func (s *postService) handleEvent(subscriber Subscriber, event Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.subscriberError(subscriber, event, errors.Wrapf(ErrSubscriberPanicked, "%v", r))
+		}
+	}()
+
+	subscriber.HandleEvent(event)
+}
+
+// subscriberError passes an error to the handler set by
+// WithSubscriberErrorHandler, if any.
+func (s *postService) subscriberError(subscriber Subscriber, event Event, err error) {
+	if s.subscriberErrorHandler != nil {
+		s.subscriberErrorHandler(subscriber, event, err)
+	}
+}
+
+// dispatch sends an event to the subscribers.
+func (s *postService) dispatch(event Event) {
+	switch e := event.(type) {
+	case PostCreated:
+		e.Post.EditTokenHash = ""
+		event = e
+	case PostUpdated:
+		e.Before.EditTokenHash = ""
+		e.After.EditTokenHash = ""
+		event = e
+	case PostDeleted:
+		e.Post.EditTokenHash = ""
+		event = e
+	}
+
+	for _, subscriber := range s.subscribers {
+		s.handleEvent(subscriber, event)
+	}
+
+	s.asyncLock.RLock()
+	defer s.asyncLock.RUnlock()
+
+	if s.asyncClosed {
+		return
+	}
+
+	for _, async := range s.asyncSubscribers {
+		select {
+		case async.queue <- event:
+		default:
+			s.subscriberError(async.subscriber, event, ErrSubscriberTooSlow)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package postservice_test
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/abustany/back-message-board/pkg/postservice"
+	"github.com/abustany/back-message-board/pkg/poststore"
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+// errorRecorder records the errors passed to a subscriber error handler.
+type errorRecorder struct {
+	sync.Mutex
+	errs []error
+}
+
+func (r *errorRecorder) handle(subscriber postservice.Subscriber, event postservice.Event, err error) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.errs = append(r.errs, err)
+}
+
+func (r *errorRecorder) causes() []error {
+	r.Lock()
+	defer r.Unlock()
+
+	causes := make([]error, len(r.errs))
+
+	for i, err := range r.errs {
+		causes[i] = errors.Cause(err)
+	}
+
+	return causes
+}
+
+func newSubscribedService(t *testing.T, options ...postservice.Option) postservice.Service {
+	store, err := poststore.NewMemoryPostStore()
+
+	if err != nil {
+		t.Fatalf("Error while creating post store: %s", err)
+	}
+
+	return postservice.New(store, options...)
+}
+
+func TestSubscribers(t *testing.T) {
+	var received []postservice.Event
+	recorder := &errorRecorder{}
+
+	service := newSubscribedService(t,
+		postservice.WithSubscriber(postservice.SubscriberFunc(func(event postservice.Event) {
+			panic("oops")
+		})),
+		postservice.WithSubscriber(postservice.SubscriberFunc(func(event postservice.Event) {
+			received = append(received, event)
+		})),
+		postservice.WithSubscriberErrorHandler(recorder.handle),
+	)
+
+	post, editToken := addPost(t, service)
+	updated := post
+	updated.Message = "Updated"
+
+	if _, err := service.Update(updated, types.FieldMask{types.FieldMessage}); err != nil {
+		t.Fatalf("Update returned an error: %s", err)
+	}
+
+	if err := service.AuthorDelete(post.ID, editToken); err != nil {
+		t.Fatalf("AuthorDelete returned an error: %s", err)
+	}
+
+	if len(received) != 3 {
+		t.Fatalf("Unexpected number of events: %d", len(received))
+	}
+
+	if created, ok := received[0].(postservice.PostCreated); !ok || !created.Post.Equal(post) || created.Post.EditTokenHash != "" {
+		t.Errorf("Unexpected event for a created post: %+v", received[0])
+	}
+
+	if update, ok := received[1].(postservice.PostUpdated); !ok || !update.Before.Equal(post) || !update.After.Equal(updated) || update.Before.EditTokenHash != "" || update.After.EditTokenHash != "" {
+		t.Errorf("Unexpected event for an updated post: %+v", received[1])
+	}
+
+	if deleted, ok := received[2].(postservice.PostDeleted); !ok || !deleted.Post.Equal(updated) || deleted.PostID() != post.ID {
+		t.Errorf("Unexpected event for a deleted post: %+v", received[2])
+	}
+
+	if causes := recorder.causes(); len(causes) != 3 || causes[0] != postservice.ErrSubscriberPanicked {
+		t.Errorf("Unexpected subscriber errors: %v", causes)
+	}
+}
+
+func TestAsyncSubscribers(t *testing.T) {
+	received := make(chan postservice.Event, 10)
+	unblock := make(chan struct{})
+	recorder := &errorRecorder{}
+
+	service := newSubscribedService(t,
+		postservice.WithAsyncSubscriber(postservice.SubscriberFunc(func(event postservice.Event) {
+			received <- event
+		}), 0),
+		postservice.WithAsyncSubscriber(postservice.SubscriberFunc(func(event postservice.Event) {
+			<-unblock
+		}), 1),
+		postservice.WithSubscriberErrorHandler(recorder.handle),
+	)
+
+	posts := addPosts(t, service, 3)
+
+	for i, post := range posts {
+		select {
+		case event := <-received:
+			if event.PostID() != post.ID {
+				t.Errorf("Unexpected event %d: got %s, expected %s", i, event.PostID(), post.ID)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timeout while waiting for event %d", i)
+		}
+	}
+
+	// The blocked subscriber took at most one event, and has room for one more
+	causes := recorder.causes()
+
+	if len(causes) == 0 || causes[0] != postservice.ErrSubscriberTooSlow {
+		t.Errorf("Unexpected subscriber errors: %v", causes)
+	}
+
+	close(unblock)
+}
+
+func TestCloseAsyncSubscribers(t *testing.T) {
+	var lock sync.Mutex
+	var received []postservice.Event
+
+	service := newSubscribedService(t,
+		postservice.WithAsyncSubscriber(postservice.SubscriberFunc(func(event postservice.Event) {
+			time.Sleep(time.Millisecond)
+
+			lock.Lock()
+			received = append(received, event)
+			lock.Unlock()
+		}), 10),
+	)
+
+	addPosts(t, service, 5)
+
+	// The queued events are handled before Close returns
+	service.(io.Closer).Close()
+
+	lock.Lock()
+	n := len(received)
+	lock.Unlock()
+
+	if n != 5 {
+		t.Errorf("Unexpected number of events handled before Close returned: %d", n)
+	}
+
+	// Changes made after Close are not dispatched, and closing twice does
+	// nothing
+	addPosts(t, service, 1)
+	service.(io.Closer).Close()
+
+	lock.Lock()
+	n = len(received)
+	lock.Unlock()
+
+	if n != 5 {
+		t.Errorf("Unexpected number of events after Close: %d", n)
+	}
+}
+
+func TestEventOrder(t *testing.T) {
+	var lock sync.Mutex
+	var received []postservice.PostUpdated
+
+	service := newSubscribedService(t,
+		postservice.WithSubscriber(postservice.SubscriberFunc(func(event postservice.Event) {
+			if updated, ok := event.(postservice.PostUpdated); ok {
+				// Lets concurrent changes catch up
+				time.Sleep(time.Millisecond)
+
+				lock.Lock()
+				received = append(received, updated)
+				lock.Unlock()
+			}
+		})),
+	)
+
+	post, _ := addPost(t, service)
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 5; j++ {
+				updated := post
+				updated.Message = fmt.Sprintf("Update %d-%d", i, j)
+
+				if _, err := service.Update(updated, types.FieldMask{types.FieldMessage}); err != nil {
+					t.Errorf("Update returned an error: %s", err)
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	// Each update starts from the post left by the previous one
+	for i := 1; i < len(received); i++ {
+		if received[i].Before.Message != received[i-1].After.Message {
+			t.Fatalf("Event %d was dispatched out of order: %s follows %s", i, received[i].Before.Message, received[i-1].After.Message)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package poststore
+
+import (
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+// RecordDecoder is implemented by the Decoders that can split decoding in two
+// steps: reading the raw records, which is sequential, and parsing them into
+// posts, which can be done in parallel. DecodeParallel uses it when available.
+type RecordDecoder interface {
+	Decoder
+
+	// ReadRecord returns the next raw record of the stream. It returns errors
+	// like Decode.
+	ReadRecord() (interface{}, error)
+
+	// ParseRecord parses a record returned by ReadRecord. It can be called
+	// concurrently, and its errors only affect the given record.
+	ParseRecord(record interface{}) (types.Post, error)
+}
+
+// RecordEncoder is implemented by the Encoders of the formats whose Decoders
+// are RecordDecoders. It allows writing back records that could not be
+// imported, so that they can be fixed.
+type RecordEncoder interface {
+	Encoder
+
+	// EncodeRecord writes a raw record returned by RecordDecoder.ReadRecord.
+	EncodeRecord(record interface{}) error
+}
+
+// DecodedRecord is a record decoded by DecodeParallel.
+type DecodedRecord struct {
+	// Index of the record in the file, starting at 1 (not counting headers)
+	Record uint
+	// Decoded post, if Err is nil
+	Post types.Post
+	// Error of the record, if it could not be decoded or checked
+	Err error
+	// Raw record returned by RecordDecoder.ReadRecord, if the decoder is a
+	// RecordDecoder and the record could be read
+	Raw interface{}
+}
+
+// DefaultBatchSize is the default number of records decoded at once by
+// DecodeParallel.
+const DefaultBatchSize = 1000
+
+// ParallelOptions configures DecodeParallel.
+type ParallelOptions struct {
+	// Number of goroutines parsing the records, runtime.NumCPU() if 0
+	Workers int
+	// Number of records decoded at once, DefaultBatchSize if 0
+	BatchSize int
+}
+
+// recordBatch is a batch of records going through DecodeParallel.
+type recordBatch struct {
+	index   int
+	records []DecodedRecord
+}
+
+// DecodeParallel decodes the records of decoder in batches, and calls f with
+// each batch, in the order of the file. The records are parsed (if decoder is
+// a RecordDecoder) and passed to check (if not nil) by a pool of workers,
+// while f is called from the calling goroutine. Errors returned by check are
+// reported in DecodedRecord.Err.
+//
+// DecodeParallel stops at the first error returned by f, or at the first
+// fatal decoding error, after calling f with the records read before it.
+func DecodeParallel(decoder Decoder, options ParallelOptions, check func(post *types.Post) error, f func(batch []DecodedRecord) error) error {
+	if options.Workers <= 0 {
+		options.Workers = runtime.NumCPU()
+	}
+
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultBatchSize
+	}
+
+	// Limits the number of batches in flight, so that the memory usage stays
+	// bounded even if a batch takes a long time to parse
+	tokens := make(chan struct{}, 2*options.Workers)
+	batches := make(chan *recordBatch)
+	parsed := make(chan *recordBatch)
+	// Closed when f returns an error, to stop the other goroutines
+	done := make(chan struct{})
+
+	var readErr error
+
+	go func() {
+		defer close(batches)
+		readErr = readBatches(decoder, options.BatchSize, tokens, batches, done)
+	}()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < options.Workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for batch := range batches {
+				parseBatch(decoder, batch, check)
+
+				select {
+				case parsed <- batch:
+				case <-done:
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(parsed)
+	}()
+
+	// Batches parsed before the ones preceding them
+	pending := map[int]*recordBatch{}
+	next := 0
+	var err error
+
+	for batch := range parsed {
+		if err != nil {
+			// Wait for the other goroutines to stop
+			continue
+		}
+
+		pending[batch.index] = batch
+
+		for ready, ok := pending[next]; ok && err == nil; ready, ok = pending[next] {
+			delete(pending, next)
+			next++
+
+			if err = f(ready.records); err != nil {
+				close(done)
+			}
+
+			<-tokens
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return readErr
+}
+
+// readBatches reads the records of decoder, and sends them to batches.
+func readBatches(decoder Decoder, batchSize int, tokens chan struct{}, batches chan *recordBatch, done chan struct{}) error {
+	recordDecoder, _ := decoder.(RecordDecoder)
+	var batch *recordBatch
+
+	send := func() bool {
+		select {
+		case batches <- batch:
+			batch = nil
+			return true
+		case <-done:
+			return false
+		}
+	}
+
+	for record, index := uint(1), 0; ; record++ {
+		if batch == nil {
+			select {
+			case tokens <- struct{}{}:
+			case <-done:
+				return nil
+			}
+
+			batch = &recordBatch{index: index}
+			index++
+		}
+
+		var raw interface{}
+		var post types.Post
+		var err error
+
+		if recordDecoder != nil {
+			raw, err = recordDecoder.ReadRecord()
+		} else {
+			post, err = decoder.Decode()
+		}
+
+		if err == io.EOF {
+			break
+		}
+
+		if recordErr, ok := err.(*RecordError); ok {
+			batch.records = append(batch.records, DecodedRecord{Record: recordErr.Record, Err: recordErr.Err})
+		} else if err != nil {
+			// Records read so far still go through f
+			if len(batch.records) > 0 {
+				send()
+			}
+
+			return errors.Wrap(err, "Error while decoding posts")
+		} else {
+			batch.records = append(batch.records, DecodedRecord{Record: record, Post: post, Raw: raw})
+		}
+
+		if len(batch.records) == batchSize && !send() {
+			return nil
+		}
+	}
+
+	if len(batch.records) > 0 {
+		send()
+	}
+
+	return nil
+}
+
+// parseBatch parses and checks the records of a batch.
+func parseBatch(decoder Decoder, batch *recordBatch, check func(post *types.Post) error) {
+	for i := range batch.records {
+		record := &batch.records[i]
+
+		if record.Err != nil {
+			continue
+		}
+
+		if record.Raw != nil {
+			record.Post, record.Err = decoder.(RecordDecoder).ParseRecord(record.Raw)
+		}
+
+		if record.Err == nil && check != nil {
+			record.Err = check(&record.Post)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package poststore
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+// Decoder reads posts from a stream, one record at a time.
+type Decoder interface {
+	// Decode returns the next post of the stream, or io.EOF when there are
+	// no more posts. Errors affecting a single record are returned as
+	// *RecordError, and Decode can be called again after them to read the
+	// next records. Other errors are fatal.
+	Decode() (types.Post, error)
+}
+
+// Encoder writes posts to a stream.
+type Encoder interface {
+	// Encode writes a post to the stream.
+	Encode(post types.Post) error
+
+	// Close terminates the stream, and flushes any buffered data. It does not
+	// close the underlying writer.
+	Close() error
+}
+
+// Format is a file format posts can be imported from or exported to.
+type Format struct {
+	// Name of the format, like "csv"
+	Name string
+	// File extensions used for the format, without the leading dot
+	Extensions []string
+	// MIME type of the format
+	ContentType string
+	// NewDecoder returns a Decoder reading posts from r
+	NewDecoder func(r io.Reader) Decoder
+	// NewEncoder returns an Encoder writing posts to w
+	NewEncoder func(w io.Writer) Encoder
+	// If true, the format does not store the state of the posts, and imported
+	// posts are published. Format.Export then leaves unconfirmed posts out.
+	Stateless bool
+}
+
+// Formats lists the supported import/export formats.
+var Formats = []*Format{&FormatCSV, &FormatJSON, &FormatNDJSON}
+
+// FormatByName returns the format with the given name.
+func FormatByName(name string) (*Format, error) {
+	for _, format := range Formats {
+		if format.Name == name {
+			return format, nil
+		}
+	}
+
+	return nil, errors.Errorf("Unknown format %s", name)
+}
+
+// FormatForFile returns the format of the given file, based on its extension.
+func FormatForFile(filename string) (*Format, error) {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+
+	for _, format := range Formats {
+		for _, e := range format.Extensions {
+			if e == ext {
+				return format, nil
+			}
+		}
+	}
+
+	return nil, errors.Errorf("Cannot guess the format of %s from its extension", filename)
+}
+
+// RecordError is an error affecting a single record of an imported file.
+type RecordError struct {
+	// Index of the record in the file, starting at 1 (not counting headers)
+	Record uint
+	Err    error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("Record %d: %s", e.Record, e.Err)
+}
+
+func (e *RecordError) Cause() error {
+	return e.Err
+}
+
+// MaxReportedErrors is the maximum number of record errors kept in the report
+// of an import.
+const MaxReportedErrors = 100
+
+// Export writes all the posts of a Store with the given encoder, and returns
+// the number of posts written. Posts are read from the store one page at a
+// time, so that large stores can be exported with a constant memory usage.
+func Export(store Store, encoder Encoder) (uint, error) {
+	return export(store, encoder, false)
+}
+
+// Export writes the posts of a Store to w in the format, like the Export
+// function. Unconfirmed posts are not written in stateless formats, since
+// importing the file again would publish them.
+func (f *Format) Export(store Store, w io.Writer) (uint, error) {
+	return export(store, f.NewEncoder(w), f.Stateless)
+}
+
+func export(store Store, encoder Encoder, skipUnconfirmed bool) (uint, error) {
+	counter := uint(0)
+	cursor := EmptyCursor
+
+	for {
+		posts, next, err := store.List(cursor, exportPageSize)
+
+		if err != nil {
+			return counter, errors.Wrap(err, "Error while listing posts")
+		}
+
+		for _, post := range posts {
+			if skipUnconfirmed && post.State == types.StateUnconfirmed {
+				continue
+			}
+
+			if err := encoder.Encode(post); err != nil {
+				return counter, errors.Wrapf(err, "Error while encoding post %s", post.ID)
+			}
+
+			counter++
+		}
+
+		if next == EmptyCursor {
+			break
+		}
+
+		cursor = next
+	}
+
+	return counter, errors.Wrap(encoder.Close(), "Error while closing encoder")
+}
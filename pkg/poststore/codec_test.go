@@ -0,0 +1,231 @@
+package poststore_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abustany/back-message-board/pkg/postservice"
+	"github.com/abustany/back-message-board/pkg/poststore"
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+func TestFormats(t *testing.T) {
+	for _, format := range poststore.Formats {
+		t.Run(format.Name, func(t *testing.T) {
+			testRoundTrip(t, format)
+		})
+	}
+
+	t.Run("Format detection", func(t *testing.T) {
+		expected := map[string]string{
+			"posts.csv":      "csv",
+			"dir/posts.JSON": "json",
+			"posts.ndjson":   "ndjson",
+			"posts.jsonl":    "ndjson",
+		}
+
+		for filename, name := range expected {
+			if format, err := poststore.FormatForFile(filename); err != nil {
+				t.Errorf("FormatForFile returned an error for %s: %s", filename, err)
+			} else if format.Name != name {
+				t.Errorf("Unexpected format for %s: got %s, expected %s", filename, format.Name, name)
+			}
+		}
+
+		if _, err := poststore.FormatForFile("posts.xml"); err == nil {
+			t.Errorf("FormatForFile didn't return an error for an unknown extension")
+		}
+	})
+}
+
+func testRoundTrip(t *testing.T, format *poststore.Format) {
+	now := time.Now()
+
+	store := newStore(t)
+
+	posts := make([]types.Post, 150)
+
+	for i := range posts {
+		posts[i] = types.Post{
+			ID:      fmt.Sprintf("ID%03d", i),
+			Author:  "John, \"the\" author",
+			Email:   "john@domain.com",
+			Message: fmt.Sprintf("Message %d\nsecond line", i),
+			Created: now.Add(-time.Duration(i) * time.Second),
+			State:   types.StatePublished,
+		}
+
+		if err := store.Add(posts[i]); err != nil {
+			t.Fatalf("Add returned an error: %s", err)
+		}
+	}
+
+	buffer := bytes.Buffer{}
+
+	if n, err := poststore.Export(store, format.NewEncoder(&buffer)); err != nil {
+		t.Fatalf("Export returned an error: %s", err)
+	} else if n != uint(len(posts)) {
+		t.Errorf("Export returned an incorrect post count: got %d, expected %d", n, len(posts))
+	}
+
+	imported := newStore(t)
+
+	report, err := postservice.New(imported).Import(format.NewDecoder(&buffer), postservice.ImportOptions{})
+
+	if err != nil {
+		t.Fatalf("Import returned an error: %s", err)
+	}
+
+	if report.Inserted != uint(len(posts)) || len(report.Errors) != 0 {
+		t.Errorf("Unexpected import report: %+v", report)
+	}
+
+	checkPosts(t, imported, posts[:100])
+
+	// Empty stores can be exported and imported too
+	empty := newStore(t)
+
+	buffer.Reset()
+
+	if _, err := poststore.Export(empty, format.NewEncoder(&buffer)); err != nil {
+		t.Fatalf("Export returned an error for an empty store: %s", err)
+	}
+
+	if report, err := postservice.New(empty).Import(format.NewDecoder(&buffer), postservice.ImportOptions{}); err != nil {
+		t.Errorf("Import returned an error for an empty file: %s", err)
+	} else if report.Inserted != 0 || len(report.Errors) != 0 {
+		t.Errorf("Unexpected import report for an empty file: %+v", report)
+	}
+}
+
+// importErrorsData has, for each format, a file with 6 records where records 2
+// and 3 are invalid, and record 4 has the same ID as record 1.
+var importErrorsData = []struct {
+	format string
+	data   string
+}{
+	{
+		"csv",
+		"id,name,email,text,created\n" +
+			"ID1,John,john@domain.com,Hello,2017-12-14T06:20:33-08:00\n" +
+			"ID2,John,john@domain.com,Hello\n" +
+			"ID3,John,john@domain.com,Hello,yesterday\n" +
+			"ID1,John,john@domain.com,Hello,2017-12-14T06:20:33-08:00\n" +
+			",John,john@domain.com,Hello,2017-12-14T06:20:33-08:00\n" +
+			"ID4,John,john@domain.com,Hello,2017-12-14T06:20:33-08:00\n",
+	},
+	{
+		"json",
+		`[{"id": "ID1", "author": "John", "email": "john@domain.com", "created": "2017-12-14T06:20:33-08:00"},
+			{"id": "ID2", "author": 42},
+			{"id": "ID3", "author": "John", "email": "john@domain.com", "created": "2017-12-14T06:20:33-08:00", "state": "whatever"},
+			{"id": "ID1", "author": "John", "email": "john@domain.com", "created": "2017-12-14T06:20:33-08:00"},
+			{"author": "John", "email": "john@domain.com", "created": "2017-12-14T06:20:33-08:00"},
+			{"id": "ID4", "author": "John", "email": "john@domain.com", "created": "2017-12-14T06:20:33-08:00"}]`,
+	},
+	{
+		"ndjson",
+		`{"id": "ID1", "author": "John", "email": "john@domain.com", "created": "2017-12-14T06:20:33-08:00"}
+			{"id": "ID2", "author": "John"
+			{"id": "ID3", "created": "yesterday"}
+
+			{"id": "ID1", "author": "John", "email": "john@domain.com", "created": "2017-12-14T06:20:33-08:00"}
+			{"author": "John", "email": "john@domain.com", "created": "2017-12-14T06:20:33-08:00"}
+			{"id": "ID4", "author": "John", "email": "john@domain.com", "created": "2017-12-14T06:20:33-08:00"}`,
+	},
+}
+
+func TestImportErrors(t *testing.T) {
+	for _, d := range importErrorsData {
+		format, err := poststore.FormatByName(d.format)
+
+		if err != nil {
+			t.Fatalf("FormatByName returned an error: %s", err)
+		}
+
+		report, err := postservice.New(newStore(t)).Import(format.NewDecoder(strings.NewReader(d.data)), postservice.ImportOptions{})
+
+		if err != nil {
+			t.Errorf("Import returned an error for format %s: %s", d.format, err)
+			continue
+		}
+
+		// The record without an ID gets a generated one
+		if report.Inserted != 3 || report.Invalid != 2 || report.Skipped != 1 {
+			t.Errorf("Unexpected import report for format %s: %+v", d.format, report)
+			continue
+		}
+
+		for i, record := range []uint{2, 3, 4} {
+			if report.Errors[i].Record != record {
+				t.Errorf("Unexpected record for error %d with format %s: got %d, expected %d (%s)", i, d.format, report.Errors[i].Record, record, report.Errors[i])
+			}
+		}
+
+		if report.Errors[2].Err != postservice.ErrDuplicateID {
+			t.Errorf("Unexpected error for a duplicate ID with format %s: %s", d.format, report.Errors[2])
+		}
+	}
+
+	// Syntax errors in JSON arrays are fatal
+	if _, err := postservice.New(newStore(t)).Import(poststore.FormatJSON.NewDecoder(strings.NewReader(`[{"id": "ID1"}, {`)), postservice.ImportOptions{}); err == nil {
+		t.Errorf("Import didn't return an error for invalid JSON")
+	}
+
+	if _, err := postservice.New(newStore(t)).Import(poststore.FormatJSON.NewDecoder(strings.NewReader(`{"id": "ID1"}`)), postservice.ImportOptions{}); err == nil {
+		t.Errorf("Import didn't return an error for a JSON object")
+	}
+}
+
+func TestDecodeParallel(t *testing.T) {
+	var buffer bytes.Buffer
+
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&buffer, `{"id": "ID%d", "author": "%d"}`+"\n", i, i)
+	}
+
+	// Batches are passed to f in the order of the file
+	record := uint(0)
+
+	err := poststore.DecodeParallel(poststore.NewNDJSONDecoder(&buffer), poststore.ParallelOptions{Workers: 4, BatchSize: 7}, nil, func(batch []poststore.DecodedRecord) error {
+		for _, r := range batch {
+			record++
+
+			if r.Record != record || r.Err != nil || r.Post.Author != fmt.Sprintf("%d", record-1) {
+				return fmt.Errorf("unexpected record %d: %+v", record, r)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("DecodeParallel returned an error: %s", err)
+	}
+
+	if record != 1000 {
+		t.Errorf("DecodeParallel decoded %d records, expected 1000", record)
+	}
+
+	// Fatal errors stop the decoding
+	err = poststore.DecodeParallel(poststore.FormatJSON.NewDecoder(strings.NewReader(`[{"id": "ID1"}, {`)), poststore.ParallelOptions{}, nil, func([]poststore.DecodedRecord) error {
+		return nil
+	})
+
+	if err == nil {
+		t.Errorf("DecodeParallel didn't return an error for invalid JSON")
+	}
+}
+
+func newStore(t *testing.T) poststore.Store {
+	store, err := poststore.NewMemoryPostStore()
+
+	if err != nil {
+		t.Fatalf("Error while creating store: %s", err)
+	}
+
+	return store
+}
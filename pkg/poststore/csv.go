@@ -3,63 +3,416 @@ package poststore
 import (
 	"encoding/csv"
 	"io"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
+	"golang.org/x/text/encoding/htmlindex"
 
 	"github.com/abustany/back-message-board/pkg/types"
 )
 
-// LoadFromCSV loads the contents of a CSV file into a Store, and return the
-// number of posts inserted.
-//
-// The CSV records must have 5 columns: id, name, email, text, created (in RFC3339 format).
-func LoadFromCSV(store Store, data io.Reader, hasHeader bool) (uint, error) {
-	reader := csv.NewReader(data)
+// csvHeader is the header record of CSV files.
+var csvHeader = []string{"id", "name", "email", "text", "created"}
 
-	// Id, name, email, text, created
-	reader.FieldsPerRecord = 5
-	reader.ReuseRecord = true
+// exportPageSize is the number of posts read at once by Export.
+const exportPageSize = 100
 
-	counter := uint(0)
+// FormatCSV reads and writes CSV files with a header record, where the records
+// have 5 columns: id, name, email, text, created (in RFC3339 format). The state
+// of the posts is not stored, imported posts are published, and unconfirmed
+// posts are left out of exports.
+var FormatCSV = Format{
+	Name:        "csv",
+	Extensions:  []string{"csv"},
+	ContentType: "text/csv; charset=utf-8",
+	NewDecoder: func(r io.Reader) Decoder {
+		return NewCSVDecoder(r, true)
+	},
+	NewEncoder: func(w io.Writer) Encoder {
+		return NewCSVEncoder(w)
+	},
+	Stateless: true,
+}
 
-	for {
-		record, err := reader.Read()
+// DateUnix is the CSVOptions.DateFormat of dates given as Unix timestamps, in
+// seconds.
+const DateUnix = "unix"
 
-		if err == io.EOF {
-			break
+// CSVColumns gives the names of the columns holding each field of the posts,
+// as written in the header of a CSV file. An empty name means that the column
+// is absent, only the Created column is mandatory. Imported posts without an
+// ID get a new one, see postservice.Service.Import.
+type CSVColumns struct {
+	ID      string
+	Author  string
+	Email   string
+	Message string
+	Created string
+}
+
+// ParseCSVColumns parses a column mapping written as a comma separated list of
+// field=name pairs, where field is one of id, author, email, message and
+// created. For example: "id=Id,author=Name,created=Date".
+func ParseCSVColumns(s string) (*CSVColumns, error) {
+	var columns CSVColumns
+
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, errors.Errorf("Invalid column mapping %s (should be field=name)", pair)
 		}
 
+		var target *string
+
+		switch strings.TrimSpace(parts[0]) {
+		case "id":
+			target = &columns.ID
+		case "author":
+			target = &columns.Author
+		case "email":
+			target = &columns.Email
+		case "message":
+			target = &columns.Message
+		case "created":
+			target = &columns.Created
+		default:
+			return nil, errors.Errorf("Unknown field %s in column mapping", parts[0])
+		}
+
+		*target = strings.TrimSpace(parts[1])
+	}
+
+	return &columns, nil
+}
+
+// CSVOptions describes the dialect of the CSV files read by
+// NewCSVDecoderWithOptions.
+type CSVOptions struct {
+	// Field delimiter, ',' if 0
+	Delimiter rune
+	// If true, the first record is a header
+	HasHeader bool
+	// If set, the columns are looked up by name in the header, and HasHeader
+	// must be true. Else, records have the 5 columns described in FormatCSV,
+	// in that order.
+	Columns *CSVColumns
+	// Go layout of the creation dates (see time.Parse), or DateUnix.
+	// time.RFC3339 if empty.
+	DateFormat string
+	// Name of the character encoding of the file, like "windows-1252" (see
+	// https://encoding.spec.whatwg.org/#names-and-labels). UTF-8 if empty.
+	Encoding string
+}
+
+// Indices of the post fields in csvDecoder.columns
+const (
+	csvID = iota
+	csvAuthor
+	csvEmail
+	csvMessage
+	csvCreated
+	csvNFields
+)
+
+type csvDecoder struct {
+	reader    *csv.Reader
+	options   CSVOptions
+	hasHeader bool
+	// Index of the column of each field, -1 if absent
+	columns [csvNFields]int
+	record  uint
+}
+
+// NewCSVDecoder returns a Decoder reading CSV records in the format described
+// in FormatCSV. If hasHeader is true, the first record is skipped.
+func NewCSVDecoder(r io.Reader, hasHeader bool) Decoder {
+	decoder, _ := NewCSVDecoderWithOptions(r, CSVOptions{HasHeader: hasHeader})
+	return decoder
+}
+
+// NewCSVDecoderWithOptions returns a Decoder reading CSV records in the given
+// dialect.
+func NewCSVDecoderWithOptions(r io.Reader, options CSVOptions) (Decoder, error) {
+	if options.Columns != nil && !options.HasHeader {
+		return nil, errors.New("Columns can only be looked up by name in files with a header")
+	}
+
+	if options.Encoding != "" {
+		encoding, err := htmlindex.Get(options.Encoding)
+
 		if err != nil {
-			return counter, errors.Wrap(err, "Error while decoding CSV file")
+			return nil, errors.Wrapf(err, "Unknown encoding %s", options.Encoding)
 		}
 
-		counter++
+		r = encoding.NewDecoder().Reader(r)
+	}
+
+	if options.DateFormat == "" {
+		options.DateFormat = time.RFC3339
+	}
+
+	reader := csv.NewReader(r)
 
-		if hasHeader && counter == 1 {
-			hasHeader = false
-			counter = 0
+	if options.Delimiter != 0 {
+		reader.Comma = options.Delimiter
+	}
+
+	decoder := &csvDecoder{
+		reader:    reader,
+		options:   options,
+		hasHeader: options.HasHeader,
+	}
+
+	if options.Columns == nil {
+		// Id, name, email, text, created
+		reader.FieldsPerRecord = csvNFields
+
+		for i := range decoder.columns {
+			decoder.columns[i] = i
+		}
+	}
+
+	return decoder, nil
+}
+
+// readHeader reads the header record, and looks up the columns in it if
+// needed.
+func (d *csvDecoder) readHeader() error {
+	header, err := d.reader.Read()
+
+	if err == io.EOF {
+		return nil
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "Error while reading CSV header")
+	}
+
+	if d.options.Columns == nil {
+		return nil
+	}
+
+	names := [csvNFields]string{
+		d.options.Columns.ID,
+		d.options.Columns.Author,
+		d.options.Columns.Email,
+		d.options.Columns.Message,
+		d.options.Columns.Created,
+	}
+
+	if names[csvCreated] == "" {
+		return errors.New("The column of the creation date is mandatory")
+	}
+
+	for i, name := range names {
+		d.columns[i] = -1
+
+		if name == "" {
 			continue
 		}
 
-		created, err := time.Parse(time.RFC3339, record[4])
+		for j, column := range header {
+			if strings.TrimSpace(column) == name {
+				d.columns[i] = j
+				break
+			}
+		}
+
+		if d.columns[i] < 0 {
+			return errors.Errorf("Column %s not found in CSV header", name)
+		}
+	}
+
+	return nil
+}
+
+// parseDate parses a creation date in the format given in the options.
+func (d *csvDecoder) parseDate(value string) (time.Time, error) {
+	if d.options.DateFormat == DateUnix {
+		seconds, err := strconv.ParseInt(value, 10, 64)
 
 		if err != nil {
-			return counter, errors.Wrapf(err, "Error while parsing creation date of record %d", counter)
+			return time.Time{}, err
+		}
+
+		return time.Unix(seconds, 0), nil
+	}
+
+	return time.Parse(d.options.DateFormat, value)
+}
+
+func (d *csvDecoder) Decode() (types.Post, error) {
+	record, err := d.ReadRecord()
+
+	if err != nil {
+		return types.Post{}, err
+	}
+
+	post, err := d.ParseRecord(record)
+
+	if err != nil {
+		return types.Post{}, &RecordError{Record: d.record, Err: err}
+	}
+
+	return post, nil
+}
+
+func (d *csvDecoder) ReadRecord() (interface{}, error) {
+	if d.hasHeader {
+		d.hasHeader = false
+
+		if err := d.readHeader(); err != nil {
+			return nil, err
 		}
+	}
+
+	record, err := d.reader.Read()
+
+	if err == io.EOF {
+		return nil, err
+	}
+
+	d.record++
+
+	if _, ok := err.(*csv.ParseError); ok {
+		// The reader skips to the next record after parse errors
+		return nil, &RecordError{Record: d.record, Err: err}
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while decoding CSV file")
+	}
+
+	return record, nil
+}
 
-		post := types.Post{
-			ID:      record[0],
-			Author:  record[1],
-			Email:   record[2],
-			Message: record[3],
-			Created: created,
+func (d *csvDecoder) ParseRecord(raw interface{}) (types.Post, error) {
+	record := raw.([]string)
+
+	field := func(i int) string {
+		if d.columns[i] < 0 {
+			return ""
+		}
+
+		return record[d.columns[i]]
+	}
+
+	created, err := d.parseDate(field(csvCreated))
+
+	if err != nil {
+		return types.Post{}, errors.Wrap(err, "Error while parsing creation date")
+	}
+
+	return types.Post{
+		ID:      field(csvID),
+		Author:  field(csvAuthor),
+		Email:   field(csvEmail),
+		Message: field(csvMessage),
+		Created: created,
+		State:   types.StatePublished,
+	}, nil
+}
+
+type csvEncoder struct {
+	writer      *csv.Writer
+	wroteHeader bool
+}
+
+// NewCSVEncoder returns an Encoder writing posts in the format described in
+// FormatCSV.
+func NewCSVEncoder(w io.Writer) Encoder {
+	return &csvEncoder{writer: csv.NewWriter(w)}
+}
+
+func (e *csvEncoder) writeHeader() error {
+	if e.wroteHeader {
+		return nil
+	}
+
+	e.wroteHeader = true
+
+	return errors.Wrap(e.writer.Write(csvHeader), "Error while writing CSV header")
+}
+
+func (e *csvEncoder) Encode(post types.Post) error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+
+	record := []string{
+		post.ID,
+		post.Author,
+		post.Email,
+		post.Message,
+		post.Created.Format(time.RFC3339Nano),
+	}
+
+	return errors.Wrap(e.writer.Write(record), "Error while writing CSV record")
+}
+
+func (e *csvEncoder) EncodeRecord(record interface{}) error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+
+	return errors.Wrap(e.writer.Write(record.([]string)), "Error while writing CSV record")
+}
+
+func (e *csvEncoder) Close() error {
+	// Empty files still have a header
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+
+	e.writer.Flush()
+
+	return errors.Wrap(e.writer.Error(), "Error while writing CSV data")
+}
+
+// LoadFromCSV loads the contents of a CSV file into a Store, and return the
+// number of posts inserted. Loaded posts are published. LoadFromCSV stops at
+// the first invalid record.
+//
+// The CSV records must have 5 columns: id, name, email, text, created (in RFC3339 format).
+//
+// Deprecated: LoadFromCSV adds the posts to the store without validating them.
+// Use postservice.Service.Import with a decoder returned by NewCSVDecoder
+// instead.
+func LoadFromCSV(store Store, data io.Reader, hasHeader bool) (uint, error) {
+	decoder := NewCSVDecoder(data, hasHeader)
+	counter := uint(0)
+
+	for {
+		post, err := decoder.Decode()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return counter, errors.Wrap(err, "Error while decoding CSV file")
 		}
 
 		if err := store.Add(post); err != nil {
-			return counter, errors.Wrapf(err, "Error while inserting post for record %d", counter)
+			return counter, errors.Wrapf(err, "Error while inserting post for record %d", counter+1)
 		}
+
+		counter++
 	}
 
 	return counter, nil
 }
+
+// ExportToCSV writes the published posts of a Store to w in the format read by
+// LoadFromCSV, with a header record, and returns the number of posts written.
+// Posts are read from the store one page at a time, so ExportToCSV can be used
+// on large stores.
+//
+// The CSV format does not include the post states, and all posts are published
+// when the file is loaded again, so unconfirmed posts are not exported.
+func ExportToCSV(store Store, w io.Writer) (uint, error) {
+	return FormatCSV.Export(store, w)
+}
@@ -1,10 +1,14 @@
 package poststore_test
 
 import (
+	"bytes"
+	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/abustany/back-message-board/pkg/poststore"
+	"github.com/abustany/back-message-board/pkg/types"
 )
 
 func TestLoadFromCSV(t *testing.T) {
@@ -81,3 +85,182 @@ func TestLoadFromCSV(t *testing.T) {
 		}
 	}
 }
+
+func TestExportToCSV(t *testing.T) {
+	store, err := poststore.NewMemoryPostStore()
+
+	if err != nil {
+		t.Fatalf("Error while creating store: %s", err)
+	}
+
+	now := time.Now()
+
+	// More than a page of posts, with characters that need quoting
+	posts := make([]types.Post, 250)
+
+	for i := range posts {
+		posts[i] = types.Post{
+			ID:      fmt.Sprintf("ID%03d", i),
+			Author:  "John, \"the\" author",
+			Email:   "john@domain.com",
+			Message: fmt.Sprintf("Message %d\nsecond line", i),
+			Created: now.Add(-time.Duration(i) * time.Second),
+			State:   types.StatePublished,
+		}
+
+		if err := store.Add(posts[i]); err != nil {
+			t.Fatalf("Add returned an error: %s", err)
+		}
+	}
+
+	// Unconfirmed posts would be published when loading the file
+	unconfirmed := types.Post{ID: "unconfirmed", Author: "John", Created: now, State: types.StateUnconfirmed}
+
+	if err := store.Add(unconfirmed); err != nil {
+		t.Fatalf("Add returned an error: %s", err)
+	}
+
+	buffer := bytes.Buffer{}
+	n, err := poststore.ExportToCSV(store, &buffer)
+
+	if err != nil {
+		t.Fatalf("ExportToCSV returned an error: %s", err)
+	}
+
+	if n != uint(len(posts)) {
+		t.Errorf("ExportToCSV returned an incorrect record count: got %d, expected %d", n, len(posts))
+	}
+
+	if !strings.HasPrefix(buffer.String(), "id,name,email,text,created\n") {
+		t.Errorf("ExportToCSV did not write the header record")
+	}
+
+	imported, err := poststore.NewMemoryPostStore()
+
+	if err != nil {
+		t.Fatalf("Error while creating store: %s", err)
+	}
+
+	if n, err := poststore.LoadFromCSV(imported, &buffer, true); err != nil {
+		t.Fatalf("LoadFromCSV returned an error on exported data: %s", err)
+	} else if n != uint(len(posts)) {
+		t.Errorf("LoadFromCSV returned an incorrect record count on exported data: got %d, expected %d", n, len(posts))
+	}
+
+	for _, post := range posts {
+		loaded, err := imported.Get(post.ID)
+
+		if err != nil {
+			t.Errorf("Exported post %s was not loaded: %s", post.ID, err)
+		} else if !loaded.Equal(post) {
+			t.Errorf("Unexpected post after export and load: got %+v, expected %+v", loaded, post)
+		}
+	}
+	if _, err := imported.Get(unconfirmed.ID); err != poststore.ErrIDNotFound {
+		t.Errorf("Unconfirmed post was exported to CSV")
+	}
+}
+
+func TestCSVOptions(t *testing.T) {
+	created := time.Date(2017, 12, 14, 14, 20, 33, 0, time.UTC)
+
+	testData := []struct {
+		name    string
+		data    string
+		options poststore.CSVOptions
+	}{
+		{
+			"Semicolon delimiter",
+			"ID;Zoé;zoe@domain.com;Hello;2017-12-14T06:20:33-08:00\n",
+			poststore.CSVOptions{Delimiter: ';'},
+		},
+		{
+			"Column mapping",
+			"Date,Text,Author,Id,Ignored\n2017-12-14T06:20:33-08:00,Hello,Zoé,ID,whatever\n",
+			poststore.CSVOptions{
+				HasHeader: true,
+				Columns:   &poststore.CSVColumns{ID: "Id", Author: "Author", Message: "Text", Created: "Date"},
+			},
+		},
+		{
+			"Unix dates",
+			"ID,Zoé,zoe@domain.com,Hello,1513261233\n",
+			poststore.CSVOptions{DateFormat: poststore.DateUnix},
+		},
+		{
+			"Custom date format",
+			"ID,Zoé,zoe@domain.com,Hello,14/12/2017 14:20:33\n",
+			poststore.CSVOptions{DateFormat: "02/01/2006 15:04:05"},
+		},
+		{
+			"Windows-1252 encoding",
+			"ID,Zo\xe9,zoe@domain.com,Hello,2017-12-14T06:20:33-08:00\n",
+			poststore.CSVOptions{Encoding: "windows-1252"},
+		},
+	}
+
+	for _, d := range testData {
+		decoder, err := poststore.NewCSVDecoderWithOptions(strings.NewReader(d.data), d.options)
+
+		if err != nil {
+			t.Errorf("NewCSVDecoderWithOptions returned an error for case %s: %s", d.name, err)
+			continue
+		}
+
+		post, err := decoder.Decode()
+
+		if err != nil {
+			t.Errorf("Decode returned an error for case %s: %s", d.name, err)
+			continue
+		}
+
+		if post.ID != "ID" || post.Author != "Zoé" || post.Message != "Hello" || !post.Created.Equal(created) {
+			t.Errorf("Unexpected post for case %s: %+v", d.name, post)
+		}
+	}
+
+	invalidOptions := map[string]poststore.CSVOptions{
+		"Columns without header": {Columns: &poststore.CSVColumns{Created: "Date"}},
+		"Unknown encoding":       {Encoding: "klingon"},
+	}
+
+	for name, options := range invalidOptions {
+		if _, err := poststore.NewCSVDecoderWithOptions(strings.NewReader(""), options); err == nil {
+			t.Errorf("NewCSVDecoderWithOptions didn't return an error for case %s", name)
+		}
+	}
+
+	// Missing columns are reported when reading the header
+	decoder, err := poststore.NewCSVDecoderWithOptions(strings.NewReader("Id,Text\nID,Hello\n"), poststore.CSVOptions{
+		HasHeader: true,
+		Columns:   &poststore.CSVColumns{ID: "Id", Created: "Date"},
+	})
+
+	if err != nil {
+		t.Fatalf("NewCSVDecoderWithOptions returned an error: %s", err)
+	}
+
+	if _, err := decoder.Decode(); err == nil {
+		t.Errorf("Decode didn't return an error for a missing column")
+	}
+}
+
+func TestParseCSVColumns(t *testing.T) {
+	columns, err := poststore.ParseCSVColumns("id=Id, author=Name,created=Date")
+
+	if err != nil {
+		t.Fatalf("ParseCSVColumns returned an error: %s", err)
+	}
+
+	expected := poststore.CSVColumns{ID: "Id", Author: "Name", Created: "Date"}
+
+	if *columns != expected {
+		t.Errorf("Unexpected columns: got %+v, expected %+v", *columns, expected)
+	}
+
+	for _, s := range []string{"", "id", "id=", "title=Title"} {
+		if _, err := poststore.ParseCSVColumns(s); err == nil {
+			t.Errorf("ParseCSVColumns didn't return an error for %q", s)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package poststore
+
+import (
+	"sort"
+)
+
+// indexBlockSize is the number of keys in the blocks of a dateIndex built with
+// build. Blocks grown by put are split when they reach twice that size.
+const indexBlockSize = 128
+
+// compareCursors compares two cursors by their date, sorting the most recent
+// first, and then by ID.
+func compareCursors(a, b Cursor) int {
+	if a.Created.Before(b.Created) {
+		return 1
+	}
+
+	if a.Created.After(b.Created) {
+		return -1
+	}
+
+	// Posts have the same creation time, sort by ID
+	if a.ID < b.ID {
+		return -1
+	}
+
+	if a.ID > b.ID {
+		return 1
+	}
+
+	return 0
+}
+
+// sortCursors sorts cursors in the order of compareCursors.
+func sortCursors(keys []Cursor) {
+	sort.Slice(keys, func(i, j int) bool {
+		return compareCursors(keys[i], keys[j]) < 0
+	})
+}
+
+// dateIndex is a sorted set of cursors, in the order of compareCursors. The
+// cursors are stored in blocks of consecutive keys, so that the whole index can
+// be built at once from sorted keys (see merge), which a balanced tree doesn't
+// allow.
+type dateIndex struct {
+	// Non empty blocks, each one holding keys smaller than the keys of the
+	// next one
+	blocks [][]Cursor
+	size   int
+}
+
+// indexPosition is the position of a key in a dateIndex. The position after
+// the last key has block set to the number of blocks.
+type indexPosition struct {
+	block int
+	i     int
+}
+
+// search returns the position of the first key greater than or equal to key.
+func (idx *dateIndex) search(key Cursor) indexPosition {
+	b := sort.Search(len(idx.blocks), func(b int) bool {
+		block := idx.blocks[b]
+		return compareCursors(block[len(block)-1], key) >= 0
+	})
+
+	if b == len(idx.blocks) {
+		return indexPosition{block: b}
+	}
+
+	block := idx.blocks[b]
+	i := sort.Search(len(block), func(i int) bool {
+		return compareCursors(block[i], key) >= 0
+	})
+
+	return indexPosition{block: b, i: i}
+}
+
+// at returns the key at the given position, or false if the position is after
+// the last key.
+func (idx *dateIndex) at(p indexPosition) (Cursor, bool) {
+	if p.block >= len(idx.blocks) {
+		return Cursor{}, false
+	}
+
+	return idx.blocks[p.block][p.i], true
+}
+
+// next returns the position following p.
+func (idx *dateIndex) next(p indexPosition) indexPosition {
+	p.i++
+
+	if p.i == len(idx.blocks[p.block]) {
+		p.block++
+		p.i = 0
+	}
+
+	return p
+}
+
+// put adds a key to the index, if not already present.
+func (idx *dateIndex) put(key Cursor) {
+	p := idx.search(key)
+
+	if existing, ok := idx.at(p); ok && compareCursors(existing, key) == 0 {
+		return
+	}
+
+	idx.size++
+
+	if len(idx.blocks) == 0 {
+		idx.blocks = [][]Cursor{{key}}
+		return
+	}
+
+	if p.block == len(idx.blocks) {
+		// The key goes after the last one
+		p.block--
+		p.i = len(idx.blocks[p.block])
+	}
+
+	block := append(idx.blocks[p.block], Cursor{})
+	copy(block[p.i+1:], block[p.i:])
+	block[p.i] = key
+
+	if len(block) < 2*indexBlockSize {
+		idx.blocks[p.block] = block
+		return
+	}
+
+	half := len(block) / 2
+	idx.blocks = append(idx.blocks, nil)
+	copy(idx.blocks[p.block+2:], idx.blocks[p.block+1:])
+	idx.blocks[p.block] = block[:half:half]
+	idx.blocks[p.block+1] = append([]Cursor(nil), block[half:]...)
+}
+
+// remove removes a key from the index, if present.
+func (idx *dateIndex) remove(key Cursor) {
+	p := idx.search(key)
+
+	if existing, ok := idx.at(p); !ok || compareCursors(existing, key) != 0 {
+		return
+	}
+
+	idx.size--
+
+	block := idx.blocks[p.block]
+	copy(block[p.i:], block[p.i+1:])
+	// Don't keep a reference to the ID of the removed key
+	block[len(block)-1] = Cursor{}
+	block = block[:len(block)-1]
+
+	if len(block) > 0 {
+		idx.blocks[p.block] = block
+		return
+	}
+
+	copy(idx.blocks[p.block:], idx.blocks[p.block+1:])
+	idx.blocks[len(idx.blocks)-1] = nil
+	idx.blocks = idx.blocks[:len(idx.blocks)-1]
+}
+
+// build replaces the contents of the index with the given keys, which must be
+// sorted and unique. The index keeps a reference to keys.
+func (idx *dateIndex) build(keys []Cursor) {
+	idx.blocks = make([][]Cursor, 0, (len(keys)+indexBlockSize-1)/indexBlockSize)
+	idx.size = len(keys)
+
+	for len(keys) > 0 {
+		n := indexBlockSize
+
+		if n > len(keys) {
+			n = len(keys)
+		}
+
+		idx.blocks = append(idx.blocks, keys[:n:n])
+		keys = keys[n:]
+	}
+}
+
+// merge adds sorted and unique keys to the index, rebuilding it in a single
+// pass over its keys. Keys already present are ignored.
+func (idx *dateIndex) merge(keys []Cursor) {
+	merged := make([]Cursor, 0, idx.size+len(keys))
+	p := indexPosition{}
+
+	for existing, ok := idx.at(p); ok || len(keys) > 0; existing, ok = idx.at(p) {
+		if !ok {
+			merged = append(merged, keys[0])
+			keys = keys[1:]
+			continue
+		}
+
+		c := 1
+
+		if len(keys) > 0 {
+			c = compareCursors(keys[0], existing)
+		}
+
+		if c < 0 {
+			merged = append(merged, keys[0])
+			keys = keys[1:]
+			continue
+		}
+
+		if c == 0 {
+			keys = keys[1:]
+		}
+
+		merged = append(merged, existing)
+		p = idx.next(p)
+	}
+
+	idx.build(merged)
+}
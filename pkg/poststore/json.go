@@ -0,0 +1,208 @@
+package poststore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+// FormatJSON reads and writes JSON arrays of posts.
+var FormatJSON = Format{
+	Name:        "json",
+	Extensions:  []string{"json"},
+	ContentType: "application/json",
+	NewDecoder:  NewJSONDecoder,
+	NewEncoder:  NewJSONEncoder,
+}
+
+// FormatNDJSON reads and writes newline delimited JSON, with one post per
+// line.
+var FormatNDJSON = Format{
+	Name:        "ndjson",
+	Extensions:  []string{"ndjson", "jsonl"},
+	ContentType: "application/x-ndjson",
+	NewDecoder:  NewNDJSONDecoder,
+	NewEncoder:  NewNDJSONEncoder,
+}
+
+type jsonDecoder struct {
+	decoder *json.Decoder
+	started bool
+	record  uint
+}
+
+// NewJSONDecoder returns a Decoder reading a JSON array of posts. The array is
+// read one element at a time.
+func NewJSONDecoder(r io.Reader) Decoder {
+	return &jsonDecoder{decoder: json.NewDecoder(r)}
+}
+
+func (d *jsonDecoder) Decode() (types.Post, error) {
+	if !d.started {
+		d.started = true
+
+		if token, err := d.decoder.Token(); err != nil {
+			return types.Post{}, errors.Wrap(err, "Error while reading the start of the JSON array")
+		} else if token != json.Delim('[') {
+			return types.Post{}, errors.New("JSON data should be an array of posts")
+		}
+	}
+
+	if !d.decoder.More() {
+		if _, err := d.decoder.Token(); err != nil {
+			return types.Post{}, errors.Wrap(err, "Error while reading the end of the JSON array")
+		}
+
+		return types.Post{}, io.EOF
+	}
+
+	d.record++
+
+	var post types.Post
+	err := d.decoder.Decode(&post)
+
+	if _, ok := err.(*json.UnmarshalTypeError); ok {
+		// The decoder skips the invalid value
+		return types.Post{}, &RecordError{Record: d.record, Err: err}
+	}
+
+	if err != nil {
+		// Syntax errors cannot be recovered from
+		return types.Post{}, errors.Wrapf(err, "Error while decoding record %d", d.record)
+	}
+
+	return post, nil
+}
+
+type jsonEncoder struct {
+	w       io.Writer
+	encoded bool
+}
+
+// NewJSONEncoder returns an Encoder writing a JSON array of posts, with one
+// post per line.
+func NewJSONEncoder(w io.Writer) Encoder {
+	return &jsonEncoder{w: w}
+}
+
+func (e *jsonEncoder) Encode(post types.Post) error {
+	data, err := json.Marshal(&post)
+
+	if err != nil {
+		return errors.Wrap(err, "Error while encoding post")
+	}
+
+	separator := ",\n"
+
+	if !e.encoded {
+		separator = "[\n"
+		e.encoded = true
+	}
+
+	_, err = e.w.Write(append([]byte(separator), data...))
+
+	return err
+}
+
+func (e *jsonEncoder) Close() error {
+	end := "\n]\n"
+
+	if !e.encoded {
+		end = "[]\n"
+	}
+
+	_, err := io.WriteString(e.w, end)
+
+	return err
+}
+
+// MaxNDJSONLineLength is the maximum length of the lines read by the NDJSON
+// decoder.
+const MaxNDJSONLineLength = 1 << 20
+
+type ndjsonDecoder struct {
+	scanner *bufio.Scanner
+	record  uint
+}
+
+// NewNDJSONDecoder returns a Decoder reading newline delimited JSON, with one
+// post per line. Empty lines are ignored.
+func NewNDJSONDecoder(r io.Reader) Decoder {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, MaxNDJSONLineLength)
+
+	return &ndjsonDecoder{scanner: scanner}
+}
+
+func (d *ndjsonDecoder) Decode() (types.Post, error) {
+	line, err := d.ReadRecord()
+
+	if err != nil {
+		return types.Post{}, err
+	}
+
+	post, err := d.ParseRecord(line)
+
+	if err != nil {
+		return types.Post{}, &RecordError{Record: d.record, Err: err}
+	}
+
+	return post, nil
+}
+
+func (d *ndjsonDecoder) ReadRecord() (interface{}, error) {
+	for d.scanner.Scan() {
+		line := bytes.TrimSpace(d.scanner.Bytes())
+
+		if len(line) == 0 {
+			continue
+		}
+
+		d.record++
+
+		// The scanner reuses its buffer
+		return append([]byte(nil), line...), nil
+	}
+
+	if err := d.scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "Error while reading NDJSON data")
+	}
+
+	return nil, io.EOF
+}
+
+func (d *ndjsonDecoder) ParseRecord(raw interface{}) (types.Post, error) {
+	var post types.Post
+	err := json.Unmarshal(raw.([]byte), &post)
+
+	return post, err
+}
+
+type ndjsonEncoder struct {
+	w       io.Writer
+	encoder *json.Encoder
+}
+
+// NewNDJSONEncoder returns an Encoder writing newline delimited JSON, with one
+// post per line.
+func NewNDJSONEncoder(w io.Writer) Encoder {
+	return &ndjsonEncoder{w: w, encoder: json.NewEncoder(w)}
+}
+
+func (e *ndjsonEncoder) Encode(post types.Post) error {
+	return e.encoder.Encode(&post)
+}
+
+func (e *ndjsonEncoder) EncodeRecord(record interface{}) error {
+	_, err := e.w.Write(append(record.([]byte), '\n'))
+	return err
+}
+
+func (e *ndjsonEncoder) Close() error {
+	return nil
+}
@@ -3,47 +3,19 @@ package poststore
 import (
 	"sync"
 
-	avl "github.com/emirpasic/gods/trees/avltree"
-
 	"github.com/abustany/back-message-board/pkg/types"
 )
 
 type memoryPostStore struct {
 	sync.RWMutex
 	posts       map[string]types.Post
-	postsByDate *avl.Tree
-}
-
-// sortPostsByDateReverse compares two posts by their date, sorting the most
-// recent first.
-func sortPostsByDateReverse(a, b interface{}) int {
-	aKey, bKey := a.(Cursor), b.(Cursor)
-
-	if aKey.Created.Before(bKey.Created) {
-		return 1
-	}
-
-	if aKey.Created.After(bKey.Created) {
-		return -1
-	}
-
-	// Posts have the same creation time, sort by ID
-	if aKey.ID < bKey.ID {
-		return -1
-	}
-
-	if aKey.ID > bKey.ID {
-		return 1
-	}
-
-	return 0
+	postsByDate dateIndex
 }
 
 // NewMemoryPostStore returns a non-persistent, in-memory implementation of Store.
 func NewMemoryPostStore() (Store, error) {
 	return &memoryPostStore{
-		posts:       map[string]types.Post{},
-		postsByDate: avl.NewWith(sortPostsByDateReverse),
+		posts: map[string]types.Post{},
 	}, nil
 }
 
@@ -51,6 +23,10 @@ func (s *memoryPostStore) Get(id string) (types.Post, error) {
 	s.RLock()
 	defer s.RUnlock()
 
+	return s.get(id)
+}
+
+func (s *memoryPostStore) get(id string) (types.Post, error) {
 	if post, exists := s.posts[id]; exists {
 		return post, nil
 	}
@@ -67,46 +43,112 @@ func (s *memoryPostStore) Add(post types.Post) error {
 	}
 
 	s.posts[post.ID] = post
-	s.postsByDate.Put(Cursor{ID: post.ID, Created: post.Created}, struct{}{})
+	s.postsByDate.put(Cursor{ID: post.ID, Created: post.Created})
 
 	return nil
 }
 
-func (s *memoryPostStore) Update(post types.Post) error {
+func (s *memoryPostStore) AddBatch(posts []types.Post) []error {
 	s.Lock()
 	defer s.Unlock()
 
-	oldPost, exists := s.posts[post.ID]
+	var errs []error
+	keys := make([]Cursor, 0, len(posts))
+
+	for i, post := range posts {
+		if _, exists := s.posts[post.ID]; exists {
+			if errs == nil {
+				errs = make([]error, len(posts))
+			}
+
+			errs[i] = ErrIDAlreadyExists
+			continue
+		}
+
+		s.posts[post.ID] = post
+		keys = append(keys, Cursor{ID: post.ID, Created: post.Created})
+	}
+
+	if len(keys) < s.postsByDate.size {
+		for _, key := range keys {
+			s.postsByDate.put(key)
+		}
+
+		return errs
+	}
+
+	// Sorting the keys and rebuilding the index is faster than inserting each
+	// key when the batch is larger than the index, for example when loading
+	// posts into an empty store
+	sortCursors(keys)
+	s.postsByDate.merge(keys)
+
+	return errs
+}
+
+func (s *memoryPostStore) Update(post types.Post, fields types.FieldMask) error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.update(post, fields)
+}
+
+func (s *memoryPostStore) update(post types.Post, fields types.FieldMask) error {
+	existing, exists := s.posts[post.ID]
 
 	if !exists {
 		return ErrIDNotFound
 	}
 
-	existing := s.posts[post.ID]
+	oldPost := existing
 
-	if post.Author != "" {
+	if fields.Has(types.FieldAuthor) {
 		existing.Author = post.Author
 	}
 
-	if post.Email != "" {
+	if fields.Has(types.FieldEmail) {
 		existing.Email = post.Email
 	}
 
-	if !post.Created.IsZero() {
+	if fields.Has(types.FieldCreated) {
 		existing.Created = post.Created
 	}
 
-	if post.Message != "" {
+	if fields.Has(types.FieldMessage) {
 		existing.Message = post.Message
 	}
 
+	if fields.Has(types.FieldState) {
+		existing.State = post.State
+	}
+
 	s.posts[post.ID] = existing
 
-	if oldPost.Created != post.Created {
-		s.postsByDate.Remove(Cursor{ID: post.ID, Created: oldPost.Created})
-		s.postsByDate.Put(Cursor{ID: post.ID, Created: post.Created}, struct{}{})
+	if !oldPost.Created.Equal(existing.Created) {
+		s.postsByDate.remove(Cursor{ID: post.ID, Created: oldPost.Created})
+		s.postsByDate.put(Cursor{ID: post.ID, Created: existing.Created})
+	}
+
+	return nil
+}
+
+func (s *memoryPostStore) Delete(id string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.delete(id)
+}
+
+func (s *memoryPostStore) delete(id string) error {
+	post, exists := s.posts[id]
+
+	if !exists {
+		return ErrIDNotFound
 	}
 
+	delete(s.posts, id)
+	s.postsByDate.remove(Cursor{ID: post.ID, Created: post.Created})
+
 	return nil
 }
 
@@ -114,32 +156,93 @@ func (s *memoryPostStore) List(c Cursor, n uint) ([]types.Post, Cursor, error) {
 	s.RLock()
 	defer s.RUnlock()
 
-	var node *avl.Node
+	var p indexPosition
 
-	if c == EmptyCursor {
-		node = s.postsByDate.Left()
-	} else {
-		node, _ = s.postsByDate.Ceiling(c)
+	if c != EmptyCursor {
+		p = s.postsByDate.search(c)
 	}
 
-	if node == nil {
+	key, ok := s.postsByDate.at(p)
+
+	if !ok {
 		// No more posts to iterate
 		return nil, EmptyCursor, nil
 	}
 
 	posts := make([]types.Post, 0, n)
 
-	for ; node != nil && uint(len(posts)) < n; node = node.Next() {
-		posts = append(posts, s.posts[node.Key.(Cursor).ID])
+	for ; ok && uint(len(posts)) < n; key, ok = s.postsByDate.at(p) {
+		posts = append(posts, s.posts[key.ID])
+		p = s.postsByDate.next(p)
 	}
 
-	var endCursor Cursor
+	endCursor := EmptyCursor
 
-	if node == nil {
-		endCursor = EmptyCursor
-	} else {
-		endCursor = node.Key.(Cursor)
+	if ok {
+		endCursor = key
 	}
 
 	return posts, endCursor, nil
 }
+
+func (s *memoryPostStore) Transaction(f func(tx Tx) error) error {
+	s.Lock()
+	defer s.Unlock()
+
+	tx := &memoryTx{
+		store:     s,
+		originals: map[string]types.Post{},
+	}
+
+	if err := f(tx); err != nil {
+		tx.rollback()
+		return err
+	}
+
+	return nil
+}
+
+// memoryTx gives access to a memoryPostStore while its lock is held, and
+// remembers the posts it modifies so that they can be restored.
+type memoryTx struct {
+	store *memoryPostStore
+	// Version of the modified posts before the transaction
+	originals map[string]types.Post
+}
+
+// save remembers the current version of a post before it is modified for the
+// first time in the transaction.
+func (tx *memoryTx) save(id string) {
+	if _, saved := tx.originals[id]; saved {
+		return
+	}
+
+	if post, exists := tx.store.posts[id]; exists {
+		tx.originals[id] = post
+	}
+}
+
+func (tx *memoryTx) rollback() {
+	for id, original := range tx.originals {
+		if _, exists := tx.store.posts[id]; exists {
+			tx.store.delete(id)
+		}
+
+		tx.store.posts[id] = original
+		tx.store.postsByDate.put(Cursor{ID: id, Created: original.Created})
+	}
+}
+
+func (tx *memoryTx) Get(id string) (types.Post, error) {
+	return tx.store.get(id)
+}
+
+func (tx *memoryTx) Update(post types.Post, fields types.FieldMask) error {
+	tx.save(post.ID)
+	return tx.store.update(post, fields)
+}
+
+func (tx *memoryTx) Delete(id string) error {
+	tx.save(id)
+	return tx.store.delete(id)
+}
@@ -31,9 +31,22 @@ type Store interface {
 	// returns ErrIDAlreadyExists.
 	Add(post types.Post) error
 
-	// Update updates a given post in the store. If a post with the given ID
-	// cannot be found, it returns ErrIDNotFound.
-	Update(post types.Post) error
+	// AddBatch adds several posts to the store at once. Stores can use it to
+	// build their indexes in bulk, when the batch is large compared to the
+	// contents of the store. It returns nil if all the posts were added, else
+	// a slice holding the error of each post (nil for the posts that were
+	// added). Like with Add, posts whose ID already exists get
+	// ErrIDAlreadyExists.
+	AddBatch(posts []types.Post) []error
+
+	// Update copies the given fields of post to the stored post with the same
+	// ID. Fields that are not in the mask are left untouched. If a post with
+	// the given ID cannot be found, it returns ErrIDNotFound.
+	Update(post types.Post, fields types.FieldMask) error
+
+	// Delete removes the post with the given ID from the store. If a post with
+	// the given ID cannot be found, it returns ErrIDNotFound.
+	Delete(id string) error
 
 	// List lists the first n posts after the given cursor.
 	//
@@ -43,6 +56,22 @@ type Store interface {
 	// continuing the iteration over the posts. When there are no more posts to
 	// iterate, the returned cursor is EmptyCursor.
 	List(c Cursor, n uint) (posts []types.Post, next Cursor, err error)
+
+	// Transaction calls f with a Tx giving exclusive access to the store. If f
+	// returns an error, all the changes made through the Tx are rolled back,
+	// and Transaction returns that error.
+	//
+	// The Tx should not be used after f returns, and f should not call other
+	// methods of the store.
+	Transaction(f func(tx Tx) error) error
+}
+
+// Tx gives access to a store during a transaction, see Store.Transaction. Its
+// methods behave like the Store methods with the same names.
+type Tx interface {
+	Get(id string) (types.Post, error)
+	Update(post types.Post, fields types.FieldMask) error
+	Delete(id string) error
 }
 
 // EmptyCursor is the smallest cursor value.
@@ -57,6 +86,6 @@ var EmptyCursor = Cursor{}
 // an ID already present in the store.
 var ErrIDAlreadyExists = errors.New("A post with this ID already exists")
 
-// ErrIDNotFound is returned by Get or Update when trying to access an ID not
+// ErrIDNotFound is returned by Get, Update or Delete when trying to access an ID not
 // present in the store.
 var ErrIDNotFound = errors.New("A post with this ID cannot be found")
@@ -1,7 +1,9 @@
 package poststore_test
 
 import (
+	"errors"
 	"fmt"
+	"math/rand"
 	"testing"
 	"time"
 
@@ -17,9 +19,13 @@ func testStore(t *testing.T, storeFactory func() poststore.Store) {
 	}
 
 	t.Run("Add", withStore(testAdd))
+	t.Run("AddBatch", withStore(testAddBatch))
+	t.Run("Many posts", withStore(testManyPosts))
 	t.Run("Update", withStore(testUpdate))
 	t.Run("List", withStore(testList))
 	t.Run("Get", withStore(testGet))
+	t.Run("Delete", withStore(testDelete))
+	t.Run("Transaction", withStore(testTransaction))
 }
 
 func checkPosts(t *testing.T, store poststore.Store, expected []types.Post) {
@@ -61,6 +67,110 @@ func testAdd(t *testing.T, store poststore.Store) {
 	checkPosts(t, store, []types.Post{post})
 }
 
+func testAddBatch(t *testing.T, store poststore.Store) {
+	now := time.Now()
+	posts := make([]types.Post, 10)
+
+	for i := range posts {
+		posts[i] = types.Post{ID: fmt.Sprintf("ID%d", i), Created: now.Add(-time.Duration(i) * time.Second)}
+	}
+
+	// Insertion order should not matter
+	shuffled := []types.Post{posts[3], posts[0], posts[9], posts[5], posts[1], posts[8], posts[2], posts[7], posts[4], posts[6]}
+
+	if errs := store.AddBatch(shuffled[:5]); errs != nil {
+		t.Errorf("AddBatch returned errors: %v", errs)
+	}
+
+	duplicate := posts[0]
+	duplicate.Author = "Duplicate"
+
+	errs := store.AddBatch(append(shuffled[5:], duplicate, duplicate))
+
+	if len(errs) != 7 {
+		t.Fatalf("AddBatch returned %d errors, expected 7", len(errs))
+	}
+
+	for i, err := range errs {
+		if expected := i >= 5; (err == poststore.ErrIDAlreadyExists) != expected {
+			t.Errorf("Unexpected error for post %d: %v", i, err)
+		}
+	}
+
+	checkPosts(t, store, posts)
+}
+
+func testManyPosts(t *testing.T, store poststore.Store) {
+	now := time.Now()
+	posts := make([]types.Post, 3000)
+
+	for i := range posts {
+		// Several posts share each creation time, and are sorted by ID
+		posts[i] = types.Post{ID: fmt.Sprintf("ID%04d", i), Created: now.Add(-time.Duration(i/3) * time.Second)}
+	}
+
+	shuffled := make([]types.Post, len(posts))
+
+	for i, j := range rand.New(rand.NewSource(1)).Perm(len(posts)) {
+		shuffled[i] = posts[j]
+	}
+
+	for _, post := range shuffled[:1000] {
+		if err := store.Add(post); err != nil {
+			t.Fatalf("Add returned an error: %s", err)
+		}
+	}
+
+	// A batch smaller than the store, then a larger one
+	for _, batch := range [][]types.Post{shuffled[1000:1100], shuffled[1100:]} {
+		if errs := store.AddBatch(batch); errs != nil {
+			t.Fatalf("AddBatch returned errors: %v", errs)
+		}
+	}
+
+	var expected []types.Post
+
+	for i, post := range posts {
+		if i%3 != 1 {
+			expected = append(expected, post)
+			continue
+		}
+
+		if err := store.Delete(post.ID); err != nil {
+			t.Fatalf("Delete returned an error: %s", err)
+		}
+	}
+
+	var listed []types.Post
+	cursor := poststore.EmptyCursor
+
+	for {
+		page, next, err := store.List(cursor, 100)
+
+		if err != nil {
+			t.Fatalf("List returned an error: %s", err)
+		}
+
+		listed = append(listed, page...)
+
+		if next == poststore.EmptyCursor {
+			break
+		}
+
+		cursor = next
+	}
+
+	if len(listed) != len(expected) {
+		t.Fatalf("List returned %d posts, expected %d", len(listed), len(expected))
+	}
+
+	for i := range expected {
+		if listed[i].ID != expected[i].ID {
+			t.Fatalf("List returned an unexpected post at index %d: got %s, expected %s", i, listed[i].ID, expected[i].ID)
+		}
+	}
+}
+
 func testUpdate(t *testing.T, store poststore.Store) {
 	post := types.Post{
 		ID:      "ID",
@@ -70,7 +180,7 @@ func testUpdate(t *testing.T, store poststore.Store) {
 		Message: "Message1",
 	}
 
-	if err := store.Update(post); err == nil {
+	if err := store.Update(post, types.AllFields); err == nil {
 		t.Errorf("Update didn't return an error when updating a non existing post")
 	} else if err != poststore.ErrIDNotFound {
 		t.Errorf("Update returned an unexpected error when updating a non existing post: %s", err)
@@ -89,7 +199,7 @@ func testUpdate(t *testing.T, store poststore.Store) {
 	post.Created = time.Now()
 	post.Message = "Message2"
 
-	if err := store.Update(post); err != nil {
+	if err := store.Update(post, types.AllFields); err != nil {
 		t.Errorf("Update returned an error when updating an existing post: %s", err)
 	}
 
@@ -97,11 +207,20 @@ func testUpdate(t *testing.T, store poststore.Store) {
 
 	post.Author = "Author3"
 
-	if err := store.Update(types.Post{ID: post.ID, Author: post.Author}); err != nil {
+	if err := store.Update(types.Post{ID: post.ID, Author: post.Author}, types.FieldMask{types.FieldAuthor}); err != nil {
 		t.Errorf("Partial update returned an error when updating an existing post: %s", err)
 	}
 
 	checkPosts(t, store, []types.Post{post})
+
+	// Fields in the mask can be cleared
+	post.Message = ""
+
+	if err := store.Update(types.Post{ID: post.ID, Author: "ignored"}, types.FieldMask{types.FieldMessage}); err != nil {
+		t.Errorf("Clearing a field returned an error: %s", err)
+	}
+
+	checkPosts(t, store, []types.Post{post})
 }
 
 func testList(t *testing.T, store poststore.Store) {
@@ -255,3 +374,100 @@ func testGet(t *testing.T, store poststore.Store) {
 		t.Errorf("Get returned an unexpected post: got %+v, expected %+v", fetched, post)
 	}
 }
+
+func testDelete(t *testing.T, store poststore.Store) {
+	now := time.Now()
+	posts := []types.Post{
+		{ID: "ID1", Created: now.Add(time.Second)},
+		{ID: "ID2", Created: now},
+	}
+
+	if err := store.Delete(posts[0].ID); err != poststore.ErrIDNotFound {
+		t.Errorf("Unexpected error when deleting a non existing post: got %v, expected %v", err, poststore.ErrIDNotFound)
+	}
+
+	for _, p := range posts {
+		if err := store.Add(p); err != nil {
+			t.Fatalf("Add returned an error: %s", err)
+		}
+	}
+
+	// Partial updates should not confuse the date index
+	if err := store.Update(types.Post{ID: posts[0].ID, Author: "Author"}, types.FieldMask{types.FieldAuthor}); err != nil {
+		t.Fatalf("Update returned an error: %s", err)
+	}
+
+	posts[0].Author = "Author"
+
+	if err := store.Delete(posts[0].ID); err != nil {
+		t.Errorf("Delete returned an error when deleting an existing post: %s", err)
+	}
+
+	checkPosts(t, store, posts[1:])
+
+	if _, err := store.Get(posts[0].ID); err != poststore.ErrIDNotFound {
+		t.Errorf("Unexpected error when getting a deleted post: got %v, expected %v", err, poststore.ErrIDNotFound)
+	}
+
+	if err := store.Delete(posts[0].ID); err != poststore.ErrIDNotFound {
+		t.Errorf("Unexpected error when deleting a post twice: got %v, expected %v", err, poststore.ErrIDNotFound)
+	}
+}
+
+func testTransaction(t *testing.T, store poststore.Store) {
+	now := time.Now()
+
+	posts := []types.Post{
+		{ID: "ID1", Author: "Author1", Created: now},
+		{ID: "ID2", Author: "Author2", Created: now.Add(-time.Hour)},
+	}
+
+	for _, p := range posts {
+		if err := store.Add(p); err != nil {
+			t.Fatalf("Add returned an error: %s", err)
+		}
+	}
+
+	errAbort := errors.New("abort")
+
+	err := store.Transaction(func(tx poststore.Tx) error {
+		if err := tx.Update(types.Post{ID: "ID1", Created: now.Add(-2 * time.Hour)}, types.FieldMask{types.FieldCreated}); err != nil {
+			t.Errorf("Update returned an error in a transaction: %s", err)
+		}
+
+		if err := tx.Update(types.Post{ID: "ID1", Author: "Changed"}, types.FieldMask{types.FieldAuthor}); err != nil {
+			t.Errorf("Update returned an error in a transaction: %s", err)
+		}
+
+		if err := tx.Delete("ID2"); err != nil {
+			t.Errorf("Delete returned an error in a transaction: %s", err)
+		}
+
+		if _, err := tx.Get("ID2"); err != poststore.ErrIDNotFound {
+			t.Errorf("Unexpected error when getting a post deleted in the transaction: got %v, expected %v", err, poststore.ErrIDNotFound)
+		}
+
+		return errAbort
+	})
+
+	if err != errAbort {
+		t.Errorf("Unexpected error from an aborted transaction: got %v, expected %v", err, errAbort)
+	}
+
+	// All changes were rolled back
+	checkPosts(t, store, posts)
+
+	err = store.Transaction(func(tx poststore.Tx) error {
+		if err := tx.Delete("does not exist"); err != poststore.ErrIDNotFound {
+			t.Errorf("Unexpected error when deleting a non existing post: got %v, expected %v", err, poststore.ErrIDNotFound)
+		}
+
+		return tx.Delete("ID1")
+	})
+
+	if err != nil {
+		t.Errorf("Transaction returned an error: %s", err)
+	}
+
+	checkPosts(t, store, posts[1:])
+}
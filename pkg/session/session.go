@@ -0,0 +1,121 @@
+// Package session keeps track of the users logged in through a browser, so
+// that they don't have to send their credentials with each request.
+package session
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// idLength is the number of random bytes of session IDs and CSRF tokens.
+const idLength = 32
+
+// Session is a logged in user.
+type Session struct {
+	// Secret ID of the session, stored in a cookie
+	ID   string
+	User string
+	// Secret token that requests changing data must carry, to prove that they
+	// come from a page of the server and not from another site
+	CSRFToken string
+	// Time after which the session is forgotten, pushed back each time the
+	// session is used
+	Expires time.Time
+}
+
+// Store holds the sessions in memory. Sessions expire after they were not used
+// for a given duration.
+type Store struct {
+	sync.Mutex
+	ttl      time.Duration
+	sessions map[string]*Session
+}
+
+// NewStore returns a new Store, whose sessions expire after not being used
+// for the given duration.
+func NewStore(ttl time.Duration) *Store {
+	return &Store{
+		ttl:      ttl,
+		sessions: map[string]*Session{},
+	}
+}
+
+func randomID() (string, error) {
+	data := make([]byte, idLength)
+
+	if _, err := rand.Read(data); err != nil {
+		return "", errors.Wrap(err, "Error while generating session ID")
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// prune forgets expired sessions. It should be called with the lock held.
+func (s *Store) prune(now time.Time) {
+	for id, session := range s.sessions {
+		if session.Expires.Before(now) {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// Create returns a new session for the given user.
+func (s *Store) Create(user string) (Session, error) {
+	id, err := randomID()
+
+	if err != nil {
+		return Session{}, err
+	}
+
+	csrfToken, err := randomID()
+
+	if err != nil {
+		return Session{}, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	s.prune(now)
+
+	session := &Session{ID: id, User: user, CSRFToken: csrfToken, Expires: now.Add(s.ttl)}
+	s.sessions[id] = session
+
+	return *session, nil
+}
+
+// Get returns the session with the given ID, and pushes back its expiry. ok is
+// false if the session does not exist or expired.
+func (s *Store) Get(id string) (session Session, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	found, ok := s.sessions[id]
+
+	if !ok {
+		return Session{}, false
+	}
+
+	if found.Expires.Before(now) {
+		delete(s.sessions, id)
+		return Session{}, false
+	}
+
+	found.Expires = now.Add(s.ttl)
+
+	return *found, true
+}
+
+// Delete forgets a session, if it exists.
+func (s *Store) Delete(id string) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.sessions, id)
+}
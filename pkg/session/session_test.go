@@ -0,0 +1,60 @@
+package session_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/abustany/back-message-board/pkg/session"
+)
+
+func TestStore(t *testing.T) {
+	store := session.NewStore(time.Hour)
+
+	created, err := store.Create("admin")
+
+	if err != nil {
+		t.Fatalf("Create returned an error: %s", err)
+	}
+
+	if created.ID == "" || created.CSRFToken == "" || created.ID == created.CSRFToken || created.User != "admin" {
+		t.Errorf("Unexpected session: %+v", created)
+	}
+
+	if other, _ := store.Create("admin"); other.ID == created.ID || other.CSRFToken == created.CSRFToken {
+		t.Errorf("Sessions share their secrets: %+v and %+v", created, other)
+	}
+
+	if found, ok := store.Get(created.ID); !ok || found.User != "admin" || found.CSRFToken != created.CSRFToken {
+		t.Errorf("Unexpected result from Get: %+v, %v", found, ok)
+	}
+
+	if _, ok := store.Get("whatever"); ok {
+		t.Errorf("Get returned an unknown session")
+	}
+
+	store.Delete(created.ID)
+
+	if _, ok := store.Get(created.ID); ok {
+		t.Errorf("Get returned a deleted session")
+	}
+
+	t.Run("Expiry", func(t *testing.T) {
+		store := session.NewStore(10 * time.Millisecond)
+		created, _ := store.Create("admin")
+
+		// Sessions that are used don't expire
+		for i := 0; i < 3; i++ {
+			time.Sleep(5 * time.Millisecond)
+
+			if _, ok := store.Get(created.ID); !ok {
+				t.Fatalf("Session expired while being used")
+			}
+		}
+
+		time.Sleep(20 * time.Millisecond)
+
+		if _, ok := store.Get(created.ID); ok {
+			t.Errorf("Get returned an expired session")
+		}
+	})
+}
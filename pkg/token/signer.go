@@ -0,0 +1,85 @@
+// Package token provides tamper-proof tokens, authenticated using an HMAC
+// signature.
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SecretLength is the length of secrets generated by NewSecret.
+const SecretLength = 32
+
+// ErrInvalidToken is returned by Signer.Verify when given a malformed token, or
+// a token whose signature does not match its payload.
+var ErrInvalidToken = errors.New("Invalid token")
+
+// Signer signs and verifies tokens carrying an opaque payload.
+//
+// Tokens are made of the base64 encoded payload and its HMAC-SHA256 signature,
+// separated by a dot. They can safely be used in URLs and HTTP headers.
+type Signer struct {
+	secret []byte
+}
+
+// NewSecret returns a new random secret suitable for NewSigner.
+func NewSecret() ([]byte, error) {
+	secret := make([]byte, SecretLength)
+
+	if _, err := rand.Read(secret); err != nil {
+		return nil, errors.Wrap(err, "Error while generating random secret")
+	}
+
+	return secret, nil
+}
+
+// NewSigner returns a new Signer using the given secret.
+func NewSigner(secret []byte) *Signer {
+	return &Signer{secret}
+}
+
+func (s *Signer) signature(payload []byte) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(payload)
+
+	return mac.Sum(nil)
+}
+
+// Sign returns a token carrying the given payload.
+func (s *Signer) Sign(payload []byte) string {
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(s.signature(payload))
+}
+
+// Verify checks the signature of the given token, and returns its payload. If
+// the token is malformed or if its signature is invalid, ErrInvalidToken is
+// returned.
+func (s *Signer) Verify(token string) ([]byte, error) {
+	parts := strings.Split(token, ".")
+
+	if len(parts) != 2 {
+		return nil, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if !hmac.Equal(signature, s.signature(payload)) {
+		return nil, ErrInvalidToken
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,48 @@
+package token_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/abustany/back-message-board/pkg/token"
+)
+
+func TestSigner(t *testing.T) {
+	secret, err := token.NewSecret()
+
+	if err != nil {
+		t.Fatalf("NewSecret returned an error: %s", err)
+	}
+
+	signer := token.NewSigner(secret)
+	payload := "hello world"
+	signed := signer.Sign([]byte(payload))
+
+	t.Run("Valid token", func(t *testing.T) {
+		verified, err := signer.Verify(signed)
+
+		if err != nil {
+			t.Errorf("Verify returned an error: %s", err)
+		} else if string(verified) != payload {
+			t.Errorf("Verify returned an unexpected payload: got %s, expected %s", verified, payload)
+		}
+	})
+
+	t.Run("Invalid tokens", func(t *testing.T) {
+		otherSigner := token.NewSigner([]byte("some other secret"))
+
+		invalidTokens := map[string]string{
+			"Empty token":      "",
+			"No signature":     strings.Split(signed, ".")[0],
+			"Invalid base64":   "!!!." + strings.Split(signed, ".")[1],
+			"Tampered payload": "x" + signed,
+			"Other secret":     otherSigner.Sign([]byte(payload)),
+		}
+
+		for name, invalid := range invalidTokens {
+			if _, err := signer.Verify(invalid); err != token.ErrInvalidToken {
+				t.Errorf("Unexpected error for case %s: got %v, expected %v", name, err, token.ErrInvalidToken)
+			}
+		}
+	})
+}
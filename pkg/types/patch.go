@@ -0,0 +1,65 @@
+package types
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// field returns a pointer to the given field of the post, or nil if the field
+// cannot be updated.
+func (p *Post) field(field PostField) interface{} {
+	switch field {
+	case FieldAuthor:
+		return &p.Author
+	case FieldEmail:
+		return &p.Email
+	case FieldCreated:
+		return &p.Created
+	case FieldMessage:
+		return &p.Message
+	case FieldState:
+		return &p.State
+	}
+
+	return nil
+}
+
+// DecodeMergePatch decodes a JSON merge patch (RFC 7396) of a post. It returns
+// the values of the patched fields, and their mask. Fields set to null in the
+// patch are part of the mask, and set to their zero value.
+//
+// Members that are not updatable fields (like the ID) are ignored.
+func DecodeMergePatch(data []byte) (Post, FieldMask, error) {
+	var members map[string]json.RawMessage
+
+	if err := json.Unmarshal(data, &members); err != nil {
+		return Post{}, nil, errors.Wrap(err, "Error while decoding JSON")
+	}
+
+	if members == nil {
+		return Post{}, nil, errors.New("A merge patch should be a JSON object")
+	}
+
+	var post Post
+	var fields FieldMask
+
+	// Iterate over the fields rather than over the map, so that the mask
+	// has a stable order
+	for _, field := range AllFields {
+		value, exists := members[string(field)]
+
+		if !exists {
+			continue
+		}
+
+		// Null values leave the field to its zero value
+		if err := json.Unmarshal(value, post.field(field)); err != nil {
+			return Post{}, nil, errors.Wrapf(err, "Error while decoding field %s", field)
+		}
+
+		fields = append(fields, field)
+	}
+
+	return post, fields, nil
+}
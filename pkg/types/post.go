@@ -5,27 +5,114 @@ import (
 	"time"
 )
 
+// PostState tells whether a post is visible to the public.
+type PostState string
+
+const (
+	// StatePublished is the state of posts visible to everyone.
+	StatePublished PostState = "published"
+
+	// StateUnconfirmed is the state of posts whose author did not confirm
+	// their email address yet.
+	StateUnconfirmed PostState = "unconfirmed"
+)
+
+// Valid returns true if and only if s is one of the known post states.
+func (s PostState) Valid() bool {
+	switch s {
+	case StatePublished, StateUnconfirmed:
+		return true
+	}
+
+	return false
+}
+
 // Post describes a post in the message board.
 type Post struct {
 	// Unique ID of the post
-	ID string `json:"id"`
+	ID string `json:"id" msgpack:"id"`
 	// Post author name
-	Author string `json:"author"`
+	Author string `json:"author" msgpack:"author"`
 	// Post author email
-	Email string `json:"email"`
+	Email string `json:"email" msgpack:"email"`
 	// Post creation time
-	Created time.Time `json:"created"`
+	Created time.Time `json:"created" msgpack:"created"`
 	// Post contents
-	Message string `json:"message"`
+	Message string `json:"message" msgpack:"message"`
+	// Post state
+	State PostState `json:"state,omitempty" msgpack:"state,omitempty"`
+	// Hash of the secret token allowing the author to edit the post. It is
+	// never serialized.
+	EditTokenHash string `json:"-" msgpack:"-"`
 }
 
 // Equal returns true if and only if the posts p and other are equal. Comparing
 // two posts using == is not always safe because of the Created field, for the
 // same reason that comparing two time.Time values using == is not always safe.
+//
+// EditTokenHash is not compared, since it is internal to the post service.
 func (p Post) Equal(other Post) bool {
 	return p.ID == other.ID &&
 		p.Author == other.Author &&
 		p.Email == other.Email &&
 		p.Created.Equal(other.Created) &&
-		p.Message == other.Message
+		p.Message == other.Message &&
+		p.State == other.State
+}
+
+// PostField identifies a field of a post that can be updated, by its JSON
+// name.
+type PostField string
+
+const (
+	FieldAuthor  PostField = "author"
+	FieldEmail   PostField = "email"
+	FieldCreated PostField = "created"
+	FieldMessage PostField = "message"
+	FieldState   PostField = "state"
+)
+
+// FieldMask lists the fields of a post affected by a partial update.
+type FieldMask []PostField
+
+// AllFields is the mask of all the fields of a post that can be updated.
+var AllFields = FieldMask{FieldAuthor, FieldEmail, FieldCreated, FieldMessage, FieldState}
+
+// Has returns true if and only if the mask contains the given field.
+func (m FieldMask) Has(field PostField) bool {
+	for _, f := range m {
+		if f == field {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NonZeroFields returns the mask of the fields of the given post that are set
+// to a non zero value.
+func NonZeroFields(post Post) FieldMask {
+	var fields FieldMask
+
+	if post.Author != "" {
+		fields = append(fields, FieldAuthor)
+	}
+
+	if post.Email != "" {
+		fields = append(fields, FieldEmail)
+	}
+
+	if !post.Created.IsZero() {
+		fields = append(fields, FieldCreated)
+	}
+
+	if post.Message != "" {
+		fields = append(fields, FieldMessage)
+	}
+
+	if post.State != "" {
+		fields = append(fields, FieldState)
+	}
+
+	return fields
 }
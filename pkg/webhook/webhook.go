@@ -0,0 +1,844 @@
+// Package webhook sends the changes made to posts to external services, by
+// POSTing signed JSON payloads to their URLs.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/satori/go.uuid"
+
+	"github.com/abustany/back-message-board/pkg/events"
+	"github.com/abustany/back-message-board/pkg/types"
+)
+
+// Webhook is an external service receiving events.
+type Webhook struct {
+	// Unique ID of the webhook, chosen by the administrator
+	ID string `json:"id"`
+	// URL receiving the events
+	URL string `json:"url"`
+	// Secret used to sign the payloads, left empty by Dispatcher.Webhooks
+	Secret string `json:"secret,omitempty"`
+	// Types of the events sent to the webhook, all if empty
+	Events []events.Type `json:"events,omitempty"`
+	// If true, the events of unconfirmed posts are sent too. Else, only the
+	// events of published posts are.
+	Unconfirmed bool `json:"unconfirmed,omitempty"`
+}
+
+// wants returns true if the webhook receives the events of the given type.
+func (w *Webhook) wants(eventType events.Type) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+
+	for _, t := range w.Events {
+		if t == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// wantsState returns true if the webhook receives the events of posts in the
+// given state.
+func (w *Webhook) wantsState(state types.PostState) bool {
+	return state == types.StatePublished || (w.Unconfirmed && state == types.StateUnconfirmed)
+}
+
+// filter returns the type and post of the event sent to the webhook, and false
+// if the webhook does not receive the event. Email addresses are never sent.
+// Updates moving a post out of the states received by the webhook are sent as
+// deleted events, whose post only carries the ID.
+func (w *Webhook) filter(event events.Event) (events.Type, types.Post, bool) {
+	eventType, post := event.Type, event.Post
+	post.Email = ""
+
+	if !w.wantsState(post.State) {
+		if eventType != events.Updated || !w.wantsState(event.PreviousState) {
+			return "", types.Post{}, false
+		}
+
+		eventType, post = events.Deleted, types.Post{ID: post.ID}
+	}
+
+	return eventType, post, w.wants(eventType)
+}
+
+// validate checks the configuration of a webhook.
+func (w *Webhook) validate() error {
+	if w.ID == "" {
+		return errors.New("Webhook without ID")
+	}
+
+	if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.Errorf("Invalid URL for webhook %s (should be an HTTP or HTTPS URL)", w.ID)
+	}
+
+	if w.Secret == "" {
+		return errors.Errorf("Webhook %s has no secret", w.ID)
+	}
+
+	for _, t := range w.Events {
+		if t != events.Created && t != events.Updated && t != events.Deleted {
+			return errors.Errorf("Invalid event type %s for webhook %s (should be created, updated or deleted)", t, w.ID)
+		}
+	}
+
+	return nil
+}
+
+// LoadConfig reads the webhooks configured in a JSON file, holding an array of
+// Webhook objects (including their secret).
+func LoadConfig(filename string) ([]Webhook, error) {
+	data, err := ioutil.ReadFile(filename)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while reading webhooks configuration")
+	}
+
+	var webhooks []Webhook
+
+	if err := json.Unmarshal(data, &webhooks); err != nil {
+		return nil, errors.Wrap(err, "Error while decoding webhooks configuration")
+	}
+
+	return webhooks, nil
+}
+
+// State is the state of a delivery.
+type State string
+
+const (
+	// StatePending is the state of deliveries waiting to be sent, or to be
+	// retried.
+	StatePending State = "pending"
+
+	// StateFailed is the state of deliveries that failed too many times,
+	// which are kept in a dead-letter list.
+	StateFailed State = "failed"
+)
+
+// Delivery is an event waiting to be sent to a webhook, or that could not be
+// sent to it. Successful deliveries are forgotten.
+type Delivery struct {
+	// Unique ID of the delivery
+	ID      string `json:"id"`
+	Webhook string `json:"webhook"`
+	State   State  `json:"state"`
+	// ID and type of the event
+	EventID   uint64      `json:"event_id"`
+	EventType events.Type `json:"event_type"`
+	Created   time.Time   `json:"created"`
+	// Number of attempts so far
+	Attempts    uint       `json:"attempts"`
+	LastAttempt *time.Time `json:"last_attempt,omitempty"`
+	// Time of the next attempt, for pending deliveries
+	NextAttempt time.Time `json:"next_attempt"`
+	// HTTP status returned by the webhook, or error that prevented getting
+	// one, at the last attempt
+	LastStatus int    `json:"last_status,omitempty"`
+	LastError  string `json:"last_error,omitempty"`
+	// JSON body sent to the webhook, see Payload
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Payload is the body of the requests sent to webhooks.
+type Payload struct {
+	// ID of the delivery, the same for all the attempts
+	Delivery string `json:"delivery"`
+	// ID, type and time of the event
+	EventID uint64      `json:"event_id"`
+	Event   events.Type `json:"event"`
+	Time    time.Time   `json:"time"`
+	// Post after the change, or before it for deleted posts, without its email
+	// address
+	Post types.Post `json:"post"`
+}
+
+// SignatureHeader is the HTTP header carrying the signature of a payload, as
+// "sha256=" followed by the hex encoded HMAC-SHA256 of the timestamp, a dot,
+// and the body, keyed with the secret of the webhook.
+const SignatureHeader = "X-Webhook-Signature"
+
+// TimestampHeader is the HTTP header carrying the Unix time at which a payload
+// was signed. Receivers should reject old timestamps to prevent replays.
+const TimestampHeader = "X-Webhook-Timestamp"
+
+// DeliveryHeader is the HTTP header carrying the ID of a delivery, which
+// receivers can use to ignore the deliveries they already processed.
+const DeliveryHeader = "X-Webhook-Delivery"
+
+// Sign returns the value of the SignatureHeader for the given body.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, strconv.FormatInt(timestamp, 10)+".")
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Options configures a Dispatcher. Zero fields get the value of the same field
+// in DefaultOptions.
+type Options struct {
+	// Number of deliveries sent at the same time
+	Workers int
+	// Timeout of the requests sent to webhooks
+	Timeout time.Duration
+	// Number of attempts after which a delivery fails
+	MaxAttempts uint
+	// Delay before the first retry of a delivery, doubled at each retry up
+	// to MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Number of failed deliveries kept for each webhook, the oldest ones are
+	// forgotten first
+	MaxFailed int
+	// Number of pending deliveries kept for each webhook. Events arriving
+	// while a webhook has that many pending deliveries go straight to its
+	// dead-letter list, so that the queue stays bounded when the webhook is
+	// down.
+	MaxPending int
+	// Interval at which the queue is saved when it changed
+	SaveInterval time.Duration
+}
+
+// DefaultOptions are the default options of a Dispatcher.
+var DefaultOptions = Options{
+	Workers:        4,
+	Timeout:        10 * time.Second,
+	MaxAttempts:    8,
+	InitialBackoff: 10 * time.Second,
+	MaxBackoff:     time.Hour,
+	MaxFailed:      1000,
+	MaxPending:     10000,
+	SaveInterval:   time.Second,
+}
+
+// ErrWebhookNotFound is returned by the Dispatcher methods when given an unknown
+// webhook ID.
+var ErrWebhookNotFound = errors.New("No webhook has this ID")
+
+// ErrDeliveryNotFound is returned by Dispatcher.Retry when given an unknown
+// delivery ID.
+var ErrDeliveryNotFound = errors.New("No delivery of this webhook has this ID")
+
+// Dispatcher sends events to webhooks, retrying failed deliveries. Pending and
+// failed deliveries are saved to a file, so that they survive restarts.
+type Dispatcher struct {
+	sync.Mutex
+	logger   log.Logger
+	client   *http.Client
+	options  Options
+	filename string
+	webhooks map[string]*Webhook
+	// Pending and failed deliveries, oldest first
+	deliveries []*Delivery
+	// Number of pending deliveries of each webhook
+	pending map[string]int
+	// Deliveries being sent by a worker
+	sending map[*Delivery]bool
+	// True if the deliveries changed since they were saved
+	dirty bool
+	// Wakes up a worker when a delivery is added
+	wake chan struct{}
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewDispatcher returns a Dispatcher sending events to the given webhooks. Its
+// queue is saved to filename, and loaded from it if the file exists.
+// Deliveries to webhooks that are not configured anymore are dropped.
+func NewDispatcher(logger log.Logger, webhooks []Webhook, filename string, options Options) (*Dispatcher, error) {
+	setDefaults(&options)
+
+	d := &Dispatcher{
+		logger:   logger,
+		client:   &http.Client{Timeout: options.Timeout},
+		options:  options,
+		filename: filename,
+		webhooks: map[string]*Webhook{},
+		pending:  map[string]int{},
+		sending:  map[*Delivery]bool{},
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+
+	for i := range webhooks {
+		w := webhooks[i]
+
+		if err := w.validate(); err != nil {
+			return nil, err
+		}
+
+		if _, exists := d.webhooks[w.ID]; exists {
+			return nil, errors.Errorf("Duplicate webhook ID %s", w.ID)
+		}
+
+		d.webhooks[w.ID] = &w
+	}
+
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func setDefaults(options *Options) {
+	if options.Workers <= 0 {
+		options.Workers = DefaultOptions.Workers
+	}
+
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultOptions.Timeout
+	}
+
+	if options.MaxAttempts == 0 {
+		options.MaxAttempts = DefaultOptions.MaxAttempts
+	}
+
+	if options.InitialBackoff <= 0 {
+		options.InitialBackoff = DefaultOptions.InitialBackoff
+	}
+
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = DefaultOptions.MaxBackoff
+	}
+
+	if options.MaxFailed <= 0 {
+		options.MaxFailed = DefaultOptions.MaxFailed
+	}
+
+	if options.MaxPending <= 0 {
+		options.MaxPending = DefaultOptions.MaxPending
+	}
+
+	if options.SaveInterval <= 0 {
+		options.SaveInterval = DefaultOptions.SaveInterval
+	}
+}
+
+// load reads the queue saved in the file of the dispatcher.
+func (d *Dispatcher) load() error {
+	data, err := ioutil.ReadFile(d.filename)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "Error while reading webhook queue")
+	}
+
+	var deliveries []*Delivery
+
+	if err := json.Unmarshal(data, &deliveries); err != nil {
+		return errors.Wrap(err, "Error while decoding webhook queue")
+	}
+
+	for _, delivery := range deliveries {
+		if _, exists := d.webhooks[delivery.Webhook]; !exists {
+			d.logger.Log("event", "webhook_delivery_dropped", "webhook", delivery.Webhook, "delivery", delivery.ID)
+			continue
+		}
+
+		d.deliveries = append(d.deliveries, delivery)
+
+		if delivery.State == StatePending {
+			d.pending[delivery.Webhook]++
+		}
+	}
+
+	return nil
+}
+
+// save writes the queue to the file of the dispatcher, replacing it atomically.
+func (d *Dispatcher) save() error {
+	d.Lock()
+	data, err := json.Marshal(d.deliveries)
+	d.dirty = false
+	d.Unlock()
+
+	if err != nil {
+		return errors.Wrap(err, "Error while encoding webhook queue")
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(d.filename), filepath.Base(d.filename)+".*")
+
+	if err != nil {
+		return errors.Wrap(err, "Error while creating webhook queue file")
+	}
+
+	_, err = f.Write(data)
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), d.filename)
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "Error while writing webhook queue")
+	}
+
+	return nil
+}
+
+// Start starts sending the events published on the bus to the webhooks, until
+// Close is called.
+func (d *Dispatcher) Start(bus *events.Bus) {
+	subscription := bus.Subscribe()
+
+	d.wg.Add(2 + d.options.Workers)
+
+	go func() {
+		defer d.wg.Done()
+		d.listen(bus, subscription)
+	}()
+
+	go func() {
+		defer d.wg.Done()
+		d.saveLoop()
+	}()
+
+	for i := 0; i < d.options.Workers; i++ {
+		go func() {
+			defer d.wg.Done()
+			d.work()
+		}()
+	}
+}
+
+// Close stops sending events, and saves the queue. Deliveries being sent are
+// completed first.
+func (d *Dispatcher) Close() error {
+	close(d.stop)
+	d.wg.Wait()
+
+	return d.save()
+}
+
+// listen enqueues the events of a bus subscription.
+func (d *Dispatcher) listen(bus *events.Bus, subscription *events.Subscription) {
+	defer func() { subscription.Close() }()
+
+	lastID := bus.LastID()
+
+	for {
+		select {
+		case event, ok := <-subscription.C:
+			if !ok {
+				// Too slow, catch up with the events published since
+				var missed []events.Event
+				var complete bool
+
+				subscription, missed, complete = bus.SubscribeSince(lastID)
+
+				if !complete {
+					d.logger.Log("event", "webhook_events_lost", "last_event_id", lastID)
+				}
+
+				for _, event := range missed {
+					d.Enqueue(event)
+					lastID = event.ID
+				}
+
+				continue
+			}
+
+			d.Enqueue(event)
+			lastID = event.ID
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// saveLoop periodically saves the queue when it changed.
+func (d *Dispatcher) saveLoop() {
+	ticker := time.NewTicker(d.options.SaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.Lock()
+			dirty := d.dirty
+			d.Unlock()
+
+			if !dirty {
+				continue
+			}
+
+			if err := d.save(); err != nil {
+				d.logger.Log("event", "webhook_queue_save", "error", err)
+			}
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// Enqueue adds a delivery of the event for each webhook receiving its type and
+// the state of its post.
+func (d *Dispatcher) Enqueue(event events.Event) {
+	d.Lock()
+	defer d.Unlock()
+
+	now := time.Now()
+
+	for _, id := range d.webhookIDs() {
+		eventType, post, ok := d.webhooks[id].filter(event)
+
+		if !ok {
+			continue
+		}
+
+		delivery := &Delivery{
+			ID:          uuid.NewV4().String(),
+			Webhook:     id,
+			State:       StatePending,
+			EventID:     event.ID,
+			EventType:   eventType,
+			Created:     now,
+			NextAttempt: now,
+		}
+
+		payload, err := json.Marshal(&Payload{
+			Delivery: delivery.ID,
+			EventID:  event.ID,
+			Event:    eventType,
+			Time:     event.Time,
+			Post:     post,
+		})
+
+		if err != nil {
+			d.logger.Log("event", "webhook_enqueue", "webhook", id, "event_id", event.ID, "error", err)
+			continue
+		}
+
+		delivery.Payload = payload
+		d.deliveries = append(d.deliveries, delivery)
+		d.dirty = true
+
+		if d.pending[id] < d.options.MaxPending {
+			d.pending[id]++
+			continue
+		}
+
+		d.logger.Log("event", "webhook_queue_full", "webhook", id, "delivery", delivery.ID, "event_id", event.ID)
+
+		delivery.State = StateFailed
+		delivery.NextAttempt = time.Time{}
+		delivery.LastError = "Too many pending deliveries"
+		d.trimFailed(id)
+	}
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// webhookIDs returns the IDs of the webhooks, sorted. It should be called with
+// the lock held.
+func (d *Dispatcher) webhookIDs() []string {
+	ids := make([]string, 0, len(d.webhooks))
+
+	for id := range d.webhooks {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	return ids
+}
+
+// next returns the oldest pending delivery that is due and not being sent, or
+// the time until the next one is due. It should be called with the lock held.
+func (d *Dispatcher) next(now time.Time) (*Delivery, time.Duration) {
+	wait := time.Minute
+
+	for _, delivery := range d.deliveries {
+		if delivery.State != StatePending || d.sending[delivery] {
+			continue
+		}
+
+		if !delivery.NextAttempt.After(now) {
+			return delivery, 0
+		}
+
+		if until := delivery.NextAttempt.Sub(now); until < wait {
+			wait = until
+		}
+	}
+
+	return nil, wait
+}
+
+// work sends the deliveries when they are due.
+func (d *Dispatcher) work() {
+	for {
+		d.Lock()
+		delivery, wait := d.next(time.Now())
+
+		if delivery != nil {
+			d.sending[delivery] = true
+		}
+
+		d.Unlock()
+
+		if delivery == nil {
+			timer := time.NewTimer(wait)
+
+			select {
+			case <-d.wake:
+			case <-timer.C:
+			case <-d.stop:
+				timer.Stop()
+				return
+			}
+
+			timer.Stop()
+			continue
+		}
+
+		status, err := d.send(delivery)
+		d.complete(delivery, status, err)
+
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+	}
+}
+
+// send sends a delivery to its webhook, and returns the HTTP status code of
+// the reply. It can be called without the lock held, since the fields it reads
+// are not modified while the delivery is being sent.
+func (d *Dispatcher) send(delivery *Delivery) (int, error) {
+	d.Lock()
+	webhook := *d.webhooks[delivery.Webhook]
+	d.Unlock()
+
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(delivery.Payload))
+
+	if err != nil {
+		return 0, errors.Wrap(err, "Error while creating request")
+	}
+
+	timestamp := time.Now().Unix()
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(DeliveryHeader, delivery.ID)
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(webhook.Secret, timestamp, delivery.Payload))
+
+	res, err := d.client.Do(req)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer res.Body.Close()
+
+	// Allows reusing the connection
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, errors.Errorf("Unexpected status code %d", res.StatusCode)
+	}
+
+	return res.StatusCode, nil
+}
+
+// backoff returns the delay before the next attempt of a delivery that failed
+// the given number of times.
+func (d *Dispatcher) backoff(attempts uint) time.Duration {
+	delay := d.options.InitialBackoff
+
+	for i := uint(1); i < attempts && delay < d.options.MaxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > d.options.MaxBackoff {
+		delay = d.options.MaxBackoff
+	}
+
+	return delay
+}
+
+// complete records the result of an attempt to send a delivery.
+func (d *Dispatcher) complete(delivery *Delivery, status int, err error) {
+	d.Lock()
+	defer d.Unlock()
+
+	delete(d.sending, delivery)
+
+	now := time.Now()
+	delivery.Attempts++
+	delivery.LastAttempt = &now
+	delivery.LastStatus = status
+	delivery.LastError = ""
+	d.dirty = true
+
+	if err == nil {
+		d.pending[delivery.Webhook]--
+		d.remove(delivery)
+		return
+	}
+
+	delivery.LastError = err.Error()
+
+	if delivery.Attempts < d.options.MaxAttempts {
+		delivery.NextAttempt = now.Add(d.backoff(delivery.Attempts))
+		return
+	}
+
+	d.logger.Log("event", "webhook_delivery_failed", "webhook", delivery.Webhook, "delivery", delivery.ID, "attempts", delivery.Attempts, "error", err)
+
+	delivery.State = StateFailed
+	delivery.NextAttempt = time.Time{}
+	d.pending[delivery.Webhook]--
+	d.trimFailed(delivery.Webhook)
+}
+
+// trimFailed forgets the oldest failed deliveries of a webhook beyond
+// MaxFailed. It should be called with the lock held.
+func (d *Dispatcher) trimFailed(webhookID string) {
+	failed := 0
+
+	for i := len(d.deliveries) - 1; i >= 0; i-- {
+		if other := d.deliveries[i]; other.Webhook == webhookID && other.State == StateFailed {
+			if failed++; failed > d.options.MaxFailed {
+				d.deliveries[i] = nil
+			}
+		}
+	}
+
+	if failed <= d.options.MaxFailed {
+		return
+	}
+
+	kept := d.deliveries[:0]
+
+	for _, delivery := range d.deliveries {
+		if delivery != nil {
+			kept = append(kept, delivery)
+		}
+	}
+
+	for i := len(kept); i < len(d.deliveries); i++ {
+		d.deliveries[i] = nil
+	}
+
+	d.deliveries = kept
+}
+
+// remove removes a delivery from the queue. It should be called with the lock
+// held.
+func (d *Dispatcher) remove(delivery *Delivery) {
+	for i, other := range d.deliveries {
+		if other == delivery {
+			d.deliveries = append(d.deliveries[:i], d.deliveries[i+1:]...)
+			return
+		}
+	}
+}
+
+// Webhooks returns the configured webhooks, sorted by ID, without their
+// secret.
+func (d *Dispatcher) Webhooks() []Webhook {
+	d.Lock()
+	defer d.Unlock()
+
+	var webhooks []Webhook
+
+	for _, id := range d.webhookIDs() {
+		w := *d.webhooks[id]
+		w.Secret = ""
+		webhooks = append(webhooks, w)
+	}
+
+	return webhooks
+}
+
+// Deliveries returns the pending and failed deliveries of a webhook, oldest
+// first. If state is not empty, only the deliveries in that state are returned.
+func (d *Dispatcher) Deliveries(webhookID string, state State) ([]Delivery, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if _, exists := d.webhooks[webhookID]; !exists {
+		return nil, ErrWebhookNotFound
+	}
+
+	deliveries := []Delivery{}
+
+	for _, delivery := range d.deliveries {
+		if delivery.Webhook == webhookID && (state == "" || delivery.State == state) {
+			deliveries = append(deliveries, *delivery)
+		}
+	}
+
+	return deliveries, nil
+}
+
+// Retry schedules a new attempt of a delivery, moving it out of the dead-letter
+// list if it failed. Its attempt count is reset.
+func (d *Dispatcher) Retry(webhookID, deliveryID string) (Delivery, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if _, exists := d.webhooks[webhookID]; !exists {
+		return Delivery{}, ErrWebhookNotFound
+	}
+
+	for _, delivery := range d.deliveries {
+		if delivery.Webhook != webhookID || delivery.ID != deliveryID {
+			continue
+		}
+
+		if !d.sending[delivery] {
+			if delivery.State != StatePending {
+				d.pending[webhookID]++
+			}
+
+			delivery.State = StatePending
+			delivery.Attempts = 0
+			delivery.NextAttempt = time.Now()
+			d.dirty = true
+
+			select {
+			case d.wake <- struct{}{}:
+			default:
+			}
+		}
+
+		return *delivery, nil
+	}
+
+	return Delivery{}, ErrDeliveryNotFound
+}
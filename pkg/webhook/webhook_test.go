@@ -0,0 +1,335 @@
+package webhook_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/abustany/back-message-board/pkg/events"
+	"github.com/abustany/back-message-board/pkg/types"
+	"github.com/abustany/back-message-board/pkg/webhook"
+)
+
+const secret = "s3cr3t"
+
+// receiver is a webhook receiver failing a given number of requests.
+type receiver struct {
+	sync.Mutex
+	t        *testing.T
+	failures int
+	payloads []webhook.Payload
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+
+	if err != nil {
+		r.t.Errorf("Error while reading webhook request: %s", err)
+		return
+	}
+
+	timestamp, err := strconv.ParseInt(req.Header.Get(webhook.TimestampHeader), 10, 64)
+
+	if err != nil {
+		r.t.Errorf("Invalid timestamp header: %s", err)
+	}
+
+	if signature := req.Header.Get(webhook.SignatureHeader); signature != webhook.Sign(secret, timestamp, body) {
+		r.t.Errorf("Invalid signature: %s", signature)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.failures > 0 {
+		r.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var payload webhook.Payload
+
+	if err := json.Unmarshal(body, &payload); err != nil {
+		r.t.Errorf("Error while decoding payload: %s", err)
+	}
+
+	if payload.Delivery != req.Header.Get(webhook.DeliveryHeader) {
+		r.t.Errorf("Delivery ID mismatch: %s in payload, %s in header", payload.Delivery, req.Header.Get(webhook.DeliveryHeader))
+	}
+
+	r.payloads = append(r.payloads, payload)
+}
+
+func (r *receiver) received() []webhook.Payload {
+	r.Lock()
+	defer r.Unlock()
+
+	return append([]webhook.Payload(nil), r.payloads...)
+}
+
+func (r *receiver) setFailures(n int) {
+	r.Lock()
+	r.failures = n
+	r.Unlock()
+}
+
+func waitFor(t *testing.T, description string, condition func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !condition(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout while waiting for %s", description)
+		}
+	}
+}
+
+var testOptions = webhook.Options{
+	Workers:        2,
+	MaxAttempts:    3,
+	InitialBackoff: time.Millisecond,
+	SaveInterval:   time.Millisecond,
+}
+
+func newDispatcher(t *testing.T, dir string, webhooks []webhook.Webhook, options webhook.Options) *webhook.Dispatcher {
+	d, err := webhook.NewDispatcher(log.NewNopLogger(), webhooks, filepath.Join(dir, "queue.json"), options)
+
+	if err != nil {
+		t.Fatalf("Error while creating dispatcher: %s", err)
+	}
+
+	return d
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "webhook")
+
+	if err != nil {
+		t.Fatalf("Error while creating temporary directory: %s", err)
+	}
+
+	return dir
+}
+
+func countDeliveries(t *testing.T, d *webhook.Dispatcher, id string, state webhook.State) int {
+	deliveries, err := d.Deliveries(id, state)
+
+	if err != nil {
+		t.Fatalf("Deliveries returned an error: %s", err)
+	}
+
+	return len(deliveries)
+}
+
+func TestDispatcher(t *testing.T) {
+	r := &receiver{t: t, failures: 2}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	webhooks := []webhook.Webhook{
+		{ID: "all", URL: server.URL, Secret: secret},
+		{ID: "deleted", URL: server.URL, Secret: secret, Events: []events.Type{events.Deleted}},
+	}
+
+	bus := events.NewBus(0)
+	d := newDispatcher(t, dir, webhooks, testOptions)
+	d.Start(bus)
+	defer d.Close()
+
+	// Not sent, unconfirmed posts are not wanted
+	bus.Publish(events.Created, types.Post{ID: "ID0", Author: "John", State: types.StateUnconfirmed})
+
+	post := types.Post{ID: "ID1", Author: "John", Email: "john@domain.com", State: types.StatePublished, EditTokenHash: "hash"}
+	bus.Publish(events.Created, post)
+
+	// Retried after two failures
+	waitFor(t, "the delivery", func() bool { return len(r.received()) == 1 })
+
+	payload := r.received()[0]
+
+	if payload.EventID != 2 || payload.Event != events.Created || payload.Post.ID != "ID1" || payload.Post.Email != "" || payload.Post.EditTokenHash != "" {
+		t.Errorf("Unexpected payload: %+v", payload)
+	}
+
+	waitFor(t, "the delivery to be forgotten", func() bool { return countDeliveries(t, d, "all", "") == 0 })
+
+	if n := countDeliveries(t, d, "deleted", ""); n != 0 {
+		t.Errorf("Unexpected number of deliveries to a webhook not receiving the event: %d", n)
+	}
+
+	t.Run("Dead letters", func(t *testing.T) {
+		r.setFailures(int(testOptions.MaxAttempts))
+		bus.Publish(events.Updated, post)
+
+		waitFor(t, "the failed delivery", func() bool { return countDeliveries(t, d, "all", webhook.StateFailed) == 1 })
+
+		deliveries, _ := d.Deliveries("all", webhook.StateFailed)
+		failed := deliveries[0]
+
+		if failed.Attempts != testOptions.MaxAttempts || failed.LastStatus != http.StatusInternalServerError || failed.LastError == "" || failed.EventType != events.Updated {
+			t.Errorf("Unexpected failed delivery: %+v", failed)
+		}
+
+		if _, err := d.Retry("all", "whatever"); err != webhook.ErrDeliveryNotFound {
+			t.Errorf("Unexpected error when retrying an unknown delivery: %v", err)
+		}
+
+		if retried, err := d.Retry("all", failed.ID); err != nil || retried.State != webhook.StatePending {
+			t.Errorf("Unexpected result of Retry: %+v, %v", retried, err)
+		}
+
+		waitFor(t, "the retried delivery", func() bool { return len(r.received()) == 2 })
+		waitFor(t, "the retried delivery to be forgotten", func() bool { return countDeliveries(t, d, "all", "") == 0 })
+	})
+
+	if _, err := d.Deliveries("whatever", ""); err != webhook.ErrWebhookNotFound {
+		t.Errorf("Unexpected error for an unknown webhook: %v", err)
+	}
+
+	t.Run("Unpublished", func(t *testing.T) {
+		unpublished := post
+		unpublished.State = types.StateUnconfirmed
+		bus.PublishUpdate(post, unpublished)
+
+		// Retracted from the webhooks that only receive published posts
+		waitFor(t, "the retraction", func() bool { return len(r.received()) == 4 })
+
+		for _, payload := range r.received()[2:] {
+			if payload.Event != events.Deleted || payload.Post.ID != post.ID || payload.Post.Author != "" {
+				t.Errorf("Unexpected payload for an unpublished post: %+v", payload)
+			}
+		}
+
+		bus.PublishUpdate(unpublished, unpublished)
+		time.Sleep(50 * time.Millisecond)
+
+		if n := len(r.received()); n != 4 {
+			t.Errorf("Unexpected number of deliveries for an unconfirmed post: %d", n)
+		}
+	})
+
+	if listed := d.Webhooks(); len(listed) != 2 || listed[0].ID != "all" || listed[0].Secret != "" {
+		t.Errorf("Unexpected webhooks: %+v", listed)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	webhooks := []webhook.Webhook{
+		{ID: "kept", URL: "http://127.0.0.1:1/", Secret: secret},
+		{ID: "removed", URL: "http://127.0.0.1:1/", Secret: secret},
+	}
+
+	d := newDispatcher(t, dir, webhooks, testOptions)
+	d.Enqueue(events.Event{ID: 1, Type: events.Created, Post: types.Post{ID: "ID1", State: types.StatePublished}})
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close returned an error: %s", err)
+	}
+
+	d = newDispatcher(t, dir, webhooks[:1], testOptions)
+
+	if deliveries, err := d.Deliveries("kept", webhook.StatePending); err != nil || len(deliveries) != 1 || deliveries[0].EventID != 1 {
+		t.Errorf("Unexpected deliveries after reloading the queue: %+v, %v", deliveries, err)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "webhooks.json")
+	config := `[{"id": "slack", "url": "https://hooks.slack.com/whatever", "secret": "s3cr3t", "events": ["created"]}]`
+
+	if err := ioutil.WriteFile(filename, []byte(config), 0600); err != nil {
+		t.Fatalf("Error while writing configuration: %s", err)
+	}
+
+	webhooks, err := webhook.LoadConfig(filename)
+
+	if err != nil {
+		t.Fatalf("LoadConfig returned an error: %s", err)
+	}
+
+	if len(webhooks) != 1 || webhooks[0].ID != "slack" || webhooks[0].Secret != "s3cr3t" || len(webhooks[0].Events) != 1 {
+		t.Errorf("Unexpected configuration: %+v", webhooks)
+	}
+
+	invalid := [][]webhook.Webhook{
+		{{URL: "https://domain.com", Secret: secret}},
+		{{ID: "a", URL: "ftp://domain.com", Secret: secret}},
+		{{ID: "a", URL: "https://domain.com"}},
+		{{ID: "a", URL: "https://domain.com", Secret: secret, Events: []events.Type{"flagged"}}},
+		{{ID: "a", URL: "https://domain.com", Secret: secret}, {ID: "a", URL: "https://domain.com", Secret: secret}},
+	}
+
+	for _, webhooks := range invalid {
+		if _, err := webhook.NewDispatcher(log.NewNopLogger(), webhooks, filepath.Join(dir, "queue.json"), webhook.Options{}); err == nil {
+			t.Errorf("NewDispatcher did not return an error for invalid webhooks %+v", webhooks)
+		}
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	webhooks := []webhook.Webhook{
+		{ID: "down", URL: "http://127.0.0.1:1/", Secret: secret},
+	}
+
+	options := testOptions
+	options.MaxPending = 100
+	options.MaxFailed = 10
+
+	// Not started, so that all the deliveries stay pending
+	d := newDispatcher(t, dir, webhooks, options)
+
+	for i := 1; i <= 10000; i++ {
+		d.Enqueue(events.Event{ID: uint64(i), Type: events.Created, Post: types.Post{ID: "ID1", State: types.StatePublished}})
+	}
+
+	pending, _ := d.Deliveries("down", webhook.StatePending)
+
+	if len(pending) != options.MaxPending || pending[0].EventID != 1 {
+		t.Errorf("Unexpected number of pending deliveries: %d", len(pending))
+	}
+
+	failed, _ := d.Deliveries("down", webhook.StateFailed)
+
+	if len(failed) != options.MaxFailed || failed[len(failed)-1].EventID != 10000 || failed[0].LastError == "" {
+		t.Errorf("Unexpected failed deliveries: %d", len(failed))
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close returned an error: %s", err)
+	}
+
+	d = newDispatcher(t, dir, webhooks, options)
+
+	if n := countDeliveries(t, d, "down", ""); n != options.MaxPending+options.MaxFailed {
+		t.Errorf("Unexpected number of deliveries after reloading the queue: %d", n)
+	}
+
+	// The queue is full again after retrying a failed delivery
+	if _, err := d.Retry("down", failed[0].ID); err != nil {
+		t.Fatalf("Retry returned an error: %s", err)
+	}
+
+	d.Enqueue(events.Event{ID: 10001, Type: events.Created, Post: types.Post{ID: "ID1", State: types.StatePublished}})
+
+	if n := countDeliveries(t, d, "down", webhook.StatePending); n != options.MaxPending+1 {
+		t.Errorf("Unexpected number of pending deliveries after a retry: %d", n)
+	}
+}